@@ -0,0 +1,9 @@
+// Package charts embeds the Helm charts of kurun, so the CLI can install them without fetching them from a repository
+package charts
+
+import "embed"
+
+// KurunServer contains the chart of a long-lived kurun-server in its kurun-server directory
+//
+//go:embed all:kurun-server
+var KurunServer embed.FS
@@ -0,0 +1,17 @@
+{{/* The name of the resources other than the service */}}
+{{- define "kurun-server.name" -}}
+{{ .Release.Name }}-kurun
+{{- end }}
+
+{{/* The labels selecting the kurun-server pods, the same as the ones of kurun install-server */}}
+{{- define "kurun-server.selectorLabels" -}}
+app.kubernetes.io/name: {{ include "kurun-server.name" . }}
+app.kubernetes.io/component: tunnel-server
+{{- end }}
+
+{{- define "kurun-server.labels" -}}
+{{ include "kurun-server.selectorLabels" . }}
+app.kubernetes.io/managed-by: {{ .Release.Service }}
+helm.sh/chart: {{ .Chart.Name }}-{{ .Chart.Version }}
+{{- end }}
+
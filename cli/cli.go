@@ -0,0 +1,49 @@
+// Package cli runs the kurun command line, so custom builds of kurun (e.g. registering extensions) don't have to
+// fork its main package.
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/banzaicloud/kurun/internal/cmd"
+)
+
+// BuildInfo describes the build of kurun, shown by --version
+type BuildInfo struct {
+	Version    string
+	CommitHash string
+	BuildDate  string
+}
+
+// Main runs kurun with the command line arguments and exits
+func Main(buildInfo BuildInfo) {
+	// kurun-<name> executables on the PATH are run as plugins, unless name is a built-in command
+	if handled, err := cmd.RunPlugin(os.Args[1:]); handled {
+		exit(err)
+	}
+
+	rootCmd := cmd.NewRootCommand()
+	if buildInfo.Version != "" {
+		rootCmd.Version = buildInfo.Version
+		rootCmd.SetVersionTemplate(fmt.Sprintf("kurun {{.Version}} (commit %s, built %s)\n", buildInfo.CommitHash, buildInfo.BuildDate))
+	}
+
+	exit(rootCmd.Execute())
+}
+
+func exit(err error) {
+	if err == nil {
+		os.Exit(0)
+	}
+
+	// pass on the exit code of the binary run inside the cluster or the plugin
+	var exitErr cmd.ExitError
+	if errors.As(err, &exitErr) && exitErr.Code > 0 {
+		os.Exit(exitErr.Code)
+	}
+
+	cmd.PresentError(os.Stderr, err)
+	os.Exit(2)
+}
@@ -0,0 +1,132 @@
+// Package extension allows extending kurun without forking it: custom builds of kurun register alternative image
+// builders and tunnel transports before running the command line, which are selected with the --builder and
+// --transport flags.
+//
+//	package main
+//
+//	import (
+//		"github.com/banzaicloud/kurun/cli"
+//		"github.com/banzaicloud/kurun/extension"
+//	)
+//
+//	func main() {
+//		extension.RegisterImageBuilder("buildkit", myBuildKitBuilder{})
+//		cli.Main(cli.BuildInfo{Version: "v0.6.0-acme"})
+//	}
+//
+// Separate executables named kurun-<name> on the PATH are run as kurun <name> subcommands, like kubectl plugins.
+package extension
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// BuildRequest is the image to build
+type BuildRequest struct {
+	// ContextDir is the build context directory, containing the Dockerfile and the compiled binary
+	ContextDir string
+	// ImageName is the name of the image without registry and tag
+	ImageName string
+	Logger    logr.Logger
+	// Namespace is the namespace of the kurun session, e.g. for builds in the cluster
+	Namespace string
+}
+
+// BuildResult is the image built
+type BuildResult struct {
+	// Ref is the image reference to use in pod specs
+	Ref string
+	// PullPolicy is the pull policy of the image, IfNotPresent by default
+	PullPolicy corev1.PullPolicy
+}
+
+// ImageBuilder builds container images from the build contexts prepared by kurun
+type ImageBuilder interface {
+	Build(ctx context.Context, req BuildRequest) (BuildResult, error)
+}
+
+// TunnelClientRequest is the tunnel to run between a kurun-server and the downstream
+type TunnelClientRequest struct {
+	// KubeConfig is the configuration to access the cluster (e.g. the API server proxy) with
+	KubeConfig *rest.Config
+	Logger     logr.Logger
+	// RoundTripper sends the requests received through the tunnel to the downstream
+	RoundTripper http.RoundTripper
+	// Service is the service of the kurun-server, with a port named control
+	Service *corev1.Service
+}
+
+// TunnelTransport runs the client side of a tunnel
+type TunnelTransport interface {
+	// RunClient relays the requests of the kurun-server to the round tripper until the context is done
+	RunClient(ctx context.Context, req TunnelClientRequest) error
+}
+
+var registry = struct {
+	sync.RWMutex
+	imageBuilders    map[string]ImageBuilder
+	tunnelTransports map[string]TunnelTransport
+}{
+	imageBuilders:    make(map[string]ImageBuilder),
+	tunnelTransports: make(map[string]TunnelTransport),
+}
+
+// RegisterImageBuilder registers the image builder with the name, replacing the one registered with it before
+func RegisterImageBuilder(name string, builder ImageBuilder) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.imageBuilders[name] = builder
+}
+
+// LookupImageBuilder returns the image builder registered with the name
+func LookupImageBuilder(name string) (ImageBuilder, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	builder, ok := registry.imageBuilders[name]
+	return builder, ok
+}
+
+// ImageBuilderNames returns the names of the registered image builders in alphabetical order
+func ImageBuilderNames() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	return sortedKeys(registry.imageBuilders)
+}
+
+// RegisterTunnelTransport registers the tunnel transport with the name, replacing the one registered with it before
+func RegisterTunnelTransport(name string, transport TunnelTransport) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.tunnelTransports[name] = transport
+}
+
+// LookupTunnelTransport returns the tunnel transport registered with the name
+func LookupTunnelTransport(name string) (TunnelTransport, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	transport, ok := registry.tunnelTransports[name]
+	return transport, ok
+}
+
+// TunnelTransportNames returns the names of the registered tunnel transports in alphabetical order
+func TunnelTransportNames() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	return sortedKeys(registry.tunnelTransports)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,36 +2,55 @@ package cmd
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"os/signal"
 	"strings"
+	"syscall"
 
+	"emperror.dev/errors"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	k8sYaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
 	clientscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 )
 
 const kurunSchemaPrefix = "kurun://"
 
-func NewApplyCommand() *cobra.Command {
+func NewApplyCommand(rootParams *rootCommandParams) *cobra.Command {
 	var files []string
+	var buildParams imageBuildParams
+	var followLogs bool
+	var logParams logParams
+	var wait bool
+	var waitFor string
 
 	cmd := &cobra.Command{
 		Use:   "apply [flags] -f pod.yaml",
 		Short: "Just like `kubectl apply -f pod.yaml` but images are built from local source code.",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			builder, err := newImageBuilder(rootParams, buildParams)
+			if err != nil {
+				return err
+			}
 
 			var rawResources [][]byte
+			var logTargets []podLogTarget
+			var appliedResources []*unstructured.Unstructured
 
 			for _, file := range files {
 				var manifest io.Reader
@@ -80,18 +99,15 @@ func NewApplyCommand() *cobra.Command {
 							return err
 						}
 
-						for i, c := range pod.Spec.Containers {
-							if strings.HasPrefix(c.Image, kurunSchemaPrefix) {
-								goFilesPath := strings.TrimPrefix(c.Image, kurunSchemaPrefix)
-								pod.Spec.Containers[i].Image, err = buildImage([]string{goFilesPath})
-								if err != nil {
-									return err
-								}
-
-								pod.Spec.Containers[i].ImagePullPolicy = corev1.PullNever
-							}
+						if err := buildKurunImages(builder, pod.Spec.Containers); err != nil {
+							return err
 						}
 
+						logTargets = append(logTargets, podLogTarget{
+							namespace:   pod.Namespace,
+							listOptions: metav1.ListOptions{FieldSelector: "metadata.name=" + pod.Name},
+						})
+
 						resource, err = runtime.DefaultUnstructuredConverter.ToUnstructured(pod)
 						if err != nil {
 							return err
@@ -103,16 +119,19 @@ func NewApplyCommand() *cobra.Command {
 							return err
 						}
 
-						for i, c := range deployment.Spec.Template.Spec.Containers {
-							if strings.HasPrefix(c.Image, kurunSchemaPrefix) {
-								goFilesPath := strings.TrimPrefix(c.Image, kurunSchemaPrefix)
-								deployment.Spec.Template.Spec.Containers[i].Image, err = buildImage([]string{goFilesPath})
-								if err != nil {
-									return err
-								}
+						if err := buildKurunImages(builder, deployment.Spec.Template.Spec.Containers); err != nil {
+							return err
+						}
 
-								deployment.Spec.Template.Spec.Containers[i].ImagePullPolicy = corev1.PullNever
+						if deployment.Spec.Selector != nil {
+							selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+							if err != nil {
+								return err
 							}
+							logTargets = append(logTargets, podLogTarget{
+								namespace:   deployment.Namespace,
+								listOptions: metav1.ListOptions{LabelSelector: selector.String()},
+							})
 						}
 
 						resource, err = runtime.DefaultUnstructuredConverter.ToUnstructured(deployment)
@@ -133,6 +152,7 @@ func NewApplyCommand() *cobra.Command {
 					}
 
 					rawResources = append(rawResources, rawResource)
+					appliedResources = append(appliedResources, &unstructured.Unstructured{Object: resource})
 
 					obj = nil
 				}
@@ -157,115 +177,246 @@ func NewApplyCommand() *cobra.Command {
 			kubectlCommand := exec.Command("kubectl", kubectlArgs...)
 			kubectlCommand.Stdin = resourceBuffer
 			kubectlCommand.Stderr = os.Stderr
-			kubectlCommand.Stdout = os.Stdout
-
-			if err := kubectlCommand.Run(); err != nil {
+			kubectlCommand.Stdout = commandStdout
+
+			err = kubectlCommand.Run()
+			if rootParams.auditLog != nil {
+				for _, resource := range appliedResources {
+					rootParams.auditLog.RecordResult(auditRecord{
+						Verb:       "apply",
+						APIVersion: resource.GetAPIVersion(),
+						Kind:       resource.GetKind(),
+						Namespace:  resource.GetNamespace(),
+						Name:       resource.GetName(),
+					}, err)
+				}
+			}
+			if err != nil {
 				cmd.SilenceUsage = true
 				cmd.SilenceErrors = true
 				return err
 			}
 
+			// kubectl has printed the applied resources for humans already
+			for _, resource := range appliedResources {
+				result, err := newResourceResult(resource)
+				if err != nil {
+					return err
+				}
+				if err := rootParams.output.Result("", result.Ref(), result); err != nil {
+					return err
+				}
+			}
+
+			if wait || waitFor != "" {
+				cmd.SilenceUsage = true
+				if err := waitForAppliedResources(cmd.Context(), rootParams, waitFor, appliedResources); err != nil {
+					return err
+				}
+			}
+
+			if followLogs {
+				cmd.SilenceUsage = true
+				return followPodLogs(cmd.Context(), rootParams, logParams, logTargets, rootParams.output.Stdout())
+			}
+
 			return nil
 		},
 	}
 
 	cmd.PersistentFlags().StringSliceVarP(&files, "filename", "f", []string{}, "Filename or URL to files to use to create the resource (use - for STDIN)")
+	cmd.PersistentFlags().BoolVar(&wait, "wait", false, "Wait until the applied pods are ready, deployments are available and jobs are complete")
+	cmd.PersistentFlags().StringVar(&waitFor, "wait-for", "", "Wait for a custom condition of all applied resources, e.g. condition=Ready or jsonpath={.status.phase}=Running (implies --wait)")
+	cmd.PersistentFlags().BoolVar(&followLogs, "logs", false, "Follow the logs of all containers of the applied pods and deployments until interrupted")
+	addLogFlags(cmd, &logParams)
+	addImageBuildFlags(cmd, &buildParams)
+	addOutputFlags(cmd, &rootParams.outputParams)
 
 	return cmd
 }
 
-func buildImage(goFiles []string) (string, error) {
-	hash := sha1.New()
-	for _, goFile := range goFiles {
-		absGoFile, err := filepath.Abs(goFile)
+// waitForAppliedResources waits until the applied resources satisfy the wait condition (or the default condition of their kind)
+func waitForAppliedResources(ctx context.Context, rootParams *rootCommandParams, waitFor string, resources []*unstructured.Unstructured) error {
+	var customCondition resourceCondition
+	if waitFor != "" {
+		var err error
+		customCondition, err = parseWaitCondition(waitFor)
 		if err != nil {
-			return "", err
+			return err
+		}
+	}
+
+	kubeConfig, err := getKubeConfig(rootParams)
+	if err != nil {
+		return err
+	}
+	mapper, err := apiutil.NewDynamicRESTMapper(kubeConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// resources are watched per namespace, so only namespace level permissions are required
+	caches := make(map[string]cache.Cache)
+
+	for _, resource := range resources {
+		condition := customCondition
+		if condition == nil {
+			condition = defaultWaitCondition(resource.GetKind())
+		}
+		if condition == nil {
+			continue
 		}
 
-		_, err = hash.Write([]byte(absGoFile))
+		gvk := resource.GroupVersionKind()
+		mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
 		if err != nil {
-			return "", err
+			return errors.WrapIfWithDetails(err, "failed to get resource mapping", "kind", gvk.Kind)
+		}
+		namespace := ""
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			namespace = resource.GetNamespace()
+			if namespace == "" {
+				namespace = rootParams.namespace
+			}
 		}
-	}
 
-	imageTag := fmt.Sprintf("kurun-%x", hash.Sum(nil))
-	directory := "/tmp/kurun/" + imageTag
+		kubeCache, ok := caches[namespace]
+		if !ok {
+			kubeCache, err = cache.New(kubeConfig, cache.Options{Mapper: mapper, Namespace: namespace})
+			if err != nil {
+				return err
+			}
+			go kubeCache.Start(ctx)
+			caches[namespace] = kubeCache
+		}
 
-	err := os.MkdirAll(directory, os.ModePerm)
-	if err != nil {
-		return "", err
+		target := &unstructured.Unstructured{}
+		target.SetGroupVersionKind(gvk)
+		target.SetNamespace(namespace)
+		target.SetName(resource.GetName())
+
+		rootParams.logger.Info("waiting for resource", "resource", strings.ToLower(gvk.Kind)+"/"+target.GetName())
+		err = waitForResource(ctx, kubeCache, clientscheme.Scheme, target, func(obj interface{}) bool {
+			u, ok := obj.(*unstructured.Unstructured)
+			return ok && u.GetNamespace() == target.GetNamespace() && u.GetName() == target.GetName() && condition(u)
+		}, rootParams.waitTimeout)
+		if err != nil {
+			return err
+		}
 	}
 
-	goBuildArgs := []string{"build", "-o", directory + "/main"}
-	goBuildArgs = append(goBuildArgs, goFiles...)
-	goBuildCommand := exec.Command("go", goBuildArgs...)
-	goBuildCommand.Stderr = os.Stderr
-	goBuildCommand.Stdout = os.Stdout
-	env := os.Environ()
-	env = append(env, "GOOS=linux", "CGO_ENABLED=0")
-	goBuildCommand.Env = env
+	return nil
+}
 
-	println(goBuildCommand.String())
+// podLogTarget selects the pods of an applied resource to follow the logs of
+type podLogTarget struct {
+	namespace   string
+	listOptions metav1.ListOptions
+}
 
-	if err := goBuildCommand.Run(); err != nil {
-		return "", err
+// followPodLogs follows the logs of the pods of the applied resources until interrupted, and writes them to out
+func followPodLogs(ctx context.Context, rootParams *rootCommandParams, params logParams, targets []podLogTarget, out io.Writer) error {
+	kubeConfig, err := getKubeConfig(rootParams)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return err
 	}
 
-	file, err := os.Create(directory + "/Dockerfile")
+	logs, err := newLogStreamer(clientset, params, out)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer file.Close()
 
-	fmt.Fprintln(file, "FROM alpine")
-	fmt.Fprintln(file, "ADD main /")
-	fmt.Fprintln(file, "CMD /main")
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-	dockerBuildCommand := exec.Command("docker", "build", "-t", imageTag, directory)
-	dockerBuildCommand.Stderr = os.Stderr
-	dockerBuildCommand.Stdout = os.Stdout
+	errCh := make(chan error, len(targets))
+	for _, target := range targets {
+		namespace := target.namespace
+		if namespace == "" {
+			namespace = rootParams.namespace
+		}
+		go reportPodProblems(ctx, clientset, namespace, target.listOptions, os.Stderr)
+		go func(namespace string, listOptions metav1.ListOptions) {
+			errCh <- logs.StreamPods(ctx, namespace, listOptions)
+		}(namespace, target.listOptions)
+	}
 
-	if err := dockerBuildCommand.Run(); err != nil {
-		return "", err
+	var combinedErr error
+	for range targets {
+		combinedErr = errors.Append(combinedErr, <-errCh)
 	}
+	return combinedErr
+}
 
-	dockerOutput := bytes.NewBuffer(nil)
+// buildKurunImages builds the images of containers referring to kurun:// URLs and updates the containers accordingly
+func buildKurunImages(builder *imageBuilder, containers []corev1.Container) error {
+	for i, c := range containers {
+		if !strings.HasPrefix(c.Image, kurunSchemaPrefix) {
+			continue
+		}
 
-	dockerInspectCommand := exec.Command("docker", "inspect", imageTag, "-f", "{{.Id}}")
-	dockerInspectCommand.Stderr = os.Stderr
-	dockerInspectCommand.Stdout = dockerOutput
-	if err := dockerInspectCommand.Run(); err != nil {
-		return "", err
-	}
+		goFilesPath, params, err := parseKurunImageURL(c.Image, builder.params)
+		if err != nil {
+			return err
+		}
 
-	imageHash := strings.TrimPrefix(strings.TrimSuffix(dockerOutput.String(), "\n"), "sha256:")
+		image, err := builder.BuildWithParams([]string{goFilesPath}, params)
+		if err != nil {
+			return err
+		}
 
-	kindCluster, err := isKindCluster()
-	if err != nil {
-		return "", err
+		containers[i].Image = image.ref
+		containers[i].ImagePullPolicy = image.pullPolicy
 	}
+	return nil
+}
 
-	fullImageTag := imageTag + ":" + imageHash
-
-	dockerTagCommand := exec.Command("docker", "tag", imageTag, fullImageTag)
-	dockerTagCommand.Stderr = os.Stderr
-	dockerTagCommand.Stdout = os.Stdout
+// parseKurunImageURL parses a kurun:// image URL, e.g. kurun://./cmd/server?tags=dev&base=gcr.io/distroless/static&args=-race
+// Build options in the query override the specified default build parameters.
+func parseKurunImageURL(image string, defaults imageBuildParams) (goFilesPath string, params imageBuildParams, err error) {
+	params = defaults
 
-	if err := dockerTagCommand.Run(); err != nil {
-		return "", err
+	goFilesPath = strings.TrimPrefix(image, kurunSchemaPrefix)
+	idx := strings.Index(goFilesPath, "?")
+	if idx < 0 {
+		return goFilesPath, params, nil
 	}
 
-	if kindCluster {
-		kindLoadCommand := exec.Command("kind", "load", "docker-image", fullImageTag)
-		kindLoadCommand.Stderr = os.Stderr
-		kindLoadCommand.Stdout = os.Stdout
-
-		if err := kindLoadCommand.Run(); err != nil {
-			return "", err
+	query, err := url.ParseQuery(goFilesPath[idx+1:])
+	if err != nil {
+		return "", params, errors.WrapIfWithDetails(err, "failed to parse build options of image", "image", image)
+	}
+	goFilesPath = goFilesPath[:idx]
+
+	for key, values := range query {
+		switch key {
+		case "args":
+			params.goBuildArgs = nil
+			for _, value := range values {
+				params.goBuildArgs = append(params.goBuildArgs, strings.Fields(value)...)
+			}
+		case "base":
+			params.baseImage = values[len(values)-1]
+		case "include":
+			params.includes = values
+		case "tags":
+			params.buildTags = nil
+			for _, value := range values {
+				params.buildTags = append(params.buildTags, strings.Split(value, ",")...)
+			}
+		default:
+			return "", params, errors.NewWithDetails("unknown build option in image", "image", image, "option", key)
 		}
 	}
 
-	return fullImageTag, nil
+	return goFilesPath, params, nil
 }
 
 func unstructuredToStructured(src *unstructured.Unstructured, dst runtime.Object) error {
@@ -275,21 +426,3 @@ func unstructuredToStructured(src *unstructured.Unstructured, dst runtime.Object
 	}
 	return runtime.DecodeInto(clientscheme.Codecs.LegacyCodec(corev1.SchemeGroupVersion), json, dst)
 }
-
-// Detect if the cluster is a KinD cluster, because in case of that
-// we need to load the Docker images into the cluster.
-func isKindCluster() (bool, error) {
-	buffer := bytes.NewBuffer(nil)
-
-	kubectlConfigCommand := exec.Command("kubectl", "config", "current-context")
-	kubectlConfigCommand.Stderr = os.Stderr
-	kubectlConfigCommand.Stdout = buffer
-
-	if err := kubectlConfigCommand.Run(); err != nil {
-		return false, err
-	}
-
-	kubeContext := strings.TrimSuffix(buffer.String(), "\n")
-
-	return kubeContext == "kubernetes-admin@kind" || kubeContext == "kind-kind", nil
-}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKurunImageURL(t *testing.T) {
+	defaults := imageBuildParams{
+		baseImage:   defaultBaseImage,
+		buildTags:   []string{"default"},
+		goBuildArgs: []string{"-trimpath"},
+		registry:    "registry.example.com",
+	}
+
+	testCases := map[string]struct {
+		image       string
+		goFilesPath string
+		params      imageBuildParams
+		err         string
+	}{
+		"without options": {
+			image:       "kurun://./cmd/server",
+			goFilesPath: "./cmd/server",
+			params:      defaults,
+		},
+		"empty options": {
+			image:       "kurun://./cmd/server?",
+			goFilesPath: "./cmd/server",
+			params:      defaults,
+		},
+		"all options": {
+			image:       "kurun://./cmd/server?tags=dev,debug&base=gcr.io/distroless/static&args=-race%20-v&include=config.yaml:/etc/app/config.yaml",
+			goFilesPath: "./cmd/server",
+			params: imageBuildParams{
+				baseImage:   "gcr.io/distroless/static",
+				buildTags:   []string{"dev", "debug"},
+				goBuildArgs: []string{"-race", "-v"},
+				includes:    []string{"config.yaml:/etc/app/config.yaml"},
+				registry:    "registry.example.com",
+			},
+		},
+		"repeated options": {
+			image:       "kurun://github.com/example/app?tags=dev&tags=debug&args=-race&args=-v&base=alpine&base=scratch&include=a&include=b",
+			goFilesPath: "github.com/example/app",
+			params: imageBuildParams{
+				baseImage:   "scratch",
+				buildTags:   []string{"dev", "debug"},
+				goBuildArgs: []string{"-race", "-v"},
+				includes:    []string{"a", "b"},
+				registry:    "registry.example.com",
+			},
+		},
+		"unknown option": {
+			image: "kurun://./cmd/server?tag=dev",
+			err:   "unknown build option in image",
+		},
+		"malformed query": {
+			image: "kurun://./cmd/server?tags=%zz",
+			err:   "failed to parse build options of image",
+		},
+		"malformed separator": {
+			image: "kurun://./cmd/server?tags=dev;debug",
+			err:   "failed to parse build options of image",
+		},
+	}
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			goFilesPath, params, err := parseKurunImageURL(testCase.image, defaults)
+			if testCase.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), testCase.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testCase.goFilesPath, goFilesPath)
+			require.Equal(t, testCase.params, params)
+		})
+	}
+
+	// the defaults are not modified by the options
+	require.Equal(t, []string{"default"}, defaults.buildTags)
+	require.Equal(t, []string{"-trimpath"}, defaults.goBuildArgs)
+}
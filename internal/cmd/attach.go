@@ -0,0 +1,312 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"golang.org/x/term"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const podExitTimeout = 30 * time.Second
+
+// runAttachedPod creates the pod, attaches the local terminal to its first container and deletes the pod when the
+// container exits (like kubectl run -i --rm), then returns the exit code of the container.
+// With tty the local terminal is switched to raw mode, so Ctrl+C is forwarded to the process and terminal resizes
+// are propagated. Otherwise an interrupt terminates the pod (a second one kills it immediately).
+// onRunning (if set) is called in the background once the container is running, and the pod is terminated if it fails.
+// The logs of the other containers (e.g. sidecars) are printed to the standard error, prefixed with the container name.
+func runAttachedPod(ctx context.Context, rootParams *rootCommandParams, pod *corev1.Pod, stdout io.Writer, tty bool, logParams logParams, startTimeout time.Duration, onRunning func() error, logger logr.Logger) (int, error) {
+	kubeConfig, err := getKubeConfig(rootParams)
+	if err != nil {
+		return 0, err
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return 0, err
+	}
+	pods := clientset.CoreV1().Pods(pod.Namespace)
+	podName, containerName := pod.Name, pod.Spec.Containers[0].Name
+
+	pod, err = pods.Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return 0, errors.WrapIfWithDetails(err, "failed to create pod", "pod", podName)
+	}
+
+	var deleteMu sync.Mutex
+	deletePod := func(gracePeriod *int64) {
+		deleteMu.Lock()
+		defer deleteMu.Unlock()
+		err := pods.Delete(context.Background(), podName, metav1.DeleteOptions{GracePeriodSeconds: gracePeriod})
+		if err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "failed to delete pod", "pod", podName)
+		}
+	}
+	defer deletePod(nil)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var gracePeriod *int64
+		for {
+			select {
+			case <-signals:
+				logger.Info("terminating pod", "pod", podName)
+				deletePod(gracePeriod)
+				gracePeriod = new(int64)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	problemsCtx, cancelProblems := context.WithCancel(ctx)
+	go reportPodProblems(problemsCtx, clientset, pod.Namespace, metav1.ListOptions{FieldSelector: "metadata.name=" + podName}, os.Stderr)
+	running, err := waitForContainerStart(ctx, pods, podName, containerName, startTimeout)
+	cancelProblems()
+	if err != nil {
+		return 0, err
+	}
+
+	onRunningErrCh := make(chan error, 1)
+	if onRunning != nil {
+		go func() {
+			err := onRunning()
+			if err != nil {
+				deletePod(new(int64))
+			}
+			onRunningErrCh <- err
+		}()
+	}
+
+	if len(pod.Spec.Containers) > 1 {
+		logs, err := newLogStreamer(clientset, logParams, os.Stderr)
+		if err != nil {
+			return 0, err
+		}
+		logsCtx, cancelLogs := context.WithCancel(ctx)
+		defer cancelLogs()
+		for _, container := range pod.Spec.Containers[1:] {
+			go func(containerName string) {
+				if err := logs.StreamContainer(logsCtx, pod.Namespace, podName, containerName, time.Time{}); err != nil {
+					logger.Error(err, "failed to stream container logs", "pod", podName, "container", containerName)
+				}
+			}(container.Name)
+		}
+	}
+
+	if running {
+		if err := attachContainer(clientset, kubeConfig, pod, containerName, stdout, tty); err != nil {
+			return 0, err
+		}
+	} else {
+		// the container exited before it could be attached, print its output instead
+		logs, err := pods.GetLogs(podName, &corev1.PodLogOptions{Container: containerName}).Stream(ctx)
+		if err != nil {
+			return 0, errors.WrapIf(err, "failed to get container logs")
+		}
+		defer logs.Close()
+		if _, err := io.Copy(stdout, logs); err != nil {
+			return 0, errors.WrapIf(err, "failed to get container logs")
+		}
+	}
+
+	select {
+	case err := <-onRunningErrCh:
+		if err != nil {
+			return 0, err
+		}
+	default:
+	}
+
+	return waitForContainerExit(ctx, pods, podName, containerName, podExitTimeout)
+}
+
+// attachContainer streams the local standard input and the specified output to the container until it exits
+func attachContainer(clientset kubernetes.Interface, kubeConfig *rest.Config, pod *corev1.Pod, containerName string, stdout io.Writer, tty bool) error {
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("attach").
+		VersionedParams(&corev1.PodAttachOptions{
+			Container: containerName,
+			Stdin:     true,
+			Stdout:    true,
+			Stderr:    !tty,
+			TTY:       tty,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(kubeConfig, "POST", req.URL())
+	if err != nil {
+		return errors.WrapIf(err, "failed to attach to container")
+	}
+
+	streamOptions := remotecommand.StreamOptions{
+		Stdin:  os.Stdin,
+		Stdout: stdout,
+		Tty:    tty,
+	}
+	if tty {
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return errors.WrapIf(err, "failed to switch terminal to raw mode")
+		}
+		defer func() {
+			_ = term.Restore(int(os.Stdin.Fd()), state)
+		}()
+
+		sizeQueue := newTerminalSizeQueue(int(os.Stdout.Fd()))
+		defer sizeQueue.Stop()
+		streamOptions.TerminalSizeQueue = sizeQueue
+	} else {
+		streamOptions.Stderr = os.Stderr
+	}
+
+	return errors.WrapIf(executor.Stream(streamOptions), "failed to stream container input and output")
+}
+
+// waitForContainerStart waits until the container is running (true) or has already terminated (false)
+func waitForContainerStart(ctx context.Context, pods typedcorev1.PodInterface, podName, containerName string, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pod, err := pods.Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.WrapIfWithDetails(err, "failed to get pod", "pod", podName)
+		}
+
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != containerName {
+				continue
+			}
+			if status.State.Running != nil {
+				return true, nil
+			}
+			if status.State.Terminated != nil {
+				return false, nil
+			}
+		}
+		if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+			return false, nil
+		}
+
+		if time.Now().After(deadline) {
+			err := errors.NewWithDetails("timeout waiting for pod to start", "pod", podName, "lastStatus", statusSummary(pod))
+			if pullErr := imagePullError(pod, err); pullErr != nil {
+				return false, pullErr
+			}
+			return false, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// waitForContainerExit waits until the container terminates and returns its exit code
+func waitForContainerExit(ctx context.Context, pods typedcorev1.PodInterface, podName, containerName string, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		pod, err := pods.Get(ctx, podName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return 0, errors.NewWithDetails("pod was deleted before the container exited", "pod", podName)
+		}
+		if err != nil {
+			return 0, errors.WrapIfWithDetails(err, "failed to get pod", "pod", podName)
+		}
+
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name == containerName && status.State.Terminated != nil {
+				return int(status.State.Terminated.ExitCode), nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return 0, errors.NewWithDetails("timeout waiting for container to exit", "pod", podName)
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// terminalSizeQueue reports the size of the local terminal to the remote one
+type terminalSizeQueue struct {
+	fd    int
+	sizes chan remotecommand.TerminalSize
+	stop  chan struct{}
+}
+
+func newTerminalSizeQueue(fd int) *terminalSizeQueue {
+	q := &terminalSizeQueue{
+		fd:    fd,
+		sizes: make(chan remotecommand.TerminalSize, 1),
+		stop:  make(chan struct{}),
+	}
+
+	resized, stopNotify := notifyTerminalResize()
+	go func() {
+		defer stopNotify()
+		defer close(q.sizes)
+
+		var last remotecommand.TerminalSize
+		for {
+			if width, height, err := term.GetSize(q.fd); err == nil {
+				size := remotecommand.TerminalSize{Width: uint16(width), Height: uint16(height)}
+				if size != last {
+					last = size
+					select {
+					case q.sizes <- size:
+					case <-q.stop:
+						return
+					}
+				}
+			}
+
+			select {
+			case <-resized:
+			case <-q.stop:
+				return
+			}
+		}
+	}()
+
+	return q
+}
+
+// Next returns the next terminal size, or nil when the queue is stopped
+func (q *terminalSizeQueue) Next() *remotecommand.TerminalSize {
+	size, ok := <-q.sizes
+	if !ok {
+		return nil
+	}
+	return &size
+}
+
+// Stop stops reporting terminal size changes
+func (q *terminalSizeQueue) Stop() {
+	close(q.stop)
+}
@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// auditRecord is a cluster-mutating action of kurun in the audit log
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Verb        string    `json:"verb"`
+	APIVersion  string    `json:"apiVersion,omitempty"`
+	Kind        string    `json:"kind,omitempty"`
+	Resource    string    `json:"resource,omitempty"`
+	Subresource string    `json:"subresource,omitempty"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Code        int       `json:"code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// auditLog writes the audit records as JSON lines
+// Records are written unbuffered, so the log is complete even if kurun is killed.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to open audit log", "path", path)
+	}
+	return &auditLog{file: file}, nil
+}
+
+// Record appends the record to the log, failures are reported on the standard error but do not stop kurun
+func (l *auditLog) Record(record auditRecord) {
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		os.Stderr.WriteString("failed to write audit log: " + err.Error() + "\n")
+	}
+}
+
+// RecordResult records the outcome of an action performed outside of the API clients (e.g. by kubectl)
+func (l *auditLog) RecordResult(record auditRecord, err error) {
+	record.Outcome = "success"
+	if err != nil {
+		record.Outcome = "failure"
+		record.Error = err.Error()
+	}
+	l.Record(record)
+}
+
+// auditRoundTripper records the mutating API requests (other than dry-runs) and their outcome
+type auditRoundTripper struct {
+	log  *auditLog
+	next http.RoundTripper
+}
+
+func (rt *auditRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	verb := map[string]string{
+		http.MethodPost:   "create",
+		http.MethodPut:    "update",
+		http.MethodPatch:  "patch",
+		http.MethodDelete: "delete",
+	}[req.Method]
+	if verb == "" || req.URL.Query().Get("dryRun") != "" {
+		return rt.next.RoundTrip(req)
+	}
+
+	record := parseAuditRequestPath(req.URL.Path)
+	record.Verb = verb
+	if verb == "delete" && record.Name == "" {
+		record.Verb = "deletecollection"
+	}
+	if record.Subresource == "attach" || record.Subresource == "exec" || record.Subresource == "proxy" {
+		return rt.next.RoundTrip(req) // streams, not changes
+	}
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		rt.log.RecordResult(record, err)
+		return resp, err
+	}
+	record.Code = resp.StatusCode
+
+	// the response contains the generated name of created objects and the reason of failures
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if readErr == nil {
+			var content struct {
+				Kind     string `json:"kind"`
+				Message  string `json:"message"`
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+			}
+			if json.Unmarshal(body, &content) == nil {
+				if content.Kind == "Status" {
+					record.Error = content.Message
+				} else {
+					record.Kind = content.Kind
+					if record.Name == "" {
+						record.Name = content.Metadata.Name
+					}
+				}
+			}
+		}
+	}
+
+	record.Outcome = "success"
+	if resp.StatusCode >= http.StatusBadRequest {
+		record.Outcome = "failure"
+	}
+	rt.log.Record(record)
+
+	return resp, nil
+}
+
+// parseAuditRequestPath returns the resource addressed by the API request path
+// e.g. /apis/apps/v1/namespaces/default/deployments/app/scale
+func parseAuditRequestPath(path string) auditRecord {
+	record := auditRecord{}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(segments) >= 2 && segments[0] == "api":
+		record.APIVersion = segments[1]
+		segments = segments[2:]
+	case len(segments) >= 3 && segments[0] == "apis":
+		record.APIVersion = segments[1] + "/" + segments[2]
+		segments = segments[3:]
+	default:
+		record.Resource = path
+		return record
+	}
+
+	if len(segments) >= 3 && segments[0] == "namespaces" {
+		record.Namespace = segments[1]
+		segments = segments[2:]
+	}
+	if len(segments) > 0 {
+		record.Resource = segments[0]
+	}
+	if len(segments) > 1 {
+		record.Name = segments[1]
+	}
+	if len(segments) > 2 {
+		record.Subresource = strings.Join(segments[2:], "/")
+	}
+	return record
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/banzaicloud/kurun/tunnel/bench"
+)
+
+// defaultBenchRequests is the number of the requests sent by kurun bench unless a duration is specified
+const defaultBenchRequests = 10000
+
+// NewBenchCommand returns the command measuring the performance of the tunnel with a local tunnel server and client
+func NewBenchCommand() *cobra.Command {
+	var soak time.Duration
+	config := bench.Config{
+		Concurrency: 16,
+		Transport:   bench.TransportMemory,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Measure the throughput and latency of the tunnel",
+		Long: "Send requests through a local tunnel server and client pair, and report the throughput, latency " +
+			"percentiles and allocations, so performance regressions of the tunnel protocol can be spotted release to release. " +
+			"With --soak the requests are sent in rounds for the specified time, reconnecting the tunnel client after each " +
+			"round, and kurun fails with the goroutine stacks if goroutines or requests are leaked.",
+		Example: "kurun bench --concurrency 64 --duration 10s --transport websocket\nkurun bench --soak 8h --duration 1m",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if soak < 0 || config.Requests < 0 || config.Duration < 0 || config.RequestSize < 0 || config.ResponseSize < 0 {
+				return errors.New("--soak, --requests, --duration and the body sizes must not be negative")
+			}
+			if config.Requests == 0 && config.Duration == 0 {
+				config.Requests = defaultBenchRequests
+			}
+
+			cmd.SilenceUsage = true // all args and flags validated before this line
+
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+			if soak > 0 {
+				return soakTunnel(ctx, soak, config)
+			}
+			result, err := bench.Run(ctx, config)
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(os.Stdout, result)
+			return nil
+		},
+	}
+
+	cmd.PersistentFlags().IntVarP(&config.Concurrency, "concurrency", "c", config.Concurrency, "Number of requests in flight")
+	cmd.PersistentFlags().DurationVarP(&config.Duration, "duration", "d", 0, "Time to send requests for (used unless --requests is specified)")
+	cmd.PersistentFlags().IntVarP(&config.Requests, "requests", "n", 0, "Number of requests to send (default 10000 unless --duration is specified)")
+	cmd.PersistentFlags().IntVar(&config.RequestSize, "request-size", 0, "Size of the request bodies in bytes")
+	cmd.PersistentFlags().IntVar(&config.ResponseSize, "response-size", 1024, "Size of the response bodies in bytes")
+	cmd.PersistentFlags().IntVar(&config.MaxFrameSize, "max-frame-size", 0, "Maximal size of the tunnel frames in bytes (0 means the default of 64KiB)")
+	cmd.PersistentFlags().DurationVar(&soak, "soak", 0, "Run a soak test for this long (e.g. 8h), the other flags configure the load of its rounds")
+	cmd.PersistentFlags().StringVar(&config.Transport, "transport", config.Transport, "Transport of the tunnel: memory or websocket (over loopback)")
+
+	return cmd
+}
+
+// soakTunnel runs a soak test, printing a snapshot after each round, and the goroutine stacks if a leak is detected
+func soakTunnel(ctx context.Context, duration time.Duration, round bench.Config) error {
+	err := bench.Soak(ctx, bench.SoakConfig{
+		Duration: duration,
+		Round:    round,
+	}, func(snapshot bench.SoakSnapshot) {
+		fmt.Fprintln(os.Stdout, snapshot)
+	})
+	var leakErr *bench.LeakError
+	if errors.As(err, &leakErr) {
+		fmt.Fprint(os.Stderr, leakErr.Stacks)
+	}
+	return err
+}
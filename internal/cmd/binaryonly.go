@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+const (
+	defaultRunnerImage = "alpine"
+	binaryOnlyDir      = "/kurun"
+)
+
+// binaryOnlyEntrypoint is the shell script run by the generic runner image
+// It waits for the binary to be streamed into the container, then executes it with the script arguments.
+const binaryOnlyEntrypoint = "mkdir -p " + binaryOnlyDir +
+	" && while [ ! -e " + binaryOnlyDir + "/.ready ]; do sleep 0.1; done" +
+	" && exec " + binaryOnlyDir + "/main \"$@\""
+
+// streamBinaryToPod copies the build context (containing the compiled binary) into the running pod
+// and signals the runner entrypoint to start the binary.
+func streamBinaryToPod(rootParams *rootCommandParams, namespace, podName, container, directory string, timeout time.Duration) error {
+	if err := waitForPodPhase(namespace, podName, "Running", timeout); err != nil {
+		return err
+	}
+
+	archive := bytes.NewBuffer(nil)
+	if err := writeBuildContextArchive(archive, directory); err != nil {
+		return errors.WrapIf(err, "failed to archive binary")
+	}
+
+	kubectlCommand := exec.Command("kubectl", "exec", "-i", podName,
+		"--namespace="+namespace,
+		"--container="+container,
+		"--",
+		"sh", "-c", "tar -xzf - -C "+binaryOnlyDir+" && touch "+binaryOnlyDir+"/.ready",
+	)
+	kubectlCommand.Stdin = archive
+	kubectlCommand.Stderr = os.Stderr
+
+	err := kubectlCommand.Run()
+	if rootParams.auditLog != nil {
+		rootParams.auditLog.RecordResult(auditRecord{Verb: "exec", APIVersion: "v1", Kind: "Pod", Subresource: "exec", Namespace: namespace, Name: podName}, err)
+	}
+	return errors.WrapIf(err, "failed to stream binary to pod")
+}
+
+// waitForPodPhase polls the pod until it reaches the specified phase or the timeout expires
+func waitForPodPhase(namespace, podName, phase string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		output := bytes.NewBuffer(nil)
+		kubectlCommand := exec.Command("kubectl", "get", "pod", podName, "--namespace="+namespace, "--ignore-not-found", "-o", "jsonpath={.status.phase}")
+		kubectlCommand.Stdout = output
+		if err := kubectlCommand.Run(); err != nil {
+			return err
+		}
+
+		current := strings.TrimSpace(output.String())
+		if current == phase {
+			return nil
+		}
+		if current == "Failed" || current == "Succeeded" {
+			return errors.Errorf("pod %s terminated (%s) before reaching phase %s", podName, current, phase)
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("timeout waiting for pod %s to reach phase %s", podName, phase)
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+}
@@ -0,0 +1,632 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/banzaicloud/kurun/extension"
+)
+
+const (
+	defaultBaseImage             = "alpine"
+	defaultInClusterBuilderImage = "gcr.io/kaniko-project/executor:v1.9.1"
+)
+
+type imageBuildParams struct {
+	baseImage        string
+	builder          string
+	buildTags        []string
+	goBuildArgs      []string
+	goos             string
+	imageHash        string
+	includes         []string
+	inCluster        bool
+	postBuildHooks   []string
+	preBuildHooks    []string
+	scan             bool
+	scanSeverities   []string
+	sign             bool
+	signKey          string
+	testBinary       bool
+	inClusterBuilder string
+	pushSecret       string
+	registry         string
+}
+
+func addImageBuildFlags(cmd *cobra.Command, params *imageBuildParams) {
+	cmd.PersistentFlags().StringVar(&params.baseImage, "base-image", defaultBaseImage, "Base image of the built images")
+	cmd.PersistentFlags().StringVar(&params.builder, "builder", "", "Image builder registered by an extension of kurun to build the images with (default: the container engine or the in-cluster builder)")
+	cmd.PersistentFlags().StringSliceVar(&params.buildTags, "build-tags", nil, "Go build tags to use when compiling the binary")
+	cmd.PersistentFlags().StringArrayVar(&params.includes, "include", nil, "Additional file or directory to copy into the image as path[:target], target defaults to /<base name of path>")
+	cmd.PersistentFlags().StringArrayVar(&params.preBuildHooks, "pre-build-hook", nil, "Command to run before compiling the binary, e.g. 'go generate ./...' (can be repeated)")
+	cmd.PersistentFlags().StringArrayVar(&params.postBuildHooks, "post-build-hook", nil, "Command to run after building the image, the image reference is available as $KURUN_IMAGE (can be repeated)")
+	cmd.PersistentFlags().BoolVar(&params.scan, "scan", false, "Scan built images for vulnerabilities with trivy and fail if findings exceed the severity threshold")
+	cmd.PersistentFlags().StringSliceVar(&params.scanSeverities, "severity", []string{defaultScanSeverity}, "Vulnerability severities failing the image scan (UNKNOWN, LOW, MEDIUM, HIGH, CRITICAL)")
+	cmd.PersistentFlags().BoolVar(&params.sign, "sign", false, "Sign pushed images with cosign")
+	cmd.PersistentFlags().StringVar(&params.signKey, "sign-key", "", "Cosign key (file path or KMS URI) to sign images with, keyless signing is used if not specified")
+	cmd.PersistentFlags().BoolVar(&params.inCluster, "build-in-cluster", false, "Build and push images in a builder pod inside the cluster instead of using a local container engine (requires --registry)")
+	cmd.PersistentFlags().StringVar(&params.inClusterBuilder, "builder-image", defaultInClusterBuilderImage, "Kaniko executor image to use for in-cluster builds")
+	cmd.PersistentFlags().StringVar(&params.pushSecret, "push-secret", "", "Docker config secret (kubernetes.io/dockerconfigjson) used by the builder pod to push images")
+	cmd.PersistentFlags().StringVar(&params.registry, "registry", "", "Registry (and repository prefix) to push in-cluster built images to, e.g. registry.example.com/team")
+}
+
+// imageBuilder builds container images from Go source code
+type imageBuilder struct {
+	// auditLog records the builder pods run in the cluster, nil if not enabled
+	auditLog   *auditLog
+	cache      buildCacheConfig
+	engineName string
+	// keepImages is the number of the most recent images kept in the local engine after a build, 0 keeps all
+	keepImages int
+	logger     logr.Logger
+	namespace  string
+	output     *outputPrinter
+	params     imageBuildParams
+}
+
+func newImageBuilder(rootParams *rootCommandParams, params imageBuildParams) (*imageBuilder, error) {
+	if params.inCluster && params.registry == "" {
+		return nil, errors.New("--registry must be specified when building in cluster")
+	}
+	if params.builder != "" {
+		if _, ok := extension.LookupImageBuilder(params.builder); !ok {
+			return nil, errors.Errorf("unknown --builder %q, registered builders: %s", params.builder, strings.Join(extension.ImageBuilderNames(), ", "))
+		}
+		if params.inCluster {
+			return nil, errors.New("--builder cannot be used with --build-in-cluster")
+		}
+	}
+	if params.sign && !params.inCluster && params.builder == "" {
+		return nil, errors.New("--sign requires images to be pushed to a registry with --build-in-cluster")
+	}
+
+	if err := validateImageHash(rootParams.config.Build.ImageHash); err != nil {
+		return nil, err
+	}
+	params.imageHash = rootParams.config.Build.ImageHash
+
+	hooks := rootParams.config.Build.Hooks
+	params.preBuildHooks = append(append([]string{}, hooks.PreBuild...), params.preBuildHooks...)
+	params.postBuildHooks = append(append([]string{}, hooks.PostBuild...), params.postBuildHooks...)
+
+	keepImages := defaultKeptImages
+	if keep := rootParams.config.Images.Keep; keep != nil {
+		keepImages = *keep
+	}
+
+	return &imageBuilder{
+		auditLog:   rootParams.auditLog,
+		cache:      rootParams.config.Build.Cache,
+		engineName: rootParams.containerEngine,
+		keepImages: keepImages,
+		logger:     rootParams.logger,
+		namespace:  rootParams.namespace,
+		output:     rootParams.output,
+		params:     params,
+	}, nil
+}
+
+// builtImage describes an image built by kurun
+type builtImage struct {
+	// name is the name of the image without registry and tag, usable as a resource name
+	name string
+	// ref is the full image reference to use in pod specs
+	ref string
+	// pullPolicy is the image pull policy to use for the image
+	pullPolicy corev1.PullPolicy
+	// engine is the name of the local container engine storing the image, empty if the image is only in a registry
+	engine string
+}
+
+// Build builds an image running the binary compiled from the specified Go files
+func (b *imageBuilder) Build(goFiles []string) (builtImage, error) {
+	return b.BuildWithParams(goFiles, b.params)
+}
+
+// BuildWithParams builds an image like Build, but uses the specified build parameters (e.g. from a kurun:// URL)
+func (b *imageBuilder) BuildWithParams(goFiles []string, params imageBuildParams) (builtImage, error) {
+	imageName, directory, err := b.PrepareBinary(goFiles, params)
+	if err != nil {
+		return builtImage{}, err
+	}
+
+	var image builtImage
+	if b.params.builder != "" {
+		image, err = b.buildWithExtension(imageName, directory)
+	} else if b.params.inCluster {
+		image, err = b.buildInCluster(imageName, directory)
+	} else {
+		image, err = b.buildLocally(imageName, directory)
+	}
+	if err != nil {
+		return image, err
+	}
+
+	if params.scan {
+		if err := scanImage(image, params.scanSeverities, b.logger); err != nil {
+			return image, err
+		}
+	}
+
+	if params.sign {
+		if err := signImage(image, params.signKey, b.logger); err != nil {
+			return image, err
+		}
+	}
+
+	if err := runBuildHooks(params.postBuildHooks, b.logger, "KURUN_IMAGE="+image.ref); err != nil {
+		return image, errors.WrapIf(err, "post-build hook failed")
+	}
+
+	if err := b.output.Result("", "", imageResult{Type: "image", Image: image.ref, GoFiles: goFiles}); err != nil {
+		return image, err
+	}
+
+	return image, nil
+}
+
+// PrepareBinary runs the pre-build hooks and prepares the build context containing the compiled binary
+func (b *imageBuilder) PrepareBinary(goFiles []string, params imageBuildParams) (imageName string, directory string, err error) {
+	if err := runBuildHooks(params.preBuildHooks, b.logger); err != nil {
+		return "", "", errors.WrapIf(err, "pre-build hook failed")
+	}
+
+	b.output.Statusf("Compiling %s", strings.Join(goFiles, " "))
+	return prepareBuildContext(goFiles, params, b.logger)
+}
+
+// runBuildHooks runs the specified hook commands in the system shell, stopping at the first failure
+func runBuildHooks(hooks []string, logger logr.Logger, env ...string) error {
+	for _, hook := range hooks {
+		var hookCommand *exec.Cmd
+		if runtime.GOOS == "windows" {
+			hookCommand = exec.Command("cmd", "/C", hook)
+		} else {
+			hookCommand = exec.Command("sh", "-c", hook)
+		}
+		hookCommand.Env = append(os.Environ(), env...)
+		hookCommand.Stderr = os.Stderr
+		hookCommand.Stdout = commandStdout
+
+		logger.Info("running build hook", "command", hookCommand.String())
+
+		if err := hookCommand.Run(); err != nil {
+			return errors.WithDetails(err, "hook", hook)
+		}
+	}
+	return nil
+}
+
+// prepareBuildContext compiles the Go files (or the test binary of the package) and writes the Dockerfile to the build context directory
+func prepareBuildContext(goFiles []string, params imageBuildParams, logger logr.Logger) (imageName string, directory string, err error) {
+	includes, err := parseIncludes(params.includes)
+	if err != nil {
+		return "", "", err
+	}
+
+	goos := params.goos
+	if goos == "" {
+		goos = linuxNodeOS
+	}
+	baseImage := params.baseImage
+	if baseImage == "" {
+		baseImage = defaultBaseImage
+	}
+	binaryName := "main"
+	if goos == windowsNodeOS {
+		binaryName = "main.exe"
+		// the default base image has no Windows variant
+		if baseImage == defaultBaseImage {
+			baseImage = defaultWindowsBaseImage
+		}
+	}
+
+	hash := sha1.New()
+	if err := hashGoFiles(hash, goFiles, params.imageHash); err != nil {
+		return "", "", err
+	}
+	for _, inc := range includes {
+		if _, err := fmt.Fprintf(hash, "\x00%s:%s", inc.source, inc.target); err != nil {
+			return "", "", err
+		}
+	}
+	if _, err := fmt.Fprintf(hash, "\x00%s\x00%v\x00%v\x00%t", baseImage, params.buildTags, params.goBuildArgs, params.testBinary); err != nil {
+		return "", "", err
+	}
+	if goos != linuxNodeOS {
+		// the images built for Linux keep their names
+		if _, err := fmt.Fprintf(hash, "\x00%s", goos); err != nil {
+			return "", "", err
+		}
+	}
+
+	imageName = fmt.Sprintf("kurun-%x", hash.Sum(nil))
+	directory = filepath.Join(buildBaseDirectory(), imageName)
+
+	if err := os.MkdirAll(directory, os.ModePerm); err != nil {
+		return "", "", err
+	}
+
+	// -trimpath keeps the local paths out of the binary, so the same code compiles to the same binary everywhere
+	goBuildArgs := []string{"build", "-trimpath", "-o", filepath.Join(directory, binaryName)}
+	if params.testBinary {
+		goBuildArgs = []string{"test", "-c", "-trimpath", "-o", filepath.Join(directory, binaryName)}
+	}
+	if len(params.buildTags) > 0 {
+		goBuildArgs = append(goBuildArgs, "-tags", strings.Join(params.buildTags, ","))
+	}
+	goBuildArgs = append(goBuildArgs, params.goBuildArgs...)
+	goBuildArgs = append(goBuildArgs, goFiles...)
+	goBuildCommand := exec.Command("go", goBuildArgs...)
+	env := os.Environ()
+	env = append(env, "GOOS="+goos, "CGO_ENABLED=0")
+	goBuildCommand.Env = env
+
+	logger.V(1).Info("compiling binary", "command", goBuildCommand.String())
+
+	if err := runTool(goBuildCommand); err != nil {
+		return "", "", errors.WrapIf(err, "failed to compile binary")
+	}
+
+	file, err := os.Create(filepath.Join(directory, "Dockerfile"))
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	includeDirectory := filepath.Join(directory, "include")
+	if err := os.RemoveAll(includeDirectory); err != nil {
+		return "", "", err
+	}
+
+	fmt.Fprintf(file, "FROM %s\n", baseImage)
+	fmt.Fprintf(file, "ADD %s /\n", binaryName)
+	for i, inc := range includes {
+		name := strconv.Itoa(i)
+		if err := copyPath(inc.source, filepath.Join(includeDirectory, name)); err != nil {
+			return "", "", errors.WrapIfWithDetails(err, "failed to copy included path", "path", inc.source)
+		}
+		fmt.Fprintf(file, "COPY include/%s %s\n", name, inc.target)
+	}
+	fmt.Fprintf(file, "CMD [\"/%s\"]\n", binaryName)
+	if err := file.Close(); err != nil {
+		return "", "", err
+	}
+
+	if err := resetModTimes(directory); err != nil {
+		return "", "", errors.WrapIf(err, "failed to reset build context timestamps")
+	}
+
+	return imageName, directory, nil
+}
+
+// include is an additional file or directory copied into the image
+type include struct {
+	source string
+	target string
+}
+
+// parseIncludes parses include specifications in path[:target] format
+// The separator is the last colon followed by an absolute target path, so Windows drive letters are handled properly.
+func parseIncludes(specs []string) ([]include, error) {
+	includes := make([]include, 0, len(specs))
+	for _, spec := range specs {
+		inc := include{
+			source: spec,
+		}
+		if idx := strings.LastIndex(spec, ":"); idx > 0 && strings.HasPrefix(spec[idx+1:], "/") {
+			inc.source, inc.target = spec[:idx], spec[idx+1:]
+		}
+		if inc.source == "" {
+			return nil, errors.Errorf("invalid include %q", spec)
+		}
+		if inc.target == "" {
+			inc.target = "/" + filepath.Base(inc.source)
+		}
+		includes = append(includes, inc)
+	}
+	return includes, nil
+}
+
+// copyPath copies the file or directory tree at src to dst
+func copyPath(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		if _, err := io.Copy(out, in); err != nil {
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// buildLocally builds the image using the local container engine and loads it into local clusters
+func (b *imageBuilder) buildLocally(imageName string, directory string) (builtImage, error) {
+	engine, err := newContainerEngine(b.engineName)
+	if err != nil {
+		return builtImage{}, err
+	}
+
+	b.output.Statusf("Building image %s", imageName)
+	if err := engine.Build(imageName, directory, b.cache.cacheRef(imageName), b.cache.Push); err != nil {
+		return builtImage{}, err
+	}
+
+	// the tag is the digest of the build context instead of the image ID, which depends on the time of the build
+	contentDigest, err := buildContextDigest(directory)
+	if err != nil {
+		return builtImage{}, err
+	}
+
+	cluster, err := detectLocalCluster()
+	if err != nil {
+		return builtImage{}, err
+	}
+
+	fullImageTag := imageName + ":" + contentDigest
+
+	if err := engine.Tag(imageName, fullImageTag); err != nil {
+		return builtImage{}, err
+	}
+
+	if cluster.typ != clusterTypeNone {
+		b.output.Statusf("Loading image %s into the %s cluster", imageName, cluster.name)
+	}
+	if err := engine.LoadIntoCluster(fullImageTag, cluster, b.logger); err != nil {
+		return builtImage{}, loadImageError(errors.WrapIf(err, "failed to load image into cluster"), cluster)
+	}
+
+	if b.keepImages > 0 {
+		if _, err := pruneKurunImages(engine, cluster, b.keepImages, 0, imageName, b.logger); err != nil {
+			b.logger.V(1).Info("cannot prune old images", "error", err.Error())
+		}
+	}
+
+	return builtImage{
+		name:       imageName,
+		ref:        "docker.io/library/" + fullImageTag,
+		pullPolicy: corev1.PullNever,
+		engine:     engine.name,
+	}, nil
+}
+
+// buildInCluster streams the build context to a Kaniko pod which builds the image and pushes it to the registry
+func (b *imageBuilder) buildInCluster(imageName string, directory string) (builtImage, error) {
+	buildContext := bytes.NewBuffer(nil)
+	contentHash := sha256.New()
+	if err := writeBuildContextArchive(io.MultiWriter(buildContext, contentHash), directory); err != nil {
+		return builtImage{}, errors.WrapIf(err, "failed to archive build context")
+	}
+
+	ref := fmt.Sprintf("%s/%s:%x", strings.TrimSuffix(b.params.registry, "/"), imageName, contentHash.Sum(nil)[:contentDigestLength])
+	podName := fmt.Sprintf("%s-build", imageName[:len("kurun-")+8])
+
+	builderContainer := corev1.Container{
+		Name:  podName,
+		Image: b.params.inClusterBuilder,
+	}
+	podSpec := corev1.PodSpec{}
+	setNodeOS(&podSpec, linuxNodeOS)
+	if b.params.pushSecret != "" {
+		builderContainer.VolumeMounts = []corev1.VolumeMount{
+			{
+				Name:      "docker-config",
+				MountPath: "/kaniko/.docker",
+			},
+		}
+		podSpec.Volumes = []corev1.Volume{
+			{
+				Name: "docker-config",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: b.params.pushSecret,
+						Items: []corev1.KeyToPath{
+							{
+								Key:  corev1.DockerConfigJsonKey,
+								Path: "config.json",
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	podSpec.Containers = []corev1.Container{builderContainer}
+
+	overrides, err := json.Marshal(map[string]interface{}{
+		"spec": podSpec,
+	})
+	if err != nil {
+		return builtImage{}, err
+	}
+
+	kubectlArgs := []string{"run", podName,
+		"-i",
+		"--quiet",
+		"--rm",
+		"--restart=Never",
+		"--image=" + b.params.inClusterBuilder,
+		"--override-type=strategic",
+		"--overrides=" + string(overrides),
+		"--namespace=" + b.namespace,
+		"--",
+		"--context=tar://stdin",
+		"--destination=" + ref,
+		"--reproducible",
+	}
+	if cacheRef := b.cache.cacheRef(imageName); cacheRef != "" {
+		// Kaniko always pushes the layers it caches, the image consists of ADD and COPY layers only
+		kubectlArgs = append(kubectlArgs, "--cache=true", "--cache-copy-layers", "--cache-repo="+cacheRef)
+	}
+	kubectlCommand := exec.Command("kubectl", kubectlArgs...)
+	kubectlCommand.Stdin = buildContext
+
+	b.output.Statusf("Building image %s in the cluster", imageName)
+	b.logger.V(1).Info("building image in cluster", "command", kubectlCommand.String())
+
+	err = runTool(kubectlCommand)
+	if b.auditLog != nil {
+		// the pod is deleted by kubectl (--rm) when the build finishes
+		b.auditLog.RecordResult(auditRecord{Verb: "run", APIVersion: "v1", Kind: "Pod", Namespace: b.namespace, Name: podName}, err)
+	}
+	if err != nil {
+		return builtImage{}, errors.WrapIf(err, "in-cluster image build failed")
+	}
+
+	return builtImage{
+		name:       imageName,
+		ref:        ref,
+		pullPolicy: corev1.PullIfNotPresent,
+	}, nil
+}
+
+// buildWithExtension builds the image with the image builder registered by an extension
+func (b *imageBuilder) buildWithExtension(imageName string, directory string) (builtImage, error) {
+	builder, _ := extension.LookupImageBuilder(b.params.builder)
+	result, err := builder.Build(context.Background(), extension.BuildRequest{
+		ContextDir: directory,
+		ImageName:  imageName,
+		Logger:     b.logger.WithValues("builder", b.params.builder),
+		Namespace:  b.namespace,
+	})
+	if err != nil {
+		return builtImage{}, errors.WrapIfWithDetails(err, "failed to build image", "builder", b.params.builder)
+	}
+	pullPolicy := result.PullPolicy
+	if pullPolicy == "" {
+		pullPolicy = corev1.PullIfNotPresent
+	}
+	return builtImage{
+		name:       imageName,
+		ref:        result.Ref,
+		pullPolicy: pullPolicy,
+	}, nil
+}
+
+// contentDigestLength is the number of the bytes of the build context digest used in image tags
+const contentDigestLength = 16
+
+// buildContextDigest returns the digest of the build context used as the tag of the image, the same for the same
+// binary, included files and Dockerfile
+func buildContextDigest(directory string) (string, error) {
+	contentHash := sha256.New()
+	if err := writeBuildContextArchive(contentHash, directory); err != nil {
+		return "", errors.WrapIf(err, "failed to archive build context")
+	}
+	return fmt.Sprintf("%x", contentHash.Sum(nil)[:contentDigestLength]), nil
+}
+
+// resetModTimes sets the modification times of the files in the directory tree to the Unix epoch, so the layers
+// added from the build context don't depend on the time of the build
+func resetModTimes(directory string) error {
+	epoch := time.Unix(0, 0)
+	return filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, epoch, epoch)
+	})
+}
+
+// writeBuildContextArchive writes the files of the build context directory as a gzipped tarball
+func writeBuildContextArchive(w io.Writer, directory string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		// strip metadata to keep the archive (and thus the image tag) stable across rebuilds of the same content
+		header.Name = filepath.ToSlash(relPath)
+		header.ModTime = time.Unix(0, 0)
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// buildBaseDirectory returns the directory under which image build contexts are created
+func buildBaseDirectory() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "kurun")
+	}
+	return filepath.Join(os.TempDir(), "kurun")
+}
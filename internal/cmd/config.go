@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+
+	"emperror.dev/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultConfigFile = ".kurun.yaml"
+
+// config is the content of the kurun configuration file
+type config struct {
+	Build  buildConfig  `yaml:"build"`
+	Images imagesConfig `yaml:"images"`
+	Server serverConfig `yaml:"server"`
+}
+
+type buildConfig struct {
+	Cache buildCacheConfig `yaml:"cache"`
+	Hooks buildHooksConfig `yaml:"hooks"`
+	// ImageHash is the way of hashing the Go files into the names of the images: path (default) or module
+	ImageHash string `yaml:"imageHash"`
+}
+
+type buildHooksConfig struct {
+	// PreBuild commands are run before compiling the binary (e.g. go generate)
+	PreBuild []string `yaml:"preBuild"`
+	// PostBuild commands are run after the image is built, the image reference is available as KURUN_IMAGE
+	PostBuild []string `yaml:"postBuild"`
+}
+
+type buildCacheConfig struct {
+	// Repository is the registry repository storing the layer caches of the image builds, e.g.
+	// registry.example.com/team/kurun-cache, the cache of each image is stored at <repository>/<image name>
+	Repository string `yaml:"repository"`
+	// Push exports the layer caches to the repository after the builds (e.g. in CI), otherwise they are only imported
+	Push bool `yaml:"push"`
+}
+
+// cacheRef returns the reference of the layer cache of the image in the cache repository, empty without a repository
+func (c buildCacheConfig) cacheRef(imageName string) string {
+	if c.Repository == "" {
+		return ""
+	}
+	return strings.TrimSuffix(c.Repository, "/") + "/" + imageName
+}
+
+type imagesConfig struct {
+	// Keep is the number of the most recent images built by kurun kept in the local engine after each build, 0 keeps
+	// all of them
+	Keep *int `yaml:"keep"`
+}
+
+type serverConfig struct {
+	// Images are the kurun-server images used instead of the default one in the clusters with nodes of the
+	// architectures (e.g. arm64: registry.example.com/kurun-server:v0.2.1-arm64), unless --server-image is set
+	Images map[string]string `yaml:"images"`
+}
+
+// loadConfig reads the configuration file at the specified path
+// A missing file is not an error unless required is set.
+func loadConfig(path string, required bool) (config, error) {
+	var cfg config
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return cfg, nil
+		}
+		return cfg, errors.WrapIfWithDetails(err, "failed to read config file", "path", path)
+	}
+
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return cfg, errors.WrapIfWithDetails(err, "failed to parse config file", "path", path)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// statuses of the doctor findings
+const (
+	findingOK      = "ok"
+	findingWarning = "warning"
+	findingError   = "error"
+)
+
+// podSecurityEnforceLabel is the namespace label setting the enforced Pod Security Standard
+const podSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+
+// doctorTimeout limits the time of the checks calling the cluster
+const doctorTimeout = 10 * time.Second
+
+func NewDoctorCommand(rootParams *rootCommandParams) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check the local tools and the cluster access needed by kurun",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			findings := runDoctorChecks(cmd.Context(), rootParams)
+			failed := printFindings(os.Stdout, findings)
+			if failed > 0 {
+				return errors.Errorf("%d checks failed", failed)
+			}
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+// doctorFinding is the outcome of a check of kurun doctor
+type doctorFinding struct {
+	check   string
+	status  string
+	message string
+	// hint tells how to fix the problem found by the check
+	hint string
+}
+
+// runDoctorChecks checks the local tools, and the cluster if it's reachable
+func runDoctorChecks(ctx context.Context, rootParams *rootCommandParams) []doctorFinding {
+	findings := checkTools(rootParams.containerEngine)
+
+	kubeConfig, err := getKubeConfig(rootParams)
+	if err != nil {
+		return append(findings, doctorFinding{
+			check:   "cluster",
+			status:  findingError,
+			message: err.Error(),
+			hint:    "set up a kubeconfig (e.g. with kind create cluster), or point KUBECONFIG to one",
+		})
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return append(findings, doctorFinding{check: "cluster", status: findingError, message: err.Error()})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+
+	finding := checkCluster(clientset, kubeConfig)
+	findings = append(findings, finding)
+	if finding.status == findingError {
+		return findings
+	}
+
+	namespace := rootParams.namespace
+	findings = append(findings,
+		checkPermissions(ctx, clientset, namespace, "run", runPermissions),
+		checkPermissions(ctx, clientset, namespace, "port-forward", portForwardPermissions),
+		checkProxyWebSocket(ctx, kubeConfig, namespace),
+		checkPodSecurity(ctx, clientset, namespace),
+	)
+	return findings
+}
+
+// checkTools checks the local tools used to build images and to load them into local clusters
+func checkTools(engineName string) []doctorFinding {
+	var findings []doctorFinding
+
+	if engine, err := newContainerEngine(engineName); err != nil {
+		findings = append(findings, doctorFinding{
+			check:   "container engine",
+			status:  findingWarning,
+			message: err.Error(),
+			hint:    "install Docker, Podman or nerdctl to build images locally, or build them with --build-in-cluster",
+		})
+	} else {
+		findings = append(findings, lookPathFinding("container engine", engine.name, findingWarning, "install "+engine.name+", or choose another engine with --container-engine"))
+	}
+
+	kubectl := lookPathFinding("kubectl", "kubectl", findingError, "install kubectl, it's used by kurun apply and to detect local clusters: https://kubernetes.io/docs/tasks/tools/")
+	findings = append(findings, kubectl)
+	if kubectl.status != findingOK {
+		return findings
+	}
+
+	cluster, err := detectLocalCluster()
+	if err != nil {
+		return append(findings, doctorFinding{
+			check:   "local cluster",
+			status:  findingWarning,
+			message: "cannot get the current kubectl context: " + err.Error(),
+		})
+	}
+	switch cluster.typ {
+	case clusterTypeKind:
+		findings = append(findings, lookPathFinding("kind", "kind", findingError, "install kind to load the built images into the kind-"+cluster.name+" cluster: https://kind.sigs.k8s.io/docs/user/quick-start/#installation"))
+	case clusterTypeK3d:
+		findings = append(findings, lookPathFinding("k3d", "k3d", findingError, "install k3d to load the built images into the k3d-"+cluster.name+" cluster: https://k3d.io/#installation"))
+	}
+	return findings
+}
+
+// lookPathFinding checks the tool is on the PATH, the finding has the status if it's not
+func lookPathFinding(check, name, status, hint string) doctorFinding {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return doctorFinding{check: check, status: status, message: name + " not found on the PATH", hint: hint}
+	}
+	return doctorFinding{check: check, status: findingOK, message: name + " found at " + path}
+}
+
+// checkCluster checks the API server of the current context is reachable
+func checkCluster(clientset kubernetes.Interface, kubeConfig *rest.Config) doctorFinding {
+	version, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		return doctorFinding{
+			check:   "cluster",
+			status:  findingError,
+			message: "cannot reach the API server at " + kubeConfig.Host + ": " + err.Error(),
+			hint:    "check the current context with kubectl config current-context, and that the cluster is running",
+		}
+	}
+	return doctorFinding{check: "cluster", status: findingOK, message: "Kubernetes " + version.GitVersion + " at " + kubeConfig.Host}
+}
+
+// checkPermissions checks the user has the permissions needed by the command in the namespace
+func checkPermissions(ctx context.Context, clientset kubernetes.Interface, namespace, command string, permissions []resourcePermission) doctorFinding {
+	check := "permissions of " + command
+	missing, err := missingPermissions(ctx, clientset, namespace, permissions)
+	if err != nil {
+		return doctorFinding{check: check, status: findingWarning, message: err.Error()}
+	}
+	if len(missing) > 0 {
+		return doctorFinding{
+			check:   check,
+			status:  findingError,
+			message: fmt.Sprintf("missing %s in namespace %s", formatPermissions(missing), namespace),
+			hint:    "ask a cluster administrator for a Role granting these permissions, or use a namespace you own with --namespace",
+		}
+	}
+	return doctorFinding{check: check, status: findingOK, message: "all permissions granted in namespace " + namespace}
+}
+
+// checkProxyWebSocket checks WebSocket connections reach the service proxy of the API server, like the tunnel of
+// port-forward does
+// No kurun-server runs behind the checked service, so the API server is expected to answer that it's not found, the
+// other responses come from the proxies in between or tell the connection is not allowed.
+func checkProxyWebSocket(ctx context.Context, kubeConfig *rest.Config, namespace string) doctorFinding {
+	const check = "API server proxy"
+
+	proxyURL, err := url.Parse(kubeConfig.Host)
+	if err != nil {
+		return doctorFinding{check: check, status: findingError, message: err.Error()}
+	}
+	proxyURL.Scheme = strings.Replace(proxyURL.Scheme, "http", "ws", 1)
+	proxyURL.Path = fmt.Sprintf("/api/v1/namespaces/%s/services/https:kurun-doctor:8333/proxy/", namespace)
+
+	tlsConfig, err := rest.TLSConfigFor(kubeConfig)
+	if err != nil {
+		return doctorFinding{check: check, status: findingError, message: err.Error()}
+	}
+	dialer := websocket.Dialer{
+		HandshakeTimeout: doctorTimeout,
+		TLSClientConfig:  tlsConfig,
+	}
+	conn, resp, err := dialer.DialContext(ctx, proxyURL.String(), nil)
+	if err == nil {
+		conn.Close()
+		return doctorFinding{check: check, status: findingOK, message: "WebSocket connections are proxied to services"}
+	}
+	if resp == nil {
+		return doctorFinding{
+			check:   check,
+			status:  findingError,
+			message: "WebSocket connection failed: " + err.Error(),
+			hint:    "check the network path to the API server, or connect the tunnel with --transport ssh",
+		}
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusServiceUnavailable:
+		return doctorFinding{check: check, status: findingOK, message: "WebSocket connections reach the service proxy"}
+	case http.StatusUnauthorized:
+		return doctorFinding{
+			check:   check,
+			status:  findingError,
+			message: "the API server rejected the credentials of the WebSocket connection",
+			hint:    "the tunnel authenticates with the TLS client certificate of the kubeconfig, use a context with one or --transport ssh",
+		}
+	case http.StatusForbidden:
+		return doctorFinding{
+			check:   check,
+			status:  findingError,
+			message: "not allowed to proxy to services in namespace " + namespace,
+			hint:    "ask a cluster administrator for the get services/proxy permission",
+		}
+	default:
+		return doctorFinding{
+			check:   check,
+			status:  findingWarning,
+			message: fmt.Sprintf("unexpected response to the WebSocket connection: %s %s", resp.Status, strings.TrimSpace(string(body))),
+			hint:    "a proxy between kurun and the API server may not support WebSockets, try --transport ssh",
+		}
+	}
+}
+
+// checkPodSecurity checks the Pod Security Standard enforced in the namespace admits the pods of kurun
+func checkPodSecurity(ctx context.Context, clientset kubernetes.Interface, name string) doctorFinding {
+	const check = "pod security"
+
+	namespace, err := clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return doctorFinding{check: check, status: findingWarning, message: "cannot get namespace " + name + ": " + err.Error()}
+	}
+	switch level := namespace.Labels[podSecurityEnforceLabel]; level {
+	case "", "privileged", "baseline":
+		if level == "" {
+			level = "not enforced"
+		}
+		return doctorFinding{check: check, status: findingOK, message: "namespace " + name + ": " + level}
+	default:
+		return doctorFinding{
+			check:   check,
+			status:  findingWarning,
+			message: "namespace " + name + " enforces the " + level + " Pod Security Standard, the pods of kurun run are not admitted",
+			hint:    "use --overrides to set a compliant security context, or another namespace with --namespace (kurun-server complies with --server-hardening)",
+		}
+	}
+}
+
+// printFindings prints the findings with their hints, and returns the number of the failed checks
+func printFindings(w io.Writer, findings []doctorFinding) int {
+	failed := 0
+	for _, finding := range findings {
+		fmt.Fprintf(w, "[%s] %s: %s\n", finding.status, finding.check, finding.message)
+		if finding.hint != "" && finding.status != findingOK {
+			fmt.Fprintf(w, "  hint: %s\n", finding.hint)
+		}
+		if finding.status == findingError {
+			failed++
+		}
+	}
+	return failed
+}
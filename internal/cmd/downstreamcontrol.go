@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+)
+
+// downstreamControlPath is the path of the control endpoint of the tunnel client switching the downstreams
+const downstreamControlPath = "/downstream"
+
+// switchableDownstream sends the requests to a downstream which can be switched at runtime, without reconnecting the
+// tunnel
+type switchableDownstream struct {
+	newTransport func(*url.URL) http.RoundTripper
+
+	mutex     sync.RWMutex
+	transport http.RoundTripper
+	url       *url.URL
+}
+
+func newSwitchableDownstream(downstreamURL *url.URL, newTransport func(*url.URL) http.RoundTripper) *switchableDownstream {
+	return &switchableDownstream{
+		newTransport: newTransport,
+		transport:    newTransport(downstreamURL),
+		url:          downstreamURL,
+	}
+}
+
+func (d *switchableDownstream) RoundTrip(r *http.Request) (*http.Response, error) {
+	d.mutex.RLock()
+	transport := d.transport
+	d.mutex.RUnlock()
+	return transport.RoundTrip(r)
+}
+
+// URL returns the URL of the current downstream
+func (d *switchableDownstream) URL() *url.URL {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.url
+}
+
+// Switch sends the next requests to the downstream of the URL, the requests in flight are finished by the previous one
+func (d *switchableDownstream) Switch(downstreamURL *url.URL) {
+	transport := d.newTransport(downstreamURL)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.transport = transport
+	d.url = downstreamURL
+}
+
+// downstreamState is the body of the requests and the responses of the control endpoint
+type downstreamState struct {
+	Downstream string `json:"downstream,omitempty"`
+	// Routes are the downstreams of the ports forwarded with --forward-port by their names
+	Routes map[string]string `json:"routes,omitempty"`
+}
+
+// downstreamControl is the local control endpoint of the tunnel client, GET /downstream returns the downstreams, PUT
+// switches the ones in the body, e.g. to another local process, without tearing down the tunnel
+// It's not authenticated, so it's only served on loopback addresses, and the requests for other hosts are refused, so
+// websites can't reach it by rebinding their names to the loopback address.
+type downstreamControl struct {
+	downstream *switchableDownstream
+	logger     logr.Logger
+	routes     map[string]*switchableDownstream
+}
+
+func (c *downstreamControl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackHost(r.Host) {
+		http.Error(w, "forbidden host", http.StatusForbidden)
+		return
+	}
+	if r.URL.Path != downstreamControlPath {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if err := c.switchDownstreams(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c.state())
+}
+
+func (c *downstreamControl) state() downstreamState {
+	state := downstreamState{
+		Downstream: c.downstream.URL().String(),
+	}
+	if len(c.routes) > 0 {
+		state.Routes = make(map[string]string, len(c.routes))
+		for name, route := range c.routes {
+			state.Routes[name] = route.URL().String()
+		}
+	}
+	return state
+}
+
+// switchDownstreams switches the downstreams of the request once all of them are validated
+func (c *downstreamControl) switchDownstreams(r *http.Request) error {
+	var state downstreamState
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&state); err != nil {
+		return errors.WrapIf(err, "invalid body, expected {\"downstream\": \"host:port or URL\", \"routes\": {\"name\": \"host:port or URL\"}}")
+	}
+
+	switches := make(map[*switchableDownstream]*url.URL, len(state.Routes)+1)
+	if state.Downstream != "" {
+		downstreamURL, err := parseDownstreamURL(state.Downstream)
+		if err != nil {
+			return err
+		}
+		switches[c.downstream] = downstreamURL
+	}
+	for name, downstream := range state.Routes {
+		route, ok := c.routes[name]
+		if !ok {
+			return errors.Errorf("unknown route %q, the routes are the ports forwarded with --forward-port", name)
+		}
+		downstreamURL, err := parseDownstreamURL(downstream)
+		if err != nil {
+			return err
+		}
+		switches[route] = downstreamURL
+	}
+
+	for downstream, downstreamURL := range switches {
+		c.logger.Info("switching downstream", "from", downstream.URL().String(), "to", downstreamURL.String())
+		downstream.Switch(downstreamURL)
+	}
+	return nil
+}
+
+// isLoopbackHost returns whether the host (with an optional port) is localhost or a loopback address
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveDownstreamControl serves the control endpoint on the address until the context is cancelled, the address must
+// be a loopback one
+func serveDownstreamControl(ctx context.Context, addr string, control *downstreamControl) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to listen on the control address", "addr", addr)
+	}
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); !ok || !tcpAddr.IP.IsLoopback() {
+		_ = listener.Close()
+		return errors.NewWithDetails("the control endpoint is not authenticated, its address must be a loopback one, e.g. localhost:9091", "addr", addr)
+	}
+	server := &http.Server{Handler: control}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			control.logger.Error(err, "control endpoint failed")
+		}
+	}()
+	control.logger.Info("serving the control endpoint", "url", "http://"+listener.Addr().String()+downstreamControlPath)
+	return nil
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+func TestDownstreamControl(t *testing.T) {
+	// the downstreams answer with their hosts
+	newTransport := func(downstreamURL *url.URL) http.RoundTripper {
+		return tunnel.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Downstream": []string{downstreamURL.Host}}, Body: http.NoBody}, nil
+		})
+	}
+	downstream := newSwitchableDownstream(&url.URL{Scheme: "http", Host: "localhost:8080"}, newTransport)
+	metrics := newSwitchableDownstream(&url.URL{Scheme: "http", Host: "localhost:9090"}, newTransport)
+	control := &downstreamControl{
+		downstream: downstream,
+		logger:     logr.Discard(),
+		routes:     map[string]*switchableDownstream{"metrics": metrics},
+	}
+
+	send := func(method, host, body string) (*httptest.ResponseRecorder, downstreamState) {
+		req := httptest.NewRequest(method, downstreamControlPath, strings.NewReader(body))
+		req.Host = host
+		rec := httptest.NewRecorder()
+		control.ServeHTTP(rec, req)
+		var state downstreamState
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state))
+		}
+		return rec, state
+	}
+	sentTo := func(downstream *switchableDownstream) string {
+		resp, err := downstream.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+		require.NoError(t, err)
+		return resp.Header.Get("X-Downstream")
+	}
+
+	rec, state := send(http.MethodGet, "localhost:9091", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, downstreamState{Downstream: "http://localhost:8080", Routes: map[string]string{"metrics": "http://localhost:9090"}}, state)
+
+	// the downstreams of the body are switched, the others are kept
+	rec, state = send(http.MethodPut, "127.0.0.1:9091", `{"downstream": "localhost:8081"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, downstreamState{Downstream: "http://localhost:8081", Routes: map[string]string{"metrics": "http://localhost:9090"}}, state)
+	require.Equal(t, "localhost:8081", sentTo(downstream))
+	require.Equal(t, "localhost:9090", sentTo(metrics))
+
+	rec, state = send(http.MethodPut, "[::1]:9091", `{"routes": {"metrics": "https://localhost:9443"}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, downstreamState{Downstream: "http://localhost:8081", Routes: map[string]string{"metrics": "https://localhost:9443"}}, state)
+	require.Equal(t, "localhost:9443", sentTo(metrics))
+
+	// nothing is switched unless all the downstreams of the body are valid
+	for _, body := range []string{
+		`{"downstream": "localhost:8082", "routes": {"unknown": "localhost:8083"}}`,
+		`{"downstream": "localhost:8082", "routes": {"metrics": "::1"}}`,
+		`downstream=localhost:8082`,
+	} {
+		rec, _ = send(http.MethodPut, "localhost:9091", body)
+		require.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+	require.Equal(t, "localhost:8081", sentTo(downstream))
+
+	rec, _ = send(http.MethodDelete, "localhost:9091", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// the requests for other hosts are refused, e.g. of websites rebound to the loopback address
+	rec, _ = send(http.MethodPut, "attacker.example.com:9091", `{"downstream": "localhost:8082"}`)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Equal(t, "localhost:8081", sentTo(downstream))
+}
+
+func TestServeDownstreamControl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	control := &downstreamControl{logger: logr.Discard()}
+
+	require.NoError(t, serveDownstreamControl(ctx, "127.0.0.1:0", control))
+	for _, addr := range []string{":0", "0.0.0.0:0"} {
+		require.Error(t, serveDownstreamControl(ctx, addr, control), addr)
+	}
+}
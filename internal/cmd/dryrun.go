@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+	clientscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	dryRunNone   = "none"
+	dryRunClient = "client"
+	dryRunServer = "server"
+)
+
+func addDryRunFlag(cmd *cobra.Command, dryRun *string) {
+	cmd.PersistentFlags().StringVar(dryRun, "dry-run", dryRunNone, "Only print the resources that would be created: client prints them as generated, server prints them as admitted (and defaulted) by the API server")
+	cmd.PersistentFlags().Lookup("dry-run").NoOptDefVal = dryRunClient
+}
+
+func validateDryRun(dryRun string) error {
+	switch dryRun {
+	case dryRunNone, dryRunClient, dryRunServer:
+		return nil
+	default:
+		return errors.Errorf("invalid --dry-run value %q, must be one of none, client or server", dryRun)
+	}
+}
+
+// printManifests prints the objects as a multi-document YAML
+// In server mode the objects are created in dry-run mode first, so the output contains the defaults and the changes
+// of admission webhooks.
+func printManifests(ctx context.Context, rootParams *rootCommandParams, w io.Writer, dryRun string, objects ...client.Object) error {
+	var kubeClient client.Client
+	if dryRun == dryRunServer {
+		kubeConfig, err := getKubeConfig(rootParams)
+		if err != nil {
+			return err
+		}
+		kubeClient, err = client.New(kubeConfig, client.Options{Scheme: clientscheme.Scheme})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, obj := range objects {
+		gvk, err := apiutil.GVKForObject(obj, clientscheme.Scheme)
+		if err != nil {
+			return err
+		}
+
+		if kubeClient != nil {
+			if err := kubeClient.Create(ctx, obj, client.DryRunAll); err != nil {
+				return errors.WrapIfWithDetails(err, "server dry-run failed", "kind", gvk.Kind, "name", client.ObjectKeyFromObject(obj))
+			}
+			obj.SetManagedFields(nil)
+		}
+		obj.GetObjectKind().SetGroupVersionKind(gvk)
+
+		manifest, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "---\n%s", manifest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
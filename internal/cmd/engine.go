@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+)
+
+var containerEngineNames = []string{"docker", "podman", "nerdctl"}
+
+// containerEngine wraps the CLI of a Docker compatible container engine
+type containerEngine struct {
+	name string
+}
+
+// newContainerEngine returns the container engine with the specified name
+// If name is empty or "auto", the first engine found on PATH is used.
+func newContainerEngine(name string) (containerEngine, error) {
+	if name == "" || name == "auto" {
+		for _, candidate := range containerEngineNames {
+			if _, err := exec.LookPath(candidate); err == nil {
+				return containerEngine{name: candidate}, nil
+			}
+		}
+		return containerEngine{}, errors.Errorf("no container engine found on PATH, tried: %s", strings.Join(containerEngineNames, ", "))
+	}
+	for _, candidate := range containerEngineNames {
+		if name == candidate {
+			return containerEngine{name: name}, nil
+		}
+	}
+	return containerEngine{}, errors.Errorf("unsupported container engine %q, supported engines: %s", name, strings.Join(containerEngineNames, ", "))
+}
+
+func (e containerEngine) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(e.name, args...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = commandStdout
+	return cmd
+}
+
+// Build builds an image from the specified context directory, importing (and exporting) the layer cache from (and to)
+// the registry if a cache reference is specified
+func (e containerEngine) Build(tag string, contextDir string, cacheRef string, pushCache bool) error {
+	args := []string{"build", "-t", tag}
+	if cacheRef != "" {
+		switch e.name {
+		case "podman":
+			// Podman takes the repository of the cache, and stores the layers with tags of their own
+			args = append(args, "--layers", "--cache-from", cacheRef)
+			if pushCache {
+				args = append(args, "--cache-to", cacheRef)
+			}
+		default:
+			args = append(args, "--cache-from", "type=registry,ref="+cacheRef+":cache")
+			if pushCache {
+				args = append(args, "--cache-to", "type=registry,ref="+cacheRef+":cache,mode=max")
+			}
+			if e.name == "docker" {
+				// --load gets the image into Docker from the builders not storing images there, e.g. the ones using the
+				// docker-container driver, which can export caches
+				args = append([]string{"buildx"}, append(args, "--load")...)
+			}
+		}
+	}
+	args = append(args, contextDir)
+	return errors.WrapIf(runTool(exec.Command(e.name, args...)), "failed to build image")
+}
+
+// Tag creates the target tag referring to the source image
+func (e containerEngine) Tag(source, target string) error {
+	return runTool(exec.Command(e.name, "tag", source, target))
+}
+
+// HasImage returns whether the image is in the local container engine
+func (e containerEngine) HasImage(image string) bool {
+	return exec.Command(e.name, "image", "inspect", image).Run() == nil
+}
+
+// Push pushes the image to its registry
+func (e containerEngine) Push(image string) error {
+	return runTool(exec.Command(e.name, "push", image))
+}
+
+// Save writes the specified image to a tar archive
+func (e containerEngine) Save(image string, archive string) error {
+	return runTool(exec.Command(e.name, "save", "-o", archive, image))
+}
+
+// LoadIntoCluster makes the image available on the nodes of local development clusters
+// The images are streamed into the nodes of KinD clusters directly, kind load is used only if that fails.
+func (e containerEngine) LoadIntoCluster(image string, cluster localCluster, logger logr.Logger) error {
+	switch cluster.typ {
+	case clusterTypeKind:
+		if e.name == "docker" || e.name == "podman" {
+			err := e.importIntoKindNodes(image, cluster, logger)
+			if err == nil {
+				return nil
+			}
+			logger.V(1).Info("cannot stream image into cluster nodes, falling back to kind load", "error", err.Error())
+
+			cmd := exec.Command("kind", "load", "docker-image", "--name", cluster.name, image)
+			if e.name == "podman" {
+				cmd.Env = append(os.Environ(), "KIND_EXPERIMENTAL_PROVIDER=podman")
+			}
+			return runTool(cmd)
+		}
+		return e.loadArchive(image, "kind", "load", "image-archive", "--name", cluster.name)
+	case clusterTypeK3d:
+		if e.name == "docker" {
+			return runTool(exec.Command("k3d", "image", "import", "--cluster", cluster.name, image))
+		}
+		return e.loadArchive(image, "k3d", "image", "import", "--cluster", cluster.name)
+	default:
+		return nil
+	}
+}
+
+// loadArchive saves the image into a temporary archive and runs the specified command with the archive path appended
+func (e containerEngine) loadArchive(image string, name string, args ...string) error {
+	dir, err := os.MkdirTemp("", "kurun-image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "image.tar")
+	if err := e.Save(image, archive); err != nil {
+		return err
+	}
+
+	return runTool(exec.Command(name, append(args, archive)...))
+}
+
+const (
+	clusterTypeNone = ""
+	clusterTypeKind = "kind"
+	clusterTypeK3d  = "k3d"
+)
+
+// localCluster describes a local development cluster whose nodes need images to be loaded explicitly
+type localCluster struct {
+	typ  string
+	name string
+}
+
+// detectLocalCluster detects KinD and k3d clusters from the current kubectl context,
+// because in case of those we need to load the images into the cluster.
+func detectLocalCluster() (localCluster, error) {
+	buffer := bytes.NewBuffer(nil)
+
+	kubectlConfigCommand := exec.Command("kubectl", "config", "current-context")
+	kubectlConfigCommand.Stderr = os.Stderr
+	kubectlConfigCommand.Stdout = buffer
+
+	if err := kubectlConfigCommand.Run(); err != nil {
+		return localCluster{}, err
+	}
+
+	kubeContext := strings.TrimSpace(buffer.String())
+
+	switch {
+	case kubeContext == "kubernetes-admin@kind":
+		return localCluster{typ: clusterTypeKind, name: "kind"}, nil
+	case strings.HasPrefix(kubeContext, "kind-"):
+		return localCluster{typ: clusterTypeKind, name: strings.TrimPrefix(kubeContext, "kind-")}, nil
+	case strings.HasPrefix(kubeContext, "k3d-"):
+		return localCluster{typ: clusterTypeK3d, name: strings.TrimPrefix(kubeContext, "k3d-")}, nil
+	default:
+		return localCluster{typ: clusterTypeNone}, nil
+	}
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// problemReasons are the waiting reasons of containers which need the attention of the user
+var problemReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+}
+
+// reportPodProblems prints the warning events (e.g. FailedScheduling) and container problems (e.g. ImagePullBackOff)
+// of the pods matching the list options until the context is cancelled, so waits don't time out without explanation
+func reportPodProblems(ctx context.Context, clientset kubernetes.Interface, namespace string, listOptions metav1.ListOptions, out io.Writer) {
+	since := time.Now().Add(-5 * time.Second) // tolerate some clock skew
+	reported := make(map[string]bool)
+
+	for {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, listOptions)
+		if err == nil {
+			podNames := make(map[string]bool, len(pods.Items))
+			for _, pod := range pods.Items {
+				podNames[pod.Name] = true
+				reportContainerProblems(&pod, reported, out)
+			}
+
+			events, err := clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+				FieldSelector: "type=Warning,involvedObject.kind=Pod",
+			})
+			if err == nil {
+				for _, event := range events.Items {
+					if !podNames[event.InvolvedObject.Name] || eventTime(&event).Before(since) {
+						continue
+					}
+					key := fmt.Sprintf("event/%s/%d", event.UID, event.Count)
+					if reported[key] {
+						continue
+					}
+					reported[key] = true
+					fmt.Fprintf(out, "Warning %s pod/%s: %s\n", event.Reason, event.InvolvedObject.Name, strings.TrimSpace(event.Message))
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func reportContainerProblems(pod *corev1.Pod, reported map[string]bool, out io.Writer) {
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		waiting := status.State.Waiting
+		if waiting == nil || !problemReasons[waiting.Reason] {
+			continue
+		}
+
+		key := fmt.Sprintf("container/%s/%s/%s/%d", pod.Name, status.Name, waiting.Reason, status.RestartCount)
+		if reported[key] {
+			continue
+		}
+		reported[key] = true
+
+		fmt.Fprintf(out, "Warning %s pod/%s container %s: %s\n", waiting.Reason, pod.Name, status.Name, strings.TrimSpace(waiting.Message))
+		if terminated := status.LastTerminationState.Terminated; terminated != nil {
+			fmt.Fprintf(out, "  last termination: %s (exit code %d)", terminated.Reason, terminated.ExitCode)
+			if message := strings.TrimSpace(terminated.Message); message != "" {
+				fmt.Fprintf(out, ": %s", message)
+			}
+			fmt.Fprintln(out)
+		}
+	}
+}
+
+func eventTime(event *corev1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	default:
+		return event.CreationTimestamp.Time
+	}
+}
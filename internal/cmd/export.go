@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"emperror.dev/errors"
+	corev1 "k8s.io/api/core/v1"
+	clientscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+)
+
+// kustomization is the subset of the kustomize configuration written by exportManifests and exportWebhookPatches
+type kustomization struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Namespace  string               `json:"namespace,omitempty"`
+	Patches    []kustomizationPatch `json:"patches,omitempty"`
+	Resources  []string             `json:"resources,omitempty"`
+}
+
+type kustomizationPatch struct {
+	Path string `json:"path"`
+}
+
+// The kinds of webhook configurations of --export-webhook
+const (
+	webhookKindMutating   = "mutating"
+	webhookKindValidating = "validating"
+)
+
+// webhookPatch points a webhook of a webhook configuration at the exported kurun-server service
+type webhookPatch struct {
+	configuration string
+	kind          string
+	webhook       string
+}
+
+// parseWebhookPatches parses the webhooks given as validating|mutating/<configuration>/<webhook>
+func parseWebhookPatches(values []string) ([]webhookPatch, error) {
+	patches := make([]webhookPatch, 0, len(values))
+	for _, value := range values {
+		parts := strings.Split(value, "/")
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" || (parts[0] != webhookKindMutating && parts[0] != webhookKindValidating) {
+			return nil, errors.Errorf("invalid webhook %q, expected validating|mutating/<configuration>/<webhook>", value)
+		}
+		patches = append(patches, webhookPatch{kind: parts[0], configuration: parts[1], webhook: parts[2]})
+	}
+	return patches, nil
+}
+
+// exportManifests writes the objects to the directory as a kustomization, one file per object
+// The namespace is set in the kustomization instead of the objects, so it's easy to change with kustomize.
+func exportManifests(dir string, namespace string, objects ...client.Object) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return errors.WrapIf(err, "failed to create export directory")
+	}
+
+	k := kustomization{
+		APIVersion: "kustomize.config.k8s.io/v1beta1",
+		Kind:       "Kustomization",
+		Namespace:  namespace,
+	}
+
+	for _, obj := range objects {
+		gvk, err := apiutil.GVKForObject(obj, clientscheme.Scheme)
+		if err != nil {
+			return err
+		}
+		obj.GetObjectKind().SetGroupVersionKind(gvk)
+		obj.SetNamespace("")
+
+		manifest, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+
+		fileName := fmt.Sprintf("%s-%s.yaml", strings.ToLower(gvk.Kind), obj.GetName())
+		if err := os.WriteFile(filepath.Join(dir, fileName), manifest, 0o644); err != nil {
+			return errors.WrapIfWithDetails(err, "failed to write manifest", "file", fileName)
+		}
+		k.Resources = append(k.Resources, fileName)
+	}
+
+	manifest, err := yaml.Marshal(k)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "kustomization.yaml"), manifest, 0o644); err != nil {
+		return errors.WrapIf(err, "failed to write kustomization")
+	}
+
+	fmt.Fprintf(os.Stdout, "kurun-server resources exported to %s, apply them with: kubectl apply -k %s\n", dir, dir)
+
+	return nil
+}
+
+// exportWebhookPatches writes the patches of the webhook configurations pointing the webhooks at the request port of
+// the service to the webhooks subdirectory of the export directory
+// The webhook configurations are managed elsewhere (e.g. with the application), so the patches are written as a
+// kustomize component to include in the kustomization of the webhook configurations, which they can only be applied by.
+func exportWebhookPatches(dir string, service *corev1.Service, patches []webhookPatch) error {
+	if len(patches) == 0 {
+		return nil
+	}
+	dir = filepath.Join(dir, "webhooks")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return errors.WrapIf(err, "failed to create export directory")
+	}
+
+	var port int32
+	for _, servicePort := range service.Spec.Ports {
+		if servicePort.Name == "request" {
+			port = servicePort.Port
+		}
+	}
+
+	// the webhooks of each configuration are patched together, in the order they were given
+	var configurations []webhookPatch
+	webhooks := make(map[webhookPatch][]interface{})
+	for _, patch := range patches {
+		configuration := webhookPatch{kind: patch.kind, configuration: patch.configuration}
+		if _, ok := webhooks[configuration]; !ok {
+			configurations = append(configurations, configuration)
+		}
+		// a strategic merge patch keeps the other settings of the webhook, e.g. the path of the service
+		webhooks[configuration] = append(webhooks[configuration], map[string]interface{}{
+			"name": patch.webhook,
+			"clientConfig": map[string]interface{}{
+				"service": map[string]interface{}{
+					"name":      service.Name,
+					"namespace": service.Namespace,
+					"port":      port,
+				},
+			},
+		})
+	}
+
+	k := kustomization{
+		APIVersion: "kustomize.config.k8s.io/v1alpha1",
+		Kind:       "Component",
+	}
+	for _, configuration := range configurations {
+		kind := "ValidatingWebhookConfiguration"
+		if configuration.kind == webhookKindMutating {
+			kind = "MutatingWebhookConfiguration"
+		}
+		manifest, err := yaml.Marshal(map[string]interface{}{
+			"apiVersion": "admissionregistration.k8s.io/v1",
+			"kind":       kind,
+			"metadata": map[string]interface{}{
+				"name": configuration.configuration,
+			},
+			"webhooks": webhooks[configuration],
+		})
+		if err != nil {
+			return err
+		}
+
+		fileName := fmt.Sprintf("%s-%s.yaml", strings.ToLower(kind), configuration.configuration)
+		if err := os.WriteFile(filepath.Join(dir, fileName), manifest, 0o644); err != nil {
+			return errors.WrapIfWithDetails(err, "failed to write webhook patch", "file", fileName)
+		}
+		k.Patches = append(k.Patches, kustomizationPatch{Path: fileName})
+	}
+
+	manifest, err := yaml.Marshal(k)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "kustomization.yaml"), manifest, 0o644); err != nil {
+		return errors.WrapIf(err, "failed to write kustomization")
+	}
+
+	fmt.Fprintf(os.Stdout, "webhook patches exported to %s, add it to the components of the kustomization of the webhook configurations\n", dir)
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+// faultParams are the faults injected by the tunnel client into the forwarded requests
+type faultParams struct {
+	errorRate string
+	latency   time.Duration
+	throttle  string
+}
+
+func addFaultFlags(cmd *cobra.Command, params *faultParams) {
+	cmd.PersistentFlags().DurationVar(&params.latency, "inject-latency", 0, "Delay each forwarded request, e.g. 200ms")
+	cmd.PersistentFlags().StringVar(&params.errorRate, "inject-error-rate", "", "Fail the percentage of the forwarded requests as if the downstream was unreachable, e.g. 5%")
+	cmd.PersistentFlags().StringVar(&params.throttle, "throttle", "", "Limit the bandwidth of the request and the response bodies in each direction, e.g. 1MBps or 512KiBps")
+}
+
+// parseFaultParams returns the fault injection configured by the flags
+func parseFaultParams(params faultParams) (tunnel.FaultInjection, error) {
+	faults := tunnel.FaultInjection{}
+
+	if params.latency < 0 {
+		return faults, errors.Errorf("invalid --inject-latency value %s, must not be negative", params.latency)
+	}
+	faults.Latency = params.latency
+
+	if params.errorRate != "" {
+		value := strings.TrimSpace(params.errorRate)
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 || math.IsNaN(percent) {
+			return faults, errors.Errorf("invalid --inject-error-rate value %q, expected a percentage between 0%% and 100%%", params.errorRate)
+		}
+		faults.ErrorRate = percent / 100
+	}
+
+	if params.throttle != "" {
+		bytesPerSecond, err := parseBandwidth(params.throttle)
+		if err != nil {
+			return faults, err
+		}
+		faults.BytesPerSecond = bytesPerSecond
+	}
+
+	return faults, nil
+}
+
+var bandwidthPattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([kKMG]i?)?B(?:ps|/s)$`)
+
+// parseBandwidth parses bandwidths in bytes per second with decimal (e.g. 1MBps) or binary (e.g. 512KiBps) prefixes
+func parseBandwidth(value string) (int64, error) {
+	match := bandwidthPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, errors.Errorf("invalid --throttle value %q, expected bytes per second, e.g. 1MBps or 512KiBps", value)
+	}
+	amount, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, errors.WrapIfWithDetails(err, "invalid --throttle value", "value", value)
+	}
+	multiplier := map[string]float64{
+		"":   1,
+		"k":  1e3,
+		"K":  1e3,
+		"M":  1e6,
+		"G":  1e9,
+		"ki": 1 << 10,
+		"Ki": 1 << 10,
+		"Mi": 1 << 20,
+		"Gi": 1 << 30,
+	}[match[2]]
+	bytesPerSecond := int64(amount * multiplier)
+	if bytesPerSecond < 1 {
+		return 0, errors.Errorf("invalid --throttle value %q, must be at least 1Bps", value)
+	}
+	return bytesPerSecond, nil
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	tunnelgrpc "github.com/banzaicloud/kurun/tunnel/grpc"
+)
+
+// grpcTunnelTransport is the built-in transport connecting to kurun-server with gRPC directly, for kurun-servers
+// exposed outside of the cluster (e.g. by a LoadBalancer), bypassing the API server proxy
+const grpcTunnelTransport = "grpc"
+
+// grpcServerName is the name in the certificate of the kurun-server gRPC server, which is verified instead of the
+// address the client connects to, as kurun doesn't know how the server is exposed
+const grpcServerName = "kurun-server"
+
+// grpcParams are the settings of the gRPC transport
+type grpcParams struct {
+	addr string
+}
+
+func addGRPCFlags(cmd *cobra.Command, params *grpcParams) {
+	cmd.PersistentFlags().StringVar(&params.addr, "grpc-addr", "", "Address (host:port) of the grpc port of kurun-server, exposed e.g. by a LoadBalancer, with --transport grpc")
+}
+
+func validateGRPCParams(params grpcParams) error {
+	if params.addr == "" {
+		return errors.New("--grpc-addr is required with --transport grpc")
+	}
+	return nil
+}
+
+// grpcCredentials are the certificate of the kurun-server gRPC server and the token of the tunnel client, generated
+// for each session and passed to kurun-server in a secret
+type grpcCredentials struct {
+	cert  []byte
+	key   []byte
+	token string
+}
+
+func newGRPCCredentials() (grpcCredentials, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return grpcCredentials{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return grpcCredentials{}, err
+	}
+	// the self-signed certificate is trusted by the client as is
+	tmpl := &x509.Certificate{
+		DNSNames:     []string{grpcServerName},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		NotBefore:    time.Now().Add(-time.Minute),
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: grpcServerName},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return grpcCredentials{}, err
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return grpcCredentials{}, err
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return grpcCredentials{}, err
+	}
+	return grpcCredentials{
+		cert:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		key:   pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}),
+		token: hex.EncodeToString(token),
+	}, nil
+}
+
+// newGRPCSecret returns the secret passing the credentials to kurun-server, mounted by newTunnelServerContainer
+func newGRPCSecret(namespace, name string, labels map[string]string, credentials grpcCredentials) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    copyLabels(labels),
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       credentials.cert,
+			corev1.TLSPrivateKeyKey: credentials.key,
+			"token":                 []byte(credentials.token),
+		},
+	}
+}
+
+// runGRPCTunnelClient relays the requests received from the gRPC server of kurun-server to the round tripper, and
+// reconnects when the connection is closed, the server is verified with the certificate of the credentials
+func runGRPCTunnelClient(ctx context.Context, params grpcParams, credentials grpcCredentials, maxFrameSize int, roundTripper http.RoundTripper, stats *tunnel.Stats, handleEvent tunnel.ConnectionEventHandler, logger logr.Logger) error {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(credentials.cert) {
+		return errors.New("invalid kurun-server gRPC certificate")
+	}
+	stats.RecordConnection()
+	return tunnelgrpc.RunClient(ctx, *tunnelgrpc.NewClientConfig(
+		params.addr,
+		roundTripper,
+		tunnelgrpc.WithLogger(logger),
+		tunnelgrpc.WithMaxFrameSize(maxFrameSize),
+		tunnelgrpc.WithReconnect(time.Second, 30*time.Second),
+		tunnelgrpc.WithConnectionEventHandler(func(event tunnel.ConnectionEvent) {
+			// each reconnection attempt dials the server again
+			if event.Type == tunnel.ConnectionEventReconnecting {
+				stats.RecordConnection()
+			}
+			handleEvent(event)
+		}),
+		tunnelgrpc.WithToken(credentials.token),
+		tunnelgrpc.WithTLSConfig(&tls.Config{
+			RootCAs:    roots,
+			ServerName: grpcServerName,
+		}),
+	))
+}
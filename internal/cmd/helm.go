@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"emperror.dev/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/banzaicloud/kurun/charts"
+)
+
+// kurunServerChart is the directory of the kurun-server chart in charts.KurunServer
+const kurunServerChart = "kurun-server"
+
+// kurunServerValues are the values of the kurun-server chart, see charts/kurun-server/values.yaml
+type kurunServerValues struct {
+	Annotations     map[string]string           `json:"annotations,omitempty"`
+	Auth            kurunServerAuthValues       `json:"auth"`
+	Image           string                      `json:"image"`
+	MaxFrameSize    int                         `json:"maxFrameSize"`
+	NetworkPolicy   kurunServerNetPolValues     `json:"networkPolicy"`
+	Resources       corev1.ResourceRequirements `json:"resources"`
+	SecurityContext kurunServerSecurityValues   `json:"securityContext"`
+	Service         kurunServerServiceValues    `json:"service"`
+	TLS             kurunServerTLSValues        `json:"tls"`
+}
+
+type kurunServerAuthValues struct {
+	AllowGroups        []string `json:"allowGroups,omitempty"`
+	AllowUsers         []string `json:"allowUsers,omitempty"`
+	RequestTokenSecret string   `json:"requestTokenSecret,omitempty"`
+}
+
+type kurunServerNetPolValues struct {
+	ControlCIDRs      []string              `json:"controlCIDRs,omitempty"`
+	Create            bool                  `json:"create"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	PodSelector       *metav1.LabelSelector `json:"podSelector,omitempty"`
+}
+
+type kurunServerSecurityValues struct {
+	Hardened  bool  `json:"hardened"`
+	RunAsUser int64 `json:"runAsUser"`
+}
+
+type kurunServerServiceValues struct {
+	IPFamilies     []string `json:"ipFamilies,omitempty"`
+	IPFamilyPolicy string   `json:"ipFamilyPolicy,omitempty"`
+	Port           int      `json:"port"`
+}
+
+type kurunServerTLSValues struct {
+	SecretName string `json:"secretName,omitempty"`
+}
+
+// newKurunServerValues returns the values of the kurun-server chart equivalent to the flags of install-server
+func newKurunServerValues(params installServerParams, annotations map[string]string) (kurunServerValues, error) {
+	values := kurunServerValues{
+		Annotations: annotations,
+		Auth: kurunServerAuthValues{
+			AllowGroups:        params.allowGroups,
+			AllowUsers:         params.allowUsers,
+			RequestTokenSecret: params.serverParams.authSecret,
+		},
+		Image:        params.serverParams.image,
+		MaxFrameSize: params.serverParams.maxFrameSize,
+		NetworkPolicy: kurunServerNetPolValues{
+			ControlCIDRs: params.netPolParams.controlCIDRs,
+			Create:       params.netPolParams.create,
+		},
+		Resources: params.serverParams.resources,
+		SecurityContext: kurunServerSecurityValues{
+			Hardened:  params.serverParams.hardening,
+			RunAsUser: params.serverParams.runAsUser,
+		},
+		Service: kurunServerServiceValues{
+			IPFamilyPolicy: params.ipFamilies.policy,
+			Port:           params.servicePort,
+		},
+		TLS: kurunServerTLSValues{
+			SecretName: params.serverParams.tlsSecret,
+		},
+	}
+	if params.ipFamilies.family != "" {
+		values.Service.IPFamilies = []string{params.ipFamilies.family}
+	}
+	if params.netPolParams.namespaceSelector != "" {
+		selector, err := metav1.ParseToLabelSelector(params.netPolParams.namespaceSelector)
+		if err != nil {
+			return values, errors.WrapIf(err, "failed to parse namespace selector")
+		}
+		values.NetworkPolicy.NamespaceSelector = selector
+	}
+	if params.netPolParams.podSelector != "" {
+		selector, err := metav1.ParseToLabelSelector(params.netPolParams.podSelector)
+		if err != nil {
+			return values, errors.WrapIf(err, "failed to parse pod selector")
+		}
+		values.NetworkPolicy.PodSelector = selector
+	}
+	return values, nil
+}
+
+// writeKurunServerChart writes the chart of kurun-server and the values file to the directory, and returns the path
+// of the chart and the values file
+func writeKurunServerChart(dir string, values kurunServerValues) (string, string, error) {
+	chartDir := filepath.Join(dir, kurunServerChart)
+	err := fs.WalkDir(charts.KurunServer, kurunServerChart, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if entry.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		data, err := charts.KurunServer.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0o644)
+	})
+	if err != nil {
+		return "", "", errors.WrapIf(err, "failed to write the kurun-server chart")
+	}
+
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return "", "", err
+	}
+	valuesFile := filepath.Join(dir, "values.yaml")
+	if err := os.WriteFile(valuesFile, data, 0o644); err != nil {
+		return "", "", errors.WrapIf(err, "failed to write the values of the kurun-server chart")
+	}
+	return chartDir, valuesFile, nil
+}
+
+// helmInstallServer installs (or upgrades) kurun-server as a Helm release of the embedded chart, so it can be managed
+// with helm afterwards; with dry-run the chart is only rendered, with exportDir it's only written with its values
+func helmInstallServer(ctx context.Context, rootParams *rootCommandParams, name string, params installServerParams, values kurunServerValues) error {
+	if params.exportDir != "" {
+		chartDir, valuesFile, err := writeKurunServerChart(params.exportDir, values)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "kurun-server chart written, install it with: helm upgrade --install --namespace %s --values %s %s %s\n", rootParams.namespace, valuesFile, name, chartDir)
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "kurun-chart-")
+	if err != nil {
+		return errors.WrapIf(err, "failed to create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	chartDir, valuesFile, err := writeKurunServerChart(dir, values)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"--namespace", rootParams.namespace, "--values", valuesFile}
+	if rootParams.apiServerCA != "" {
+		args = append(args, "--kube-ca-file", rootParams.apiServerCA)
+	}
+	if params.dryRun != dryRunNone {
+		helmCommand := exec.CommandContext(ctx, "helm", append(append([]string{"template"}, args...), name, chartDir)...)
+		helmCommand.Stdout = os.Stdout
+		helmCommand.Stderr = os.Stderr
+		return errors.WrapIf(helmCommand.Run(), "failed to render the kurun-server chart")
+	}
+
+	args = append(args, "--wait", "--timeout", rootParams.waitTimeout.Round(time.Second).String())
+	helmCommand := exec.CommandContext(ctx, "helm", append(append([]string{"upgrade", "--install"}, args...), name, chartDir)...)
+	err = runTool(helmCommand)
+	if rootParams.auditLog != nil {
+		rootParams.auditLog.RecordResult(auditRecord{Verb: "helm upgrade", Namespace: rootParams.namespace, Name: name}, err)
+	}
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to install the kurun-server chart", "release", name)
+	}
+
+	fmt.Fprintf(os.Stdout, "kurun-server is ready, connect to it with: kurun port-forward --namespace %s --attach %s <upstream>\n", rootParams.namespace, name)
+	return nil
+}
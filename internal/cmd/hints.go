@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"syscall"
+
+	"emperror.dev/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	tunnelws "github.com/banzaicloud/kurun/tunnel/websocket"
+)
+
+// troubleshootingURL is the troubleshooting section of the documentation, linked from the hints of the errors
+const troubleshootingURL = "https://github.com/banzaicloud/kurun#troubleshooting"
+
+// HintError is an error of a common failure mode, with a hint on fixing it and a link to the documentation
+type HintError struct {
+	Err  error
+	Hint string
+	// DocURL is the documentation of the failure, if any
+	DocURL string
+}
+
+func (e *HintError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HintError) Unwrap() error {
+	return e.Err
+}
+
+// keepaliveFailedHint is the hint of tunnel connections dropped for being idle even with the most frequent pings
+const keepaliveFailedHint = "a proxy or load balancer between kurun and the API server drops idle connections too soon, " +
+	"raise its idle timeout (e.g. of the cloud load balancer) or use another transport (e.g. --transport ssh)"
+
+// withHint attaches the hint and the documentation link to the error, nil errors are returned as is
+func withHint(err error, hint, docURL string) error {
+	if err == nil {
+		return nil
+	}
+	return &HintError{Err: err, Hint: hint, DocURL: docURL}
+}
+
+// PresentError prints the error of a command for humans: its message, the details attached to it, and the hint on
+// fixing it if it's a HintError
+func PresentError(w io.Writer, err error) {
+	fmt.Fprintf(w, "Error: %s\n", err)
+
+	details := errors.GetDetails(err)
+	for i := 0; i+1 < len(details); i += 2 {
+		fmt.Fprintf(w, "  %v: %v\n", details[i], details[i+1])
+	}
+
+	var hintErr *HintError
+	if errors.As(err, &hintErr) {
+		fmt.Fprintf(w, "Hint: %s\n", hintErr.Hint)
+		if hintErr.DocURL != "" {
+			fmt.Fprintf(w, "See %s\n", hintErr.DocURL)
+		}
+	}
+}
+
+// imagePullError returns the hint error of the containers of the pod failing to pull their images, nil if none of
+// them fails
+func imagePullError(pod *corev1.Pod, err error) error {
+	for _, status := range pod.Status.ContainerStatuses {
+		waiting := status.State.Waiting
+		if waiting == nil {
+			continue
+		}
+		switch waiting.Reason {
+		case "ErrImagePull", "ImagePullBackOff", "InvalidImageName":
+			return withHint(
+				errors.WithDetails(err, "image", status.Image, "reason", waiting.Reason),
+				"the nodes cannot pull the image: for local clusters check the image is loaded (KinD and k3d are detected from the kubectl context), otherwise push it with --build-in-cluster --registry, and check the pull secrets of the service account",
+				troubleshootingURL,
+			)
+		}
+	}
+	return nil
+}
+
+// tunnelClientError explains the errors of the tunnel client connecting through the API server proxy
+func tunnelClientError(err error) error {
+	var handshakeErr *tunnelws.HandshakeError
+	if !errors.As(err, &handshakeErr) {
+		return err
+	}
+	switch handshakeErr.StatusCode {
+	case http.StatusForbidden:
+		return withHint(err, "the API server doesn't allow proxying to the kurun-server service, the get services/proxy permission is needed in the namespace, check it with kurun doctor", troubleshootingURL)
+	case http.StatusUnauthorized:
+		return withHint(err, "the API server rejected the credentials of the tunnel connection, it authenticates with the TLS client certificate of the kubeconfig", troubleshootingURL)
+	case http.StatusNotFound, http.StatusServiceUnavailable:
+		return withHint(err, "no kurun-server is ready behind the service, check its pods and the port named control of the service", troubleshootingURL)
+	default:
+		return withHint(err, "the tunnel connection was refused, a proxy between kurun and the API server may not support WebSockets, try --transport ssh", troubleshootingURL)
+	}
+}
+
+// listenError explains the errors of listening on a local port
+func listenError(err error, port int) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return withHint(err, fmt.Sprintf("another process listens on port %d, stop it or choose another port with --port", port), troubleshootingURL)
+	}
+	return err
+}
+
+// loadImageError explains the errors of loading the built images into local clusters
+func loadImageError(err error, cluster localCluster) error {
+	switch cluster.typ {
+	case clusterTypeKind:
+		return withHint(err, fmt.Sprintf("check the %s cluster exists with kind get clusters, with Podman set KIND_EXPERIMENTAL_PROVIDER=podman when creating it", cluster.name), troubleshootingURL)
+	case clusterTypeK3d:
+		return withHint(err, fmt.Sprintf("check the %s cluster exists and runs with k3d cluster list", cluster.name), troubleshootingURL)
+	default:
+		return err
+	}
+}
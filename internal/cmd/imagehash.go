@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"emperror.dev/errors"
+)
+
+// the ways of hashing the Go files into the names of the built images
+const (
+	// imageHashPath hashes the absolute paths of the Go files, so each checkout of a project has its own images
+	imageHashPath = "path"
+	// imageHashModule hashes the module paths and the paths of the Go files inside their modules, so the same code
+	// gets the same image names on every machine, and the images can be shared through registries and CI caches
+	imageHashModule = "module"
+)
+
+var moduleDirective = regexp.MustCompile(`(?m)^module\s+"?([^"\s]+)"?\s*$`)
+
+func validateImageHash(imageHash string) error {
+	switch imageHash {
+	case "", imageHashPath, imageHashModule:
+		return nil
+	default:
+		return errors.Errorf("invalid build.imageHash value %q, must be %s or %s", imageHash, imageHashPath, imageHashModule)
+	}
+}
+
+// hashGoFiles writes the identity of the Go files to the hash in the specified way
+func hashGoFiles(hash io.Writer, goFiles []string, imageHash string) error {
+	for _, goFile := range goFiles {
+		absGoFile, err := filepath.Abs(goFile)
+		if err != nil {
+			return err
+		}
+
+		if imageHash == imageHashModule {
+			moduleDir, modulePath, err := findModule(absGoFile)
+			if err != nil {
+				return err
+			}
+			relGoFile, err := filepath.Rel(moduleDir, absGoFile)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(hash, "%s/%s\x00", modulePath, filepath.ToSlash(relGoFile)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := hash.Write([]byte(absGoFile)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findModule returns the directory and the path of the Go module containing the file or directory
+func findModule(path string) (dir string, modulePath string, err error) {
+	dir = path
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		dir = filepath.Dir(path)
+	}
+	for ; ; dir = filepath.Dir(dir) {
+		data, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+		if err == nil {
+			match := moduleDirective.FindSubmatch(data)
+			if match == nil {
+				return "", "", errors.Errorf("no module directive in %s", filepath.Join(dir, "go.mod"))
+			}
+			return dir, string(match[1]), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", "", err
+		}
+		if filepath.Dir(dir) == dir {
+			return "", "", errors.Errorf("no go.mod found for %s, the module image hash requires Go modules", path)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+)
+
+// defaultKeptImages is the number of the most recent images built by kurun kept in the local engine after each build,
+// unless set in the configuration file
+const defaultKeptImages = 20
+
+// kurunImageRepository matches the repositories of the images built by kurun, named after the hash of their sources
+var kurunImageRepository = regexp.MustCompile(`^kurun-[0-9a-f]{40}$`)
+
+// imageCreatedLayout is the layout of the creation times listed by the container engines
+const imageCreatedLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// NewImagesCommand returns the commands managing the images built by kurun
+func NewImagesCommand(rootParams *rootCommandParams) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "images",
+		Short: "Manage the images built by kurun in the local container engine and the nodes of local clusters",
+	}
+
+	cmd.AddCommand(
+		newImagesListCommand(rootParams),
+		newImagesPruneCommand(rootParams),
+	)
+
+	return cmd
+}
+
+func newImagesListCommand(rootParams *rootCommandParams) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the images built by kurun in the local container engine, the most recent first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			engine, err := newContainerEngine(rootParams.containerEngine)
+			if err != nil {
+				return err
+			}
+			images, err := engine.KurunImages()
+			if err != nil {
+				return err
+			}
+			for _, image := range images {
+				if err := rootParams.output.Result(image.repository+"\t"+image.created.Format(time.RFC3339), image.repository, newKurunImageResult("image", image)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	addOutputFlags(cmd, &rootParams.outputParams)
+
+	return cmd
+}
+
+func newImagesPruneCommand(rootParams *rootCommandParams) *cobra.Command {
+	var (
+		keep      int
+		olderThan time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the old images built by kurun from the local container engine and the nodes of KinD clusters",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if keep < 0 {
+				return errors.New("--keep cannot be negative")
+			}
+			cmd.SilenceUsage = true
+
+			engine, err := newContainerEngine(rootParams.containerEngine)
+			if err != nil {
+				return err
+			}
+			cluster, err := detectLocalCluster()
+			if err != nil {
+				rootParams.logger.V(1).Info("cannot detect local cluster", "error", err.Error())
+			}
+			pruned, err := pruneKurunImages(engine, cluster, keep, olderThan, "", rootParams.logger)
+			for _, image := range pruned {
+				if err := rootParams.output.Result("Removed "+image.repository, image.repository, newKurunImageResult("prunedImage", image)); err != nil {
+					return err
+				}
+			}
+			return err
+		},
+	}
+	cmd.Flags().IntVar(&keep, "keep", defaultKeptImages, "Number of the most recent images to keep, 0 to select the images by age only")
+	cmd.Flags().DurationVar(&olderThan, "older-than", 0, "Remove the images built longer ago than this, e.g. 168h, regardless of --keep")
+	addOutputFlags(cmd, &rootParams.outputParams)
+
+	return cmd
+}
+
+// kurunImage is an image built by kurun in the local container engine, with all of its tags
+type kurunImage struct {
+	// repository is the name of the image without the registry, e.g. kurun-<hash>
+	repository string
+	refs       []string
+	created    time.Time
+}
+
+// kurunImageResult is an image built by kurun
+type kurunImageResult struct {
+	Type    string    `json:"type"`
+	Image   string    `json:"image"`
+	Created time.Time `json:"created"`
+}
+
+func newKurunImageResult(typ string, image kurunImage) kurunImageResult {
+	return kurunImageResult{
+		Type:    typ,
+		Image:   image.repository,
+		Created: image.created,
+	}
+}
+
+// KurunImages returns the images built by kurun, the most recent first
+func (e containerEngine) KurunImages() ([]kurunImage, error) {
+	output := bytes.NewBuffer(nil)
+	cmd := e.command("image", "ls", "--format", "{{.Repository}}\t{{.Tag}}\t{{.CreatedAt}}")
+	cmd.Stdout = output
+	if err := cmd.Run(); err != nil {
+		return nil, errors.WrapIf(err, "failed to list images")
+	}
+
+	byRepository := make(map[string]*kurunImage)
+	for _, line := range strings.Split(output.String(), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		// e.g. localhost/kurun-<hash> with Podman
+		repository := fields[0][strings.LastIndex(fields[0], "/")+1:]
+		if !kurunImageRepository.MatchString(repository) || fields[1] == "<none>" {
+			continue
+		}
+		created, err := time.Parse(imageCreatedLayout, strings.TrimSpace(fields[2]))
+		if err != nil {
+			return nil, errors.WrapIfWithDetails(err, "failed to parse image creation time", "image", fields[0])
+		}
+
+		image, ok := byRepository[repository]
+		if !ok {
+			image = &kurunImage{repository: repository}
+			byRepository[repository] = image
+		}
+		image.refs = append(image.refs, fields[0]+":"+fields[1])
+		if created.After(image.created) {
+			image.created = created
+		}
+	}
+
+	images := make([]kurunImage, 0, len(byRepository))
+	for _, image := range byRepository {
+		images = append(images, *image)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].created.After(images[j].created)
+	})
+	return images, nil
+}
+
+// selectPrunedImages returns the images beyond the most recent ones to keep, and the ones created longer ago than
+// olderThan, the images are sorted the most recent first
+func selectPrunedImages(images []kurunImage, keep int, olderThan time.Duration, now time.Time) []kurunImage {
+	var pruned []kurunImage
+	for i, image := range images {
+		if (keep > 0 && i >= keep) || (olderThan > 0 && now.Sub(image.created) > olderThan) {
+			pruned = append(pruned, image)
+		}
+	}
+	return pruned
+}
+
+// pruneKurunImages removes the old images built by kurun from the local engine and the nodes of the KinD cluster,
+// except the image of the repository to spare (e.g. the one just built), and returns the removed images
+func pruneKurunImages(engine containerEngine, cluster localCluster, keep int, olderThan time.Duration, spare string, logger logr.Logger) ([]kurunImage, error) {
+	images, err := engine.KurunImages()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []kurunImage
+	var combinedErr error
+	repositories := make(map[string]bool)
+	for _, image := range selectPrunedImages(images, keep, olderThan, time.Now()) {
+		if image.repository == spare {
+			continue
+		}
+		if err := engine.command(append([]string{"image", "rm"}, image.refs...)...).Run(); err != nil {
+			// e.g. used by a container
+			combinedErr = errors.Append(combinedErr, errors.WrapIfWithDetails(err, "failed to remove image", "image", image.repository))
+			continue
+		}
+		removed = append(removed, image)
+		repositories[image.repository] = true
+	}
+
+	if cluster.typ == clusterTypeKind && len(repositories) > 0 {
+		combinedErr = errors.Append(combinedErr, engine.removeFromKindNodes(cluster, repositories, logger))
+	}
+	return removed, combinedErr
+}
+
+// removeFromKindNodes removes the images of the repositories from the containerd of the nodes of the KinD cluster
+func (e containerEngine) removeFromKindNodes(cluster localCluster, repositories map[string]bool, logger logr.Logger) error {
+	if e.name != "docker" && e.name != "podman" {
+		return nil
+	}
+	nodes, err := e.kindNodes(cluster)
+	if err != nil {
+		return err
+	}
+
+	var combinedErr error
+	for _, node := range nodes {
+		output := bytes.NewBuffer(nil)
+		list := exec.Command(e.name, "exec", node, "ctr", "--namespace=k8s.io", "images", "ls", "-q")
+		list.Stderr = os.Stderr
+		list.Stdout = output
+		if err := list.Run(); err != nil {
+			combinedErr = errors.Append(combinedErr, errors.WrapIfWithDetails(err, "failed to list node images", "node", node))
+			continue
+		}
+
+		var refs []string
+		for _, ref := range strings.Fields(output.String()) {
+			// e.g. docker.io/library/kurun-<hash>:<tag>
+			repository := ref[strings.LastIndex(ref, "/")+1:]
+			if i := strings.IndexAny(repository, ":@"); i >= 0 {
+				repository = repository[:i]
+			}
+			if repositories[repository] {
+				refs = append(refs, ref)
+			}
+		}
+		if len(refs) == 0 {
+			continue
+		}
+
+		logger.V(1).Info("removing images from cluster node", "node", node, "images", len(refs))
+		remove := exec.Command(e.name, append([]string{"exec", node, "ctr", "--namespace=k8s.io", "images", "rm"}, refs...)...)
+		remove.Stderr = os.Stderr
+		remove.Stdout = commandStdout
+		if err := remove.Run(); err != nil {
+			combinedErr = errors.Append(combinedErr, errors.WrapIfWithDetails(err, "failed to remove node images", "node", node))
+		}
+	}
+	return combinedErr
+}
@@ -0,0 +1,367 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	clientscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+)
+
+type installServerParams struct {
+	allowGroups  []string
+	allowUsers   []string
+	annotations  []string
+	dryRun       string
+	exportDir    string
+	helm         bool
+	ipFamilies   ipFamilyParams
+	limits       map[string]string
+	loadImage    bool
+	netPolParams networkPolicyParams
+	requests     map[string]string
+	serverParams tunnelServerParams
+	servicePort  int
+}
+
+// NewInstallServerCommand returns the command installing kurun-server as a long-lived component, which is then
+// used with port-forward --attach
+func NewInstallServerCommand(rootParams *rootCommandParams) *cobra.Command {
+	var params installServerParams
+
+	cmd := &cobra.Command{
+		Use:     "install-server [flags] [name]",
+		Short:   "Install kurun-server permanently, so port-forward --attach can connect to it without creating resources",
+		Example: "kurun install-server --namespace apps --allow-group developers myapp-dev",
+		Args:    cobra.MaximumNArgs(1),
+
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := "kurun"
+			if len(args) > 0 {
+				name = args[0]
+			}
+
+			if err := validateDryRun(params.dryRun); err != nil {
+				return err
+			}
+			if params.dryRun != dryRunNone && params.exportDir != "" {
+				return errors.New("--dry-run cannot be used with --export")
+			}
+			if params.dryRun != dryRunNone && params.loadImage {
+				return errors.New("--dry-run cannot be used with --load-server-image")
+			}
+			if params.dryRun == dryRunServer && params.helm {
+				return errors.New("--dry-run=server cannot be used with --helm, the chart is rendered by helm template")
+			}
+			if err := validateIPFamilyParams(params.ipFamilies); err != nil {
+				return err
+			}
+			annotations, err := parseAnnotations(params.annotations)
+			if err != nil {
+				return err
+			}
+
+			resources, err := parseResourceRequirements(params.requests, params.limits)
+			if err != nil {
+				return err
+			}
+			params.serverParams.resources = resources
+
+			cmd.SilenceUsage = true // all args and flags validated before this line
+
+			if params.loadImage {
+				if err := loadServerImage(params.serverParams.image, rootParams.containerEngine, rootParams.output, rootParams.logger); err != nil {
+					return err
+				}
+			}
+
+			if params.helm {
+				values, err := newKurunServerValues(params, annotations)
+				if err != nil {
+					return err
+				}
+				return helmInstallServer(cmd.Context(), rootParams, name, params, values)
+			}
+
+			objects, deployment, err := newInstallServerObjects(rootParams.namespace, name, params)
+			if err != nil {
+				return err
+			}
+			setAnnotations(annotations, objects...)
+
+			if params.exportDir != "" {
+				return exportManifests(params.exportDir, rootParams.namespace, objects...)
+			}
+			if params.dryRun != dryRunNone {
+				return printManifests(cmd.Context(), rootParams, os.Stdout, params.dryRun, objects...)
+			}
+
+			kubeConfig, err := getKubeConfig(rootParams)
+			if err != nil {
+				return err
+			}
+			kubeCluster, err := cluster.New(kubeConfig, func(o *cluster.Options) {
+				o.Namespace = rootParams.namespace
+			})
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithCancel(cmd.Context())
+			defer cancel()
+
+			go kubeCluster.Start(ctx)
+
+			if !kubeCluster.GetCache().WaitForCacheSync(ctx) {
+				return errors.New("cache did not sync")
+			}
+			kubeClient := kubeCluster.GetClient()
+			clientset, err := kubernetes.NewForConfig(kubeConfig)
+			if err != nil {
+				return err
+			}
+
+			container := deployment.Spec.Template.Spec.Containers[0].Name
+			selectServerImage(ctx, clientset, params.serverParams.image, rootParams.config.Server.Images, rootParams.logger).apply(&deployment.Spec.Template.Spec, container)
+
+			for _, obj := range objects {
+				gvk, err := apiutil.GVKForObject(obj, clientscheme.Scheme)
+				if err != nil {
+					return err
+				}
+				if err := installObject(ctx, kubeClient, obj); err != nil {
+					return errors.WrapIfWithDetails(err, "failed to install resource", "kind", gvk.Kind, "name", client.ObjectKeyFromObject(obj))
+				}
+				fmt.Fprintf(os.Stdout, "%s/%s configured\n", strings.ToLower(gvk.Kind), obj.GetName())
+			}
+
+			podListOptions := metav1.ListOptions{LabelSelector: metav1.FormatLabelSelector(deployment.Spec.Selector)}
+			err = waitForServerImage(ctx, clientset, rootParams.namespace, podListOptions, container, func(ctx context.Context) error {
+				return waitForResource(ctx, kubeCluster.GetCache(), kubeCluster.GetScheme(), deployment, func(obj interface{}) bool {
+					deploy, ok := obj.(*appsv1.Deployment)
+					return ok && deploy.Namespace == deployment.Namespace && deploy.Name == deployment.Name && deploy.Generation >= deployment.Generation && hasRolledOut(deploy)
+				}, rootParams.waitTimeout)
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(os.Stdout, "kurun-server is ready, connect to it with: kurun port-forward --namespace %s --attach %s <upstream>\n", rootParams.namespace, name)
+
+			return nil
+		},
+	}
+
+	addDryRunFlag(cmd, &params.dryRun)
+	cmd.PersistentFlags().StringVar(&params.exportDir, "export", "", "Write the resources as a kustomization to this directory instead of creating them, e.g. to manage them with GitOps")
+	cmd.PersistentFlags().BoolVar(&params.helm, "helm", false, "Install kurun-server as a Helm release (named after the service) of the chart embedded in kurun, so it can be upgraded and uninstalled with helm (requires helm); with --export the chart and its values are written instead")
+	cmd.PersistentFlags().StringSliceVar(&params.allowGroups, "allow-group", nil, "Group allowed to attach to the kurun-server through the API server proxy")
+	cmd.PersistentFlags().StringSliceVar(&params.allowUsers, "allow-user", nil, "User allowed to attach to the kurun-server through the API server proxy")
+	cmd.PersistentFlags().StringToStringVar(&params.requests, "requests", defaultServerRequests(), "Resource requests of the kurun-server container")
+	cmd.PersistentFlags().StringToStringVar(&params.limits, "limits", defaultServerLimits(), "Resource limits of the kurun-server container")
+	cmd.PersistentFlags().StringVar(&params.serverParams.image, "server-image", kurunServerImage, "kurun tunnel server image to use")
+	cmd.PersistentFlags().BoolVar(&params.loadImage, "load-server-image", false, "Load the server image from the local container engine into the nodes of local clusters (KinD and k3d), or push it to the registry of --server-image, for clusters without access to the default registry")
+	addTunnelServerSecurityFlags(cmd, &params.serverParams)
+	addIPFamilyFlags(cmd, &params.ipFamilies)
+	addAnnotationFlag(cmd, &params.annotations)
+	cmd.PersistentFlags().IntVar(&params.servicePort, "serviceport", 80, "Service port to set for the service")
+	cmd.PersistentFlags().IntVar(&params.serverParams.maxFrameSize, "max-frame-size", 0, "Split the requests sent through the tunnel into frames of at most this many bytes, e.g. for proxies limiting the WebSocket message size (0 means the default of 64KiB)")
+	cmd.PersistentFlags().StringVar(&params.serverParams.tlsSecret, "tlssecret", "", "Use the certs for kurun-server")
+	addRequestAuthFlag(cmd, &params.serverParams)
+	cmd.PersistentFlags().BoolVar(&params.netPolParams.create, "create-networkpolicy", false, "Create a NetworkPolicy restricting ingress to the kurun-server pod")
+	cmd.PersistentFlags().StringVar(&params.netPolParams.namespaceSelector, "networkpolicy-namespace-selector", "", "Label selector of namespaces allowed to send requests to the kurun-server pod (default: same namespace only)")
+	cmd.PersistentFlags().StringVar(&params.netPolParams.podSelector, "networkpolicy-pod-selector", "", "Label selector of pods allowed to send requests to the kurun-server pod")
+	cmd.PersistentFlags().StringSliceVar(&params.netPolParams.controlCIDRs, "networkpolicy-control-cidr", nil, "CIDRs allowed to reach the control port, e.g. the API server addresses (default: any)")
+
+	return cmd
+}
+
+// newInstallServerObjects returns the resources of a long-lived kurun-server, and its deployment separately
+// The service keeps the name, so port-forward --attach can refer to it; the other resources get a -kurun suffix.
+func newInstallServerObjects(namespace, name string, params installServerParams) ([]client.Object, *appsv1.Deployment, error) {
+	controlPort := corev1.ContainerPort{
+		Name:          "control",
+		ContainerPort: 8333,
+	}
+	requestPort := corev1.ContainerPort{
+		Name:          "request",
+		ContainerPort: 8444,
+	}
+
+	deploymentName := name + "-kurun"
+	labels := map[string]string{
+		"app.kubernetes.io/name":      deploymentName,
+		"app.kubernetes.io/component": "tunnel-server",
+	}
+
+	service := newKurunService(namespace, name, labels, params.servicePort, requestPort, controlPort)
+	setServiceIPFamilies(service, params.ipFamilies)
+	objects := []client.Object{service}
+
+	if params.netPolParams.create {
+		netPol, err := newTunnelNetworkPolicy(metav1.ObjectMeta{
+			Name:      deploymentName,
+			Namespace: namespace,
+		}, labels, requestPort, controlPort, params.netPolParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, netPol)
+	}
+
+	if len(params.allowUsers) > 0 || len(params.allowGroups) > 0 {
+		role, binding := newAttachRBAC(namespace, deploymentName, name, controlPort.ContainerPort, params.allowUsers, params.allowGroups)
+		objects = append(objects, role, binding)
+	}
+
+	container, volumes := newTunnelServerContainer(params.serverParams, requestPort, controlPort)
+	deployment := newTunnelServerDeployment(namespace, deploymentName, labels, container, volumes)
+	objects = append(objects, deployment)
+
+	for _, obj := range objects {
+		setManagedByKurun(obj)
+	}
+
+	return objects, deployment, nil
+}
+
+// newAttachRBAC returns the role (and its binding to the users and groups) allowing to attach to the kurun-server
+// behind the service, without any other permissions in the namespace
+func newAttachRBAC(namespace, name, serviceName string, controlPort int32, users, groups []string) (*rbacv1.Role, *rbacv1.RoleBinding) {
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups:     []string{""},
+				Resources:     []string{"services"},
+				ResourceNames: []string{serviceName},
+				Verbs:         []string{"get"},
+			},
+			{
+				APIGroups:     []string{""},
+				Resources:     []string{"services/proxy"},
+				ResourceNames: []string{fmt.Sprintf("https:%s:%d", serviceName, controlPort)},
+				Verbs:         []string{"get", "create"},
+			},
+		},
+	}
+
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     name,
+		},
+	}
+	for _, user := range users {
+		binding.Subjects = append(binding.Subjects, rbacv1.Subject{APIGroup: rbacv1.GroupName, Kind: rbacv1.UserKind, Name: user})
+	}
+	for _, group := range groups {
+		binding.Subjects = append(binding.Subjects, rbacv1.Subject{APIGroup: rbacv1.GroupName, Kind: rbacv1.GroupKind, Name: group})
+	}
+
+	return role, binding
+}
+
+// installObject creates or updates the object to the desired state, refusing to touch objects not managed by kurun
+func installObject(ctx context.Context, kubeClient client.Client, obj client.Object) error {
+	desired := obj.DeepCopyObject().(client.Object)
+	return createOrUpdateManaged(ctx, kubeClient, obj, func() error {
+		labels := obj.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		for k, v := range desired.GetLabels() {
+			labels[k] = v
+		}
+		obj.SetLabels(labels)
+		setAnnotations(desired.GetAnnotations(), obj)
+		if owners := desired.GetOwnerReferences(); len(owners) > 0 {
+			obj.SetOwnerReferences(owners)
+		}
+
+		switch obj := obj.(type) {
+		case *corev1.Service:
+			obj.Spec.Selector = desired.(*corev1.Service).Spec.Selector
+			obj.Spec.Ports = desired.(*corev1.Service).Spec.Ports
+			if policy := desired.(*corev1.Service).Spec.IPFamilyPolicy; policy != nil {
+				obj.Spec.IPFamilyPolicy = policy
+			}
+			if families := desired.(*corev1.Service).Spec.IPFamilies; len(families) > 0 {
+				obj.Spec.IPFamilies = families
+			}
+		case *networkingv1.NetworkPolicy:
+			obj.Spec = desired.(*networkingv1.NetworkPolicy).Spec
+		case *rbacv1.Role:
+			obj.Rules = desired.(*rbacv1.Role).Rules
+		case *rbacv1.RoleBinding:
+			obj.RoleRef = desired.(*rbacv1.RoleBinding).RoleRef // immutable, but never changes
+			obj.Subjects = desired.(*rbacv1.RoleBinding).Subjects
+		case *rbacv1.ClusterRole:
+			obj.Rules = desired.(*rbacv1.ClusterRole).Rules
+		case *rbacv1.ClusterRoleBinding:
+			obj.RoleRef = desired.(*rbacv1.ClusterRoleBinding).RoleRef // immutable, but never changes
+			obj.Subjects = desired.(*rbacv1.ClusterRoleBinding).Subjects
+		case *corev1.ServiceAccount:
+		case *unstructured.Unstructured:
+			obj.Object["spec"] = desired.(*unstructured.Unstructured).Object["spec"]
+		case *appsv1.Deployment:
+			if obj.Spec.Selector == nil { // immutable
+				obj.Spec.Selector = desired.(*appsv1.Deployment).Spec.Selector
+			}
+			obj.Spec.Template = desired.(*appsv1.Deployment).Spec.Template
+		default:
+			return errors.Errorf("unsupported resource type %T", obj)
+		}
+		return nil
+	})
+}
+
+// parseResourceRequirements parses the resource requests and limits given as name=quantity pairs
+func parseResourceRequirements(requests, limits map[string]string) (corev1.ResourceRequirements, error) {
+	var err error
+	result := corev1.ResourceRequirements{}
+	if result.Requests, err = parseResourceList(requests); err != nil {
+		return result, errors.WrapIf(err, "invalid resource requests")
+	}
+	if result.Limits, err = parseResourceList(limits); err != nil {
+		return result, errors.WrapIf(err, "invalid resource limits")
+	}
+	return result, nil
+}
+
+func parseResourceList(values map[string]string) (corev1.ResourceList, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	list := make(corev1.ResourceList, len(values))
+	for name, value := range values {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, errors.WrapIfWithDetails(err, "invalid quantity", "resource", name)
+		}
+		list[corev1.ResourceName(name)] = quantity
+	}
+	return list, nil
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+)
+
+// kindImportCommand imports the image archive from the standard input into the containerd of a KinD node, like kind
+// load does
+const kindImportCommand = "ctr --namespace=k8s.io images import --all-platforms --digests -"
+
+// kindImportProgressPeriod is the period of logging the progress of the image imports
+const kindImportProgressPeriod = 2 * time.Second
+
+// importIntoKindNodes streams the image into the containerd of all nodes of the KinD cluster in parallel, without
+// saving it into a temporary archive first like kind load
+// The stream is compressed with zstd if it's available both locally and on the nodes, which pays off with remote
+// engines (e.g. DOCKER_HOST=ssh://...).
+func (e containerEngine) importIntoKindNodes(image string, cluster localCluster, logger logr.Logger) error {
+	nodes, err := e.kindNodes(cluster)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.Errorf("no nodes found in the %s cluster", cluster.name)
+	}
+
+	compress := e.zstdAvailable(nodes)
+	importCommand := kindImportCommand
+	if compress {
+		importCommand = "zstd -dc | " + importCommand
+	}
+
+	imports := make([]*exec.Cmd, 0, len(nodes))
+	var stdins []io.Writer
+	var closers []io.Closer
+	var outputs []*toolOutput
+	// waitImports ends the input of the imports and waits for them to finish
+	waitImports := func() error {
+		for _, closer := range closers {
+			_ = closer.Close()
+		}
+		var combinedErr error
+		for i, cmd := range imports {
+			combinedErr = errors.Append(combinedErr, errors.WrapIfWithDetails(outputs[i].Wrap(cmd.Wait()), "failed to import image", "node", nodes[i]))
+		}
+		return combinedErr
+	}
+	for _, node := range nodes {
+		cmd := exec.Command(e.name, "exec", "-i", node, "sh", "-c", importCommand)
+		outputs = append(outputs, attachToolOutput(cmd))
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return errors.Append(err, waitImports())
+		}
+		if err := cmd.Start(); err != nil {
+			return errors.Append(errors.WrapIfWithDetails(err, "failed to start image import", "node", node), waitImports())
+		}
+		imports = append(imports, cmd)
+		stdins = append(stdins, stdin)
+		closers = append(closers, stdin)
+	}
+
+	save := exec.Command(e.name, "save", image)
+	save.Stderr = os.Stderr
+	source, err := save.StdoutPipe()
+	if err != nil {
+		return errors.Append(err, waitImports())
+	}
+	sources := []*exec.Cmd{save}
+	if compress {
+		zstd := exec.Command("zstd", "-c", "-T0", "-q")
+		zstd.Stdin = source
+		zstd.Stderr = os.Stderr
+		if source, err = zstd.StdoutPipe(); err != nil {
+			return errors.Append(err, waitImports())
+		}
+		sources = append(sources, zstd)
+	}
+
+	sent := &byteCounter{}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(kindImportProgressPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				logger.Info("importing image into cluster nodes", "image", image, "nodes", len(nodes), "sent", formatBytes(sent.Load()), "compressed", compress)
+			}
+		}
+	}()
+
+	var combinedErr error
+	for i, cmd := range sources {
+		if err := cmd.Start(); err != nil {
+			combinedErr = errors.WrapIfWithDetails(err, "failed to start image export", "command", cmd.String())
+			for _, started := range sources[:i] {
+				_ = started.Process.Kill()
+				_ = started.Wait()
+			}
+			break
+		}
+	}
+	if combinedErr == nil {
+		_, err := io.Copy(io.MultiWriter(append(stdins, sent)...), source)
+		if err != nil {
+			// e.g. an import failed, nothing reads the rest of the image
+			combinedErr = errors.WrapIf(err, "failed to stream image")
+			for _, cmd := range sources {
+				_ = cmd.Process.Kill()
+			}
+		}
+		for _, cmd := range sources {
+			combinedErr = errors.Append(combinedErr, errors.WrapIfWithDetails(cmd.Wait(), "failed to export image", "command", cmd.String()))
+		}
+	}
+	close(done)
+
+	combinedErr = errors.Append(combinedErr, waitImports())
+	if combinedErr == nil {
+		logger.V(1).Info("imported image into cluster nodes", "image", image, "nodes", len(nodes), "sent", formatBytes(sent.Load()), "compressed", compress)
+	}
+	return combinedErr
+}
+
+// kindNodes returns the names of the node containers of the KinD cluster
+func (e containerEngine) kindNodes(cluster localCluster) ([]string, error) {
+	output := bytes.NewBuffer(nil)
+	cmd := exec.Command("kind", "get", "nodes", "--name", cluster.name)
+	if e.name == "podman" {
+		cmd.Env = append(os.Environ(), "KIND_EXPERIMENTAL_PROVIDER=podman")
+	}
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = output
+	if err := cmd.Run(); err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to list cluster nodes", "cluster", cluster.name)
+	}
+	return strings.Fields(output.String()), nil
+}
+
+// zstdAvailable returns whether zstd is available locally and on all nodes
+func (e containerEngine) zstdAvailable(nodes []string) bool {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return false
+	}
+	for _, node := range nodes {
+		if err := exec.Command(e.name, "exec", node, "sh", "-c", "command -v zstd").Run(); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// byteCounter is a writer counting the bytes written to it
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.n, int64(len(p)))
+	return len(p), nil
+}
+
+func (c *byteCounter) Load() int64 {
+	return atomic.LoadInt64(&c.n)
+}
@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"net/http"
+
+	"k8s.io/client-go/rest"
+	ctrlconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// getKubeConfig returns the Kubernetes client configuration, which records the requests in the audit log if enabled
+// The API server is verified with the CA bundle given with --apiserver-ca instead of the kubeconfig one if set.
+func getKubeConfig(rootParams *rootCommandParams) (*rest.Config, error) {
+	kubeConfig, err := ctrlconfig.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	if rootParams.apiServerCA != "" {
+		kubeConfig.TLSClientConfig.CAFile = rootParams.apiServerCA
+		kubeConfig.TLSClientConfig.CAData = nil
+		kubeConfig.TLSClientConfig.Insecure = false
+	}
+	if rootParams.auditLog != nil {
+		kubeConfig.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return &auditRoundTripper{log: rootParams.auditLog, next: rt}
+		})
+	}
+	return kubeConfig, nil
+}
@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/pointer"
+)
+
+const (
+	// sessionLeaseDuration is the time a session lease is held for without renewal, e.g. after kurun was killed
+	sessionLeaseDuration = 30 * time.Second
+	// sessionLeaseRenewPeriod is the period of renewing the session lease
+	sessionLeaseRenewPeriod = 10 * time.Second
+)
+
+// errSessionTakenOver is the cause of cancelling a session when another kurun takes over its lease with --force
+const errSessionTakenOver = errors.Sentinel("the session was taken over")
+
+// sessionLease is the Lease held by a port-forward session of a service, so two sessions don't fight over the same
+// service
+type sessionLease struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+	holder    string
+	logger    logr.Logger
+}
+
+// sessionHeldError is returned when the lease of the service is held by another session
+type sessionHeldError struct {
+	holder   string
+	acquired time.Time
+}
+
+func (e *sessionHeldError) Error() string {
+	return fmt.Sprintf("the service is used by %s since %s", sessionHolderName(e.holder), e.acquired.Format(time.RFC3339))
+}
+
+// newSessionLease returns the lease of the port-forward sessions of the service, held by the current user on this host
+func newSessionLease(clientset kubernetes.Interface, namespace, serviceName string, logger logr.Logger) *sessionLease {
+	return &sessionLease{
+		clientset: clientset,
+		namespace: namespace,
+		name:      serviceName + "-kurun-session",
+		holder:    sessionHolder(),
+		logger:    logger,
+	}
+}
+
+// sessionHolder identifies the holder of a session lease, e.g. alice@alice-laptop#5f3a1c2e, the random nonce tells
+// apart the sessions of the same user on the same host (e.g. in two terminals), see sessionHolderName
+func sessionHolder() string {
+	username := "unknown"
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	nonce := make([]byte, 4)
+	_, _ = rand.Read(nonce)
+	return username + "@" + hostname + "#" + hex.EncodeToString(nonce)
+}
+
+// sessionHolderName returns the user and the host of the holder of a session lease for the messages to the users,
+// without the nonce
+func sessionHolderName(holder string) string {
+	name, _, _ := strings.Cut(holder, "#")
+	return name
+}
+
+// Acquire takes the lease, a *sessionHeldError is returned if another session holds it, unless it's taken over with
+// force
+func (l *sessionLease) Acquire(ctx context.Context, force bool) error {
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+	now := metav1.NowMicro()
+
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      l.name,
+				Namespace: l.namespace,
+				Labels:    map[string]string{managedByLabel: managedByKurun},
+			},
+			Spec: l.spec(now),
+		}, metav1.CreateOptions{})
+		return errors.WrapIfWithDetails(err, "failed to create session lease", "lease", l.name)
+	}
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to get session lease", "lease", l.name)
+	}
+
+	if holder := pointer.StringDeref(lease.Spec.HolderIdentity, ""); holder != "" && holder != l.holder && !leaseExpired(lease, now.Time) {
+		if !force {
+			acquired := now.Time
+			if lease.Spec.AcquireTime != nil {
+				acquired = lease.Spec.AcquireTime.Time
+			}
+			return &sessionHeldError{holder: holder, acquired: acquired}
+		}
+		l.logger.Info("WARNING: taking over the session of another user", "holder", sessionHolderName(holder))
+	}
+
+	transitions := pointer.Int32Deref(lease.Spec.LeaseTransitions, 0) + 1
+	lease.Spec = l.spec(now)
+	lease.Spec.LeaseTransitions = &transitions
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return errors.WrapIfWithDetails(err, "failed to take session lease", "lease", l.name)
+}
+
+func (l *sessionLease) spec(now metav1.MicroTime) coordinationv1.LeaseSpec {
+	return coordinationv1.LeaseSpec{
+		HolderIdentity:       pointer.String(l.holder),
+		LeaseDurationSeconds: pointer.Int32(int32(sessionLeaseDuration / time.Second)),
+		AcquireTime:          &now,
+		RenewTime:            &now,
+	}
+}
+
+// KeepAlive renews the lease until the context is done, and calls lost with errSessionTakenOver if another session
+// takes it over
+func (l *sessionLease) KeepAlive(ctx context.Context, lost func(error)) {
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+	ticker := time.NewTicker(sessionLeaseRenewPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+		if err != nil {
+			l.logger.V(1).Info("cannot renew session lease", "error", err.Error())
+			continue
+		}
+		if holder := pointer.StringDeref(lease.Spec.HolderIdentity, ""); holder != l.holder {
+			lost(errors.WithDetails(errSessionTakenOver, "holder", sessionHolderName(holder)))
+			return
+		}
+		now := metav1.NowMicro()
+		lease.Spec.RenewTime = &now
+		if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+			l.logger.V(1).Info("cannot renew session lease", "error", err.Error())
+		}
+	}
+}
+
+// Release deletes the lease if it's still held by the session
+func (l *sessionLease) Release(ctx context.Context) error {
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to get session lease", "lease", l.name)
+	}
+	if pointer.StringDeref(lease.Spec.HolderIdentity, "") != l.holder {
+		return nil
+	}
+	err = leases.Delete(ctx, l.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+	if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+		return nil
+	}
+	return errors.WrapIfWithDetails(err, "failed to delete session lease", "lease", l.name)
+}
+
+// leaseExpired returns whether the lease wasn't renewed in its duration, e.g. because its holder was killed
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// workloadConfig is the configuration of an existing workload copied into the pods run by kurun with --like
+type workloadConfig struct {
+	ref      string
+	template corev1.PodTemplateSpec
+	// selector are the labels selecting the pods of the workload, they are not copied
+	selector map[string]string
+}
+
+// getWorkloadConfig returns the configuration of the workload referenced as kind/name, e.g. deployment/foo
+func getWorkloadConfig(ctx context.Context, rootParams *rootCommandParams, namespace, ref string) (*workloadConfig, error) {
+	kind, name, ok := strings.Cut(ref, "/")
+	if !ok || name == "" {
+		return nil, errors.Errorf("invalid --like value %q, expected kind/name, e.g. deployment/foo", ref)
+	}
+
+	kubeConfig, err := getKubeConfig(rootParams)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &workloadConfig{ref: ref}
+	var selector *metav1.LabelSelector
+	switch strings.ToLower(kind) {
+	case "deployment", "deployments", "deploy":
+		deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.WrapIfWithDetails(err, "failed to get workload", "workload", ref)
+		}
+		config.template, selector = deployment.Spec.Template, deployment.Spec.Selector
+	case "statefulset", "statefulsets", "sts":
+		statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.WrapIfWithDetails(err, "failed to get workload", "workload", ref)
+		}
+		config.template, selector = statefulSet.Spec.Template, statefulSet.Spec.Selector
+	case "daemonset", "daemonsets", "ds":
+		daemonSet, err := clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.WrapIfWithDetails(err, "failed to get workload", "workload", ref)
+		}
+		config.template, selector = daemonSet.Spec.Template, daemonSet.Spec.Selector
+	default:
+		return nil, errors.Errorf("unsupported --like kind %q, expected deployment, statefulset or daemonset", kind)
+	}
+	if len(config.template.Spec.Containers) == 0 {
+		return nil, errors.NewWithDetails("workload has no containers", "workload", ref)
+	}
+	if selector != nil {
+		config.selector = selector.MatchLabels
+	}
+	return config, nil
+}
+
+// apply copies the environment, the configuration volumes, the service account and the labels of the workload into
+// the pod, the first container of the workload is copied into the first one of the pod
+// The labels of the selector are not copied, so the controller of the workload doesn't adopt the pod and the services
+// of the workload don't send requests to it. The volumes of other sources than config maps, secrets, projected and
+// downward API volumes (e.g. persistent volume claims) are not copied either, as the pod could not share them with
+// the workload.
+func (c *workloadConfig) apply(pod *corev1.Pod, keepServiceAccount bool, logger logr.Logger) {
+	source := c.template.Spec.Containers[0]
+	container := &pod.Spec.Containers[0]
+
+	// the variables of --env take precedence
+	container.Env = append(append([]corev1.EnvVar{}, source.Env...), container.Env...)
+	container.EnvFrom = append(append([]corev1.EnvFromSource{}, source.EnvFrom...), container.EnvFrom...)
+
+	copied := make(map[string]bool)
+	for _, volume := range c.template.Spec.Volumes {
+		if volume.ConfigMap == nil && volume.Secret == nil && volume.Projected == nil && volume.DownwardAPI == nil {
+			logger.V(1).Info("not copying volume of workload", "workload", c.ref, "volume", volume.Name)
+			continue
+		}
+		pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+		copied[volume.Name] = true
+	}
+	for _, mount := range source.VolumeMounts {
+		if copied[mount.Name] {
+			container.VolumeMounts = append(container.VolumeMounts, mount)
+		}
+	}
+
+	if !keepServiceAccount {
+		pod.Spec.ServiceAccountName = c.template.Spec.ServiceAccountName
+	}
+
+	for key, value := range c.template.Labels {
+		if _, ok := c.selector[key]; ok {
+			continue
+		}
+		if _, ok := pod.Labels[key]; !ok {
+			pod.Labels[key] = value
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/go-logr/stdr"
+)
+
+// formats of the log lines of kurun
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// outputs of the log lines besides file paths
+const (
+	logOutputStderr = "stderr"
+	logOutputStdout = "stdout"
+)
+
+// newLogger returns the logger of kurun writing to the output (stderr, stdout or the path of a file to append to) in
+// the format, the log lines above the verbosity are dropped
+func newLogger(format, output string, verbosity int) (logr.Logger, error) {
+	var w io.Writer
+	switch output {
+	case "", logOutputStderr:
+		w = os.Stderr
+	case logOutputStdout:
+		w = os.Stdout
+	default:
+		file, err := os.OpenFile(output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return logr.Discard(), errors.WrapIfWithDetails(err, "failed to open log file", "path", output)
+		}
+		w = file
+	}
+
+	switch format {
+	case "", logFormatText:
+		stdr.SetVerbosity(verbosity)
+		return stdr.New(log.New(w, "", log.LstdFlags|log.LUTC)), nil
+	case logFormatJSON:
+		var mu sync.Mutex
+		return funcr.NewJSON(func(obj string) {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintln(w, obj)
+		}, funcr.Options{
+			LogTimestamp: true,
+			Verbosity:    verbosity,
+		}), nil
+	default:
+		return logr.Discard(), errors.Errorf("unknown --log-format %q, expected %s or %s", format, logFormatText, logFormatJSON)
+	}
+}
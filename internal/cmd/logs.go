@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type logParams struct {
+	filter string
+	since  time.Duration
+	tail   int64
+}
+
+func addLogFlags(cmd *cobra.Command, params *logParams) {
+	cmd.PersistentFlags().DurationVar(&params.since, "since", 0, "Only show logs newer than a relative duration like 5s, 2m, or 3h (defaults to all logs)")
+	cmd.PersistentFlags().Int64Var(&params.tail, "tail", -1, "Number of recent log lines to show from each container (defaults to all lines)")
+	cmd.PersistentFlags().StringVar(&params.filter, "log-filter", "", "Only show log lines matching the regular expression")
+}
+
+var logColors = []string{"\x1b[31m", "\x1b[32m", "\x1b[33m", "\x1b[34m", "\x1b[35m", "\x1b[36m"}
+
+const logColorReset = "\x1b[0m"
+
+// logStreamer interleaves the logs of multiple containers line by line, prefixed (and colored on terminals) with the container
+type logStreamer struct {
+	clientset kubernetes.Interface
+	filter    *regexp.Regexp
+	params    logParams
+	out       io.Writer
+	colored   bool
+
+	mu sync.Mutex
+}
+
+func newLogStreamer(clientset kubernetes.Interface, params logParams, out io.Writer) (*logStreamer, error) {
+	s := &logStreamer{
+		clientset: clientset,
+		params:    params,
+		out:       out,
+	}
+	if file, ok := out.(*os.File); ok {
+		s.colored = term.IsTerminal(int(file.Fd()))
+	}
+	if params.filter != "" {
+		filter, err := regexp.Compile(params.filter)
+		if err != nil {
+			return nil, errors.WrapIf(err, "invalid log filter")
+		}
+		s.filter = filter
+	}
+	return s, nil
+}
+
+// StreamContainer follows the logs of the container until it terminates or the context is cancelled
+// since overrides the configured --since duration if not zero (e.g. when the container is restarted).
+func (s *logStreamer) StreamContainer(ctx context.Context, namespace, podName, containerName string, since time.Time) error {
+	options := &corev1.PodLogOptions{
+		Container: containerName,
+		Follow:    true,
+	}
+	if !since.IsZero() {
+		sinceTime := metav1.NewTime(since)
+		options.SinceTime = &sinceTime
+	} else {
+		if s.params.since > 0 {
+			sinceSeconds := int64(s.params.since.Seconds())
+			options.SinceSeconds = &sinceSeconds
+		}
+		if s.params.tail >= 0 {
+			options.TailLines = &s.params.tail
+		}
+	}
+
+	stream, err := s.clientset.CoreV1().Pods(namespace).GetLogs(podName, options).Stream(ctx)
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to stream container logs", "pod", podName, "container", containerName)
+	}
+	defer stream.Close()
+
+	prefix := fmt.Sprintf("[%s/%s] ", podName, containerName)
+	if s.colored {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(prefix))
+		prefix = logColors[hash.Sum32()%uint32(len(logColors))] + prefix + logColorReset
+	}
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if s.filter != nil && !s.filter.MatchString(line) {
+			continue
+		}
+
+		s.mu.Lock()
+		fmt.Fprintln(s.out, prefix+line)
+		s.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return errors.WrapIfWithDetails(err, "failed to read container logs", "pod", podName, "container", containerName)
+	}
+	return nil
+}
+
+// StreamJobPods follows the logs of all containers of the pods matching the list options until the context is
+// cancelled or done is closed, each container once, including the ones terminated already (e.g. the pods of short
+// jobs, which are not restarted)
+// Once done is closed the containers are listed once more, and the streams are waited for to end.
+func (s *logStreamer) StreamJobPods(ctx context.Context, namespace string, listOptions metav1.ListOptions, done <-chan struct{}) error {
+	streamed := make(map[string]bool)
+	var wg sync.WaitGroup
+
+	for {
+		final := false
+		select {
+		case <-done:
+			final = true
+		default:
+		}
+
+		pods, err := s.clientset.CoreV1().Pods(namespace).List(ctx, listOptions)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.WrapIf(err, "failed to list pods")
+		}
+
+		for _, pod := range pods.Items {
+			for _, status := range pod.Status.ContainerStatuses {
+				key := pod.Name + "/" + status.Name
+				if status.State.Waiting != nil || streamed[key] {
+					continue
+				}
+				streamed[key] = true
+
+				wg.Add(1)
+				go func(podName, containerName string) {
+					defer wg.Done()
+					if err := s.StreamContainer(ctx, namespace, podName, containerName, time.Time{}); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+					}
+				}(pod.Name, status.Name)
+			}
+		}
+		if final {
+			wg.Wait()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-done:
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// StreamPods follows the logs of all containers of the pods matching the list options until the context is cancelled
+// Pods created later (e.g. by a rollout) and restarted containers are picked up as well.
+func (s *logStreamer) StreamPods(ctx context.Context, namespace string, listOptions metav1.ListOptions) error {
+	var mu sync.Mutex
+	streaming := make(map[string]bool)
+	ended := make(map[string]time.Time)
+
+	for {
+		pods, err := s.clientset.CoreV1().Pods(namespace).List(ctx, listOptions)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.WrapIf(err, "failed to list pods")
+		}
+
+		for _, pod := range pods.Items {
+			for _, status := range pod.Status.ContainerStatuses {
+				if status.State.Running == nil {
+					continue
+				}
+
+				key := pod.Name + "/" + status.Name
+				mu.Lock()
+				if streaming[key] {
+					mu.Unlock()
+					continue
+				}
+				streaming[key] = true
+				since := ended[key]
+				mu.Unlock()
+
+				go func(podName, containerName string) {
+					if err := s.StreamContainer(ctx, namespace, podName, containerName, since); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+					}
+
+					mu.Lock()
+					streaming[key] = false
+					ended[key] = time.Now()
+					mu.Unlock()
+				}(pod.Name, status.Name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
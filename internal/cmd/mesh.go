@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"strconv"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	meshNone    = ""
+	meshIstio   = "istio"
+	meshLinkerd = "linkerd"
+)
+
+// meshParams are the service mesh settings of the kurun-server
+type meshParams struct {
+	mesh               string
+	excludeControlPort bool
+}
+
+func addMeshFlags(cmd *cobra.Command, params *meshParams) {
+	cmd.PersistentFlags().StringVar(&params.mesh, "mesh", meshNone, "Service mesh of the namespace (istio or linkerd): inject its sidecar into kurun-server and declare the protocols of the ports")
+	cmd.PersistentFlags().BoolVar(&params.excludeControlPort, "mesh-exclude-control-port", true, "Bypass the mesh sidecar on the control port, as the API server proxy can't take part in mutual TLS")
+}
+
+func validateMeshParams(params meshParams) error {
+	switch params.mesh {
+	case meshNone, meshIstio, meshLinkerd:
+		return nil
+	default:
+		return errors.Errorf("invalid --mesh value %q, must be istio or linkerd", params.mesh)
+	}
+}
+
+// applyMeshToService declares the application protocols of the service ports, so the mesh doesn't have to sniff them
+func applyMeshToService(params meshParams, tlsRequests bool, forwardedPorts []forwardedPort, service *corev1.Service) {
+	if params.mesh == meshNone {
+		return
+	}
+
+	requestProtocol := "http"
+	if tlsRequests {
+		requestProtocol = "https"
+	}
+	controlProtocol := "https"
+	protocols := map[string]*string{
+		"request": &requestProtocol,
+		"control": &controlProtocol,
+	}
+	for _, forwarded := range forwardedPorts {
+		protocol := forwarded.scheme()
+		protocols[forwarded.name] = &protocol
+	}
+	for i := range service.Spec.Ports {
+		port := &service.Spec.Ports[i]
+		if protocol, ok := protocols[port.Name]; ok {
+			port.AppProtocol = protocol
+		}
+	}
+}
+
+// applyMeshToPodTemplate enables the sidecar injection of the mesh for the pod template, and excludes the control
+// port from the sidecar if configured
+func applyMeshToPodTemplate(params meshParams, template *corev1.PodTemplateSpec, controlPort int32) {
+	annotations := make(map[string]string)
+	switch params.mesh {
+	case meshIstio:
+		annotations["sidecar.istio.io/inject"] = "true"
+		if params.excludeControlPort {
+			annotations["traffic.sidecar.istio.io/excludeInboundPorts"] = strconv.Itoa(int(controlPort))
+		}
+	case meshLinkerd:
+		annotations["linkerd.io/inject"] = "enabled"
+		if params.excludeControlPort {
+			annotations["config.linkerd.io/skip-inbound-ports"] = strconv.Itoa(int(controlPort))
+		}
+	default:
+		return
+	}
+	template.Annotations = mergeMaps(template.Annotations, annotations)
+}
+
+// checkMeshSidecars returns an error if the ready pods matching the list options run without the sidecar of the mesh
+// e.g. because injection is disabled for the namespace, so requests of meshed clients may fail
+func checkMeshSidecars(ctx context.Context, clientset kubernetes.Interface, namespace string, listOptions metav1.ListOptions, mesh string) error {
+	sidecarName := map[string]string{
+		meshIstio:   "istio-proxy",
+		meshLinkerd: "linkerd-proxy",
+	}[mesh]
+	if sidecarName == "" {
+		return nil
+	}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, listOptions)
+	if err != nil {
+		return errors.WrapIf(err, "failed to list pods")
+	}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		injected := false
+		// the sidecar is a regular container, or a restartable init container in native sidecar mode
+		for _, container := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+			if container.Name == sidecarName {
+				injected = true
+			}
+		}
+		if !injected {
+			return errors.NewWithDetails("the mesh sidecar was not injected, check the injection settings of the namespace", "pod", pod.Name, "sidecar", sidecarName)
+		}
+	}
+	return nil
+}
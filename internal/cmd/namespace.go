@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	ephemeralNamespaceLabel      = "kurun.banzaicloud.io/ephemeral"
+	ephemeralNamespaceHostAnnot  = "kurun.banzaicloud.io/session-host"
+	ephemeralNamespacePIDAnnot   = "kurun.banzaicloud.io/session-pid"
+	ephemeralNamespaceNamePrefix = "kurun-"
+)
+
+// addEphemeralNamespaceFlag adds the --ephemeral-namespace flag to the command and its subcommands
+func addEphemeralNamespaceFlag(cmd *cobra.Command, rootParams *rootCommandParams) {
+	cmd.PersistentFlags().BoolVar(&rootParams.ephemeralNamespace, "ephemeral-namespace", false, "create a uniquely named namespace for the session and delete it on exit")
+}
+
+// withEphemeralNamespace creates a uniquely named namespace for the session of the command, and changes the command
+// to delete it when it finishes or is interrupted. Namespaces orphaned by earlier sessions on this host are deleted first.
+func withEphemeralNamespace(cmd *cobra.Command, rootParams *rootCommandParams) error {
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	kubeConfig, err := getKubeConfig(rootParams)
+	if err != nil {
+		return err
+	}
+	kubeClient, err := client.New(kubeConfig, client.Options{})
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+
+	logger := rootParams.logger
+	if err := deleteOrphanedNamespaces(ctx, kubeClient, hostname, logger); err != nil {
+		return err
+	}
+
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: ephemeralNamespaceNamePrefix,
+			Labels: map[string]string{
+				ephemeralNamespaceLabel: "true",
+			},
+			Annotations: map[string]string{
+				ephemeralNamespaceHostAnnot: hostname,
+				ephemeralNamespacePIDAnnot:  strconv.Itoa(os.Getpid()),
+			},
+		},
+	}
+	if err := kubeClient.Create(ctx, namespace); err != nil {
+		return errors.WrapIf(err, "failed to create ephemeral namespace")
+	}
+	logger.Info("using ephemeral namespace", "namespace", namespace.Name)
+	rootParams.namespace = namespace.Name
+
+	var deleteOnce sync.Once
+	deleteNamespace := func() {
+		deleteOnce.Do(func() {
+			err := kubeClient.Delete(context.Background(), namespace, client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil && !apierrors.IsNotFound(err) {
+				logger.Error(err, "failed to delete ephemeral namespace", "namespace", namespace.Name)
+			}
+		})
+	}
+
+	runE := cmd.RunE
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		// deleting the namespace terminates the session's pods, so attached commands exit as well
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-signals:
+				deleteNamespace()
+			case <-done:
+			}
+		}()
+
+		defer deleteNamespace()
+
+		return runE(cmd, args)
+	}
+
+	return nil
+}
+
+// deleteOrphanedNamespaces deletes the ephemeral namespaces of kurun sessions on this host which are not running anymore
+func deleteOrphanedNamespaces(ctx context.Context, kubeClient client.Client, hostname string, logger logr.Logger) error {
+	var namespaces corev1.NamespaceList
+	if err := kubeClient.List(ctx, &namespaces, client.MatchingLabels{ephemeralNamespaceLabel: "true"}); err != nil {
+		return errors.WrapIf(err, "failed to list ephemeral namespaces")
+	}
+
+	for i := range namespaces.Items {
+		namespace := &namespaces.Items[i]
+		if namespace.DeletionTimestamp != nil || namespace.Annotations[ephemeralNamespaceHostAnnot] != hostname {
+			continue
+		}
+		pid, err := strconv.Atoi(namespace.Annotations[ephemeralNamespacePIDAnnot])
+		if err == nil && processExists(pid) {
+			continue
+		}
+
+		logger.Info("deleting orphaned ephemeral namespace", "namespace", namespace.Name)
+		if err := kubeClient.Delete(ctx, namespace, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !apierrors.IsNotFound(err) {
+			return errors.WrapIfWithDetails(err, "failed to delete orphaned ephemeral namespace", "namespace", namespace.Name)
+		}
+	}
+
+	return nil
+}
+
+// processExists checks whether a local process with the specified PID is running
+func processExists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer process.Release()
+
+	if runtime.GOOS == "windows" {
+		// FindProcess fails on Windows if the process doesn't exist
+		return true
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"emperror.dev/errors"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+type networkPolicyParams struct {
+	create            bool
+	controlCIDRs      []string
+	namespaceSelector string
+	podSelector       string
+}
+
+// newTunnelNetworkPolicy returns a NetworkPolicy that restricts ingress to the tunnel server pods
+// The request port is reachable only from the peers matching the configured selectors,
+// the control port is reachable from the configured CIDRs (or from anywhere, as API server proxy traffic
+// does not originate from a pod in most clusters).
+func newTunnelNetworkPolicy(meta metav1.ObjectMeta, podLabels map[string]string, requestPort, controlPort corev1.ContainerPort, params networkPolicyParams) (*networkingv1.NetworkPolicy, error) {
+	requestPeer := networkingv1.NetworkPolicyPeer{}
+	if params.namespaceSelector != "" {
+		selector, err := metav1.ParseToLabelSelector(params.namespaceSelector)
+		if err != nil {
+			return nil, errors.WrapIf(err, "failed to parse namespace selector")
+		}
+		requestPeer.NamespaceSelector = selector
+	}
+	if params.podSelector != "" {
+		selector, err := metav1.ParseToLabelSelector(params.podSelector)
+		if err != nil {
+			return nil, errors.WrapIf(err, "failed to parse pod selector")
+		}
+		requestPeer.PodSelector = selector
+	}
+	if requestPeer.NamespaceSelector == nil && requestPeer.PodSelector == nil {
+		// only pods in the same namespace
+		requestPeer.PodSelector = &metav1.LabelSelector{}
+	}
+
+	var controlPeers []networkingv1.NetworkPolicyPeer
+	for _, cidr := range params.controlCIDRs {
+		controlPeers = append(controlPeers, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{
+				CIDR: cidr,
+			},
+		})
+	}
+
+	tcp := corev1.ProtocolTCP
+	requestPortValue := intstr.FromInt(int(requestPort.ContainerPort))
+	controlPortValue := intstr.FromInt(int(controlPort.ContainerPort))
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: meta,
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: podLabels,
+			},
+			PolicyTypes: []networkingv1.PolicyType{
+				networkingv1.PolicyTypeIngress,
+			},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					Ports: []networkingv1.NetworkPolicyPort{
+						{
+							Protocol: &tcp,
+							Port:     &requestPortValue,
+						},
+					},
+					From: []networkingv1.NetworkPolicyPeer{
+						requestPeer,
+					},
+				},
+				{
+					Ports: []networkingv1.NetworkPolicyPort{
+						{
+							Protocol: &tcp,
+							Port:     &controlPortValue,
+						},
+					},
+					From: controlPeers,
+				},
+			},
+		},
+	}, nil
+}
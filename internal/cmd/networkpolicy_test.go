@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestTunnelNetworkPolicy(t *testing.T) {
+	meta := metav1.ObjectMeta{Namespace: "default", Name: "kurun"}
+	podLabels := map[string]string{"app": "kurun"}
+	requestPort := corev1.ContainerPort{Name: "request", ContainerPort: 8444}
+	controlPort := corev1.ContainerPort{Name: "control", ContainerPort: 8333}
+
+	testCases := map[string]struct {
+		params       networkPolicyParams
+		requestPeer  networkingv1.NetworkPolicyPeer
+		controlPeers []networkingv1.NetworkPolicyPeer
+		err          string
+	}{
+		"same namespace by default": {
+			requestPeer: networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{}},
+		},
+		"selectors": {
+			params: networkPolicyParams{
+				namespaceSelector: "team=dev",
+				podSelector:       "app in (frontend, backend)",
+			},
+			requestPeer: networkingv1.NetworkPolicyPeer{
+				NamespaceSelector: &metav1.LabelSelector{
+					MatchLabels:      map[string]string{"team": "dev"},
+					MatchExpressions: []metav1.LabelSelectorRequirement{},
+				},
+				PodSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{},
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"backend", "frontend"}},
+					},
+				},
+			},
+		},
+		"namespace selector only": {
+			params: networkPolicyParams{namespaceSelector: "team=dev"},
+			requestPeer: networkingv1.NetworkPolicyPeer{NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels:      map[string]string{"team": "dev"},
+				MatchExpressions: []metav1.LabelSelectorRequirement{},
+			}},
+		},
+		"control CIDRs": {
+			params:      networkPolicyParams{controlCIDRs: []string{"10.0.0.0/8", "192.168.0.1/32"}},
+			requestPeer: networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{}},
+			controlPeers: []networkingv1.NetworkPolicyPeer{
+				{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8"}},
+				{IPBlock: &networkingv1.IPBlock{CIDR: "192.168.0.1/32"}},
+			},
+		},
+		"invalid namespace selector": {
+			params: networkPolicyParams{namespaceSelector: "team in dev"},
+			err:    "failed to parse namespace selector",
+		},
+		"invalid pod selector": {
+			params: networkPolicyParams{podSelector: "app=(frontend"},
+			err:    "failed to parse pod selector",
+		},
+	}
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			policy, err := newTunnelNetworkPolicy(meta, podLabels, requestPort, controlPort, testCase.params)
+			if testCase.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), testCase.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, meta, policy.ObjectMeta)
+			require.Equal(t, podLabels, policy.Spec.PodSelector.MatchLabels)
+			require.Equal(t, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}, policy.Spec.PolicyTypes)
+			require.Len(t, policy.Spec.Ingress, 2)
+
+			requestRule := policy.Spec.Ingress[0]
+			require.Len(t, requestRule.Ports, 1)
+			require.Equal(t, intstr.FromInt(8444), *requestRule.Ports[0].Port)
+			require.Equal(t, corev1.ProtocolTCP, *requestRule.Ports[0].Protocol)
+			require.Equal(t, []networkingv1.NetworkPolicyPeer{testCase.requestPeer}, requestRule.From)
+
+			// the control port is open to anyone without CIDRs, as the API server proxy isn't a pod in most clusters
+			controlRule := policy.Spec.Ingress[1]
+			require.Len(t, controlRule.Ports, 1)
+			require.Equal(t, intstr.FromInt(8333), *controlRule.Ports[0].Port)
+			require.Equal(t, testCase.controlPeers, controlRule.From)
+		})
+	}
+}
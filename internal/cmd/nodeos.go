@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"emperror.dev/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// operating systems of the nodes the generated pods are scheduled to
+const (
+	linuxNodeOS   = "linux"
+	windowsNodeOS = "windows"
+)
+
+// defaultWindowsBaseImage is the base image of the images built for Windows nodes, unless --base-image is set
+const defaultWindowsBaseImage = "mcr.microsoft.com/windows/nanoserver:ltsc2022"
+
+func validateNodeOS(nodeOS string) error {
+	switch nodeOS {
+	case "", linuxNodeOS, windowsNodeOS:
+		return nil
+	default:
+		return errors.Errorf("invalid --node-os value %q, must be linux, windows or empty for any", nodeOS)
+	}
+}
+
+// setNodeOS schedules the pod to the nodes of the operating system, so the pods of Linux images don't land on the
+// Windows nodes of mixed clusters and crash there
+// The node selector set already (e.g. by the user) is kept, nothing is set for an empty operating system.
+func setNodeOS(spec *corev1.PodSpec, nodeOS string) {
+	if nodeOS == "" {
+		return
+	}
+	if _, ok := spec.NodeSelector[corev1.LabelOSStable]; ok {
+		return
+	}
+	if spec.NodeSelector == nil {
+		spec.NodeSelector = make(map[string]string)
+	}
+	spec.NodeSelector[corev1.LabelOSStable] = nodeOS
+}
@@ -0,0 +1,256 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"emperror.dev/errors"
+	"github.com/banzaicloud/kurun/tunnel"
+	"github.com/spf13/cobra"
+	clientscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// formats of the results printed by kurun
+const (
+	outputFormatJSON = "json"
+	outputFormatText = "text"
+)
+
+// commandStdout receives the standard output of the external commands run by kurun (e.g. go build, the container
+// engine or kubectl), so it doesn't mix with the results printed for scripts
+var commandStdout io.Writer = os.Stdout
+
+// verboseCommands prints the output of the tools run by kurun to build images (see toolOutput), set with -v
+var verboseCommands bool
+
+// outputParams are the settings of the results printed by the commands
+type outputParams struct {
+	format string
+	quiet  bool
+}
+
+func addOutputFlags(cmd *cobra.Command, params *outputParams) {
+	cmd.PersistentFlags().StringVar(&params.format, "output", outputFormatText, "Format of the results (built images, applied resources, forwarded URL): text or json (a JSON object per line)")
+	cmd.PersistentFlags().BoolVar(&params.quiet, "quiet", false, "Print only the results, without status lines and the output of the tools run by kurun")
+}
+
+// outputPrinter prints the status lines and the results of a command to the standard output
+// In JSON mode only the results are printed, as a JSON object per line, anything else goes to the standard error.
+type outputPrinter struct {
+	json  bool
+	quiet bool
+	out   io.Writer
+	mutex sync.Mutex
+}
+
+// newOutputPrinter returns the printer of the results, and redirects the output of the external commands according
+// to the params
+func newOutputPrinter(params outputParams) (*outputPrinter, error) {
+	p := &outputPrinter{
+		quiet: params.quiet,
+		out:   os.Stdout,
+	}
+	switch params.format {
+	case "", outputFormatText:
+	case outputFormatJSON:
+		p.json = true
+	default:
+		return nil, errors.Errorf("unknown --output %q, expected %s or %s", params.format, outputFormatText, outputFormatJSON)
+	}
+
+	switch {
+	case p.json:
+		commandStdout = os.Stderr
+	case p.quiet:
+		commandStdout = io.Discard
+	default:
+		commandStdout = os.Stdout
+	}
+	return p, nil
+}
+
+// Stdout returns the writer of the output requested by the user besides the results, e.g. the output of the binary
+// run in the cluster or the logs of the applied pods, it's the standard error in JSON mode
+func (p *outputPrinter) Stdout() io.Writer {
+	if p.json {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Statusf prints a status line for humans, nothing is printed in quiet and JSON mode
+func (p *outputPrinter) Statusf(format string, args ...interface{}) {
+	if p.json || p.quiet {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	fmt.Fprintf(p.out, format+"\n", args...)
+}
+
+// Result prints a result of the command: the status line in text mode, only the value in quiet mode or the result
+// object in JSON mode, empty lines and values are not printed
+func (p *outputPrinter) Result(status, value string, result interface{}) error {
+	line := status
+	switch {
+	case p.json:
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			return errors.WrapIf(err, "failed to encode result")
+		}
+		line = string(encoded)
+	case p.quiet:
+		line = value
+	}
+	if line == "" {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, err := fmt.Fprintln(p.out, line)
+	return err
+}
+
+// ConnectionEvent prints the connection lifecycle events of the tunnel client as status lines, or as results in
+// JSON mode
+func (p *outputPrinter) ConnectionEvent(event tunnel.ConnectionEvent) {
+	result := connectionEventResult{
+		Type:    "tunnel",
+		Event:   string(event.Type),
+		Attempt: event.Attempt,
+	}
+	if event.Type == tunnel.ConnectionEventReconnecting {
+		result.Backoff = event.Backoff.String()
+	}
+	if event.Err != nil {
+		result.Error = event.Err.Error()
+	}
+	status := "Tunnel " + event.String()
+	switch event.Type {
+	case tunnel.ConnectionEventPingAdapted:
+		result.Idle = event.Idle.String()
+		result.PingInterval = event.PingInterval.String()
+	case tunnel.ConnectionEventKeepaliveFailed:
+		result.Idle = event.Idle.String()
+		result.Hint = keepaliveFailedHint
+		status += fmt.Sprintf("\nHint: %s\nSee %s", keepaliveFailedHint, troubleshootingURL)
+	}
+	_ = p.Result(status, "", result)
+}
+
+// SessionSummary prints the statistics of the requests relayed in the session
+func (p *outputPrinter) SessionSummary(summary tunnel.StatsSummary) {
+	_ = p.Result(formatSessionSummary(summary), "", sessionSummaryResult{
+		Type:         "summary",
+		BytesDown:    summary.BytesDown,
+		BytesUp:      summary.BytesUp,
+		ClientErrors: summary.ClientErrors,
+		Errors:       summary.Errors,
+		LatencyP50:   summary.LatencyP50.String(),
+		LatencyP95:   summary.LatencyP95.String(),
+		LatencyP99:   summary.LatencyP99.String(),
+		Reconnects:   summary.Reconnects,
+		Requests:     summary.Requests,
+		ServerErrors: summary.ServerErrors,
+	})
+}
+
+// imageResult is a built image
+type imageResult struct {
+	Type    string   `json:"type"`
+	Image   string   `json:"image"`
+	GoFiles []string `json:"goFiles"`
+}
+
+// resourceResult is a resource created or applied in the cluster
+type resourceResult struct {
+	Type       string `json:"type"`
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+func newResourceResult(obj client.Object) (resourceResult, error) {
+	gvk, err := apiutil.GVKForObject(obj, clientscheme.Scheme)
+	if err != nil {
+		return resourceResult{}, err
+	}
+	return resourceResult{
+		Type:       "resource",
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       gvk.Kind,
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+	}, nil
+}
+
+// Ref returns the reference of the resource in the kind/name form of kubectl
+func (r resourceResult) Ref() string {
+	return strings.ToLower(r.Kind) + "/" + r.Name
+}
+
+// forwardResult is the endpoint forwarding the requests through the tunnel
+type forwardResult struct {
+	Type      string `json:"type"`
+	URL       string `json:"url,omitempty"`
+	Service   string `json:"service"`
+	Namespace string `json:"namespace"`
+	Upstream  string `json:"upstream"`
+	Curl      string `json:"curl,omitempty"`
+	CABundle  string `json:"caBundle,omitempty"`
+}
+
+// exitResult is the exit code of the binary run in the cluster
+type exitResult struct {
+	Type     string `json:"type"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// jobResult is the result of a job running the binary in the cluster
+type jobResult struct {
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Succeeded bool   `json:"succeeded"`
+	Message   string `json:"message,omitempty"`
+}
+
+// podExitResult is the exit status of a pod of a job running the binary in the cluster
+type podExitResult struct {
+	Type     string `json:"type"`
+	Pod      string `json:"pod"`
+	ExitCode int    `json:"exitCode"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type connectionEventResult struct {
+	Type    string `json:"type"`
+	Event   string `json:"event"`
+	Attempt int    `json:"attempt,omitempty"`
+	Backoff string `json:"backoff,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Idle and PingInterval are set on the events of --adaptive-ping
+	Idle         string `json:"idle,omitempty"`
+	PingInterval string `json:"pingInterval,omitempty"`
+	Hint         string `json:"hint,omitempty"`
+}
+
+type sessionSummaryResult struct {
+	Type         string `json:"type"`
+	BytesDown    int64  `json:"bytesDown"`
+	BytesUp      int64  `json:"bytesUp"`
+	ClientErrors int    `json:"clientErrors"`
+	Errors       int    `json:"errors"`
+	LatencyP50   string `json:"latencyP50"`
+	LatencyP95   string `json:"latencyP95"`
+	LatencyP99   string `json:"latencyP99"`
+	Reconnects   int    `json:"reconnects"`
+	Requests     int    `json:"requests"`
+	ServerErrors int    `json:"serverErrors"`
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/banzaicloud/kurun/extension"
+)
+
+const pluginPrefix = "kurun-"
+
+// RunPlugin runs the kurun-<name> executable found on the PATH for the arguments, like kubectl plugins, e.g.
+// kurun foo bar --baz runs kurun-foo-bar --baz if found, otherwise kurun-foo bar --baz
+// It returns false if the arguments refer to a built-in command or no plugin is found.
+func RunPlugin(args []string) (bool, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return false, nil
+	}
+	switch args[0] {
+	case "help", "completion", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+		return false, nil
+	}
+	if cmd, _, err := NewRootCommand().Find(args); err == nil && cmd.HasParent() {
+		return false, nil
+	}
+
+	nameParts := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			break
+		}
+		nameParts = append(nameParts, arg)
+	}
+	// the longest matching name wins
+	for i := len(nameParts); i > 0; i-- {
+		path, err := exec.LookPath(pluginPrefix + strings.Join(nameParts[:i], "-"))
+		if err != nil {
+			continue
+		}
+
+		pluginCommand := exec.Command(path, args[i:]...)
+		pluginCommand.Stdin = os.Stdin
+		pluginCommand.Stdout = os.Stdout
+		pluginCommand.Stderr = os.Stderr
+		if err := pluginCommand.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return true, ExitError{Code: exitErr.ExitCode()}
+			}
+			return true, errors.WrapIfWithDetails(err, "failed to run plugin", "path", path)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// NewPluginCommand returns the command listing the plugins and extensions of kurun
+func NewPluginCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plugin",
+		Short: "Inspect the plugins and extensions of kurun",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the kurun-<name> plugins on the PATH and the registered image builders and tunnel transports",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			plugins := findPlugins()
+			if len(plugins) == 0 {
+				fmt.Fprintln(os.Stdout, "No plugins found on the PATH")
+			} else {
+				fmt.Fprintln(os.Stdout, "Plugins:")
+				for _, plugin := range plugins {
+					fmt.Fprintf(os.Stdout, "  %s\n", plugin)
+				}
+			}
+			fmt.Fprintf(os.Stdout, "Image builders: %s\n", strings.Join(append([]string{"default"}, extension.ImageBuilderNames()...), ", "))
+			fmt.Fprintf(os.Stdout, "Tunnel transports: %s\n", strings.Join(tunnelTransportNames(), ", "))
+			return nil
+		},
+	})
+
+	return cmd
+}
+
+// findPlugins returns the paths of the kurun-<name> executables on the PATH, the first one of each name
+func findPlugins() []string {
+	seen := make(map[string]bool)
+	plugins := []string{}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !strings.HasPrefix(name, pluginPrefix) || seen[name] {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			if runtime.GOOS != "windows" && info.Mode()&0o111 == 0 {
+				continue
+			}
+			seen[name] = true
+			plugins = append(plugins, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(plugins)
+	return plugins
+}
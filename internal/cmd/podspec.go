@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"emperror.dev/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// parseExtraContainers parses the values of the --sidecar and --init-container flags: <image>[,<command>], the command
+// is split at white space
+// The containers are named after their images (e.g. envoy for envoyproxy/envoy:v1.25.0), or <flag>-<index> if it's
+// not a valid or unique name, e.g. sidecar-1.
+func parseExtraContainers(values []string, flag string) ([]corev1.Container, error) {
+	containers := make([]corev1.Container, 0, len(values))
+	names := make(map[string]bool)
+	for i, value := range values {
+		parts := strings.SplitN(value, ",", 2)
+		if parts[0] == "" {
+			return nil, errors.Errorf("invalid --%s value %q, expected <image>[,<command>]", flag, value)
+		}
+		container := corev1.Container{
+			Name:  containerNameOf(parts[0]),
+			Image: parts[0],
+		}
+		if len(parts) == 2 {
+			container.Command = strings.Fields(parts[1])
+		}
+		if len(validation.IsDNS1123Label(container.Name)) > 0 || names[container.Name] {
+			container.Name = fmt.Sprintf("%s-%d", flag, i)
+		}
+		names[container.Name] = true
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// containerNameOf returns the name of the image without the registry, the repository path, the tag and the digest
+func containerNameOf(image string) string {
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.IndexAny(name, ":@"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// parseExtendedResources parses the values of the --gpu flag, the names of extended resources are prefixed with the
+// domain of their device plugin, e.g. nvidia.com/gpu
+// Kubernetes requests as much of them as the limits, they cannot be overcommitted.
+func parseExtendedResources(values map[string]string) (corev1.ResourceList, error) {
+	resources, err := parseResourceList(values)
+	if err != nil {
+		return nil, errors.WrapIf(err, "invalid --gpu value")
+	}
+	for name, quantity := range resources {
+		if !strings.Contains(string(name), "/") || strings.Contains(string(name), corev1.ResourceDefaultNamespacePrefix) || len(validation.IsQualifiedName(string(name))) > 0 {
+			return nil, errors.Errorf("invalid --gpu resource %q, expected an extended resource like nvidia.com/gpu", name)
+		}
+		// the devices are allocated whole
+		if quantity.Sign() <= 0 || quantity.MilliValue()%1000 != 0 {
+			return nil, errors.Errorf("invalid --gpu quantity %q of %q, expected a positive whole number", quantity.String(), name)
+		}
+	}
+	return resources, nil
+}
+
+// setExtendedResourceLimits sets the limits of the extended resources on the container
+func setExtendedResourceLimits(container *corev1.Container, resources corev1.ResourceList) {
+	if len(resources) == 0 {
+		return
+	}
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = make(corev1.ResourceList, len(resources))
+	}
+	for name, quantity := range resources {
+		container.Resources.Limits[name] = quantity
+	}
+}
+
+// applyPodTemplate merges the partial pod spec of the YAML file into the spec of the pod, e.g. to add sidecars with
+// volumes
+func applyPodTemplate(pod *corev1.Pod, fileName string) error {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return errors.WrapIf(err, "failed to read pod template")
+	}
+	spec, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to parse pod template", "file", fileName)
+	}
+	patch, err := json.Marshal(map[string]json.RawMessage{"spec": spec})
+	if err != nil {
+		return err
+	}
+	return errors.WrapIfWithDetails(strategicMergePod(pod, patch), "failed to apply pod template", "file", fileName)
+}
+
+// readPodTemplatePatch reads a strategic merge patch of a pod template from the YAML file, and checks that it applies
+func readPodTemplatePatch(fileName string) ([]byte, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.WrapIf(err, "failed to read pod template patch")
+	}
+	patch, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to parse pod template patch", "file", fileName)
+	}
+	if err := patchPodTemplate(&corev1.PodTemplateSpec{}, patch); err != nil {
+		return nil, errors.WithDetails(err, "file", fileName)
+	}
+	return patch, nil
+}
+
+// patchPodTemplate applies the strategic merge patch to the pod template, it's not changed without a patch
+func patchPodTemplate(template *corev1.PodTemplateSpec, patch []byte) error {
+	if len(patch) == 0 {
+		return nil
+	}
+	original, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	patched, err := strategicpatch.StrategicMergePatch(original, patch, corev1.PodTemplateSpec{})
+	if err != nil {
+		return errors.WrapIf(err, "failed to apply pod template patch")
+	}
+	*template = corev1.PodTemplateSpec{}
+	return errors.WrapIf(json.Unmarshal(patched, template), "failed to apply pod template patch")
+}
+
+// strategicMergePod applies the strategic merge patch to the pod, lists like the containers are merged by their keys
+func strategicMergePod(pod *corev1.Pod, patch []byte) error {
+	original, err := json.Marshal(pod)
+	if err != nil {
+		return err
+	}
+	patched, err := strategicpatch.StrategicMergePatch(original, patch, corev1.Pod{})
+	if err != nil {
+		return err
+	}
+	*pod = corev1.Pod{}
+	return json.Unmarshal(patched, pod)
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestParseExtendedResources(t *testing.T) {
+	testCases := map[string]struct {
+		values    map[string]string
+		resources corev1.ResourceList
+		err       string
+	}{
+		"no resources": {},
+		"GPU": {
+			values:    map[string]string{"nvidia.com/gpu": "1"},
+			resources: corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")},
+		},
+		"multiple resources": {
+			values: map[string]string{"nvidia.com/gpu": "2", "example.com/fpga": "1"},
+			resources: corev1.ResourceList{
+				"nvidia.com/gpu":   resource.MustParse("2"),
+				"example.com/fpga": resource.MustParse("1"),
+			},
+		},
+		"invalid quantity": {
+			values: map[string]string{"nvidia.com/gpu": "one"},
+			err:    "invalid --gpu value",
+		},
+		"fractional quantity": {
+			values: map[string]string{"nvidia.com/gpu": "0.5"},
+			err:    `invalid --gpu quantity "500m" of "nvidia.com/gpu", expected a positive whole number`,
+		},
+		"milli quantity": {
+			values: map[string]string{"nvidia.com/gpu": "1500m"},
+			err:    "expected a positive whole number",
+		},
+		"zero": {
+			values: map[string]string{"nvidia.com/gpu": "0"},
+			err:    "expected a positive whole number",
+		},
+		"negative quantity": {
+			values: map[string]string{"nvidia.com/gpu": "-1"},
+			err:    "expected a positive whole number",
+		},
+		"standard resource": {
+			values: map[string]string{"cpu": "1"},
+			err:    `invalid --gpu resource "cpu", expected an extended resource like nvidia.com/gpu`,
+		},
+		"kubernetes.io resource": {
+			values: map[string]string{"kubernetes.io/gpu": "1"},
+			err:    `invalid --gpu resource "kubernetes.io/gpu"`,
+		},
+		"invalid resource name": {
+			values: map[string]string{"nvidia.com/": "1"},
+			err:    `invalid --gpu resource "nvidia.com/"`,
+		},
+	}
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			resources, err := parseExtendedResources(testCase.values)
+			if testCase.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), testCase.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testCase.resources, resources)
+		})
+	}
+}
+
+func TestSetExtendedResourceLimits(t *testing.T) {
+	resources, err := parseExtendedResources(map[string]string{"nvidia.com/gpu": "2"})
+	require.NoError(t, err)
+
+	container := corev1.Container{
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
+			},
+		},
+	}
+	setExtendedResourceLimits(&container, resources)
+	require.Equal(t, corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("100m"),
+		corev1.ResourceMemory: resource.MustParse("128Mi"),
+		"nvidia.com/gpu":      resource.MustParse("2"),
+	}, container.Resources.Limits)
+	// Kubernetes requests as much of them as the limits
+	require.Empty(t, container.Resources.Requests)
+
+	container = corev1.Container{}
+	setExtendedResourceLimits(&container, resources)
+	require.Equal(t, corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("2")}, container.Resources.Limits)
+
+	container = corev1.Container{}
+	setExtendedResourceLimits(&container, nil)
+	require.Nil(t, container.Resources.Limits)
+}
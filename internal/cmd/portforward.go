@@ -3,35 +3,36 @@ package cmd
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"emperror.dev/errors"
+	"github.com/banzaicloud/kurun/extension"
 	"github.com/banzaicloud/kurun/tunnel"
 	tunnelws "github.com/banzaicloud/kurun/tunnel/websocket"
-	"github.com/go-logr/stdr"
+	"github.com/go-logr/logr"
 	"github.com/gorilla/websocket"
 	"github.com/spf13/cobra"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/util/intstr"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	toolscache "k8s.io/client-go/tools/cache"
-	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/cluster"
 )
 
@@ -39,22 +40,42 @@ const kurunServerImage = "ghcr.io/banzaicloud/kurun-server:v0.2.1"
 
 func NewPortForwardCommand(rootParams *rootCommandParams) *cobra.Command {
 	var (
-		labels      []string
-		serverImage string
-		serviceName string
-		servicePort int
-		tlsSecret   string
+		addServicePorts  bool
+		annotations      []string
+		attach           string
+		clientParams     tunnelClientParams
+		dryRun           string
+		exportDir        string
+		exportWebhooks   []string
+		force            bool
+		forwardPorts     []string
+		injectInto       string
+		ipFamilies       ipFamilyParams
+		join             bool
+		labels           []string
+		loadImage        bool
+		mesh             meshParams
+		netPolParams     networkPolicyParams
+		noRestore        bool
+		offlineQueue     string
+		podTemplatePatch string
+		selector         string
+		serverLimits     map[string]string
+		serverParams     tunnelServerParams
+		serverRequests   map[string]string
+		serveDir         string
+		serviceName      string
+		servicePort      int
+		writeEnv         string
 	)
 
 	cmd := &cobra.Command{
-		Use:     "port-forward [flags] upstream",
+		Use:     "port-forward [flags] (upstream | --serve-dir dir)",
 		Short:   "Just like `kubectl port-forward ...` but the other way around!",
 		Example: "kurun port-forward --namespace apps localhost:4443",
-		Args:    cobra.MinimumNArgs(1),
 
 		RunE: func(cmd *cobra.Command, args []string) error {
 			namespace := rootParams.namespace
-			verbosity := rootParams.verbosity
 
 			controlPort := corev1.ContainerPort{
 				Name:          "control",
@@ -65,24 +86,146 @@ func NewPortForwardCommand(rootParams *rootCommandParams) *cobra.Command {
 				ContainerPort: 8444,
 			}
 
-			downstream := args[0]
-			downstreamURL := &url.URL{
-				Scheme: "http",
-				Host:   downstream,
+			if serverParams.splitFallback == "" && (len(serverParams.splitHeaders) > 0 || serverParams.splitPercent > 0) {
+				return errors.New("--split-header and --split-percent require --split-fallback")
 			}
-			if strings.Contains(downstream, "://") {
-				var err error
-				downstreamURL, err = url.Parse(downstream)
+			if serverParams.splitPercent < 0 || serverParams.splitPercent > 100 {
+				return errors.Errorf("--split-percent must be between 0 and 100, got %d", serverParams.splitPercent)
+			}
+
+			if err := validateDryRun(dryRun); err != nil {
+				return err
+			}
+			if err := validateIPFamilyParams(ipFamilies); err != nil {
+				return err
+			}
+			if err := validateMeshParams(mesh); err != nil {
+				return err
+			}
+			annotationsMap, err := parseAnnotations(annotations)
+			if err != nil {
+				return err
+			}
+
+			resources, err := parseResourceRequirements(serverRequests, serverLimits)
+			if err != nil {
+				return err
+			}
+			serverParams.resources = resources
+			if (dryRun != dryRunNone || exportDir != "") && injectInto != "" {
+				return errors.New("--dry-run and --export cannot be used with --inject-into")
+			}
+			if dryRun != dryRunNone && exportDir != "" {
+				return errors.New("--dry-run cannot be used with --export")
+			}
+			if len(exportWebhooks) > 0 && exportDir == "" {
+				return errors.New("--export-webhook requires --export")
+			}
+			webhookPatches, err := parseWebhookPatches(exportWebhooks)
+			if err != nil {
+				return err
+			}
+			if (dryRun != dryRunNone || exportDir != "") && rootParams.output.json {
+				return errors.New("--output json cannot be used with --dry-run and --export")
+			}
+
+			configuresServer := injectInto != "" || dryRun != dryRunNone || exportDir != "" || netPolParams.create || serverParams.splitFallback != "" || offlineQueue != "" || len(forwardPorts) > 0 || podTemplatePatch != ""
+			if attach != "" && configuresServer {
+				return errors.New("--attach cannot be used with flags creating or configuring kurun-server resources")
+			}
+			if selector != "" {
+				if attach != "" || configuresServer {
+					return errors.New("--selector cannot be used with --attach and flags creating or configuring kurun-server resources")
+				}
+				if _, err := k8slabels.Parse(selector); err != nil {
+					return errors.WrapIf(err, "invalid --selector")
+				}
+				if clientParams.transport != defaultTunnelTransport {
+					return errors.Errorf("--selector cannot be used with --transport %s", clientParams.transport)
+				}
+			}
+			if join && (configuresServer || attach != "" || selector != "") {
+				return errors.New("--join cannot be used with --attach, --selector and flags creating or configuring kurun-server resources")
+			}
+			if loadImage && (attach != "" || join || dryRun != dryRunNone) {
+				return errors.New("--load-server-image cannot be used with --attach, --join and --dry-run")
+			}
+			if join && force {
+				return errors.New("--join cannot be used with --force")
+			}
+			if (attach != "" || selector != "") && writeEnv != "" {
+				return errors.New("--write-env cannot be used with --attach and --selector")
+			}
+
+			if injectInto != "" && netPolParams.create {
+				return errors.New("--create-networkpolicy cannot be used with --inject-into as the policy would apply to the workload's pods")
+			}
+
+			if injectInto != "" && podTemplatePatch != "" {
+				return errors.New("--pod-template-patch cannot be used with --inject-into, patch the deployment itself instead")
+			}
+			var templatePatch []byte
+			if podTemplatePatch != "" {
+				templatePatch, err = readPodTemplatePatch(podTemplatePatch)
 				if err != nil {
-					return errors.WithMessage(err, "failed to parse downstream URL")
+					return err
 				}
 			}
 
-			stdr.SetVerbosity(verbosity)
-			logger := stdr.New(log.New(os.Stdout, "", log.LstdFlags|log.LUTC))
+			var downstreamURL *url.URL
+			switch {
+			case serveDir != "" && len(args) > 0:
+				return errors.New("upstream cannot be specified with --serve-dir")
+			case serveDir != "":
+				downstreamURL, err = serveDirURL(serveDir)
+			case len(args) == 0:
+				return errors.New("upstream must be specified, or a directory to serve with --serve-dir")
+			default:
+				downstreamURL, err = parseDownstreamURL(args[0])
+			}
+			if err != nil {
+				return err
+			}
 
-			cmdCtx, cancelCmdCtx := context.WithCancel(cmd.Context())
-			defer cancelCmdCtx()
+			if err := validateTunnelClientParams(&clientParams); err != nil {
+				return err
+			}
+			forwardedPorts, err := parseForwardedPorts(forwardPorts)
+			if err != nil {
+				return err
+			}
+			for _, port := range forwardedPorts {
+				if port.servicePort == int32(servicePort) {
+					return errors.Errorf("--forward-port service port %d is already used by --serviceport", port.servicePort)
+				}
+			}
+			clientParams.routes = forwardedPortRoutes(forwardedPorts)
+			if offlineQueue != "" {
+				size, err := resource.ParseQuantity(offlineQueue)
+				if err != nil || size.Sign() <= 0 {
+					return errors.Errorf("--offline-queue must be a positive size, e.g. 1Mi, got %q", offlineQueue)
+				}
+				serverParams.offlineQueueSize = size.Value()
+			}
+			if clientParams.transport == grpcTunnelTransport && (attach != "" || dryRun != dryRunNone || exportDir != "") {
+				return errors.New("--transport grpc cannot be used with --attach, --dry-run or --export, as the credentials of the session are generated for the kurun-server it creates")
+			}
+			if clientParams.transport == sshTunnelTransport && clientParams.ssh.sidecar && (attach != "" || join || injectInto != "" || dryRun != dryRunNone || exportDir != "") {
+				return errors.New("--transport ssh cannot be used with --attach, --join, --inject-into, --dry-run or --export, as the sidecar runs next to the kurun-server it creates with keys generated for the session (use your own sshd with --ssh-sidecar=false)")
+			}
+			// kurun-server splits the requests the same way as the client splits the responses
+			serverParams.maxFrameSize = clientParams.maxFrameSize
+			// and it keeps the connection alive and resumable from its side as well
+			serverParams.pingInterval = clientParams.pingInterval
+			serverParams.idleTimeout = clientParams.idleTimeout
+			serverParams.sessionGracePeriod = clientParams.sessionGracePeriod
+			serverParams.readinessProbe = clientParams.healthCheckPath != ""
+
+			logger := rootParams.logger
+			output := rootParams.output
+
+			cmdCtx, cancelCmdCtx := context.WithCancelCause(cmd.Context())
+			defer cancelCmdCtx(nil)
 
 			go func() {
 				signals := make(chan os.Signal, 1)
@@ -90,12 +233,67 @@ func NewPortForwardCommand(rootParams *rootCommandParams) *cobra.Command {
 
 				select {
 				case <-signals:
-					cancelCmdCtx()
-					fmt.Fprintln(os.Stdout, "Ctrl+C pressed, exiting...")
+					cancelCmdCtx(nil)
+					output.Statusf("Ctrl+C pressed, exiting...")
 				case <-cmdCtx.Done():
 				}
 			}()
 
+			// attachSession connects the tunnel client to the kurun-server behind an existing service, or to the
+			// kurun-server pods of the selector if it's set
+			attachSession := func(name, selector string) error {
+				kubeConfig, err := getKubeConfig(rootParams)
+				if err != nil {
+					return err
+				}
+				permissions := tunnelPermissions
+				if selector != "" {
+					permissions = podSelectorTunnelPermissions
+				}
+				if err := checkPreflightPermissions(cmdCtx, kubeConfig, namespace, permissions, logger); err != nil {
+					return err
+				}
+
+				var target tunnelTarget
+				var endpoint string
+				if selector != "" {
+					target = tunnelTarget{namespace: namespace, resources: "pods", selector: selector}
+					endpoint = fmt.Sprintf("pods/%s.%s", selector, namespace)
+				} else {
+					kurunService, err := getAttachService(cmdCtx, kubeConfig, namespace, name, controlPort, logger)
+					if err != nil {
+						return err
+					}
+					target = serviceTunnelTarget(kurunService)
+					endpoint = fmt.Sprintf("%s.%s.svc", kurunService.Name, kurunService.Namespace)
+				}
+
+				stats, err := startTunnelClient(cmdCtx, cancelCmdCtx, kubeConfig, target, downstreamURL, clientParams, output, logger)
+				if err != nil {
+					return err
+				}
+
+				if err := output.Result("Forwarding "+endpoint+" -> "+downstreamURL.String(), endpoint, forwardResult{
+					Type:      "forward",
+					Service:   target.name,
+					Namespace: target.namespace,
+					Upstream:  downstreamURL.String(),
+				}); err != nil {
+					return err
+				}
+
+				<-cmdCtx.Done()
+
+				output.SessionSummary(stats.Summary())
+
+				return tunnelExitError(cmdCtx)
+			}
+
+			if attach != "" || selector != "" {
+				cmd.SilenceUsage = true
+				return attachSession(attach, selector)
+			}
+
 			deploymentName := serviceName
 			if !strings.HasSuffix(deploymentName, "kurun") {
 				deploymentName += "-kurun"
@@ -114,11 +312,100 @@ func NewPortForwardCommand(rootParams *rootCommandParams) *cobra.Command {
 
 			cmd.SilenceUsage = true // all args and flags validated before this line
 
-			kubeConfig, err := config.GetConfig()
+			if loadImage {
+				if err := loadServerImage(serverParams.image, rootParams.containerEngine, rootParams.output, logger); err != nil {
+					return err
+				}
+			}
+
+			if dryRun != dryRunNone || exportDir != "" {
+				tunnelServerContainer, volumes := newTunnelServerContainer(serverParams, requestPort, controlPort)
+				volumes = addForwardedContainerPorts(&tunnelServerContainer, volumes, forwardedPorts)
+				kurunService := newKurunService(namespace, serviceName, labelsMap, servicePort, requestPort, controlPort)
+				addForwardedServicePorts(kurunService, forwardedPorts)
+				setServiceIPFamilies(kurunService, ipFamilies)
+				applyMeshToService(mesh, serverParams.tlsSecret != "", forwardedPorts, kurunService)
+				objects := []client.Object{kurunService}
+				if netPolParams.create {
+					netPol, err := newTunnelNetworkPolicy(metav1.ObjectMeta{
+						Name:      deploymentName,
+						Namespace: namespace,
+					}, labelsMap, requestPort, controlPort, netPolParams)
+					if err != nil {
+						return err
+					}
+					addForwardedNetworkPolicyPorts(netPol, forwardedPorts)
+					objects = append(objects, netPol)
+				}
+				deployment := newTunnelServerDeployment(namespace, deploymentName, labelsMap, tunnelServerContainer, volumes)
+				applyMeshToPodTemplate(mesh, &deployment.Spec.Template, controlPort.ContainerPort)
+				if err := patchPodTemplate(&deployment.Spec.Template, templatePatch); err != nil {
+					return err
+				}
+				objects = append(objects, deployment)
+
+				for _, obj := range objects {
+					setManagedByKurun(obj)
+				}
+				setAnnotations(annotationsMap, objects...)
+				if exportDir != "" {
+					// the namespace of the exported objects is removed
+					exportedService := kurunService.DeepCopy()
+					if err := exportManifests(exportDir, namespace, objects...); err != nil {
+						return err
+					}
+					return exportWebhookPatches(exportDir, exportedService, webhookPatches)
+				}
+				return printManifests(cmdCtx, rootParams, os.Stdout, dryRun, objects...)
+			}
+
+			kubeConfig, err := getKubeConfig(rootParams)
 			if err != nil {
 				return err
 			}
 
+			permissions := portForwardPermissions
+			if injectInto != "" {
+				permissions = joinPermissions(sidecarPermissions, tunnelPermissions)
+			}
+			if netPolParams.create {
+				permissions = joinPermissions(permissions, networkPolicyPermissions)
+			}
+			if serverParams.tlsSecret != "" {
+				permissions = joinPermissions(permissions, tlsSecretPermissions)
+			}
+			if err := checkPreflightPermissions(cmdCtx, kubeConfig, namespace, permissions, logger); err != nil {
+				return err
+			}
+
+			clientset, err := kubernetes.NewForConfig(kubeConfig)
+			if err != nil {
+				return err
+			}
+
+			// the sessions of the same service would fight over its kurun-server
+			lease := newSessionLease(clientset, namespace, serviceName, logger)
+			err = lease.Acquire(cmdCtx, force)
+			var heldErr *sessionHeldError
+			switch {
+			case errors.As(err, &heldErr) && join:
+				output.Statusf("Joining the session of %s", sessionHolderName(heldErr.holder))
+				return attachSession(serviceName, "")
+			case errors.As(err, &heldErr):
+				return withHint(err, "stop that session, take it over with --force, or connect another tunnel client to its kurun-server with --join", troubleshootingURL)
+			case apierrors.IsForbidden(err):
+				logger.Info("WARNING: not allowed to lock the service with a lease, other sessions may change it", "error", err.Error())
+			case err != nil:
+				return err
+			default:
+				defer func() {
+					if err := lease.Release(context.Background()); err != nil {
+						logger.Error(err, "failed to release session lease")
+					}
+				}()
+				go lease.KeepAlive(cmdCtx, cancelCmdCtx)
+			}
+
 			kubeCluster, err := cluster.New(kubeConfig, func(o *cluster.Options) {
 				o.Namespace = namespace
 			})
@@ -134,43 +421,72 @@ func NewPortForwardCommand(rootParams *rootCommandParams) *cobra.Command {
 
 			kubeClient := kubeCluster.GetClient()
 
-			kurunServiceCreated := false
-			kurunService := &corev1.Service{
-				ObjectMeta: metav1.ObjectMeta{
+			var targetDeploymentKey client.ObjectKey
+			if injectInto != "" {
+				targetDeploymentKey = client.ObjectKey{
 					Namespace: namespace,
-					Name:      serviceName,
-					Labels:    labelsMap,
-				},
-				Spec: corev1.ServiceSpec{
-					Selector: labelsMap,
-					Ports: []corev1.ServicePort{
-						{
-							Name:       "request",
-							Port:       int32(servicePort),
-							TargetPort: intstr.FromString(requestPort.Name),
-						},
-						{
-							Name:       "control",
-							Port:       controlPort.ContainerPort,
-							TargetPort: intstr.FromString(controlPort.Name),
-						},
-					},
-				},
+					Name:      injectInto,
+				}
+				targetDeployment := &appsv1.Deployment{}
+				if err := kubeClient.Get(cmdCtx, targetDeploymentKey, targetDeployment); err != nil {
+					return errors.WrapIfWithDetails(err, "failed to get deployment to inject tunnel server into", "deployment", targetDeploymentKey)
+				}
+				if targetDeployment.Spec.Selector == nil || len(targetDeployment.Spec.Selector.MatchLabels) == 0 {
+					return errors.NewWithDetails("deployment has no match labels in its selector", "deployment", targetDeploymentKey)
+				}
+				if replicas := targetDeployment.Spec.Replicas; replicas != nil && *replicas > 1 {
+					logger.Info("WARNING: deployment has multiple replicas, only requests routed to the pod the tunnel client connects to will be forwarded", "deployment", targetDeploymentKey, "replicas", *replicas)
+				}
+				labelsMap = targetDeployment.Spec.Selector.MatchLabels
 			}
-			if err := kubeClient.Get(cmdCtx, client.ObjectKeyFromObject(kurunService), kurunService); err != nil {
-				if apierrors.IsNotFound(err) {
-					if err := kubeClient.Create(cmdCtx, kurunService); err != nil {
-						return err
+
+			podListOptions := metav1.ListOptions{LabelSelector: k8slabels.SelectorFromSet(labelsMap).String()}
+
+			kurunServiceCreated := false
+			kurunService := newKurunService(namespace, serviceName, labelsMap, servicePort, requestPort, controlPort)
+			addForwardedServicePorts(kurunService, forwardedPorts)
+			setServiceIPFamilies(kurunService, ipFamilies)
+			applyMeshToService(mesh, serverParams.tlsSecret != "", forwardedPorts, kurunService)
+			existingService := &corev1.Service{}
+			err = withRetry(func() error {
+				return kubeClient.Get(cmdCtx, client.ObjectKeyFromObject(kurunService), existingService)
+			})
+			switch {
+			case apierrors.IsNotFound(err) || (err == nil && isManagedByKurun(existingService)):
+				desiredService := kurunService.DeepCopy()
+				if err := createOrUpdateManaged(cmdCtx, kubeClient, kurunService, func() error {
+					if kurunService.Labels == nil {
+						kurunService.Labels = make(map[string]string)
 					}
-					kurunServiceCreated = true
-				} else {
+					for k, v := range desiredService.Labels {
+						kurunService.Labels[k] = v
+					}
+					setAnnotations(annotationsMap, kurunService)
+					kurunService.Spec.Selector = desiredService.Spec.Selector
+					kurunService.Spec.Ports = desiredService.Spec.Ports
+					if desiredService.Spec.IPFamilyPolicy != nil {
+						kurunService.Spec.IPFamilyPolicy = desiredService.Spec.IPFamilyPolicy
+					}
+					if len(desiredService.Spec.IPFamilies) > 0 {
+						kurunService.Spec.IPFamilies = desiredService.Spec.IPFamilies
+					}
+					return nil
+				}); err != nil {
+					return errors.WrapIf(err, "failed to create service")
+				}
+				kurunServiceCreated = true
+				if err := printCreatedResource(output, kurunService); err != nil {
 					return err
 				}
+			case err != nil:
+				return err
+			default:
+				kurunService = existingService
 			}
 
 			defer func() {
 				if kurunServiceCreated {
-					if err := kubeClient.Delete(context.TODO(), kurunService); err != nil {
+					if err := deleteWithRetry(context.Background(), kubeClient, kurunService); err != nil {
 						logger.Error(err, "failed to delete service")
 					}
 				}
@@ -181,6 +497,17 @@ func NewPortForwardCommand(rootParams *rootCommandParams) *cobra.Command {
 			if !kurunServiceCreated {
 				serviceRequestPort = kurunService.Spec.Ports[0].Name
 
+				missingPorts := reconcileServicePorts(kurunService, serviceRequestPort, forwardedPorts, logger)
+				if len(missingPorts) > 0 && !addServicePorts {
+					missingServicePorts := make([]int32, 0, len(missingPorts))
+					for _, port := range missingPorts {
+						missingServicePorts = append(missingServicePorts, port.servicePort)
+					}
+					return errors.NewWithDetails("service has no ports for some of the --forward-port flags, add them for the session with --add-service-ports", "service", client.ObjectKeyFromObject(kurunService), "ports", missingServicePorts)
+				}
+				// the routes are named after the container ports of the service
+				clientParams.routes = forwardedPortRoutes(forwardedPorts)
+
 				hasControlPortAlready := false
 				for _, port := range kurunService.Spec.Ports {
 					switch port.Name {
@@ -189,15 +516,32 @@ func NewPortForwardCommand(rootParams *rootCommandParams) *cobra.Command {
 					}
 				}
 
+				serviceKey := client.ObjectKeyFromObject(kurunService)
+				originalPorts := len(kurunService.Spec.Ports)
 				if !hasControlPortAlready {
 					kurunService.Spec.Ports = append(kurunService.Spec.Ports, corev1.ServicePort{
 						Name: "control",
 						Port: controlPort.ContainerPort,
 					})
+				}
+				addForwardedServicePorts(kurunService, missingPorts)
 
+				if !hasControlPortAlready || len(missingPorts) > 0 {
+					addedPorts := append([]corev1.ServicePort(nil), kurunService.Spec.Ports[originalPorts:]...)
 					if err = kubeClient.Update(cmd.Context(), kurunService); err != nil {
 						return err
 					}
+
+					// the service may be shared, e.g. by other developers or the workload itself
+					defer func() {
+						if noRestore {
+							logger.Info("keeping the changes of the service", "service", serviceKey)
+							return
+						}
+						if err := restoreService(kubeConfig, serviceKey, addedPorts); err != nil {
+							logger.Error(err, "failed to restore service", "service", serviceKey)
+						}
+					}()
 				}
 
 				labelsMap = kurunService.Spec.Selector
@@ -212,193 +556,821 @@ func NewPortForwardCommand(rootParams *rootCommandParams) *cobra.Command {
 				}
 			}
 
-			tunnelServerContainer := corev1.Container{
-				Name:            "tunnel-server",
-				Image:           serverImage,
-				ImagePullPolicy: corev1.PullIfNotPresent, // HACK
-				Args: []string{
-					"--ctrl-srv-addr",
-					fmt.Sprintf("0.0.0.0:%d", controlPort.ContainerPort),
-					"--ctrl-srv-self-signed",
-					"--req-srv-addr",
-					fmt.Sprintf("0.0.0.0:%d", requestPort.ContainerPort),
-				},
-				Ports: []corev1.ContainerPort{
-					requestPort,
-					controlPort,
-				},
+			if clientParams.transport == grpcTunnelTransport {
+				credentials, err := newGRPCCredentials()
+				if err != nil {
+					return errors.WrapIf(err, "failed to generate gRPC credentials")
+				}
+				clientParams.grpcCredentials = credentials
+
+				secret := newGRPCSecret(namespace, deploymentName+"-grpc", labelsMap, credentials)
+				desiredSecret := secret.DeepCopy()
+				if err := createOrUpdateManaged(cmdCtx, kubeClient, secret, func() error {
+					secret.Type = desiredSecret.Type
+					secret.Data = desiredSecret.Data
+					return nil
+				}); err != nil {
+					return errors.WrapIf(err, "failed to create gRPC secret")
+				}
+
+				defer func() {
+					if err := deleteWithRetry(context.Background(), kubeClient, secret); err != nil {
+						logger.Error(err, "failed to delete gRPC secret")
+					}
+				}()
+
+				serverParams.grpcSecret = secret.Name
 			}
 
-			volumes := []corev1.Volume{}
+			var sshSidecar *corev1.Container
+			var sshVolume corev1.Volume
+			if clientParams.transport == sshTunnelTransport && clientParams.ssh.sidecar {
+				credentials, err := newSSHCredentials()
+				if err != nil {
+					return errors.WrapIf(err, "failed to generate SSH keys")
+				}
+				clientParams.sshCredentials = credentials
 
-			requestScheme := "http"
-			if tlsSecret != "" {
-				requestScheme = "https"
+				secret := newSSHSecret(namespace, deploymentName+"-ssh", labelsMap, credentials)
+				desiredSecret := secret.DeepCopy()
+				if err := createOrUpdateManaged(cmdCtx, kubeClient, secret, func() error {
+					secret.Type = desiredSecret.Type
+					secret.Data = desiredSecret.Data
+					return nil
+				}); err != nil {
+					return errors.WrapIf(err, "failed to create SSH secret")
+				}
 
-				tunnelServerContainer.Args = append(
-					tunnelServerContainer.Args,
-					"--req-srv-cert",
-					"/etc/tls/tls.crt",
-					"--req-srv-key",
-					"/etc/tls/tls.key",
-					"-v",
-				)
-				tunnelServerContainer.VolumeMounts = []corev1.VolumeMount{
-					{
-						Name:      tlsSecret,
-						MountPath: "/etc/tls",
-					},
+				defer func() {
+					if err := deleteWithRetry(context.Background(), kubeClient, secret); err != nil {
+						logger.Error(err, "failed to delete SSH secret")
+					}
+				}()
+
+				container, volume := newSSHSidecarContainer(serverParams, secret.Name, controlPort)
+				sshSidecar, sshVolume = &container, volume
+				if clientParams.ssh.target == "" {
+					clientParams.ssh.target = sshSidecarTarget(controlPort)
 				}
-				volumes = append(volumes, corev1.Volume{
-					Name: tlsSecret,
-					VolumeSource: corev1.VolumeSource{
-						Secret: &corev1.SecretVolumeSource{
-							SecretName: tlsSecret,
-						},
-					},
-				})
 			}
 
-			deployment := &appsv1.Deployment{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:      deploymentName,
-					Namespace: namespace,
-				},
-				Spec: appsv1.DeploymentSpec{
-					Selector: &metav1.LabelSelector{
-						MatchLabels: labelsMap,
-					},
-					Template: corev1.PodTemplateSpec{
-						ObjectMeta: metav1.ObjectMeta{
-							Labels: labelsMap,
-						},
-						Spec: corev1.PodSpec{
-							Containers: []corev1.Container{
-								tunnelServerContainer,
-							},
-							Volumes: volumes,
-						},
-					},
-				},
+			tunnelServerContainer, volumes := newTunnelServerContainer(serverParams, requestPort, controlPort)
+			volumes = addForwardedContainerPorts(&tunnelServerContainer, volumes, forwardedPorts)
+			serverImage := selectServerImage(cmdCtx, clientset, serverParams.image, rootParams.config.Server.Images, logger)
+			// the sidecar runs on the nodes of the workload, only its image is selected
+			tunnelServerContainer.Image = serverImage.image
+			if sshSidecar != nil {
+				sshSidecar.Image = serverImage.image
 			}
 
-			if err := kubeClient.Create(cmdCtx, deployment); err != nil {
-				return err
+			requestScheme := "http"
+			if serverParams.tlsSecret != "" {
+				requestScheme = "https"
 			}
 
-			defer func() {
-				if err := kubeClient.Delete(context.Background(), deployment); err != nil {
-					logger.Error(err, "failed to delete deployment")
+			if injectInto != "" {
+				tunnelServerContainer.Name = sidecarContainerName
+
+				deployment, err := injectSidecar(cmdCtx, kubeClient, targetDeploymentKey, tunnelServerContainer, volumes)
+				if err != nil {
+					return errors.WrapIfWithDetails(err, "failed to inject tunnel server sidecar", "deployment", targetDeploymentKey)
 				}
-			}()
 
-			if err := waitForResource(cmdCtx, kubeCluster.GetCache(), kubeCluster.GetScheme(), deployment, func(obj interface{}) bool {
-				deploy, ok := obj.(*appsv1.Deployment)
-				return ok && deploy.Namespace == deployment.Namespace && deploy.Name == deployment.Name && hasAvailable(deploy)
-			}, 60*time.Second); err != nil {
-				return err
-			}
+				defer func() {
+					if err := removeSidecar(context.Background(), kubeClient, targetDeploymentKey, tunnelServerContainer.Name, volumes); err != nil {
+						logger.Error(err, "failed to remove tunnel server sidecar", "deployment", targetDeploymentKey)
+					}
+				}()
 
-			proxyURL, err := url.Parse(kubeConfig.Host)
-			if err != nil {
-				return err
+				problemsCtx, cancelProblems := context.WithCancel(cmdCtx)
+				go reportPodProblems(problemsCtx, clientset, namespace, podListOptions, os.Stderr)
+				err = waitForServerImage(cmdCtx, clientset, namespace, podListOptions, tunnelServerContainer.Name, func(ctx context.Context) error {
+					return waitForResource(ctx, kubeCluster.GetCache(), kubeCluster.GetScheme(), deployment, func(obj interface{}) bool {
+						deploy, ok := obj.(*appsv1.Deployment)
+						return ok && deploy.Namespace == deployment.Namespace && deploy.Name == deployment.Name && deploy.Generation >= deployment.Generation && hasRolledOut(deploy)
+					}, rootParams.waitTimeout)
+				})
+				cancelProblems()
+				if err != nil {
+					return err
+				}
+			} else {
+				if netPolParams.create {
+					netPol, err := newTunnelNetworkPolicy(metav1.ObjectMeta{
+						Name:      deploymentName,
+						Namespace: namespace,
+					}, labelsMap, requestPort, controlPort, netPolParams)
+					if err != nil {
+						return err
+					}
+					addForwardedNetworkPolicyPorts(netPol, forwardedPorts)
+
+					desiredNetPol := netPol.DeepCopy()
+					if err := createOrUpdateManaged(cmdCtx, kubeClient, netPol, func() error {
+						setAnnotations(annotationsMap, netPol)
+						netPol.Spec = desiredNetPol.Spec
+						return nil
+					}); err != nil {
+						return errors.WrapIf(err, "failed to create network policy")
+					}
+					if err := printCreatedResource(output, netPol); err != nil {
+						return err
+					}
+
+					defer func() {
+						if err := deleteWithRetry(context.Background(), kubeClient, netPol); err != nil {
+							logger.Error(err, "failed to delete network policy")
+						}
+					}()
+				}
+
+				deployment := newTunnelServerDeployment(namespace, deploymentName, labelsMap, tunnelServerContainer, volumes)
+				if sshSidecar != nil {
+					podSpec := &deployment.Spec.Template.Spec
+					podSpec.Containers = append(podSpec.Containers, *sshSidecar)
+					podSpec.Volumes = append(podSpec.Volumes, sshVolume)
+				}
+				serverImage.apply(&deployment.Spec.Template.Spec, tunnelServerContainer.Name)
+				applyMeshToPodTemplate(mesh, &deployment.Spec.Template, controlPort.ContainerPort)
+				if err := patchPodTemplate(&deployment.Spec.Template, templatePatch); err != nil {
+					return err
+				}
+
+				desiredDeployment := deployment.DeepCopy()
+				if err := createOrUpdateManaged(cmdCtx, kubeClient, deployment, func() error {
+					if deployment.Spec.Selector == nil { // immutable
+						deployment.Spec.Selector = desiredDeployment.Spec.Selector
+					}
+					deployment.Spec.Template = desiredDeployment.Spec.Template
+					setAnnotations(annotationsMap, deployment)
+					return nil
+				}); err != nil {
+					return errors.WrapIf(err, "failed to create deployment")
+				}
+				if err := printCreatedResource(output, deployment); err != nil {
+					return err
+				}
+
+				defer func() {
+					if err := deleteWithRetry(context.Background(), kubeClient, deployment); err != nil {
+						logger.Error(err, "failed to delete deployment")
+					}
+				}()
+
+				problemsCtx, cancelProblems := context.WithCancel(cmdCtx)
+				go reportPodProblems(problemsCtx, clientset, namespace, podListOptions, os.Stderr)
+				err := waitForServerImage(cmdCtx, clientset, namespace, podListOptions, tunnelServerContainer.Name, func(ctx context.Context) error {
+					return waitForResource(ctx, kubeCluster.GetCache(), kubeCluster.GetScheme(), deployment, func(obj interface{}) bool {
+						deploy, ok := obj.(*appsv1.Deployment)
+						return ok && deploy.Namespace == deployment.Namespace && deploy.Name == deployment.Name && hasAvailable(deploy)
+					}, rootParams.waitTimeout)
+				})
+				cancelProblems()
+				if err != nil {
+					return err
+				}
 			}
-			if proxyURL.Scheme != "https" {
-				panic("API server URL not HTTPS")
+
+			if err := checkMeshSidecars(cmdCtx, clientset, namespace, podListOptions, mesh.mesh); err != nil {
+				logger.Error(err, "WARNING: requests of meshed clients may fail")
 			}
-			proxyURL.Scheme = "wss"
-			proxyURL.Path = fmt.Sprintf("/api/v1/namespaces/%s/services/https:%s:%d/proxy/", namespace, kurunService.Name, selectServicePort(kurunService, "control").Port)
 
-			proxyTLSCfg, err := rest.TLSConfigFor(kubeConfig)
+			stats, err := startTunnelClient(cmdCtx, cancelCmdCtx, kubeConfig, serviceTunnelTarget(kurunService), downstreamURL, clientParams, output, logger)
 			if err != nil {
 				return err
 			}
-			proxyTLSCfg.InsecureSkipVerify = true
 
-			baseTransport := &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true, // TODO: add flags for insecure and ca cert
-				},
+			forwardURL := fmt.Sprintf("%s://%s.%s.svc:%d", requestScheme, kurunService.Name, kurunService.Namespace, selectServicePort(kurunService, serviceRequestPort).Port)
+			snippets := newEndpointSnippets(cmdCtx, clientset, namespace, forwardURL, serverParams, logger)
+			if err := output.Result("Forwarding "+forwardURL+" -> "+downstreamURL.String(), forwardURL, forwardResult{
+				Type:      "forward",
+				URL:       forwardURL,
+				Service:   kurunService.Name,
+				Namespace: kurunService.Namespace,
+				Upstream:  downstreamURL.String(),
+				Curl:      snippets.curl,
+				CABundle:  snippets.caBundle,
+			}); err != nil {
+				return err
 			}
-			transport := tunnel.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
-				r.URL.Scheme = downstreamURL.Scheme
-				r.URL.Host = downstreamURL.Host
-				if downstreamURL.Path != "" {
-					r.URL.Path = path.Join(downstreamURL.Path, r.URL.Path)
+			snippets.print(output)
+			for _, port := range forwardedPorts {
+				portURL := fmt.Sprintf("%s://%s.%s.svc:%d", port.scheme(), kurunService.Name, kurunService.Namespace, port.servicePort)
+				if err := output.Result("Forwarding "+portURL+" -> "+port.downstream.String(), portURL, forwardResult{
+					Type:      "forward",
+					URL:       portURL,
+					Service:   kurunService.Name,
+					Namespace: kurunService.Namespace,
+					Upstream:  port.downstream.String(),
+				}); err != nil {
+					return err
 				}
-				return baseTransport.RoundTrip(r)
-			})
-
-			tunnelClientCfg := tunnelws.NewClientConfig(
-				proxyURL.String(),
-				transport,
-				tunnelws.WithLogger(logger),
-				tunnelws.WithDialerCtor(func() *websocket.Dialer {
-					return &websocket.Dialer{
-						TLSClientConfig: proxyTLSCfg.Clone(),
-					}
-				}),
-			)
-			go func() {
-				if err := tunnelws.RunClient(cmdCtx, *tunnelClientCfg); err != nil {
-					logger.Error(err, "tunnel client exited with error")
+			}
+			if writeEnv != "" {
+				if err := snippets.writeEnv(writeEnv); err != nil {
+					return err
 				}
-				cancelCmdCtx()
-			}()
-
-			fmt.Fprintf(os.Stdout, "Forwarding %s://%s.%s.svc:%d -> %s\n",
-				requestScheme, kurunService.Name, kurunService.Namespace, selectServicePort(kurunService, serviceRequestPort).Port,
-				downstreamURL.String())
+			}
 
 			<-cmdCtx.Done()
 
-			return nil
+			output.SessionSummary(stats.Summary())
+
+			return tunnelExitError(cmdCtx)
 		},
 	}
 
+	cmd.PersistentFlags().StringVar(&attach, "attach", "", "Connect to the kurun-server behind this existing service (e.g. deployed with Helm or GitOps) instead of creating any resources")
+	cmd.PersistentFlags().StringVar(&selector, "selector", "", "Connect to a Ready kurun-server pod of this label selector (e.g. app=kurun-server) instead of creating any resources, and to another one when it goes away")
+	addDryRunFlag(cmd, &dryRun)
+	addOutputFlags(cmd, &rootParams.outputParams)
+	addTunnelClientFlags(cmd, &clientParams)
+	addIPFamilyFlags(cmd, &ipFamilies)
+	addAnnotationFlag(cmd, &annotations)
+	addMeshFlags(cmd, &mesh)
+	cmd.PersistentFlags().StringVar(&exportDir, "export", "", "Write the kurun-server resources as a kustomization to this directory instead of creating them, e.g. to manage them with GitOps")
+	cmd.PersistentFlags().StringArrayVar(&exportWebhooks, "export-webhook", nil, "Webhook to point at the exported kurun-server service as validating|mutating/<configuration>/<webhook>, the patches are written as a kustomize component to the webhooks directory of --export (can be repeated)")
+	cmd.PersistentFlags().StringArrayVar(&forwardPorts, "forward-port", nil, "Additional service port forwarded to another local target as <service port>=<upstream>[,name=<port name>][,tlssecret=<secret>], e.g. 9443=localhost:9443,tlssecret=webhook-certs (can be repeated)")
+	cmd.PersistentFlags().BoolVar(&addServicePorts, "add-service-ports", false, "Add the --forward-port ports missing from an existing service for the session, they are removed on exit")
+	cmd.PersistentFlags().BoolVar(&noRestore, "no-restore", false, "Keep the changes of an existing service (e.g. the added control port) on exit instead of restoring its original ports")
+	cmd.PersistentFlags().BoolVar(&force, "force", false, "Take over the service from the port-forward session of another user holding its lease")
+	cmd.PersistentFlags().BoolVar(&join, "join", false, "Connect to the kurun-server of the port-forward session of another user holding the lease of the service instead of failing")
+	cmd.PersistentFlags().StringVar(&serveDir, "serve-dir", "", "Serve the files of this local directory through the tunnel instead of forwarding the requests to an upstream")
+	cmd.PersistentFlags().StringVar(&injectInto, "inject-into", "", "Inject kurun-server as a sidecar into the pod template of this deployment instead of creating a new one")
 	cmd.PersistentFlags().StringSliceVarP(&labels, "label", "l", []string{}, "Pod labels to add")
-	cmd.PersistentFlags().StringVar(&serverImage, "server-image", kurunServerImage, "kurun tunnel server image to use")
+	cmd.PersistentFlags().StringVar(&serverParams.image, "server-image", kurunServerImage, "kurun tunnel server image to use")
+	cmd.PersistentFlags().BoolVar(&loadImage, "load-server-image", false, "Load the server image from the local container engine into the nodes of local clusters (KinD and k3d), or push it to the registry of --server-image, for clusters without access to the default registry")
+	cmd.PersistentFlags().StringToStringVar(&serverRequests, "server-requests", defaultServerRequests(), "Resource requests of the kurun-server container")
+	cmd.PersistentFlags().StringToStringVar(&serverLimits, "server-limits", defaultServerLimits(), "Resource limits of the kurun-server container")
+	addTunnelServerSecurityFlags(cmd, &serverParams)
 	cmd.PersistentFlags().StringVar(&serviceName, "servicename", "kurun", "Service name to set for the service")
 	cmd.PersistentFlags().IntVar(&servicePort, "serviceport", 80, "Service port to set for the service")
-	cmd.PersistentFlags().StringVar(&tlsSecret, "tlssecret", "", "Use the certs for kurun-server")
+	cmd.PersistentFlags().StringVar(&serverParams.tlsSecret, "tlssecret", "", "Use the certs for kurun-server")
+	addRequestAuthFlag(cmd, &serverParams)
+	cmd.PersistentFlags().BoolVar(&netPolParams.create, "create-networkpolicy", false, "Create a NetworkPolicy restricting ingress to the kurun-server pod")
+	cmd.PersistentFlags().StringVar(&netPolParams.namespaceSelector, "networkpolicy-namespace-selector", "", "Label selector of namespaces allowed to send requests to the kurun-server pod (default: same namespace only)")
+	cmd.PersistentFlags().StringVar(&netPolParams.podSelector, "networkpolicy-pod-selector", "", "Label selector of pods allowed to send requests to the kurun-server pod")
+	cmd.PersistentFlags().StringSliceVar(&netPolParams.controlCIDRs, "networkpolicy-control-cidr", nil, "CIDRs allowed to reach the control port, e.g. the API server addresses (default: any)")
+	cmd.PersistentFlags().StringVar(&serverParams.splitFallback, "split-fallback", "", "In-cluster URL (e.g. http://myapp-stable:8080) receiving requests not selected for the tunnel")
+	cmd.PersistentFlags().StringSliceVar(&serverParams.splitHeaders, "split-header", nil, "Only forward requests with this header (name=value) to the local service, e.g. X-Kurun-Dev=alice")
+	cmd.PersistentFlags().IntVar(&serverParams.splitPercent, "split-percent", 0, "Percentage of requests to forward to the local service")
+	cmd.PersistentFlags().StringVar(&writeEnv, "write-env", "", "Write the in-cluster URL, a curl command and the webhook caBundle of the forwarded endpoint to this file as shell variables (KURUN_URL, KURUN_CURL and KURUN_CA_BUNDLE)")
+	cmd.PersistentFlags().StringVar(&podTemplatePatch, "pod-template-patch", "", "YAML file of a strategic merge patch applied to the pod template of the kurun-server deployment, e.g. with tolerations or a priority class")
+	cmd.PersistentFlags().StringVar(&offlineQueue, "offline-queue", "", "Size of the queue (e.g. 1Mi) of the POST requests kurun-server accepts while kurun is disconnected, they are sent through the tunnel once it reconnects")
 
 	return cmd
 }
 
-func waitForResource(ctx context.Context, kubeCache cache.Cache, scheme *runtime.Scheme, obj client.Object, filter func(interface{}) bool, timeout time.Duration) error {
-	done := make(chan struct{}, 1)
-	informer, err := kubeCache.GetInformer(ctx, obj)
+// parseDownstreamURL parses the local service to forward the requests to, either as host:port or as URL
+// A bare host (e.g. localhost or [::1]) is accepted too, the requests are sent to its default HTTP port then.
+func parseDownstreamURL(downstream string) (*url.URL, error) {
+	if !strings.Contains(downstream, "://") {
+		if _, _, err := net.SplitHostPort(downstream); err != nil && strings.Contains(downstream, ":") && !strings.HasSuffix(downstream, "]") {
+			if ip := net.ParseIP(downstream); ip != nil && ip.To4() == nil {
+				return nil, errors.Errorf("invalid downstream %q, IPv6 addresses must be enclosed in brackets, e.g. [::1]:8080", downstream)
+			}
+			return nil, errors.WrapIfWithDetails(err, "invalid downstream, expected host:port or URL", "downstream", downstream)
+		}
+		return &url.URL{
+			Scheme: "http",
+			Host:   downstream,
+		}, nil
+	}
+	downstreamURL, err := url.Parse(downstream)
+	return downstreamURL, errors.WithMessage(err, "failed to parse downstream URL")
+}
+
+// getAttachService returns the existing service of a pre-deployed kurun-server
+// Users allowed to proxy to services but not to read them get a service with the default control port.
+func getAttachService(ctx context.Context, kubeConfig *rest.Config, namespace, name string, controlPort corev1.ContainerPort, logger logr.Logger) (*corev1.Service, error) {
+	kubeClient, err := client.New(kubeConfig, client.Options{})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	informer.AddEventHandler(toolscache.FilteringResourceEventHandler{
-		FilterFunc: filter,
-		Handler: toolscache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				select {
-				case done <- struct{}{}:
-				default:
-				}
+
+	service := &corev1.Service{}
+	key := client.ObjectKey{Namespace: namespace, Name: name}
+	err = withRetry(func() error {
+		return kubeClient.Get(ctx, key, service)
+	})
+	switch {
+	case apierrors.IsForbidden(err):
+		logger.Info("not allowed to get service, assuming default control port", "service", key, "port", controlPort.ContainerPort)
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
 			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				select {
-				case done <- struct{}{}:
-				default:
-				}
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{
+					{
+						Name: controlPort.Name,
+						Port: controlPort.ContainerPort,
+					},
+				},
 			},
-		},
-	})
+		}, nil
+	case err != nil:
+		return nil, errors.WrapIfWithDetails(err, "failed to get kurun-server service", "service", key)
+	}
+
+	if selectServicePort(service, controlPort.Name) == nil {
+		return nil, errors.NewWithDetails("service has no control port, is it a kurun-server service?", "service", key, "port", controlPort.Name)
+	}
+	return service, nil
+}
 
-	select {
-	case <-done:
-		return nil
-	case <-time.After(timeout):
-		resourceType := "resource"
-		if gvk, err := apiutil.GVKForObject(obj, scheme); err == nil {
-			resourceType = strings.ToLower(gvk.Kind)
+// tunnelClientParams are the settings of the tunnel client connecting the kurun-server with the downstream
+type tunnelClientParams struct {
+	adaptivePing bool
+	controlAddr  string
+	dedupWindows []string
+	// downstreamCAs verify the certificates of HTTPS downstreams instead of the system roots if set
+	downstreamCAs       *x509.CertPool
+	duplicates          tunnel.DuplicateFilter
+	faultParams         faultParams
+	faults              tunnel.FaultInjection
+	grpc                grpcParams
+	grpcCredentials     grpcCredentials
+	healthCheckInterval time.Duration
+	healthCheckPath     string
+	healthzPath         string
+	idleTimeout         time.Duration
+	insecureAPIServer   bool
+	insecureDownstream  bool
+	maxFrameSize        int
+	pingInterval        time.Duration
+	routes              map[string]*url.URL
+	sessionGracePeriod  time.Duration
+	ssh                 sshParams
+	sshCredentials      *sshCredentials
+	standby             string
+	standbyURL          *url.URL
+	transport           string
+	// tunnelToken is read from the tunnelTokenFile
+	tunnelToken         string
+	tunnelTokenFile     string
+	webhookTimeoutCheck bool
+}
+
+func addTunnelClientFlags(cmd *cobra.Command, params *tunnelClientParams) {
+	cmd.PersistentFlags().BoolVar(&params.adaptivePing, "adaptive-ping", true, "Ping kurun-server more often when the connection is dropped after being idle, e.g. by a load balancer in front of the API server, starting from --ping-interval")
+	cmd.PersistentFlags().StringVar(&params.controlAddr, "control-addr", "", "Serve the local control endpoint on this loopback address (e.g. localhost:9091), PUT /downstream switches the downstream and the ones of the forwarded ports without restarting the tunnel")
+	cmd.PersistentFlags().StringSliceVar(&params.dedupWindows, "dedup-window", nil, "Drop the duplicates of the requests of a method received in a window (method=duration, e.g. POST=2m), e.g. retried webhook deliveries, they get the response of the original request")
+	cmd.PersistentFlags().StringVar(&params.healthCheckPath, "downstream-healthcheck", "", "Check the health of the downstream with GET requests of this path (e.g. /healthz), reported by --healthz-path and the readiness of kurun-server")
+	cmd.PersistentFlags().DurationVar(&params.healthCheckInterval, "downstream-healthcheck-interval", 10*time.Second, "Interval of the downstream health checks")
+	cmd.PersistentFlags().StringVar(&params.standby, "downstream-standby", "", "Send the requests to this downstream (host:port or URL) while the one checked by --downstream-healthcheck is unhealthy")
+	cmd.PersistentFlags().StringVar(&params.healthzPath, "healthz-path", "", "Answer the requests of this path (e.g. /healthz) by kurun instead of the downstream, so the callers can check the tunnel is up")
+	cmd.PersistentFlags().DurationVar(&params.idleTimeout, "idle-timeout", 0, "Reconnect the tunnel when nothing (including pongs) is received from kurun-server in this time, e.g. to detect connections dropped silently by VPNs, requires a shorter --ping-interval (0 means no timeout)")
+	cmd.PersistentFlags().BoolVar(&params.insecureAPIServer, "insecure-apiserver", false, "Skip verifying the API server certificate for the tunnel connection (insecure)")
+	cmd.PersistentFlags().BoolVar(&params.insecureDownstream, "insecure-downstream", false, "Skip verifying the certificate of HTTPS downstreams, e.g. local services with self-signed certificates (insecure)")
+	cmd.PersistentFlags().IntVar(&params.maxFrameSize, "max-frame-size", 0, "Split the messages sent through the tunnel into frames of at most this many bytes, e.g. for proxies limiting the WebSocket message size (0 means the default of 64KiB)")
+	cmd.PersistentFlags().DurationVar(&params.pingInterval, "ping-interval", 0, "Ping kurun-server when nothing was received from it in this interval, so NATs and firewalls don't drop the connection of an idle tunnel (0 disables pinging)")
+	cmd.PersistentFlags().DurationVar(&params.sessionGracePeriod, "session-grace-period", 0, "Keep handling the requests when the tunnel connection is lost, and send their responses when reconnected in this time, so brief network drops are invisible to the callers (0 fails them right away)")
+	cmd.PersistentFlags().StringVar(&params.transport, "transport", defaultTunnelTransport, "Transport of the tunnel to kurun-server: "+strings.Join(tunnelTransportNames(), ", "))
+	cmd.PersistentFlags().StringVar(&params.tunnelTokenFile, "tunnel-token-file", "", "File containing the token identifying the tunnel to a kurun-server serving several tunnels (kurun-server --tunnel-id token)")
+	cmd.PersistentFlags().BoolVar(&params.webhookTimeoutCheck, "webhook-timeout-check", true, "Warn when the downstream latency approaches the timeout of the admission webhooks calling the service")
+	addFaultFlags(cmd, &params.faultParams)
+	addGRPCFlags(cmd, &params.grpc)
+	addSSHFlags(cmd, &params.ssh)
+}
+
+// validateTunnelClientParams checks the flags of the tunnel client, and parses the faults to inject
+func validateTunnelClientParams(params *tunnelClientParams) error {
+	if !isTunnelTransport(params.transport) {
+		return errors.Errorf("unknown --transport %q, available transports: %s", params.transport, strings.Join(tunnelTransportNames(), ", "))
+	}
+	if params.transport == grpcTunnelTransport {
+		if err := validateGRPCParams(params.grpc); err != nil {
+			return err
 		}
-		return errors.Errorf("timeout waiting for %s", resourceType)
 	}
+	if params.healthzPath != "" && !strings.HasPrefix(params.healthzPath, "/") {
+		return errors.Errorf("--healthz-path must start with /, got %q", params.healthzPath)
+	}
+	if params.healthCheckPath != "" && !strings.HasPrefix(params.healthCheckPath, "/") {
+		return errors.Errorf("--downstream-healthcheck must start with /, got %q", params.healthCheckPath)
+	}
+	if params.healthCheckInterval <= 0 {
+		return errors.Errorf("--downstream-healthcheck-interval must be positive, got %s", params.healthCheckInterval)
+	}
+	if params.standby != "" {
+		if params.healthCheckPath == "" {
+			return errors.New("--downstream-standby requires --downstream-healthcheck, the requests are sent to the standby while the downstream is unhealthy")
+		}
+		standbyURL, err := parseDownstreamURL(params.standby)
+		if err != nil {
+			return errors.WrapIf(err, "invalid --downstream-standby")
+		}
+		params.standbyURL = standbyURL
+	}
+	if params.maxFrameSize < 0 {
+		return errors.Errorf("--max-frame-size must not be negative, got %d", params.maxFrameSize)
+	}
+	if params.pingInterval < 0 {
+		return errors.Errorf("--ping-interval must not be negative, got %s", params.pingInterval)
+	}
+	if params.idleTimeout < 0 {
+		return errors.Errorf("--idle-timeout must not be negative, got %s", params.idleTimeout)
+	}
+	if params.idleTimeout > 0 && (params.pingInterval <= 0 || params.pingInterval >= params.idleTimeout) {
+		return errors.New("--idle-timeout requires a shorter --ping-interval, so the connection of an idle tunnel is kept")
+	}
+	if params.sessionGracePeriod < 0 {
+		return errors.Errorf("--session-grace-period must not be negative, got %s", params.sessionGracePeriod)
+	}
+	if params.transport == sshTunnelTransport {
+		if err := validateSSHParams(params.ssh); err != nil {
+			return err
+		}
+	}
+	if params.tunnelTokenFile != "" && params.transport != defaultTunnelTransport {
+		return errors.Errorf("--tunnel-token-file requires --transport %s", defaultTunnelTransport)
+	}
+	if params.tunnelTokenFile != "" {
+		content, err := os.ReadFile(params.tunnelTokenFile)
+		if err != nil {
+			return errors.WrapIfWithDetails(err, "failed to read tunnel token", "path", params.tunnelTokenFile)
+		}
+		if params.tunnelToken = strings.TrimSpace(string(content)); params.tunnelToken == "" {
+			return errors.Errorf("--tunnel-token-file %s is empty", params.tunnelTokenFile)
+		}
+	}
+	faults, err := parseFaultParams(params.faultParams)
+	if err != nil {
+		return err
+	}
+	params.faults = faults
+	duplicates, err := parseDedupWindows(params.dedupWindows)
+	if err != nil {
+		return err
+	}
+	params.duplicates = duplicates
+	return nil
+}
+
+// parseDedupWindows returns the duplicate filter of the --dedup-window values
+func parseDedupWindows(values []string) (tunnel.DuplicateFilter, error) {
+	filter := tunnel.DuplicateFilter{Windows: map[string]time.Duration{}}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return filter, errors.Errorf("invalid --dedup-window value %q, expected method=duration, e.g. POST=2m", value)
+		}
+		window, err := time.ParseDuration(parts[1])
+		if err != nil || window <= 0 {
+			return filter, errors.Errorf("invalid --dedup-window value %q, expected a positive duration, e.g. POST=2m", value)
+		}
+		filter.Windows[strings.ToUpper(parts[0])] = window
+	}
+	return filter, nil
+}
+
+// adaptivePingMinInterval is the shortest ping interval of --adaptive-ping, the connections dropped after being idle
+// for less than twice as long are reported instead, the path to kurun-server is not suitable for a tunnel
+const adaptivePingMinInterval = 5 * time.Second
+
+// defaultTunnelTransport is the built-in transport of the tunnel, WebSocket through the API server proxy
+const defaultTunnelTransport = "websocket"
+
+// tunnelTransportNames returns the built-in and the registered tunnel transports
+func tunnelTransportNames() []string {
+	return append([]string{defaultTunnelTransport, grpcTunnelTransport, sshTunnelTransport}, extension.TunnelTransportNames()...)
+}
+
+func isTunnelTransport(name string) bool {
+	for _, transport := range tunnelTransportNames() {
+		if name == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnelTarget is the kurun-server the tunnel client connects to through the API server proxy
+type tunnelTarget struct {
+	namespace string
+	// resources is the resource type of the target, pods or services
+	resources string
+	name      string
+	// port is the name or the number of the control port of kurun-server
+	port string
+	// selector selects the kurun-server pods instead of the name, see podSelectorResolver
+	selector string
+	// service is the service of kurun-server, nil if the target is a pod
+	service *corev1.Service
+}
+
+// serviceTunnelTarget returns the target of the control port of the kurun-server behind the service
+func serviceTunnelTarget(service *corev1.Service) tunnelTarget {
+	return tunnelTarget{
+		namespace: service.Namespace,
+		resources: "services",
+		name:      service.Name,
+		port:      strconv.Itoa(int(selectServicePort(service, "control").Port)),
+		service:   service,
+	}
+}
+
+// startTunnelClient connects the tunnel client to the target kurun-server through the API server proxy
+// and forwards the requests to the downstream URL in the background. The context is cancelled when the client exits,
+// with the error of the client as cause, see tunnelExitError.
+// The returned stats collect the requests relayed by the client, the connection events are printed to the output.
+func startTunnelClient(ctx context.Context, cancel context.CancelCauseFunc, kubeConfig *rest.Config, target tunnelTarget, downstreamURL *url.URL, params tunnelClientParams, output *outputPrinter, logger logr.Logger) (*tunnel.Stats, error) {
+	proxyURL, err := url.Parse(kubeConfig.Host)
+	if err != nil {
+		return nil, errors.WrapIf(err, "failed to parse API server URL")
+	}
+	if proxyURL.Scheme != "https" {
+		return nil, errors.Errorf("the API server URL %s is not HTTPS, the tunnel connects through its proxy with TLS", kubeConfig.Host)
+	}
+	proxyURL.Scheme = "wss"
+	proxyURLOf := func(name, port string) string {
+		targetURL := *proxyURL
+		targetURL.Path = fmt.Sprintf("/api/v1/namespaces/%s/%s/https:%s:%s/proxy/", target.namespace, target.resources, name, port)
+		return targetURL.String()
+	}
+	// the options of nil are ignored
+	var adaptivePing tunnelws.ClientConfigOption
+	if params.adaptivePing {
+		adaptivePing = tunnelws.WithAdaptivePing(adaptivePingMinInterval, 0)
+	}
+	var tunnelToken tunnelws.ClientConfigOption
+	if params.tunnelToken != "" {
+		tunnelToken = tunnelws.WithTunnelToken(params.tunnelToken)
+	}
+	var serverAddrResolver tunnelws.ClientConfigOption
+	if target.selector != "" {
+		clientset, err := kubernetes.NewForConfig(kubeConfig)
+		if err != nil {
+			return nil, err
+		}
+		resolver := &podSelectorResolver{
+			clientset: clientset,
+			logger:    logger,
+			namespace: target.namespace,
+			port:      target.port,
+			selector:  target.selector,
+		}
+		serverAddrResolver = tunnelws.WithServerAddrResolver(func(ctx context.Context) (string, error) {
+			name, port, err := resolver.Resolve(ctx)
+			if err != nil {
+				return "", err
+			}
+			return proxyURLOf(name, port), nil
+		})
+	} else {
+		logger.V(1).Info("connecting to kurun-server through the API server proxy", "url", proxyURLOf(target.name, target.port))
+	}
+
+	// the API server is verified with the CA of the client configuration, like any other request of kurun
+	proxyTLSCfg, err := rest.TLSConfigFor(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	if params.insecureAPIServer {
+		logger.Info("WARNING: the API server certificate is not verified for the tunnel connection, requests and credentials may be intercepted")
+		if proxyTLSCfg == nil {
+			proxyTLSCfg = &tls.Config{}
+		}
+		proxyTLSCfg.InsecureSkipVerify = true
+	}
+
+	baseTransport := http.DefaultTransport.(*http.Transport).Clone()
+	if params.insecureDownstream {
+		if downstreamURL.Scheme == "https" {
+			logger.Info("WARNING: the downstream certificate is not verified, forwarded requests may be intercepted", "downstream", downstreamURL.String())
+		}
+		baseTransport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	} else if params.downstreamCAs != nil {
+		baseTransport.TLSClientConfig = &tls.Config{
+			RootCAs: params.downstreamCAs,
+		}
+	}
+	downstreamTransport := func(downstreamURL *url.URL) http.RoundTripper {
+		if downstreamURL.Scheme == serveDirScheme {
+			return serveDirRoundTripper(downstreamURL, logger)
+		}
+		return tunnel.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			r.URL.Scheme = downstreamURL.Scheme
+			r.URL.Host = downstreamURL.Host
+			if downstreamURL.Path != "" {
+				r.URL.Path = path.Join(downstreamURL.Path, r.URL.Path)
+			}
+			return baseTransport.RoundTrip(r)
+		})
+	}
+	// the downstreams can be switched through the control endpoint
+	downstream := newSwitchableDownstream(downstreamURL, downstreamTransport)
+	control := &downstreamControl{
+		downstream: downstream,
+		logger:     logger,
+		routes:     make(map[string]*switchableDownstream, len(params.routes)),
+	}
+	for route, routeURL := range params.routes {
+		control.routes[route] = newSwitchableDownstream(routeURL, downstreamTransport)
+	}
+	if params.controlAddr != "" {
+		if err := serveDownstreamControl(ctx, params.controlAddr, control); err != nil {
+			return nil, err
+		}
+	}
+
+	var transport http.RoundTripper = downstream
+	var healthChecker *tunnel.DownstreamHealthChecker
+	if params.healthCheckPath != "" {
+		healthCheck := tunnel.DownstreamHealthCheck{
+			Interval: params.healthCheckInterval,
+			Path:     params.healthCheckPath,
+		}
+		if params.standbyURL != nil {
+			healthCheck.Standby = downstreamTransport(params.standbyURL)
+		}
+		healthChecker = tunnel.NewDownstreamHealthChecker(healthCheck, transport)
+		transport = healthChecker
+		go healthChecker.Run(ctx)
+		go watchDownstreamHealth(ctx, healthChecker, logger)
+	}
+	if len(control.routes) > 0 {
+		routes := make(map[string]http.RoundTripper, len(control.routes))
+		for route, routeDownstream := range control.routes {
+			routes[route] = routeDownstream
+		}
+		transport = tunnel.NewRouteRoundTripper(transport, routes)
+	}
+
+	if params.faults.Enabled() {
+		logger.Info("WARNING: injecting faults into the forwarded requests", "latency", params.faults.Latency, "errorRate", params.faults.ErrorRate, "bytesPerSecond", params.faults.BytesPerSecond)
+		transport = params.faults.RoundTripper(transport)
+	}
+
+	// on top of the faults, so the injected latency is checked too
+	if params.webhookTimeoutCheck && target.service != nil {
+		if clientset, err := kubernetes.NewForConfig(kubeConfig); err != nil {
+			logger.V(1).Info("cannot check admission webhooks", "error", err.Error())
+		} else if timeout, webhooks, err := findWebhookTimeout(ctx, clientset, target.service); err != nil {
+			logger.V(1).Info("cannot check admission webhooks", "error", err.Error())
+		} else if timeout > 0 {
+			logger.Info("admission webhooks call the service, watching the downstream latency", "webhooks", webhooks, "timeout", timeout)
+			transport = &webhookLatencyWatcher{logger: logger, next: transport, timeout: timeout, webhooks: webhooks}
+		}
+	}
+
+	// on top of the faults too, so the duplicates don't get faults of their own
+	if params.duplicates.Enabled() {
+		logger.V(1).Info("dropping duplicate requests", "windows", params.duplicates.Windows)
+		transport = params.duplicates.RoundTripper(transport)
+	}
+
+	// the stats are collected on top of the faults, so they show what the callers experienced
+	stats := tunnel.NewStats()
+	roundTripper := stats.RoundTripper(transport)
+	if params.healthzPath != "" {
+		// answered by kurun, so the callers can check the tunnel without reaching the downstream
+		router := tunnel.NewRouter(roundTripper)
+		router.HandleFunc(params.healthzPath, func(w http.ResponseWriter, r *http.Request) {
+			if healthChecker == nil {
+				_, _ = io.WriteString(w, "ok\n")
+				return
+			}
+			// the health of the downstream is reported too, the status code tells whether it can serve requests
+			health := healthChecker.Health()
+			switch {
+			case !health.Healthy():
+				http.Error(w, "downstream unhealthy: "+health.Error, http.StatusServiceUnavailable)
+			case health.Standby:
+				_, _ = io.WriteString(w, "ok, standby downstream\n")
+			default:
+				_, _ = io.WriteString(w, "ok\n")
+			}
+		})
+		roundTripper = router
+	}
+	tunnelClientCfg := tunnelws.NewClientConfig(
+		proxyURLOf(target.name, target.port),
+		roundTripper,
+		tunnelws.WithLogger(logger),
+		tunnelws.WithMaxFrameSize(params.maxFrameSize),
+		tunnelws.WithPingInterval(params.pingInterval),
+		adaptivePing,
+		tunnelws.WithIdleTimeout(params.idleTimeout),
+		tunnelws.WithSessionGracePeriod(params.sessionGracePeriod),
+		tunnelws.WithDownstreamHealth(healthChecker),
+		tunnelws.WithReconnect(time.Second, 30*time.Second),
+		tunnelws.WithConnectionEventHandler(output.ConnectionEvent),
+		tunnelws.WithDialerCtor(func() *websocket.Dialer {
+			stats.RecordConnection()
+			return &websocket.Dialer{
+				TLSClientConfig: proxyTLSCfg.Clone(),
+			}
+		}),
+		serverAddrResolver,
+		tunnelToken,
+	)
+	if params.transport == grpcTunnelTransport {
+		go func() {
+			err := runGRPCTunnelClient(ctx, params.grpc, params.grpcCredentials, params.maxFrameSize, roundTripper, stats, output.ConnectionEvent, logger)
+			cancel(errors.WrapIfWithDetails(err, "tunnel client exited with error", "transport", params.transport))
+		}()
+		return stats, nil
+	}
+	if params.transport == sshTunnelTransport {
+		if params.ssh.target == "" {
+			if params.ssh.target, err = defaultSSHTarget(target); err != nil {
+				return nil, err
+			}
+		}
+		go func() {
+			err := runSSHTunnelClient(ctx, params.ssh, params.sshCredentials, params.maxFrameSize, roundTripper, stats, output.ConnectionEvent, logger)
+			cancel(errors.WrapIfWithDetails(err, "tunnel client exited with error", "transport", params.transport))
+		}()
+		return stats, nil
+	}
+	if params.transport != defaultTunnelTransport {
+		extensionTransport, _ := extension.LookupTunnelTransport(params.transport)
+		req := extension.TunnelClientRequest{
+			KubeConfig:   kubeConfig,
+			Logger:       logger,
+			RoundTripper: roundTripper,
+			Service:      target.service,
+		}
+		go func() {
+			err := extensionTransport.RunClient(ctx, req)
+			cancel(errors.WrapIfWithDetails(err, "tunnel client exited with error", "transport", params.transport))
+		}()
+		return stats, nil
+	}
+
+	go func() {
+		err := tunnelws.RunClient(ctx, *tunnelClientCfg)
+		cancel(tunnelClientError(errors.WrapIf(err, "tunnel client exited with error")))
+	}()
+
+	return stats, nil
+}
+
+// watchDownstreamHealth logs the changes of the downstream health until the context is cancelled
+func watchDownstreamHealth(ctx context.Context, checker *tunnel.DownstreamHealthChecker, logger logr.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-checker.Changed():
+		}
+		switch health := checker.Health(); {
+		case !health.Healthy():
+			logger.Info("WARNING: the downstream is unhealthy", "error", health.Error)
+		case health.Standby:
+			logger.Info("WARNING: the downstream is unhealthy, sending the requests to the standby downstream", "error", health.Error)
+		default:
+			logger.Info("the downstream is healthy again")
+		}
+	}
+}
+
+// tunnelExitError returns the error the tunnel client has exited with, nil if the context was cancelled otherwise,
+// e.g. by Ctrl+C
+func tunnelExitError(ctx context.Context) error {
+	if err := context.Cause(ctx); !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// printCreatedResource prints a kurun-server resource created by port-forward as a result in JSON mode, they aren't
+// printed otherwise
+func printCreatedResource(output *outputPrinter, obj client.Object) error {
+	result, err := newResourceResult(obj)
+	if err != nil {
+		return err
+	}
+	return output.Result("", "", result)
+}
+
+// formatSessionSummary formats the statistics of the requests relayed in the session as a status line
+func formatSessionSummary(summary tunnel.StatsSummary) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Session summary: %d requests relayed (%d failed, %d client errors, %d server errors)", summary.Requests, summary.Errors, summary.ClientErrors, summary.ServerErrors)
+	if summary.Requests > summary.Errors {
+		fmt.Fprintf(&b, ", latency p50 %s p95 %s p99 %s", summary.LatencyP50.Round(time.Millisecond), summary.LatencyP95.Round(time.Millisecond), summary.LatencyP99.Round(time.Millisecond))
+	}
+	fmt.Fprintf(&b, ", %s up, %s down, %d reconnects", formatBytes(summary.BytesUp), formatBytes(summary.BytesDown), summary.Reconnects)
+	return b.String()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 func hasAvailable(deployment *appsv1.Deployment) bool {
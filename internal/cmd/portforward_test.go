@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/banzaicloud/kurun/extension"
+)
+
+// testTunnelTransport relays a request to the downstream and reports the tunnel it was run with
+type testTunnelTransport struct {
+	requests chan<- extension.TunnelClientRequest
+}
+
+func (t testTunnelTransport) RunClient(ctx context.Context, req extension.TunnelClientRequest) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://kurun-server/path", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := req.RoundTripper.RoundTrip(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	t.requests <- req
+	return nil
+}
+
+func TestExtensionTunnelTransport(t *testing.T) {
+	requests := make(chan extension.TunnelClientRequest, 1)
+	extension.RegisterTunnelTransport("test-transport", testTunnelTransport{requests: requests})
+
+	require.Subset(t, tunnelTransportNames(), []string{defaultTunnelTransport, grpcTunnelTransport, sshTunnelTransport, "test-transport"})
+	err := validateTunnelClientParams(&tunnelClientParams{transport: "unknown", healthCheckInterval: time.Second})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "test-transport")
+
+	params := tunnelClientParams{transport: "test-transport", healthCheckInterval: time.Second}
+	require.NoError(t, validateTunnelClientParams(&params))
+
+	var downstreamPath string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downstreamPath = r.URL.Path
+	}))
+	defer downstream.Close()
+	downstreamURL, err := url.Parse(downstream.URL)
+	require.NoError(t, err)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kurun"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "control", Port: 8333}},
+		},
+	}
+	output, err := newOutputPrinter(outputParams{quiet: true})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	// the selected transport runs the client instead of connecting to the API server
+	_, err = startTunnelClient(ctx, cancel, &rest.Config{Host: "https://127.0.0.1:1"}, serviceTunnelTarget(service), downstreamURL, params, output, logr.Discard())
+	require.NoError(t, err)
+
+	select {
+	case req := <-requests:
+		require.Equal(t, service, req.Service)
+		require.Equal(t, "/path", downstreamPath)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the registered transport was not run")
+	}
+	select {
+	case <-ctx.Done():
+		require.NoError(t, tunnelExitError(ctx))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the context was not cancelled when the transport exited")
+	}
+}
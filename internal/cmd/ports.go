@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// firstForwardedContainerPort is the container port of the first additional request server of kurun-server, the
+// following ones listen on the next ports
+const firstForwardedContainerPort = 8445
+
+// forwardedPort is an additional port of the kurun-server service, its requests are forwarded to another local target
+// through the tunnel, routed by the name of the port
+type forwardedPort struct {
+	name          string
+	servicePort   int32
+	containerPort int32
+	downstream    *url.URL
+	// tlsSecret is the secret of the certificate served on the port, plain HTTP is served without it
+	tlsSecret string
+}
+
+// parseForwardedPorts parses the values of the --forward-port flags: <service port>=<upstream> with the optional
+// name=<name> and tlssecret=<secret> settings, e.g. 9443=localhost:9443,tlssecret=webhook-certs
+func parseForwardedPorts(values []string) ([]forwardedPort, error) {
+	ports := make([]forwardedPort, 0, len(values))
+	names := map[string]bool{"request": true, "control": true}
+	servicePorts := map[int32]bool{}
+	for i, value := range values {
+		fields := strings.Split(value, ",")
+		parts := strings.SplitN(fields[0], "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid --forward-port value %q, expected <service port>=<upstream>", value)
+		}
+		servicePort, err := strconv.ParseInt(parts[0], 10, 32)
+		if err != nil || servicePort <= 0 || servicePort > 65535 {
+			return nil, errors.Errorf("invalid --forward-port value %q, the service port must be between 1 and 65535", value)
+		}
+		downstream, err := parseDownstreamURL(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		port := forwardedPort{
+			name:          fmt.Sprintf("port-%d", servicePort),
+			servicePort:   int32(servicePort),
+			containerPort: firstForwardedContainerPort + int32(i),
+			downstream:    downstream,
+		}
+		for _, field := range fields[1:] {
+			setting := strings.SplitN(field, "=", 2)
+			if len(setting) != 2 {
+				return nil, errors.Errorf("invalid --forward-port setting %q, expected key=value", field)
+			}
+			switch setting[0] {
+			case "name":
+				port.name = setting[1]
+			case "tlssecret":
+				port.tlsSecret = setting[1]
+			default:
+				return nil, errors.Errorf("unknown --forward-port setting %q, expected name or tlssecret", setting[0])
+			}
+		}
+
+		// the name is used for the container port too
+		if msgs := validation.IsValidPortName(port.name); len(msgs) > 0 {
+			return nil, errors.Errorf("invalid --forward-port name %q: %s", port.name, strings.Join(msgs, ", "))
+		}
+		if names[port.name] {
+			return nil, errors.Errorf("--forward-port name %q is already used", port.name)
+		}
+		if servicePorts[port.servicePort] {
+			return nil, errors.Errorf("--forward-port service port %d is already used", port.servicePort)
+		}
+		names[port.name] = true
+		servicePorts[port.servicePort] = true
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// scheme returns the scheme of the requests of the port
+func (p forwardedPort) scheme() string {
+	if p.tlsSecret != "" {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardedPortRoutes returns the downstreams of the tunnel client by the routes of the ports
+func forwardedPortRoutes(ports []forwardedPort) map[string]*url.URL {
+	routes := make(map[string]*url.URL, len(ports))
+	for _, port := range ports {
+		routes[port.name] = port.downstream
+	}
+	return routes
+}
+
+// addForwardedServicePorts adds the forwarded ports to the kurun-server service, targeting the container ports of the
+// same name
+func addForwardedServicePorts(service *corev1.Service, ports []forwardedPort) {
+	for _, port := range ports {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Name:       port.name,
+			Port:       port.servicePort,
+			TargetPort: intstr.FromString(port.name),
+		})
+	}
+}
+
+// addForwardedNetworkPolicyPorts allows the forwarded ports from the peers allowed to send requests to kurun-server
+func addForwardedNetworkPolicyPorts(netPol *networkingv1.NetworkPolicy, ports []forwardedPort) {
+	tcp := corev1.ProtocolTCP
+	for _, port := range ports {
+		portValue := intstr.FromInt(int(port.containerPort))
+		netPol.Spec.Ingress[0].Ports = append(netPol.Spec.Ingress[0].Ports, networkingv1.NetworkPolicyPort{
+			Protocol: &tcp,
+			Port:     &portValue,
+		})
+	}
+}
+
+// addForwardedContainerPorts adds a request server of kurun-server for each port, with the volumes of their
+// certificates
+func addForwardedContainerPorts(container *corev1.Container, volumes []corev1.Volume, ports []forwardedPort) []corev1.Volume {
+	for _, port := range ports {
+		container.Ports = append(container.Ports, corev1.ContainerPort{
+			Name:          port.name,
+			ContainerPort: port.containerPort,
+		})
+		route := fmt.Sprintf("name=%s,addr=:%d", port.name, port.containerPort)
+		if port.tlsSecret != "" {
+			volumeName := tlsVolumeNamePrefix + port.name
+			mountPath := "/etc/tls-" + port.name
+			route += fmt.Sprintf(",cert=%s/tls.crt,key=%s/tls.key", mountPath, mountPath)
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      volumeName,
+				MountPath: mountPath,
+				ReadOnly:  true,
+			})
+			volumes = append(volumes, corev1.Volume{
+				Name: volumeName,
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: port.tlsSecret,
+					},
+				},
+			})
+		}
+		container.Args = append(container.Args, "--req-srv-route", route)
+	}
+	return volumes
+}
+
+// reconcileServicePorts maps the ports of an existing service to the request servers of kurun-server: the request
+// port to the default one, and the forwarded ports to their own, matched by the service port
+// The forwarded ports are changed to listen on the targets of the service ports, and the ports of the service not
+// mapped to any request server are reported, as their requests fail. The forwarded ports missing from the service are
+// returned.
+func reconcileServicePorts(service *corev1.Service, requestPortName string, forwardedPorts []forwardedPort, logger logr.Logger) []forwardedPort {
+	var missing []forwardedPort
+	mapped := map[string]bool{requestPortName: true, "control": true}
+	for i := range forwardedPorts {
+		port := &forwardedPorts[i]
+		servicePort := findServicePort(service, port.servicePort)
+		if servicePort == nil {
+			missing = append(missing, *port)
+			continue
+		}
+		mapped[servicePort.Name] = true
+		switch {
+		case servicePort.TargetPort.Type == intstr.String && servicePort.TargetPort.StrVal != "":
+			// the route is named after the container port, like the request servers of the generated services
+			port.name = servicePort.TargetPort.StrVal
+		case servicePort.TargetPort.IntVal != 0:
+			port.containerPort = servicePort.TargetPort.IntVal
+		default:
+			port.containerPort = servicePort.Port
+		}
+	}
+
+	for _, servicePort := range service.Spec.Ports {
+		if !mapped[servicePort.Name] {
+			logger.Info("WARNING: service port is not forwarded, add it with --forward-port", "service", client.ObjectKeyFromObject(service), "port", servicePort.Port, "name", servicePort.Name)
+		}
+	}
+	return missing
+}
+
+func findServicePort(service *corev1.Service, port int32) *corev1.ServicePort {
+	for i := range service.Spec.Ports {
+		if service.Spec.Ports[i].Port == port {
+			return &service.Spec.Ports[i]
+		}
+	}
+	return nil
+}
+
+// restoreServiceTimeout is the timeout of restoring the service after the session, when the context of the command is
+// already cancelled
+const restoreServiceTimeout = 30 * time.Second
+
+// restoreService removes the ports added to the service for the session
+// It uses a direct client, as the cache of the session stops with the command, and only changes the added ports, the
+// rest of the service may have been changed by others since.
+func restoreService(kubeConfig *rest.Config, key client.ObjectKey, addedPorts []corev1.ServicePort) error {
+	kubeClient, err := client.New(kubeConfig, client.Options{})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), restoreServiceTimeout)
+	defer cancel()
+	return removeServicePorts(ctx, kubeClient, key, addedPorts)
+}
+
+// removeServicePorts removes the ports from the service, matched by their name and port
+func removeServicePorts(ctx context.Context, kubeClient client.Client, key client.ObjectKey, ports []corev1.ServicePort) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		service := &corev1.Service{}
+		if err := kubeClient.Get(ctx, key, service); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		servicePorts := make([]corev1.ServicePort, 0, len(service.Spec.Ports))
+		for _, servicePort := range service.Spec.Ports {
+			if !containsServicePort(ports, servicePort) {
+				servicePorts = append(servicePorts, servicePort)
+			}
+		}
+		if len(servicePorts) == len(service.Spec.Ports) {
+			return nil
+		}
+		service.Spec.Ports = servicePorts
+		return kubeClient.Update(ctx, service)
+	})
+}
+
+func containsServicePort(ports []corev1.ServicePort, port corev1.ServicePort) bool {
+	for _, p := range ports {
+		if p.Name == port.Name && p.Port == port.Port {
+			return true
+		}
+	}
+	return false
+}
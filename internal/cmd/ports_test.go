@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestParseForwardedPorts(t *testing.T) {
+	testCases := map[string]struct {
+		values []string
+		ports  []forwardedPort
+		err    string
+	}{
+		"no ports": {
+			ports: []forwardedPort{},
+		},
+		"host and port": {
+			values: []string{"9090=localhost:9090"},
+			ports: []forwardedPort{
+				{name: "port-9090", servicePort: 9090, containerPort: 8445, downstream: &url.URL{Scheme: "http", Host: "localhost:9090"}},
+			},
+		},
+		"URL": {
+			values: []string{"443=https://localhost:9443/webhooks"},
+			ports: []forwardedPort{
+				{name: "port-443", servicePort: 443, containerPort: 8445, downstream: &url.URL{Scheme: "https", Host: "localhost:9443", Path: "/webhooks"}},
+			},
+		},
+		"name and TLS secret": {
+			values: []string{"9443=localhost:9443,name=webhook,tlssecret=webhook-certs"},
+			ports: []forwardedPort{
+				{name: "webhook", servicePort: 9443, containerPort: 8445, downstream: &url.URL{Scheme: "http", Host: "localhost:9443"}, tlsSecret: "webhook-certs"},
+			},
+		},
+		"multiple ports": {
+			values: []string{"1=localhost:8080", "65535=[::1]:8081,name=metrics"},
+			ports: []forwardedPort{
+				{name: "port-1", servicePort: 1, containerPort: 8445, downstream: &url.URL{Scheme: "http", Host: "localhost:8080"}},
+				{name: "metrics", servicePort: 65535, containerPort: 8446, downstream: &url.URL{Scheme: "http", Host: "[::1]:8081"}},
+			},
+		},
+		"duplicate name": {
+			values: []string{"8080=localhost:8080,name=web", "8081=localhost:8081,name=web"},
+			err:    `--forward-port name "web" is already used`,
+		},
+		"name of the request port": {
+			values: []string{"8080=localhost:8080,name=request"},
+			err:    `--forward-port name "request" is already used`,
+		},
+		"name of the control port": {
+			values: []string{"8080=localhost:8080,name=control"},
+			err:    `--forward-port name "control" is already used`,
+		},
+		"duplicate service port": {
+			values: []string{"8080=localhost:8080", "8080=localhost:8081,name=other"},
+			err:    "--forward-port service port 8080 is already used",
+		},
+		"service port 0": {
+			values: []string{"0=localhost:8080"},
+			err:    "the service port must be between 1 and 65535",
+		},
+		"service port over 65535": {
+			values: []string{"65536=localhost:8080"},
+			err:    "the service port must be between 1 and 65535",
+		},
+		"negative service port": {
+			values: []string{"-1=localhost:8080"},
+			err:    "the service port must be between 1 and 65535",
+		},
+		"non-numeric service port": {
+			values: []string{"http=localhost:8080"},
+			err:    "the service port must be between 1 and 65535",
+		},
+		"no upstream": {
+			values: []string{"8080"},
+			err:    "expected <service port>=<upstream>",
+		},
+		"local:remote": {
+			values: []string{"8080:9090"},
+			err:    "expected <service port>=<upstream>",
+		},
+		"invalid upstream": {
+			values: []string{"8080=localhost:8080:8081"},
+			err:    "invalid downstream, expected host:port or URL",
+		},
+		"unbracketed IPv6 upstream": {
+			values: []string{"8080=::1"},
+			err:    "IPv6 addresses must be enclosed in brackets",
+		},
+		"setting without value": {
+			values: []string{"8080=localhost:8080,name"},
+			err:    `invalid --forward-port setting "name", expected key=value`,
+		},
+		"unknown setting": {
+			values: []string{"8080=localhost:8080,path=/"},
+			err:    `unknown --forward-port setting "path"`,
+		},
+		"invalid name": {
+			values: []string{"8080=localhost:8080,name=Web_Port"},
+			err:    `invalid --forward-port name "Web_Port"`,
+		},
+		"name over 15 characters": {
+			values: []string{"8080=localhost:8080,name=a-very-long-port-name"},
+			err:    `invalid --forward-port name "a-very-long-port-name"`,
+		},
+	}
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			ports, err := parseForwardedPorts(testCase.values)
+			if testCase.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), testCase.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testCase.ports, ports)
+		})
+	}
+}
+
+func TestRemoveServicePorts(t *testing.T) {
+	appPort := corev1.ServicePort{Name: "http", Port: 80}
+	controlPort := corev1.ServicePort{Name: "control", Port: 8333}
+	forwardedPort := corev1.ServicePort{Name: "port-9443", Port: 9443}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec: corev1.ServiceSpec{
+			Ports:    []corev1.ServicePort{appPort, controlPort, forwardedPort},
+			Selector: map[string]string{"app": "app"},
+		},
+	}
+	kubeClient := fake.NewClientBuilder().WithObjects(service).Build()
+	key := client.ObjectKeyFromObject(service)
+	ctx := context.Background()
+
+	// the service is changed by someone else during the session
+	changed := &corev1.Service{}
+	require.NoError(t, kubeClient.Get(ctx, key, changed))
+	changed.Spec.Selector = map[string]string{"app": "app", "version": "v2"}
+	changed.Spec.Ports = append(changed.Spec.Ports, corev1.ServicePort{Name: "metrics", Port: 9090})
+	require.NoError(t, kubeClient.Update(ctx, changed))
+
+	require.NoError(t, removeServicePorts(ctx, kubeClient, key, []corev1.ServicePort{controlPort, forwardedPort}))
+
+	restored := &corev1.Service{}
+	require.NoError(t, kubeClient.Get(ctx, key, restored))
+	require.Equal(t, []corev1.ServicePort{appPort, {Name: "metrics", Port: 9090}}, restored.Spec.Ports)
+	require.Equal(t, changed.Spec.Selector, restored.Spec.Selector)
+
+	// restoring again, or a deleted service, is a no-op
+	require.NoError(t, removeServicePorts(ctx, kubeClient, key, []corev1.ServicePort{controlPort, forwardedPort}))
+	require.NoError(t, kubeClient.Delete(ctx, restored))
+	require.NoError(t, removeServicePorts(ctx, kubeClient, key, []corev1.ServicePort{controlPort}))
+}
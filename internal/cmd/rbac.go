@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// resourcePermission is a permission kurun needs in the namespace of its resources
+type resourcePermission struct {
+	verb        string
+	group       string
+	resource    string
+	subresource string
+}
+
+// String returns the permission the way kubectl auth can-i takes it, e.g. create deployments.apps
+func (p resourcePermission) String() string {
+	resource := p.resource
+	if p.group != "" {
+		resource += "." + p.group
+	}
+	if p.subresource != "" {
+		resource += "/" + p.subresource
+	}
+	return p.verb + " " + resource
+}
+
+// permissions needed by the commands in the namespace of their resources
+var (
+	runPermissions = []resourcePermission{
+		{verb: "create", resource: "pods"},
+		{verb: "get", resource: "pods"},
+		{verb: "watch", resource: "pods"},
+		{verb: "delete", resource: "pods"},
+		{verb: "create", resource: "pods", subresource: "attach"},
+		{verb: "get", resource: "pods", subresource: "log"},
+	}
+	// binaryOnlyPermissions are needed to stream the binary into the runner pod with --binary-only
+	binaryOnlyPermissions = []resourcePermission{
+		{verb: "create", resource: "pods", subresource: "exec"},
+	}
+	// scheduledRunPermissions are needed to run the binary on a schedule with --schedule
+	scheduledRunPermissions = []resourcePermission{
+		{verb: "create", group: "batch", resource: "cronjobs"},
+		{verb: "delete", group: "batch", resource: "cronjobs"},
+		{verb: "list", group: "batch", resource: "jobs"},
+		{verb: "list", resource: "pods"},
+		{verb: "get", resource: "pods", subresource: "log"},
+	}
+	// jobRunPermissions are needed to run the binary in a Job with --job
+	jobRunPermissions = []resourcePermission{
+		{verb: "create", group: "batch", resource: "jobs"},
+		{verb: "get", group: "batch", resource: "jobs"},
+		{verb: "delete", group: "batch", resource: "jobs"},
+		{verb: "list", resource: "pods"},
+		{verb: "get", resource: "pods", subresource: "log"},
+	}
+	// tunnelPermissions are needed to connect the tunnel through the API server proxy of the kurun-server service
+	tunnelPermissions = []resourcePermission{
+		{verb: "get", resource: "services", subresource: "proxy"},
+	}
+	// podTunnelPermissions are needed to connect the tunnel client to a kurun-server pod directly
+	podTunnelPermissions = []resourcePermission{
+		{verb: "get", resource: "pods", subresource: "proxy"},
+	}
+	// podSelectorTunnelPermissions are needed to connect the tunnel client to the kurun-server pods of a selector
+	podSelectorTunnelPermissions = []resourcePermission{
+		{verb: "list", resource: "pods"},
+		{verb: "get", resource: "pods", subresource: "proxy"},
+	}
+	kurunServerPermissions = []resourcePermission{
+		{verb: "create", resource: "services"},
+		{verb: "get", resource: "services"},
+		{verb: "delete", resource: "services"},
+		{verb: "create", group: "apps", resource: "deployments"},
+		{verb: "get", group: "apps", resource: "deployments"},
+		{verb: "delete", group: "apps", resource: "deployments"},
+	}
+	// sidecarPermissions are needed to inject kurun-server into an existing deployment with --inject-into
+	sidecarPermissions = []resourcePermission{
+		{verb: "create", resource: "services"},
+		{verb: "get", resource: "services"},
+		{verb: "delete", resource: "services"},
+		{verb: "get", group: "apps", resource: "deployments"},
+		{verb: "update", group: "apps", resource: "deployments"},
+	}
+	networkPolicyPermissions = []resourcePermission{
+		{verb: "create", group: "networking.k8s.io", resource: "networkpolicies"},
+		{verb: "delete", group: "networking.k8s.io", resource: "networkpolicies"},
+	}
+	// tlsSecretPermissions are needed to read the CA bundle of the kurun-server certificate with --tlssecret
+	tlsSecretPermissions = []resourcePermission{
+		{verb: "get", resource: "secrets"},
+	}
+	portForwardPermissions = joinPermissions(kurunServerPermissions, tunnelPermissions)
+)
+
+func joinPermissions(lists ...[]resourcePermission) []resourcePermission {
+	var joined []resourcePermission
+	for _, list := range lists {
+		joined = append(joined, list...)
+	}
+	return joined
+}
+
+// checkPreflightPermissions fails if the current user lacks any of the permissions in the namespace, so commands fail
+// before creating anything instead of in the middle with an API error
+// Clusters not supporting access reviews are not checked.
+func checkPreflightPermissions(ctx context.Context, kubeConfig *rest.Config, namespace string, permissions []resourcePermission, logger logr.Logger) error {
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return err
+	}
+	missing, err := missingPermissions(ctx, clientset, namespace, permissions)
+	if err != nil {
+		logger.V(1).Info("cannot check permissions", "error", err.Error())
+		return nil
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("missing %s in namespace %s, see kurun doctor", formatPermissions(missing), namespace)
+	}
+	return nil
+}
+
+// missingPermissions returns the permissions the current user lacks in the namespace, checked with
+// SelfSubjectAccessReviews
+func missingPermissions(ctx context.Context, clientset kubernetes.Interface, namespace string, permissions []resourcePermission) ([]resourcePermission, error) {
+	var missing []resourcePermission
+	for _, permission := range permissions {
+		review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   namespace,
+					Verb:        permission.verb,
+					Group:       permission.group,
+					Resource:    permission.resource,
+					Subresource: permission.subresource,
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return nil, errors.WrapIfWithDetails(err, "failed to review access", "permission", permission.String())
+		}
+		if !review.Status.Allowed {
+			missing = append(missing, permission)
+		}
+	}
+	return missing, nil
+}
+
+// formatPermissions joins the permissions for messages, e.g. create deployments.apps, get services/proxy
+func formatPermissions(permissions []resourcePermission) string {
+	formatted := make([]string, 0, len(permissions))
+	for _, permission := range permissions {
+		formatted = append(formatted, permission.String())
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByKurun = "kurun"
+)
+
+// isTransientError reports whether the API request failed with an error worth retrying
+func isTransientError(err error) bool {
+	return apierrors.IsConflict(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsConnectionRefused(err) ||
+		utilnet.IsProbableEOF(err)
+}
+
+// withRetry calls fn until it succeeds or fails with a non-transient error, with bounded exponential backoff
+func withRetry(fn func() error) error {
+	return retry.OnError(retry.DefaultBackoff, isTransientError, fn)
+}
+
+// isManagedByKurun reports whether the object was created by kurun
+func isManagedByKurun(obj client.Object) bool {
+	return obj.GetLabels()[managedByLabel] == managedByKurun
+}
+
+// setManagedByKurun marks the object as created by kurun
+func setManagedByKurun(obj client.Object) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[managedByLabel] = managedByKurun
+	obj.SetLabels(labels)
+}
+
+// createOrUpdateManaged creates the object, or adopts it if it exists and is managed by kurun (e.g. left over by a
+// crashed session). mutate sets the desired state of the object, it's called with the existing object if there is one.
+func createOrUpdateManaged(ctx context.Context, kubeClient client.Client, obj client.Object, mutate func() error) error {
+	createOrUpdate := func() error {
+		_, err := controllerutil.CreateOrUpdate(ctx, kubeClient, obj, func() error {
+			if creationTimestamp := obj.GetCreationTimestamp(); !creationTimestamp.IsZero() && !isManagedByKurun(obj) {
+				return errors.NewWithDetails("object already exists and is not managed by kurun", "name", client.ObjectKeyFromObject(obj))
+			}
+
+			if err := mutate(); err != nil {
+				return err
+			}
+
+			setManagedByKurun(obj)
+
+			return nil
+		})
+		return err
+	}
+	return withRetry(func() error {
+		err := createOrUpdate()
+		if apierrors.IsAlreadyExists(err) {
+			// created by someone else since it was looked up, get and update (or refuse to adopt) it instead
+			err = createOrUpdate()
+		}
+		return err
+	})
+}
+
+// deleteWithRetry deletes the object, ignoring if it's already gone
+func deleteWithRetry(ctx context.Context, kubeClient client.Client, obj client.Object) error {
+	return withRetry(func() error {
+		return client.IgnoreNotFound(kubeClient.Delete(ctx, obj))
+	})
+}
+
+func addAnnotationFlag(cmd *cobra.Command, annotations *[]string) {
+	cmd.PersistentFlags().StringArrayVar(annotations, "annotation", nil, "Annotation (key=value) to add to the generated resources and pod templates, e.g. sidecar.istio.io/inject=false (can be repeated)")
+}
+
+// parseAnnotations parses the annotations given as key=value
+func parseAnnotations(values []string) (map[string]string, error) {
+	annotations := make(map[string]string, len(values))
+	for _, value := range values {
+		keyValue := strings.SplitN(value, "=", 2)
+		if len(keyValue) != 2 || keyValue[0] == "" {
+			return nil, errors.Errorf("invalid annotation %q, expected key=value", value)
+		}
+		annotations[keyValue[0]] = keyValue[1]
+	}
+	return annotations, nil
+}
+
+// setAnnotations adds the annotations to the objects, and to the pod templates of deployments
+func setAnnotations(annotations map[string]string, objects ...client.Object) {
+	if len(annotations) == 0 {
+		return
+	}
+	for _, obj := range objects {
+		obj.SetAnnotations(mergeMaps(obj.GetAnnotations(), annotations))
+		if deployment, ok := obj.(*appsv1.Deployment); ok {
+			deployment.Spec.Template.Annotations = mergeMaps(deployment.Spec.Template.Annotations, annotations)
+		}
+	}
+}
+
+func mergeMaps(dst, src map[string]string) map[string]string {
+	if dst == nil {
+		dst = make(map[string]string, len(src))
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
@@ -1,27 +1,114 @@
 package cmd
 
-import "github.com/spf13/cobra"
+import (
+	"os"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+)
 
 func NewRootCommand() *cobra.Command {
 	var params rootCommandParams
 
 	cmd := &cobra.Command{
 		Use: "kurun",
+		// the errors are printed with their hints by PresentError
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := loadConfig(params.configFile, cmd.Flags().Changed("config"))
+			if err != nil {
+				return err
+			}
+			params.config = cfg
+
+			if params.logger, err = newLogger(params.logFormat, params.logOutput, params.verbosity); err != nil {
+				return err
+			}
+			if params.output, err = newOutputPrinter(params.outputParams); err != nil {
+				return err
+			}
+			verboseCommands = params.verbosity > 0
+
+			if params.apiServerCA != "" {
+				if _, err := os.Stat(params.apiServerCA); err != nil {
+					return errors.WrapIf(err, "invalid --apiserver-ca")
+				}
+			}
+
+			if params.auditLogFile != "" {
+				if params.auditLog, err = openAuditLog(params.auditLogFile); err != nil {
+					return err
+				}
+			}
+
+			if params.ephemeralNamespace {
+				if cmd.Flags().Changed("namespace") {
+					return errors.New("--namespace cannot be used with --ephemeral-namespace")
+				}
+				if dryRun := cmd.Flags().Lookup("dry-run"); dryRun != nil && dryRun.Value.String() != dryRunNone {
+					return errors.New("--dry-run cannot be used with --ephemeral-namespace")
+				}
+				return withEphemeralNamespace(cmd, &params)
+			}
+
+			return nil
+		},
 	}
 
+	cmd.PersistentFlags().StringVar(&params.apiServerCA, "apiserver-ca", "", "CA bundle file to verify the Kubernetes API server with (e.g. of a corporate CA), instead of the one in the kubeconfig")
+	cmd.PersistentFlags().StringVar(&params.auditLogFile, "audit-log", "", "append every create, update and delete kurun performs in the cluster to this file as JSON lines")
+	cmd.PersistentFlags().StringVar(&params.configFile, "config", defaultConfigFile, "configuration file to use")
 	cmd.PersistentFlags().StringVar(&params.namespace, "namespace", "default", "namespace to use for resources")
+	cmd.PersistentFlags().StringVar(&params.containerEngine, "container-engine", "auto", "container engine to build images with (auto, docker, podman or nerdctl)")
+	cmd.PersistentFlags().DurationVar(&params.waitTimeout, "wait-timeout", defaultWaitTimeout, "how long to wait for resources (e.g. pods) to become ready")
 	cmd.PersistentFlags().CountVarP(&params.verbosity, "verbose", "v", "logging verbosity")
+	cmd.PersistentFlags().StringVar(&params.logFormat, "log-format", logFormatText, "format of the log lines (text or json)")
+	cmd.PersistentFlags().StringVar(&params.logOutput, "log-output", logOutputStderr, "where to write the log lines: stderr, stdout or the path of a file to append to")
 
-	cmd.AddCommand(
-		NewApplyCommand(),
+	// only the commands deploying to the cluster can run their sessions in ephemeral namespaces
+	sessionCommands := []*cobra.Command{
+		NewApplyCommand(&params),
 		NewPortForwardCommand(&params),
 		NewRunCommand(&params),
+		NewTestCommand(&params),
+		NewTunnelCommand(&params),
+	}
+	for _, sessionCmd := range sessionCommands {
+		addEphemeralNamespaceFlag(sessionCmd, &params)
+	}
+
+	cmd.AddCommand(sessionCommands...)
+	cmd.AddCommand(
+		NewBenchCommand(),
+		NewDoctorCommand(&params),
+		NewImagesCommand(&params),
+		NewInstallServerCommand(&params),
+		NewPluginCommand(),
+		NewSelfUpdateCommand(),
+		NewServeCommand(&params),
+		NewTunnelClientCommand(&params),
 	)
 
 	return cmd
 }
 
 type rootCommandParams struct {
-	namespace string
-	verbosity int
+	apiServerCA string
+	// auditLog is the audit log of the session (if enabled), shared by all clients created with getKubeConfig
+	auditLog           *auditLog
+	auditLogFile       string
+	config             config
+	configFile         string
+	containerEngine    string
+	ephemeralNamespace bool
+	logger             logr.Logger
+	logFormat          string
+	logOutput          string
+	namespace          string
+	output             *outputPrinter
+	outputParams       outputParams
+	verbosity          int
+	waitTimeout        time.Duration
 }
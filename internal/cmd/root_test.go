@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEphemeralNamespaceFlag(t *testing.T) {
+	root := NewRootCommand()
+	for _, args := range [][]string{
+		{"apply"},
+		{"port-forward"},
+		{"run"},
+		{"test"},
+		{"tunnel", "attach"},
+	} {
+		cmd, _, err := root.Find(args)
+		require.NoError(t, err)
+		require.NotNil(t, cmd.Flag("ephemeral-namespace"), cmd.CommandPath())
+	}
+
+	// the other commands don't deploy anything, so they don't accept the flag
+	for _, args := range [][]string{
+		{"doctor"},
+		{"self-update"},
+		{"serve"},
+		{"tunnel-client"},
+	} {
+		cmd, _, err := root.Find(args)
+		require.NoError(t, err)
+		require.Nil(t, cmd.Flag("ephemeral-namespace"), cmd.CommandPath())
+	}
+}
@@ -1,30 +1,28 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"strings"
 
-	jsonpatch "github.com/evanphx/json-patch"
+	"emperror.dev/errors"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func NewRunCommand(rootParams *rootCommandParams) *cobra.Command {
-	var serviceAccount string
-	var overrides string
-	var podEnv []string
+	var podParams podRunParams
+	var buildParams imageBuildParams
 
 	cmd := &cobra.Command{
 		Use:   "run [flags] -- gofiles... [arguments...]",
 		Short: "Just like `go run main.go` but executed inside Kubernetes with one command.",
 		Args:  cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			namespace := rootParams.namespace
-
 			var gofiles []string
 			var finalArguments []string
 
@@ -36,94 +34,356 @@ func NewRunCommand(rootParams *rootCommandParams) *cobra.Command {
 				}
 			}
 
-			image, err := buildImage(gofiles)
+			builder, err := newImageBuilder(rootParams, buildParams)
 			if err != nil {
 				return err
 			}
 
-			mode := "-i"
-			if fileInfo, _ := os.Stdout.Stat(); (fileInfo.Mode() & os.ModeCharDevice) != 0 {
-				mode += "t"
-			}
+			return buildAndRunInPod(cmd, rootParams, builder, gofiles, podParams, finalArguments)
+		},
+	}
+	addPodRunFlags(cmd, &podParams)
+	addImageBuildFlags(cmd, &buildParams)
+	cmd.PersistentFlags().BoolVar(&podParams.shell, "shell", false, "Open an interactive shell in a pod running the built image instead of running the binary")
+	cmd.PersistentFlags().StringVar(&podParams.shellImage, "shell-image", defaultShellImage, "Image to copy busybox from with --shell, for images without a shell")
+	cmd.PersistentFlags().StringVar(&podParams.schedule, "schedule", "", "Run the binary on a cron schedule in a CronJob instead of an attached pod, e.g. \"*/5 * * * *\", until interrupted")
+	cmd.PersistentFlags().BoolVar(&podParams.follow, "follow", false, "Stream the logs of each run with --schedule")
+	cmd.PersistentFlags().BoolVar(&podParams.job.enabled, "job", false, "Run the binary in a Job instead of an attached pod, wait for its completion and report the exit status of each pod")
+	cmd.PersistentFlags().Int32Var(&podParams.job.completions, "completions", 1, "Number of successful runs of the binary to complete the Job with --job")
+	cmd.PersistentFlags().Int32Var(&podParams.job.parallelism, "parallelism", 1, "Number of runs of the binary in parallel with --job")
+	cmd.PersistentFlags().Int32Var(&podParams.job.backoffLimit, "backoff-limit", 6, "Number of retries of the failed runs before failing the Job with --job")
+	addDryRunFlag(cmd, &podParams.dryRun)
+	addOutputFlags(cmd, &rootParams.outputParams)
 
-			podName := strings.Split(image, ":")[0]
-
-			kubectlArgs := []string{
-				"run", podName,
-				mode,
-				"--image=docker.io/library/" + image,
-				"--quiet",
-				"--image-pull-policy=IfNotPresent",
-				"--restart=Never",
-				"--rm",
-				"--override-type=strategic",
-			}
+	return cmd
+}
 
-			limitsPatch := map[string]interface{}{
-				"spec": corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  podName,
-							Image: "docker.io/library/" + image,
-							Resources: corev1.ResourceRequirements{
-								Limits: corev1.ResourceList{
-									"cpu":    resource.MustParse("100m"),
-									"memory": resource.MustParse("128Mi"),
-								},
-							},
-						},
-					},
-				},
-			}
+// podRunParams are the settings of the pods running binaries built from local source
+type podRunParams struct {
+	annotations       []string
+	binaryOnly        bool
+	dryRun            string
+	env               []string
+	extendedResources map[string]string
+	follow            bool
+	initContainers    []string
+	job               jobRunParams
+	like              string
+	logs              logParams
+	nodeOS            string
+	overrides         string
+	podTemplate       string
+	runnerImage       string
+	runtimeClass      string
+	schedule          string
+	serviceAccount    string
+	shell             bool
+	shellImage        string
+	sidecars          []string
+	// stdout receives the output of the binary instead of the standard output if set
+	stdout io.Writer
+}
 
-			limitsOverride, err := json.Marshal(limitsPatch)
-			if err != nil {
-				return err
-			}
+// jobRunParams are the settings of the Job running the binary with --job
+type jobRunParams struct {
+	enabled      bool
+	completions  int32
+	parallelism  int32
+	backoffLimit int32
+}
 
-			combinedOverride := limitsOverride
+func addPodRunFlags(cmd *cobra.Command, params *podRunParams) {
+	cmd.PersistentFlags().StringVar(&params.serviceAccount, "serviceaccount", "", "Service account to set for the pod")
+	cmd.PersistentFlags().StringVar(&params.overrides, "overrides", "", "An inline JSON override for the generated pod object, e.g. '{\"metadata\":{\"name\":\"my-pod\"}}'")
+	cmd.PersistentFlags().StringArrayVarP(&params.env, "env", "e", nil, "Environment variables to pass to the pod's containers")
+	cmd.PersistentFlags().StringVar(&params.like, "like", "", "Run with the environment, config map and secret volumes, service account and labels of this workload, e.g. deployment/foo")
+	cmd.PersistentFlags().StringArrayVar(&params.sidecars, "sidecar", nil, "Sidecar container to run next to the binary, as <image>[,<command>], e.g. envoyproxy/envoy:v1.25.0")
+	cmd.PersistentFlags().StringArrayVar(&params.initContainers, "init-container", nil, "Init container to run before the binary, as <image>[,<command>]")
+	cmd.PersistentFlags().StringVar(&params.podTemplate, "pod-template", "", "YAML file of a partial pod spec merged into the generated pod, e.g. with sidecars and their volumes")
+	cmd.PersistentFlags().StringToStringVar(&params.extendedResources, "gpu", nil, "GPUs or other extended resources to request for the pod, e.g. nvidia.com/gpu=1")
+	cmd.PersistentFlags().StringVar(&params.runtimeClass, "runtime-class", "", "Runtime class of the pod, e.g. nvidia")
+	cmd.PersistentFlags().StringVar(&params.nodeOS, "node-os", linuxNodeOS, "Operating system of the nodes to run the pod on (linux or windows, the binary is built for it), empty to schedule it to any node")
+	cmd.PersistentFlags().BoolVar(&params.binaryOnly, "binary-only", false, "Skip the image build, run a generic runner image and stream only the compiled binary into the pod")
+	cmd.PersistentFlags().StringVar(&params.runnerImage, "runner-image", defaultRunnerImage, "Generic runner image to use with --binary-only (must contain sh and tar)")
+	addAnnotationFlag(cmd, &params.annotations)
+	addLogFlags(cmd, &params.logs)
+}
 
-			if serviceAccount != "" {
-				serviceAccountPatch := fmt.Sprintf(`{"spec":{"serviceAccount":"%s"}}`, serviceAccount)
-				serviceAccountOverride, err := jsonpatch.MergeMergePatches(combinedOverride, []byte(serviceAccountPatch))
-				if err != nil {
-					return err
-				}
-				combinedOverride = serviceAccountOverride
-			}
+// buildAndRunInPod builds the Go files and runs the resulting binary with the specified arguments in a pod, attached to the local terminal
+// If the binary fails, an ExitError with its exit code is returned.
+// With a schedule the binary is run by a CronJob instead, until interrupted, and with job by a Job, returning an
+// ExitError if it fails.
+func buildAndRunInPod(cmd *cobra.Command, rootParams *rootCommandParams, builder *imageBuilder, goFiles []string, params podRunParams, arguments []string) error {
+	if params.shell && params.binaryOnly {
+		return errors.New("--shell cannot be used with --binary-only")
+	}
+	if params.schedule != "" && (params.shell || params.binaryOnly) {
+		return errors.New("--schedule cannot be used with --shell or --binary-only")
+	}
+	if params.follow && params.schedule == "" {
+		return errors.New("--follow can only be used with --schedule")
+	}
+	if params.job.enabled {
+		switch {
+		case params.schedule != "":
+			return errors.New("--job cannot be used with --schedule")
+		case params.shell || params.binaryOnly:
+			return errors.New("--job cannot be used with --shell or --binary-only")
+		case params.job.completions < 1 || params.job.parallelism < 1:
+			return errors.New("--completions and --parallelism must be at least 1")
+		case params.job.backoffLimit < 0:
+			return errors.New("--backoff-limit cannot be negative")
+		}
+	}
+	// nothing is attached to the runs of CronJobs and Jobs
+	detached := params.schedule != "" || params.job.enabled
+	if err := validateNodeOS(params.nodeOS); err != nil {
+		return err
+	}
+	if params.nodeOS == windowsNodeOS {
+		switch {
+		case params.shell || params.binaryOnly:
+			return errors.New("--shell and --binary-only cannot be used with --node-os windows")
+		case builder.params.inCluster:
+			return errors.New("--build-in-cluster cannot build images for --node-os windows")
+		}
+		builder.params.goos = windowsNodeOS
+	}
+	if params.dryRun == "" {
+		params.dryRun = dryRunNone
+	}
+	if err := validateDryRun(params.dryRun); err != nil {
+		return err
+	}
+	if params.dryRun != dryRunNone && rootParams.output.json {
+		return errors.New("--output json cannot be used with --dry-run")
+	}
+	if params.dryRun != dryRunNone && builder.params.inCluster {
+		// the builder pod would be created in the cluster
+		return errors.New("--build-in-cluster cannot be used with --dry-run")
+	}
+	annotations, err := parseAnnotations(params.annotations)
+	if err != nil {
+		return err
+	}
 
-			if overrides != "" {
-				overridesOverride, err := jsonpatch.MergeMergePatches(combinedOverride, []byte(overrides))
-				if err != nil {
-					return err
-				}
-				combinedOverride = overridesOverride
-			}
+	namespace := rootParams.namespace
 
-			kubectlArgs = append(kubectlArgs, fmt.Sprintf("--overrides=%s", string(combinedOverride)))
+	if params.dryRun == dryRunNone {
+		kubeConfig, err := getKubeConfig(rootParams)
+		if err != nil {
+			return err
+		}
+		permissions := runPermissions
+		switch {
+		case params.schedule != "":
+			permissions = scheduledRunPermissions
+		case params.job.enabled:
+			permissions = jobRunPermissions
+		case params.binaryOnly:
+			permissions = joinPermissions(runPermissions, binaryOnlyPermissions)
+		}
+		// before the build, which may take a while
+		if err := checkPreflightPermissions(cmd.Context(), kubeConfig, namespace, permissions, rootParams.logger); err != nil {
+			return err
+		}
+	}
 
-			for _, e := range podEnv {
-				kubectlArgs = append(kubectlArgs, fmt.Sprintf("--env=%s", e))
-			}
+	var workload *workloadConfig
+	if params.like != "" {
+		workload, err = getWorkloadConfig(cmd.Context(), rootParams, namespace, params.like)
+		if err != nil {
+			return err
+		}
+	}
 
-			kubectlArgs = append(kubectlArgs, fmt.Sprintf("--namespace=%s", namespace), "--command", "--", "sh", "-c", fmt.Sprintf("sleep 1 && /main %s", strings.Join(finalArguments[:], " ")))
-			kubectlCommand := exec.Command("kubectl", kubectlArgs...)
-			kubectlCommand.Stdin = os.Stdin
-			kubectlCommand.Stderr = os.Stderr
-			kubectlCommand.Stdout = os.Stdout
+	var image builtImage
+	var binaryDirectory string
+	if params.binaryOnly {
+		if len(builder.params.includes) > 0 {
+			return errors.New("--include cannot be used with --binary-only")
+		}
 
-			if err := kubectlCommand.Run(); err != nil {
-				cmd.SilenceUsage = true
-				cmd.SilenceErrors = true
-				return err
-			}
+		imageName, directory, err := builder.PrepareBinary(goFiles, builder.params)
+		if err != nil {
+			return err
+		}
+		image = builtImage{
+			name:       imageName,
+			ref:        params.runnerImage,
+			pullPolicy: corev1.PullIfNotPresent,
+		}
+		binaryDirectory = directory
+	} else {
+		var err error
+		image, err = builder.Build(goFiles)
+		if err != nil {
+			return err
+		}
+	}
 
-			return nil
+	stdout := params.stdout
+	tty := false
+	if stdout == nil && !detached {
+		stdout = rootParams.output.Stdout()
+		tty = stdout == os.Stdout && term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+	}
+
+	podName := image.name
+	if params.shell {
+		podName += "-shell"
+	}
+
+	var command []string
+	switch {
+	case params.shell:
+		// the built binary is available as /main in the shell
+		command = []string{shellToolsDir + "/sh"}
+	case params.binaryOnly:
+		command = append([]string{"sh", "-c", binaryOnlyEntrypoint, "kurun"}, arguments...)
+	case params.nodeOS == windowsNodeOS:
+		// there is no shell to wait for the terminal to attach, the first lines of the output may be missed
+		command = append([]string{"/main.exe"}, arguments...)
+	case detached:
+		// the runs don't have to wait for the terminal to attach
+		command = append([]string{"/main"}, arguments...)
+	default:
+		command = append([]string{"sh", "-c", "sleep 1 && exec /main \"$@\"", "kurun"}, arguments...)
+	}
+
+	var env []corev1.EnvVar
+	for _, e := range params.env {
+		nameValue := strings.SplitN(e, "=", 2)
+		if len(nameValue) != 2 {
+			return errors.Errorf("invalid environment variable %q, expected NAME=VALUE", e)
+		}
+		env = append(env, corev1.EnvVar{Name: nameValue[0], Value: nameValue[1]})
+	}
+	sidecars, err := parseExtraContainers(params.sidecars, "sidecar")
+	if err != nil {
+		return err
+	}
+	initContainers, err := parseExtraContainers(params.initContainers, "init-container")
+	if err != nil {
+		return err
+	}
+	extendedResources, err := parseExtendedResources(params.extendedResources)
+	if err != nil {
+		return err
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      podName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"run": podName,
+			},
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:            podName,
+					Image:           image.ref,
+					ImagePullPolicy: image.pullPolicy,
+					Command:         command,
+					Env:             env,
+					Stdin:           !detached,
+					StdinOnce:       !detached,
+					TTY:             tty,
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{
+							"cpu":    resource.MustParse("100m"),
+							"memory": resource.MustParse("128Mi"),
+						},
+					},
+				},
+			},
+			RestartPolicy:      corev1.RestartPolicyNever,
+			ServiceAccountName: params.serviceAccount,
 		},
 	}
-	cmd.PersistentFlags().StringVar(&serviceAccount, "serviceaccount", "", "Service account to set for the pod")
-	cmd.PersistentFlags().StringVar(&overrides, "overrides", "", "An inline JSON override for the generated pod object, e.g. '{\"metadata\":{\"name\":\"my-pod\"}}'")
-	cmd.PersistentFlags().StringArrayVarP(&podEnv, "env", "e", nil, "Environment variables to pass to the pod's containers")
+	setNodeOS(&pod.Spec, params.nodeOS)
+	if workload != nil {
+		workload.apply(pod, params.serviceAccount != "", rootParams.logger)
+	}
+	setExtendedResourceLimits(&pod.Spec.Containers[0], extendedResources)
+	if params.runtimeClass != "" {
+		pod.Spec.RuntimeClassName = &params.runtimeClass
+	}
+	pod.Spec.Containers = append(pod.Spec.Containers, sidecars...)
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, initContainers...)
+	if params.podTemplate != "" {
+		if err := applyPodTemplate(pod, params.podTemplate); err != nil {
+			return err
+		}
+	}
+	if params.shell {
+		addShellTools(&pod.Spec, params.shellImage)
+	}
 
-	return cmd
+	if params.overrides != "" {
+		if err := strategicMergePod(pod, []byte(params.overrides)); err != nil {
+			return errors.WrapIf(err, "failed to apply overrides")
+		}
+	}
+
+	if params.schedule != "" {
+		cronJob := newRunCronJob(pod, params.schedule)
+		cmd.SilenceUsage = true
+		if params.dryRun != dryRunNone {
+			return printManifests(cmd.Context(), rootParams, os.Stdout, params.dryRun, cronJob)
+		}
+		return runCronJob(cmd.Context(), rootParams, cronJob, params.follow, params.logs, rootParams.output, rootParams.logger)
+	}
+	if params.job.enabled {
+		job := newRunJob(pod, params.job.completions, params.job.parallelism, params.job.backoffLimit)
+		cmd.SilenceUsage = true
+		if params.dryRun != dryRunNone {
+			return printManifests(cmd.Context(), rootParams, os.Stdout, params.dryRun, job)
+		}
+		err := runJob(cmd.Context(), rootParams, job, params.logs, rootParams.output, rootParams.logger)
+		if errors.As(err, &ExitError{}) {
+			cmd.SilenceErrors = true
+		}
+		return err
+	}
+
+	if params.dryRun != dryRunNone {
+		cmd.SilenceUsage = true
+		return printManifests(cmd.Context(), rootParams, os.Stdout, params.dryRun, pod)
+	}
+
+	var onRunning func() error
+	if params.binaryOnly {
+		onRunning = func() error {
+			return streamBinaryToPod(rootParams, namespace, pod.Name, pod.Spec.Containers[0].Name, binaryDirectory, rootParams.waitTimeout)
+		}
+	}
+
+	cmd.SilenceUsage = true
+
+	exitCode, err := runAttachedPod(cmd.Context(), rootParams, pod, stdout, tty, params.logs, rootParams.waitTimeout, onRunning, rootParams.logger)
+	if err != nil {
+		return err
+	}
+	if err := rootParams.output.Result("", "", exitResult{Type: "exit", ExitCode: exitCode}); err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		cmd.SilenceErrors = true
+		return ExitError{Code: exitCode}
+	}
+
+	return nil
+}
+
+// ExitError is returned when the binary run inside the cluster exits with a non-zero exit code
+type ExitError struct {
+	Code int
+}
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
 }
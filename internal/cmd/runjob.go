@@ -0,0 +1,330 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	typedbatchv1 "k8s.io/client-go/kubernetes/typed/batch/v1"
+)
+
+// runJobLabels are the labels of the jobs of the named run and of their pods, they select the runs of the binary
+func runJobLabels(name string) map[string]string {
+	return map[string]string{
+		"run":          name,
+		managedByLabel: managedByKurun,
+	}
+}
+
+// newRunJobTemplate returns the template of the jobs running the pod, the name of the pod is left to the job controller
+func newRunJobTemplate(pod *corev1.Pod) batchv1.JobTemplateSpec {
+	labels := runJobLabels(pod.Name)
+	podLabels := make(map[string]string, len(pod.Labels)+len(labels))
+	for key, value := range pod.Labels {
+		podLabels[key] = value
+	}
+	for key, value := range labels {
+		podLabels[key] = value
+	}
+
+	return batchv1.JobTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      labels,
+			Annotations: pod.Annotations,
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      podLabels,
+					Annotations: pod.Annotations,
+				},
+				Spec: pod.Spec,
+			},
+		},
+	}
+}
+
+// newRunCronJob returns the CronJob running the pod on the schedule, a run is skipped while the previous one is still
+// running
+func newRunCronJob(pod *corev1.Pod, schedule string) *batchv1.CronJob {
+	return &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pod.Name,
+			Namespace:   pod.Namespace,
+			Labels:      runJobLabels(pod.Name),
+			Annotations: pod.Annotations,
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:          schedule,
+			ConcurrencyPolicy: batchv1.ForbidConcurrent,
+			JobTemplate:       newRunJobTemplate(pod),
+		},
+	}
+}
+
+// newRunJob returns the Job running the pod to the number of completions, the failed pods are retried up to the
+// backoff limit
+func newRunJob(pod *corev1.Pod, completions, parallelism, backoffLimit int32) *batchv1.Job {
+	template := newRunJobTemplate(pod)
+	template.Spec.Completions = &completions
+	template.Spec.Parallelism = &parallelism
+	template.Spec.BackoffLimit = &backoffLimit
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pod.Name,
+			Namespace:   pod.Namespace,
+			Labels:      template.Labels,
+			Annotations: template.Annotations,
+		},
+		Spec: template.Spec,
+	}
+}
+
+// runJob creates the Job, prints the logs of its pods until it completes or fails, then reports the exit status of
+// each pod and deletes the Job with its pods
+// If the Job fails, an ExitError with the exit code of the last failed pod is returned.
+func runJob(ctx context.Context, rootParams *rootCommandParams, job *batchv1.Job, logParams logParams, output *outputPrinter, logger logr.Logger) error {
+	kubeConfig, err := getKubeConfig(rootParams)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return err
+	}
+	jobs := clientset.BatchV1().Jobs(job.Namespace)
+	name, containerName := job.Name, job.Spec.Template.Spec.Containers[0].Name
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	job, err = jobs.Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to create job", "job", name)
+	}
+	defer func() {
+		propagation := metav1.DeletePropagationBackground
+		err := jobs.Delete(context.Background(), name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "failed to delete job", "job", name)
+		}
+	}()
+	output.Statusf("Job %s started", name)
+
+	listOptions := metav1.ListOptions{LabelSelector: k8slabels.SelectorFromSet(runJobLabels(name)).String()}
+	go reportPodProblems(ctx, clientset, job.Namespace, listOptions, os.Stderr)
+	logs, err := newLogStreamer(clientset, logParams, output.Stdout())
+	if err != nil {
+		return err
+	}
+	finished := make(chan struct{})
+	logsDone := make(chan struct{})
+	go func() {
+		defer close(logsDone)
+		if err := logs.StreamJobPods(ctx, job.Namespace, listOptions, finished); err != nil {
+			logger.Error(err, "failed to stream job logs", "job", name)
+		}
+	}()
+
+	var succeeded bool
+	var message string
+	for {
+		job, err = jobs.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.WrapIfWithDetails(err, "failed to get job", "job", name)
+		}
+		var done bool
+		if done, succeeded, message = jobFinished(job); done {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(2 * time.Second):
+		}
+	}
+	close(finished)
+	<-logsDone
+
+	pods, err := clientset.CoreV1().Pods(job.Namespace).List(ctx, listOptions)
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to list job pods", "job", name)
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].CreationTimestamp.Before(&pods.Items[j].CreationTimestamp)
+	})
+	exitCode := 1
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != containerName || status.State.Terminated == nil {
+				continue
+			}
+			terminated := status.State.Terminated
+			if terminated.ExitCode != 0 {
+				exitCode = int(terminated.ExitCode)
+			}
+			if err := output.Result(fmt.Sprintf("pod/%s exited with %d (%s)", pod.Name, terminated.ExitCode, terminated.Reason), "", podExitResult{
+				Type:     "podExit",
+				Pod:      pod.Name,
+				ExitCode: int(terminated.ExitCode),
+				Reason:   terminated.Reason,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := output.Result(jobResultStatus(name, succeeded, message), name, jobResult{
+		Type:      "job",
+		Name:      name,
+		Succeeded: succeeded,
+		Message:   message,
+	}); err != nil {
+		return err
+	}
+	if !succeeded {
+		return ExitError{Code: exitCode}
+	}
+	return nil
+}
+
+// runCronJob creates the CronJob and reports the start and the result of its jobs until interrupted, then deletes it
+// with its jobs and their pods
+// With follow the logs of the runs are printed as well.
+func runCronJob(ctx context.Context, rootParams *rootCommandParams, cronJob *batchv1.CronJob, follow bool, logParams logParams, output *outputPrinter, logger logr.Logger) error {
+	kubeConfig, err := getKubeConfig(rootParams)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return err
+	}
+	cronJobs := clientset.BatchV1().CronJobs(cronJob.Namespace)
+	name := cronJob.Name
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	cronJob, err = cronJobs.Create(ctx, cronJob, metav1.CreateOptions{})
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to create cron job", "cronjob", name)
+	}
+	defer func() {
+		propagation := metav1.DeletePropagationBackground
+		err := cronJobs.Delete(context.Background(), name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil && !apierrors.IsNotFound(err) {
+			logger.Error(err, "failed to delete cron job", "cronjob", name)
+		}
+	}()
+
+	result, err := newResourceResult(cronJob)
+	if err != nil {
+		return err
+	}
+	if err := output.Result("Scheduled "+result.Ref()+" at "+cronJob.Spec.Schedule+", interrupt to delete it", result.Ref(), result); err != nil {
+		return err
+	}
+
+	listOptions := metav1.ListOptions{LabelSelector: k8slabels.SelectorFromSet(runJobLabels(name)).String()}
+	go reportPodProblems(ctx, clientset, cronJob.Namespace, listOptions, os.Stderr)
+	if follow {
+		logs, err := newLogStreamer(clientset, logParams, output.Stdout())
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := logs.StreamJobPods(ctx, cronJob.Namespace, listOptions, nil); err != nil {
+				logger.Error(err, "failed to stream job logs", "cronjob", name)
+			}
+		}()
+	}
+
+	return reportRunJobs(ctx, clientset.BatchV1().Jobs(cronJob.Namespace), listOptions, output)
+}
+
+// reportRunJobs prints the start and the result of the jobs matching the list options until the context is cancelled
+func reportRunJobs(ctx context.Context, jobs typedbatchv1.JobInterface, listOptions metav1.ListOptions, output *outputPrinter) error {
+	// finished by the name of the reported jobs
+	reported := make(map[string]bool)
+	for {
+		list, err := jobs.List(ctx, listOptions)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.WrapIf(err, "failed to list jobs")
+		}
+
+		for _, job := range list.Items {
+			finished, ok := reported[job.Name]
+			if finished {
+				continue
+			}
+			if !ok {
+				output.Statusf("Job %s started", job.Name)
+				reported[job.Name] = false
+			}
+			if finished, succeeded, message := jobFinished(&job); finished {
+				reported[job.Name] = true
+				if err := output.Result(jobResultStatus(job.Name, succeeded, message), job.Name, jobResult{
+					Type:      "job",
+					Name:      job.Name,
+					Succeeded: succeeded,
+					Message:   message,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// jobFinished returns whether the job completed or failed, with the message of the failure
+func jobFinished(job *batchv1.Job) (finished, succeeded bool, message string) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return true, true, ""
+		case batchv1.JobFailed:
+			return true, false, condition.Message
+		}
+	}
+	return false, false, ""
+}
+
+func jobResultStatus(name string, succeeded bool, message string) string {
+	switch {
+	case succeeded:
+		return "Job " + name + " succeeded"
+	case message != "":
+		return "Job " + name + " failed: " + message
+	default:
+		return "Job " + name + " failed"
+	}
+}
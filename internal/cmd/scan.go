@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+)
+
+const defaultScanSeverity = "CRITICAL"
+
+// scanImage scans the image for vulnerabilities with trivy and fails if findings of the specified severities are found
+// Local images are read from the container engine, in-cluster built images from the registry.
+func scanImage(image builtImage, severities []string, logger logr.Logger) error {
+	ref, engine := image.ref, image.engine
+
+	if _, err := exec.LookPath("trivy"); err != nil {
+		return errors.WrapIf(err, "image scanning requires trivy to be installed")
+	}
+
+	if len(severities) == 0 {
+		severities = []string{defaultScanSeverity}
+	}
+
+	trivyArgs := []string{"image", "--exit-code", "1", "--no-progress", "--severity", strings.ToUpper(strings.Join(severities, ","))}
+	switch engine {
+	case "docker", "podman":
+		trivyArgs = append(trivyArgs, "--image-src", engine)
+	case "nerdctl":
+		trivyArgs = append(trivyArgs, "--image-src", "containerd")
+	case "":
+		trivyArgs = append(trivyArgs, "--image-src", "remote")
+	}
+	trivyArgs = append(trivyArgs, ref)
+
+	trivyCommand := exec.Command("trivy", trivyArgs...)
+	trivyCommand.Stderr = os.Stderr
+	trivyCommand.Stdout = commandStdout
+
+	logger.Info("scanning image", "command", trivyCommand.String())
+
+	if err := trivyCommand.Run(); err != nil {
+		if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return errors.NewWithDetails("vulnerabilities exceeding the severity threshold found in image", "image", ref, "severity", severities)
+		}
+		return errors.WrapIfWithDetails(err, "failed to scan image", "image", ref)
+	}
+
+	return nil
+}
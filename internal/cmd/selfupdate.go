@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	releasesURL           = "https://api.github.com/repos/banzaicloud/kurun/releases"
+	releaseChecksumsAsset = "kurun_checksums.txt"
+)
+
+type selfUpdateParams struct {
+	check      bool
+	signingKey string
+	version    string
+}
+
+// NewSelfUpdateCommand returns the command replacing the kurun executable with a released binary
+func NewSelfUpdateCommand() *cobra.Command {
+	var params selfUpdateParams
+
+	cmd := &cobra.Command{
+		Use:   "self-update",
+		Short: "Update kurun to the latest (or the specified) release",
+		Long: "Update kurun to the latest (or the specified) release from GitHub. The downloaded binary is verified " +
+			"with the checksums of the release (and their signature if a key is specified) before atomically replacing " +
+			"the current executable.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return selfUpdate(cmd.Context(), cmd.Root().Version, params)
+		},
+	}
+
+	cmd.PersistentFlags().BoolVar(&params.check, "check", false, "Only check whether a newer release is available")
+	cmd.PersistentFlags().StringVar(&params.signingKey, "key", "", "Cosign public key to verify the signature of the release checksums with (requires cosign)")
+	cmd.PersistentFlags().StringVar(&params.version, "version", "", "Release to install, e.g. v0.6.0 (default: the latest release)")
+
+	return cmd
+}
+
+type githubRelease struct {
+	TagName string               `json:"tag_name"`
+	Assets  []githubReleaseAsset `json:"assets"`
+}
+
+type githubReleaseAsset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+func (r githubRelease) assetURL(name string) string {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.BrowserDownloadURL
+		}
+	}
+	return ""
+}
+
+func selfUpdate(ctx context.Context, currentVersion string, params selfUpdateParams) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.WrapIf(err, "failed to locate the kurun executable")
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return errors.WrapIf(err, "failed to locate the kurun executable")
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+
+	release, err := getRelease(ctx, client, releasesURL, params.version)
+	if err != nil {
+		return err
+	}
+
+	if currentVersion != "" && normalizeVersion(currentVersion) == normalizeVersion(release.TagName) {
+		fmt.Fprintf(os.Stdout, "kurun %s is up to date\n", currentVersion)
+		return nil
+	}
+	if params.check {
+		fmt.Fprintf(os.Stdout, "kurun %s is available (current: %s), update with: kurun self-update\n", release.TagName, versionOrUnknown(currentVersion))
+		return nil
+	}
+
+	if strings.Contains(filepath.ToSlash(executable), "/Cellar/") {
+		return errors.NewWithDetails("kurun was installed with Homebrew, update it with: brew upgrade kurun", "path", executable)
+	}
+
+	assetName := fmt.Sprintf("kurun-%s-%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		assetName += ".exe"
+	}
+	assetURL := release.assetURL(assetName)
+	if assetURL == "" {
+		return errors.NewWithDetails("the release has no binary for the platform", "release", release.TagName, "asset", assetName)
+	}
+	checksumsURL := release.assetURL(releaseChecksumsAsset)
+	if checksumsURL == "" {
+		return errors.NewWithDetails("the release has no checksums, refusing to install an unverified binary", "release", release.TagName)
+	}
+
+	checksums, err := download(ctx, client, checksumsURL)
+	if err != nil {
+		return err
+	}
+	if params.signingKey != "" {
+		if err := verifyChecksumsSignature(ctx, client, release, checksums, params.signingKey); err != nil {
+			return err
+		}
+	}
+	expectedChecksum, err := findChecksum(checksums, assetName)
+	if err != nil {
+		return err
+	}
+
+	// the new binary is written next to the executable, so it can be renamed over it atomically
+	tmpFile, err := os.CreateTemp(filepath.Dir(executable), ".kurun-update-*")
+	if err != nil {
+		return errors.WrapIf(err, "failed to create temporary file next to the kurun executable")
+	}
+	defer os.Remove(tmpFile.Name())
+
+	checksum, err := downloadTo(ctx, client, assetURL, tmpFile)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if checksum != expectedChecksum {
+		return errors.NewWithDetails("checksum mismatch, the downloaded binary is corrupt or tampered with", "asset", assetName, "expected", expectedChecksum, "actual", checksum)
+	}
+	if err := os.Chmod(tmpFile.Name(), 0o755); err != nil {
+		return errors.WrapIf(err, "failed to make the new binary executable")
+	}
+
+	if err := replaceExecutable(executable, tmpFile.Name()); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "kurun updated from %s to %s\n", versionOrUnknown(currentVersion), release.TagName)
+	return nil
+}
+
+// getRelease returns the latest (or the specified) release from the releases endpoint of the GitHub API
+func getRelease(ctx context.Context, client *http.Client, baseURL, version string) (githubRelease, error) {
+	release := githubRelease{}
+
+	url := baseURL + "/latest"
+	if version != "" {
+		url = baseURL + "/tags/v" + normalizeVersion(version)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return release, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	// authenticated requests have a higher rate limit
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return release, errors.WrapIf(err, "failed to get release")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return release, errors.NewWithDetails("release not found", "version", version)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return release, errors.NewWithDetails("failed to get release", "status", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return release, errors.WrapIf(err, "failed to parse release")
+	}
+	return release, nil
+}
+
+func download(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if _, err := downloadTo(ctx, client, url, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// downloadTo writes the content of the URL to the writer and returns its SHA-256 checksum
+func downloadTo(ctx context.Context, client *http.Client, url string, w io.Writer) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.WrapIfWithDetails(err, "failed to download", "url", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.NewWithDetails("failed to download", "url", url, "status", resp.Status)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), resp.Body); err != nil {
+		return "", errors.WrapIfWithDetails(err, "failed to download", "url", url)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// findChecksum returns the checksum of the file in the sha256sum formatted checksums
+func findChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", errors.NewWithDetails("no checksum for the binary in the release checksums", "asset", name)
+}
+
+// verifyChecksumsSignature verifies the cosign signature of the checksums, which transitively verifies the binary
+func verifyChecksumsSignature(ctx context.Context, client *http.Client, release githubRelease, checksums []byte, key string) error {
+	if _, err := exec.LookPath("cosign"); err != nil {
+		return errors.WrapIf(err, "signature verification requires cosign to be installed")
+	}
+	signatureURL := release.assetURL(releaseChecksumsAsset + ".sig")
+	if signatureURL == "" {
+		return errors.NewWithDetails("the release has no signature for its checksums", "release", release.TagName)
+	}
+	signature, err := download(ctx, client, signatureURL)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "kurun-update-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	checksumsFile := filepath.Join(dir, releaseChecksumsAsset)
+	signatureFile := checksumsFile + ".sig"
+	if err := os.WriteFile(checksumsFile, checksums, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(signatureFile, signature, 0o600); err != nil {
+		return err
+	}
+
+	cosignCommand := exec.CommandContext(ctx, "cosign", "verify-blob", "--key", key, "--signature", signatureFile, checksumsFile)
+	cosignCommand.Stderr = os.Stderr
+	return errors.WrapIfWithDetails(cosignCommand.Run(), "failed to verify the signature of the release checksums", "release", release.TagName)
+}
+
+// replaceExecutable renames the new binary over the executable
+// Running executables can't be replaced on Windows, so the current one is moved aside first.
+func replaceExecutable(executable, newBinary string) error {
+	if runtime.GOOS == "windows" {
+		oldExecutable := executable + ".old"
+		_ = os.Remove(oldExecutable)
+		if err := os.Rename(executable, oldExecutable); err != nil {
+			return errors.WrapIfWithDetails(err, "failed to move the current executable aside", "path", executable)
+		}
+		if err := os.Rename(newBinary, executable); err != nil {
+			_ = os.Rename(oldExecutable, executable)
+			return errors.WrapIfWithDetails(err, "failed to replace the executable", "path", executable)
+		}
+		return nil
+	}
+	return errors.WrapIfWithDetails(os.Rename(newBinary, executable), "failed to replace the executable", "path", executable)
+}
+
+func normalizeVersion(version string) string {
+	return strings.TrimPrefix(strings.TrimSpace(version), "v")
+}
+
+func versionOrUnknown(version string) string {
+	if version == "" {
+		return "(unknown version)"
+	}
+	return version
+}
@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindChecksum(t *testing.T) {
+	checksums := []byte("0A1B2C  kurun-linux-amd64\n" +
+		"3d4e5f *kurun-windows-amd64.exe\n" +
+		"\n" +
+		"not a checksum line\n" +
+		"6a7b8c  kurun-darwin-arm64\n")
+
+	testCases := map[string]struct {
+		name     string
+		checksum string
+	}{
+		"text mode":           {name: "kurun-linux-amd64", checksum: "0a1b2c"},
+		"binary mode (*name)": {name: "kurun-windows-amd64.exe", checksum: "3d4e5f"},
+		"last entry":          {name: "kurun-darwin-arm64", checksum: "6a7b8c"},
+		"missing entry":       {name: "kurun-linux-arm64"},
+		"prefix of an entry":  {name: "kurun-linux"},
+		"binary mode marker":  {name: "*kurun-windows-amd64.exe"},
+		"malformed line":      {name: "line"},
+	}
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			checksum, err := findChecksum(checksums, testCase.name)
+			if testCase.checksum == "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "no checksum for the binary")
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testCase.checksum, checksum)
+		})
+	}
+}
+
+func TestNormalizeVersion(t *testing.T) {
+	for version, expected := range map[string]string{
+		"v0.6.0":    "0.6.0",
+		"0.6.0":     "0.6.0",
+		" v0.6.0\n": "0.6.0",
+		"":          "",
+		"vv1":       "v1",
+	} {
+		require.Equal(t, expected, normalizeVersion(version), version)
+	}
+}
+
+func TestGetRelease(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/releases/latest":
+			_ = json.NewEncoder(w).Encode(githubRelease{TagName: "v0.7.0", Assets: []githubReleaseAsset{{Name: releaseChecksumsAsset, BrowserDownloadURL: "https://example.com/checksums"}}})
+		case "/releases/tags/v0.6.0":
+			_ = json.NewEncoder(w).Encode(githubRelease{TagName: "v0.6.0"})
+		case "/releases/tags/v0.5.0":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/releases/tags/v0.4.0":
+			_, _ = w.Write([]byte("{"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	t.Setenv("GITHUB_TOKEN", "token")
+	release, err := getRelease(ctx, server.Client(), server.URL+"/releases", "")
+	require.NoError(t, err)
+	require.Equal(t, "v0.7.0", release.TagName)
+	require.Equal(t, "https://example.com/checksums", release.assetURL(releaseChecksumsAsset))
+	require.Empty(t, release.assetURL("kurun-plan9-amd64"))
+	require.Equal(t, "Bearer token", authorization)
+
+	t.Setenv("GITHUB_TOKEN", "")
+	for _, version := range []string{"v0.6.0", "0.6.0"} {
+		release, err = getRelease(ctx, server.Client(), server.URL+"/releases", version)
+		require.NoError(t, err)
+		require.Equal(t, "v0.6.0", release.TagName)
+		require.Empty(t, authorization)
+	}
+
+	_, err = getRelease(ctx, server.Client(), server.URL+"/releases", "v0.1.0")
+	require.EqualError(t, err, "release not found")
+	_, err = getRelease(ctx, server.Client(), server.URL+"/releases", "v0.5.0")
+	require.EqualError(t, err, "failed to get release")
+	_, err = getRelease(ctx, server.Client(), server.URL+"/releases", "v0.4.0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to parse release")
+}
+
+func TestDownload(t *testing.T) {
+	content := []byte("kurun binary")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/kurun-linux-amd64" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	downloaded, err := download(ctx, server.Client(), server.URL+"/kurun-linux-amd64")
+	require.NoError(t, err)
+	require.Equal(t, content, downloaded)
+
+	buf := &bytes.Buffer{}
+	checksum, err := downloadTo(ctx, server.Client(), server.URL+"/kurun-linux-amd64", buf)
+	require.NoError(t, err)
+	require.Equal(t, content, buf.Bytes())
+	expected := sha256.Sum256(content)
+	require.Equal(t, hex.EncodeToString(expected[:]), checksum)
+
+	_, err = download(ctx, server.Client(), server.URL+"/kurun-plan9-amd64")
+	require.EqualError(t, err, "failed to download")
+}
+
+func TestReplaceExecutable(t *testing.T) {
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "kurun")
+	newBinary := filepath.Join(dir, ".kurun-update-1")
+	require.NoError(t, os.WriteFile(executable, []byte("old"), 0o755))
+	require.NoError(t, os.WriteFile(newBinary, []byte("new"), 0o755))
+
+	require.NoError(t, replaceExecutable(executable, newBinary))
+	content, err := os.ReadFile(executable)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(content))
+	_, err = os.Stat(newBinary)
+	require.True(t, os.IsNotExist(err), "the new binary should be moved")
+
+	// the executable is kept if the new binary is missing
+	err = replaceExecutable(executable, newBinary)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to")
+	content, err = os.ReadFile(executable)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(content))
+}
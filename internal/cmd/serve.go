@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/kurun/tunnel/pkg/tlstools"
+)
+
+type serveParams struct {
+	files     fileHandlerParams
+	port      int
+	tls       bool
+	tlsSecret string
+}
+
+// NewServeCommand returns the command serving a local directory over HTTP(S), e.g. to share build artifacts with
+// in-cluster consumers through `kurun port-forward`
+func NewServeCommand(rootParams *rootCommandParams) *cobra.Command {
+	params := serveParams{
+		files: fileHandlerParams{
+			listDirs: true,
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:   "serve [flags] [dir]",
+		Short: "Serve a local directory over HTTP(S)",
+		Long: "Serve a local directory (the current one by default) over HTTP(S), optionally with the certificate of a " +
+			"Kubernetes TLS secret, e.g. to expose it to the cluster with `kurun port-forward`.",
+		Example: "kurun serve --spa --port 8080 ./build",
+		Args:    cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			params.files.dir = "."
+			if len(args) > 0 {
+				params.files.dir = args[0]
+			}
+			if info, err := os.Stat(params.files.dir); err != nil {
+				return errors.WrapIf(err, "cannot serve directory")
+			} else if !info.IsDir() {
+				return errors.NewWithDetails("cannot serve a file, expected a directory", "dir", params.files.dir)
+			}
+
+			cmd.SilenceUsage = true // all args and flags validated before this line
+
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+			return serve(ctx, rootParams, rootParams.namespace, params, rootParams.logger)
+		},
+	}
+
+	cmd.PersistentFlags().IntVarP(&params.port, "port", "p", 8000, "Port to listen on")
+	cmd.PersistentFlags().BoolVar(&params.tls, "tls", false, "Listen with TLS, with a self-signed certificate unless --tlssecret is specified")
+	cmd.PersistentFlags().StringVar(&params.tlsSecret, "tlssecret", "", "Kubernetes TLS secret ([namespace/]name) to load the certificate from, implies --tls")
+	cmd.PersistentFlags().BoolVar(&params.files.spa, "spa", false, "Serve index.html for the missing paths without a file extension, for single page applications with client-side routing")
+	cmd.PersistentFlags().BoolVar(&params.files.listDirs, "list-dirs", true, "List the files of the directories without an index.html")
+	cmd.PersistentFlags().BoolVar(&params.files.upload, "upload", false, "Accept PUT and POST (multipart form) uploads into the directory")
+
+	return cmd
+}
+
+func serve(ctx context.Context, rootParams *rootCommandParams, namespace string, params serveParams, logger logr.Logger) error {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", params.port),
+		Handler: newFileHandler(params.files, logger),
+	}
+	if params.tls || params.tlsSecret != "" {
+		cert, err := serveCertificate(ctx, rootParams, namespace, params.tlsSecret)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	var err error
+	if server.TLSConfig != nil {
+		fmt.Fprintf(os.Stdout, "Serving %s on https://localhost:%d\n", params.files.dir, params.port)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		fmt.Fprintf(os.Stdout, "Serving %s on http://localhost:%d\n", params.files.dir, params.port)
+		err = server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return listenError(err, params.port)
+}
+
+// serveCertificate loads the certificate of the TLS secret, or generates a self-signed one for localhost if not
+// specified
+func serveCertificate(ctx context.Context, rootParams *rootCommandParams, namespace, tlsSecret string) (tls.Certificate, error) {
+	if tlsSecret == "" {
+		caCert, caKey, err := tlstools.GenerateSelfSignedCA()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tlstools.GenerateTLSCert(caCert, caKey, big.NewInt(1), []string{"localhost"}, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")})
+	}
+
+	kubeClient, err := newKubeClient(rootParams)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key := client.ObjectKey{
+		Namespace: namespace,
+		Name:      tlsSecret,
+	}
+	if parts := strings.SplitN(tlsSecret, string(types.Separator), 2); len(parts) == 2 {
+		key.Namespace, key.Name = parts[0], parts[1]
+	}
+	var secret corev1.Secret
+	if err := kubeClient.Get(ctx, key, &secret); err != nil {
+		return tls.Certificate{}, errors.WrapIfWithDetails(err, "failed to get TLS secret", "secret", key)
+	}
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	return cert, errors.WrapIfWithDetails(err, "invalid TLS secret", "secret", key)
+}
+
+// fileHandlerParams are the settings of the handlers serving local directories
+type fileHandlerParams struct {
+	dir      string
+	listDirs bool
+	spa      bool
+	upload   bool
+}
+
+// newFileHandler returns the handler serving the files of the directory, and accepting uploads into it if enabled
+func newFileHandler(params fileHandlerParams, logger logr.Logger) http.Handler {
+	fileServer := http.FileServer(serveFileSystem{
+		FileSystem: http.Dir(params.dir),
+		params:     params,
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.Info("request received", "method", r.Method, "path", r.URL.Path)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			fileServer.ServeHTTP(w, r)
+		case http.MethodPut, http.MethodPost:
+			if !params.upload {
+				http.Error(w, "uploads are disabled", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := handleUpload(params.dir, r); err != nil {
+				logger.Error(err, "upload failed", "path", r.URL.Path)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// serveFileSystem hides the directories without an index.html unless listing them is enabled, and falls back to the
+// root index.html for the single page applications
+type serveFileSystem struct {
+	http.FileSystem
+	params fileHandlerParams
+}
+
+func (fs serveFileSystem) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if errors.Is(err, os.ErrNotExist) && fs.params.spa && path.Ext(name) == "" {
+		return fs.FileSystem.Open("/index.html")
+	}
+	if err != nil || fs.params.listDirs {
+		return f, err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		index, err := fs.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			_ = f.Close()
+			return nil, os.ErrNotExist
+		}
+		_ = index.Close()
+	}
+	return f, nil
+}
+
+// handleUpload writes the body of the request to the file of its path, or the files of a multipart form into the
+// directory of its path
+func handleUpload(dir string, r *http.Request) error {
+	target := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return err
+		}
+		for {
+			part, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			name := part.FileName()
+			if name == "" {
+				continue // not a file
+			}
+			if err := writeUploadedFile(filepath.Join(target, filepath.Base(filepath.FromSlash(name))), part); err != nil {
+				return err
+			}
+		}
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/") {
+		return errors.New("the path of the uploaded file must not be a directory")
+	}
+	return writeUploadedFile(target, r.Body)
+}
+
+// writeUploadedFile writes the file through a temporary one, so it's not served partially
+func writeUploadedFile(name string, content io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+// serveDirScheme is the scheme of the downstream URLs of the local directories served by kurun itself
+const serveDirScheme = "file"
+
+// serveDirURL returns the downstream URL of the local directory served through the tunnel
+func serveDirURL(dir string) (*url.URL, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to resolve directory to serve", "dir", dir)
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "cannot serve directory", "dir", dir)
+	}
+	if !info.IsDir() {
+		return nil, errors.NewWithDetails("cannot serve a file, expected a directory", "dir", dir)
+	}
+	return &url.URL{
+		Scheme: serveDirScheme,
+		Path:   filepath.ToSlash(abs),
+	}, nil
+}
+
+// serveDirRoundTripper serves the requests received through the tunnel from the directory of the downstream URL
+func serveDirRoundTripper(downstreamURL *url.URL, logger logr.Logger) http.RoundTripper {
+	return tunnel.HandlerRoundTripper(newFileHandler(fileHandlerParams{
+		dir:      filepath.FromSlash(downstreamURL.Path),
+		listDirs: true,
+	}, logger.V(1)))
+}
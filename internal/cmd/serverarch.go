@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"context"
+	"sort"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// kurunServerArchs are the architectures the default kurun-server image is published for
+var kurunServerArchs = map[string]bool{
+	"amd64": true,
+	"arm":   true,
+	"arm64": true,
+}
+
+// serverImageSelection is the kurun-server image selected for the architectures of the nodes
+type serverImageSelection struct {
+	image string
+	// archs are the architectures of the nodes kurun-server has to be scheduled to, empty for any
+	archs []string
+}
+
+// selectServerImage selects the kurun-server image for the architectures of the Linux nodes of the cluster
+// The image of the configuration for the most common architecture of the nodes is used if there is any, otherwise the
+// default image, which is scheduled to the nodes of its architectures in mixed clusters. Images set with --server-image
+// are used as is, and so is the default image if the nodes cannot be listed.
+func selectServerImage(ctx context.Context, clientset kubernetes.Interface, image string, archImages map[string]string, logger logr.Logger) serverImageSelection {
+	selection := serverImageSelection{image: image}
+	if image != kurunServerImage {
+		return selection
+	}
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: corev1.LabelOSStable + "=" + linuxNodeOS,
+	})
+	if err != nil {
+		logger.V(1).Info("cannot list nodes to select the server image for their architecture", "error", err.Error())
+		return selection
+	}
+
+	nodeCounts := make(map[string]int)
+	for _, node := range nodes.Items {
+		if arch := node.Labels[corev1.LabelArchStable]; arch != "" && !node.Spec.Unschedulable {
+			nodeCounts[arch]++
+		}
+	}
+	archs := make([]string, 0, len(nodeCounts))
+	for arch := range nodeCounts {
+		archs = append(archs, arch)
+	}
+	sort.Slice(archs, func(i, j int) bool {
+		if nodeCounts[archs[i]] != nodeCounts[archs[j]] {
+			return nodeCounts[archs[i]] > nodeCounts[archs[j]]
+		}
+		return archs[i] < archs[j]
+	})
+
+	for _, arch := range archs {
+		if archImage := archImages[arch]; archImage != "" {
+			logger.V(1).Info("using the server image of the node architecture", "arch", arch, "image", archImage)
+			return serverImageSelection{image: archImage, archs: []string{arch}}
+		}
+	}
+
+	var supported []string
+	for _, arch := range archs {
+		if kurunServerArchs[arch] {
+			supported = append(supported, arch)
+		}
+	}
+	switch {
+	case len(supported) == 0 && len(archs) > 0:
+		logger.Info("WARNING: the server image is not available for the architectures of the nodes, set an image for them in server.images of the config file", "archs", archs)
+	case len(supported) < len(archs):
+		selection.archs = supported
+	}
+	return selection
+}
+
+// apply sets the image of the kurun-server container, and schedules the pod to the nodes of the selected
+// architectures
+func (s serverImageSelection) apply(spec *corev1.PodSpec, containerName string) {
+	for i := range spec.Containers {
+		if spec.Containers[i].Name == containerName {
+			spec.Containers[i].Image = s.image
+		}
+	}
+	if len(s.archs) == 0 {
+		return
+	}
+
+	requirement := corev1.NodeSelectorRequirement{
+		Key:      corev1.LabelArchStable,
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   s.archs,
+	}
+	if spec.Affinity == nil {
+		spec.Affinity = &corev1.Affinity{}
+	}
+	if spec.Affinity.NodeAffinity == nil {
+		spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	required := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil {
+		required = &corev1.NodeSelector{}
+		spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required
+	}
+	if len(required.NodeSelectorTerms) == 0 {
+		required.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	// the terms are ORed, the requirement has to be met by all of them
+	for i := range required.NodeSelectorTerms {
+		required.NodeSelectorTerms[i].MatchExpressions = append(required.NodeSelectorTerms[i].MatchExpressions, requirement)
+	}
+}
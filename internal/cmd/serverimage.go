@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+)
+
+// loadServerImage makes the kurun-server image of the local container engine available to the cluster, so clusters
+// without access to the default registry (e.g. air-gapped ones) can run it: the image is loaded into the nodes of
+// local clusters (KinD and k3d), and pushed to its registry otherwise
+// If the image isn't in the local engine, but the default one is (e.g. loaded from an archive), it's tagged as the
+// image first, so --server-image can refer to a registry reachable by the cluster.
+func loadServerImage(image string, engineName string, output *outputPrinter, logger logr.Logger) error {
+	engine, err := newContainerEngine(engineName)
+	if err != nil {
+		return err
+	}
+
+	if !engine.HasImage(image) {
+		if image == kurunServerImage || !engine.HasImage(kurunServerImage) {
+			return withHint(
+				errors.Errorf("image %s not found in the local container engine", image),
+				"pull the image where the registry is reachable and load it into the local container engine, e.g. with docker save and docker load",
+				troubleshootingURL,
+			)
+		}
+		if err := engine.Tag(kurunServerImage, image); err != nil {
+			return errors.WrapIfWithDetails(err, "failed to tag server image", "image", image)
+		}
+	}
+
+	cluster, err := detectLocalCluster()
+	if err != nil {
+		return err
+	}
+	if cluster.typ != clusterTypeNone {
+		output.Statusf("Loading image %s into the %s cluster", image, cluster.name)
+		if err := engine.LoadIntoCluster(image, cluster, logger); err != nil {
+			return loadImageError(errors.WrapIf(err, "failed to load server image into cluster"), cluster)
+		}
+		return nil
+	}
+
+	if image == kurunServerImage {
+		return errors.New("--server-image must refer to a registry reachable by the cluster to push the image to")
+	}
+	output.Statusf("Pushing image %s", image)
+	return errors.WrapIfWithDetails(engine.Push(image), "failed to push server image", "image", image)
+}
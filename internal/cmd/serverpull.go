@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// serverImageHint is the remediation of the kurun-server pods failing to pull the server image
+const serverImageHint = "use an image the cluster can pull, e.g. from a mirror, with --server-image, or bring the image along from the local container engine in air-gapped clusters with --load-server-image"
+
+// waitForServerImage runs the wait for the kurun-server pods, and stops it as soon as they cannot pull the server image,
+// so the command fails with the registry error instead of a timeout
+func waitForServerImage(ctx context.Context, clientset kubernetes.Interface, namespace string, listOptions metav1.ListOptions, containerName string, wait func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var pullErr error
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		if pullErr = watchServerImagePull(ctx, clientset, namespace, listOptions, containerName); pullErr != nil {
+			cancel()
+		}
+	}()
+
+	err := wait(ctx)
+	cancel()
+	<-watched
+	if err != nil && pullErr != nil {
+		return pullErr
+	}
+	return err
+}
+
+// watchServerImagePull polls the pods until the context is cancelled, and returns the error of the first one failing
+// to pull the image of the container
+func watchServerImagePull(ctx context.Context, clientset kubernetes.Interface, namespace string, listOptions metav1.ListOptions, containerName string) error {
+	for {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, listOptions)
+		if err == nil {
+			for i := range pods.Items {
+				if err := serverImagePullError(ctx, clientset, &pods.Items[i], containerName); err != nil {
+					return err
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// serverImagePullError returns the hint error of the container of the pod failing to pull its image with the error of
+// the registry, nil if it doesn't fail
+func serverImagePullError(ctx context.Context, clientset kubernetes.Interface, pod *corev1.Pod, containerName string) error {
+	for _, status := range pod.Status.ContainerStatuses {
+		waiting := status.State.Waiting
+		if status.Name != containerName || waiting == nil {
+			continue
+		}
+		switch waiting.Reason {
+		case "ErrImagePull", "ImagePullBackOff", "InvalidImageName":
+		default:
+			continue
+		}
+
+		message := strings.TrimSpace(waiting.Message)
+		// the message of ImagePullBackOff is only the back-off, the registry error is in the events of the kubelet
+		if pullFailure := lastPullFailure(ctx, clientset, pod); pullFailure != "" {
+			message = pullFailure
+		}
+		return withHint(
+			errors.WithDetails(errors.New("kurun-server cannot pull its image"), "pod", pod.Name, "image", status.Image, "reason", waiting.Reason, "error", message),
+			serverImageHint,
+			troubleshootingURL,
+		)
+	}
+	return nil
+}
+
+// lastPullFailure returns the message of the last event of the kubelet failing to pull an image of the pod, empty if
+// there is none
+func lastPullFailure(ctx context.Context, clientset kubernetes.Interface, pod *corev1.Pod) string {
+	events, err := clientset.CoreV1().Events(pod.Namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: "type=Warning,reason=Failed,involvedObject.kind=Pod,involvedObject.name=" + pod.Name,
+	})
+	if err != nil {
+		return ""
+	}
+
+	var message string
+	var last time.Time
+	for i := range events.Items {
+		event := &events.Items[i]
+		// e.g. Failed to pull image "...": rpc error: ... not found
+		if !strings.HasPrefix(event.Message, "Failed to pull image") || eventTime(event).Before(last) {
+			continue
+		}
+		message, last = strings.TrimSpace(event.Message), eventTime(event)
+	}
+	return message
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultShellImage = "busybox"
+	shellToolsDir     = "/kurun-tools"
+)
+
+// addShellTools changes the pod spec to copy a statically linked busybox from the shell image into the first container,
+// so a shell (and the basic tools) is available even if the image built from local source has none (e.g. distroless)
+func addShellTools(spec *corev1.PodSpec, shellImage string) {
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "kurun-tools",
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	})
+
+	toolsMount := corev1.VolumeMount{
+		Name:      "kurun-tools",
+		MountPath: shellToolsDir,
+	}
+
+	spec.InitContainers = append(spec.InitContainers, corev1.Container{
+		Name:    "kurun-tools",
+		Image:   shellImage,
+		Command: []string{"sh", "-c", "cp /bin/busybox " + shellToolsDir + "/ && " + shellToolsDir + "/busybox --install -s " + shellToolsDir},
+		VolumeMounts: []corev1.VolumeMount{
+			toolsMount,
+		},
+	})
+
+	container := &spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, toolsMount)
+	// the tools of the image take precedence
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "PATH",
+		Value: "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:" + shellToolsDir,
+	})
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const sidecarContainerName = "kurun-tunnel-server"
+
+// kurunVolumePrefix is the prefix of the names of the volumes kurun adds to the pods, the volumes of the workload are
+// never replaced or removed by the sidecar
+const kurunVolumePrefix = "kurun-"
+
+// tlsVolumeNamePrefix is the prefix of the names of the volumes of the certificates of kurun-server, followed by the
+// name of the port serving the certificate
+const tlsVolumeNamePrefix = kurunVolumePrefix + "tls-"
+
+// injectSidecar adds the specified container and volumes to the pod template of the deployment
+func injectSidecar(ctx context.Context, kubeClient client.Client, key client.ObjectKey, container corev1.Container, volumes []corev1.Volume) (*appsv1.Deployment, error) {
+	deployment := &appsv1.Deployment{}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := kubeClient.Get(ctx, key, deployment); err != nil {
+			return err
+		}
+
+		podSpec := &deployment.Spec.Template.Spec
+		podSpec.Containers = append(removeContainer(podSpec.Containers, container.Name), container)
+		for _, volume := range volumes {
+			podSpec.Volumes = append(removeVolume(podSpec.Volumes, volume.Name), volume)
+		}
+
+		return kubeClient.Update(ctx, deployment)
+	})
+	return deployment, err
+}
+
+// removeSidecar removes the specified container and volumes from the pod template of the deployment
+func removeSidecar(ctx context.Context, kubeClient client.Client, key client.ObjectKey, containerName string, volumes []corev1.Volume) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment := &appsv1.Deployment{}
+		if err := kubeClient.Get(ctx, key, deployment); err != nil {
+			return err
+		}
+
+		podSpec := &deployment.Spec.Template.Spec
+		podSpec.Containers = removeContainer(podSpec.Containers, containerName)
+		for _, volume := range volumes {
+			podSpec.Volumes = removeVolume(podSpec.Volumes, volume.Name)
+		}
+
+		return kubeClient.Update(ctx, deployment)
+	})
+}
+
+func removeContainer(containers []corev1.Container, name string) []corev1.Container {
+	result := make([]corev1.Container, 0, len(containers))
+	for _, c := range containers {
+		if c.Name != name {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// removeVolume removes the volume added by kurun with the specified name, the volumes of the workload are kept
+func removeVolume(volumes []corev1.Volume, name string) []corev1.Volume {
+	result := make([]corev1.Volume, 0, len(volumes))
+	for _, v := range volumes {
+		if v.Name != name || !strings.HasPrefix(v.Name, kurunVolumePrefix) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// hasRolledOut returns whether the latest pod template of the deployment has been rolled out and is available
+func hasRolledOut(deployment *appsv1.Deployment) bool {
+	if deployment == nil || deployment.Status.ObservedGeneration < deployment.Generation {
+		return false
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	return deployment.Status.UpdatedReplicas == replicas &&
+		deployment.Status.AvailableReplicas == replicas &&
+		deployment.Status.Replicas == replicas
+}
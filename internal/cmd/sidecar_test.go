@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSidecarVolumes(t *testing.T) {
+	// the workload mounts the same secret kurun-server serves its certificate from
+	workloadVolume := corev1.Volume{
+		Name: "certs",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "app-tls"},
+		},
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app"}},
+					Volumes:    []corev1.Volume{workloadVolume},
+				},
+			},
+		},
+	}
+	kubeClient := fake.NewClientBuilder().WithObjects(deployment).Build()
+	key := client.ObjectKeyFromObject(deployment)
+
+	container, volumes := newTunnelServerContainer(tunnelServerParams{tlsSecret: "app-tls"}, corev1.ContainerPort{Name: "request", ContainerPort: 8444}, corev1.ContainerPort{Name: "control", ContainerPort: 8333})
+	container.Name = sidecarContainerName
+	require.Len(t, volumes, 1)
+	require.Equal(t, "kurun-tls-request", volumes[0].Name)
+	require.Equal(t, "kurun-tls-request", container.VolumeMounts[0].Name)
+
+	// the volumes of kurun-server are replaced, not duplicated, when the sidecar is injected again
+	for i := 0; i < 2; i++ {
+		injected, err := injectSidecar(context.Background(), kubeClient, key, container, volumes)
+		require.NoError(t, err)
+		require.Len(t, injected.Spec.Template.Spec.Containers, 2)
+		require.Equal(t, []corev1.Volume{workloadVolume, volumes[0]}, injected.Spec.Template.Spec.Volumes)
+	}
+
+	// the volumes of the workload are kept, even if they are passed with the volumes to remove
+	require.NoError(t, removeSidecar(context.Background(), kubeClient, key, container.Name, append(volumes, workloadVolume)))
+	removed := &appsv1.Deployment{}
+	require.NoError(t, kubeClient.Get(context.Background(), key, removed))
+	require.Equal(t, []corev1.Container{{Name: "app"}}, removed.Spec.Template.Spec.Containers)
+	require.Equal(t, []corev1.Volume{workloadVolume}, removed.Spec.Template.Spec.Volumes)
+}
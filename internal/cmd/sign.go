@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+)
+
+// signImage signs the pushed image with cosign, using the specified key or the keyless (OIDC) flow if key is empty
+func signImage(image builtImage, key string, logger logr.Logger) error {
+	if image.engine != "" {
+		return errors.NewWithDetails("only images pushed to a registry can be signed, use --build-in-cluster with --registry", "image", image.ref)
+	}
+
+	if _, err := exec.LookPath("cosign"); err != nil {
+		return errors.WrapIf(err, "image signing requires cosign to be installed")
+	}
+
+	cosignArgs := []string{"sign", "--yes"}
+	if key != "" {
+		cosignArgs = append(cosignArgs, "--key", key)
+	}
+	cosignArgs = append(cosignArgs, image.ref)
+
+	cosignCommand := exec.Command("cosign", cosignArgs...)
+	cosignCommand.Stdin = os.Stdin // for key password and OIDC prompts
+	cosignCommand.Stderr = os.Stderr
+	cosignCommand.Stdout = commandStdout
+	if key == "" {
+		cosignCommand.Env = append(os.Environ(), "COSIGN_EXPERIMENTAL=1")
+	}
+
+	logger.Info("signing image", "command", cosignCommand.String())
+
+	return errors.WrapIfWithDetails(cosignCommand.Run(), "failed to sign image", "image", image.ref)
+}
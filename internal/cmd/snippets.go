@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// curlImage is the image of the debug pod sending a request to the forwarded endpoint in the printed curl command
+const curlImage = "curlimages/curl"
+
+// caCertKey is the key of the CA certificate in TLS secrets, e.g. the ones issued by cert-manager
+const caCertKey = "ca.crt"
+
+// endpointSnippets are the ready to use details of the endpoint forwarded by port-forward
+type endpointSnippets struct {
+	// url is the in-cluster URL of the endpoint
+	url string
+	// curl is a command sending a request to the endpoint from a debug pod
+	curl string
+	// caBundle is the base64 encoded CA bundle for the clientConfig of webhook configurations, empty without TLS
+	caBundle string
+}
+
+// newEndpointSnippets returns the snippets of the forwarded endpoint, the CA bundle is read from the TLS secret of
+// kurun-server if any
+func newEndpointSnippets(ctx context.Context, clientset kubernetes.Interface, namespace, url string, params tunnelServerParams, logger logr.Logger) endpointSnippets {
+	curl := []string{"kubectl", "run", "kurun-curl", "--namespace", namespace, "--rm", "-it", "--restart=Never", "--image=" + curlImage, "--", "curl", "-sS"}
+	if params.tlsSecret != "" {
+		// the debug pod doesn't have the CA bundle
+		curl = append(curl, "--insecure")
+	}
+	if params.authSecret != "" {
+		curl = append(curl, "-H", shellQuote("Authorization: Bearer <token of "+params.authSecret+">"))
+	}
+	snippets := endpointSnippets{
+		url:  url,
+		curl: strings.Join(append(curl, url), " "),
+	}
+
+	if params.tlsSecret != "" {
+		caBundle, err := readCABundle(ctx, clientset, namespace, params.tlsSecret)
+		if err != nil {
+			logger.Info("cannot get the CA bundle of the endpoint", "error", err.Error())
+		}
+		snippets.caBundle = caBundle
+	}
+
+	return snippets
+}
+
+// readCABundle returns the base64 encoded CA certificate of the TLS secret, or the certificate itself for secrets
+// without CA (e.g. self-signed certificates)
+func readCABundle(ctx context.Context, clientset kubernetes.Interface, namespace, name string) (string, error) {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.WrapIfWithDetails(err, "failed to get TLS secret", "secret", name)
+	}
+	caCert := secret.Data[caCertKey]
+	if len(caCert) == 0 {
+		caCert = secret.Data[corev1.TLSCertKey]
+	}
+	if len(caCert) == 0 {
+		return "", errors.NewWithDetails("TLS secret has no certificate", "secret", name)
+	}
+	return base64.StdEncoding.EncodeToString(caCert), nil
+}
+
+// print prints the snippets as status lines
+func (s endpointSnippets) print(output *outputPrinter) {
+	output.Statusf("  In-cluster URL:   %s", s.url)
+	output.Statusf("  Test from a pod:  %s", s.curl)
+	if s.caBundle != "" {
+		output.Statusf("  Webhook caBundle: %s", s.caBundle)
+	}
+}
+
+// writeEnv writes the snippets to the file as shell variable assignments, so other tools can source it
+func (s endpointSnippets) writeEnv(path string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "KURUN_URL=%s\n", shellQuote(s.url))
+	fmt.Fprintf(&b, "KURUN_CURL=%s\n", shellQuote(s.curl))
+	fmt.Fprintf(&b, "KURUN_CA_BUNDLE=%s\n", shellQuote(s.caBundle))
+	err := os.WriteFile(path, []byte(b.String()), 0o644)
+	return errors.WrapIfWithDetails(err, "failed to write endpoint details", "path", path)
+}
+
+// shellQuote quotes the string for POSIX shells
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	tunnelssh "github.com/banzaicloud/kurun/tunnel/ssh"
+)
+
+// sshTunnelTransport is the built-in transport connecting to kurun-server through an sshd, for clusters where the
+// WebSocket upgrades through the API server proxy are blocked
+const sshTunnelTransport = "ssh"
+
+// sshPort is the port of the kurun-sshd sidecar, accepting the tunnel clients of the ssh transport
+const sshPort = 2222
+
+// sshParams are the settings of the SSH transport
+type sshParams struct {
+	addr            string
+	insecureHostKey bool
+	keyFile         string
+	knownHosts      string
+	sidecar         bool
+	target          string
+	user            string
+}
+
+func addSSHFlags(cmd *cobra.Command, params *sshParams) {
+	cmd.PersistentFlags().StringVar(&params.addr, "ssh-addr", "", "Address (host:port) of the sshd relaying the tunnel with --transport ssh, e.g. the ssh port of the kurun-sshd sidecar exposed by a LoadBalancer")
+	cmd.PersistentFlags().BoolVar(&params.sidecar, "ssh-sidecar", true, "Run the kurun-sshd sidecar next to kurun-server with keys generated for the session, disable it to connect through your own sshd (e.g. a bastion)")
+	cmd.PersistentFlags().StringVar(&params.target, "ssh-target", "", "URL of the control port of kurun-server reached from the sshd (default: localhost with --ssh-sidecar, the kurun-server service otherwise)")
+	cmd.PersistentFlags().StringVar(&params.user, "ssh-user", "kurun", "User to log in to the sshd as")
+	cmd.PersistentFlags().StringVar(&params.keyFile, "ssh-key", "", "Private key file to authenticate to your own sshd with (default the keys of the SSH agent)")
+	cmd.PersistentFlags().StringVar(&params.knownHosts, "ssh-known-hosts", "", "Known hosts file verifying the host key of your own sshd (default ~/.ssh/known_hosts)")
+	cmd.PersistentFlags().BoolVar(&params.insecureHostKey, "ssh-insecure-ignore-host-key", false, "Skip verifying the host key of your own sshd (insecure)")
+}
+
+func validateSSHParams(params sshParams) error {
+	if params.addr == "" {
+		return errors.New("--ssh-addr is required with --transport ssh")
+	}
+	if _, _, err := net.SplitHostPort(params.addr); err != nil {
+		return errors.Errorf("invalid --ssh-addr %q, expected host:port", params.addr)
+	}
+	if params.sidecar && (params.keyFile != "" || params.knownHosts != "" || params.insecureHostKey) {
+		return errors.New("--ssh-key, --ssh-known-hosts and --ssh-insecure-ignore-host-key require --ssh-sidecar=false, the keys of the sidecar are generated for the session")
+	}
+	return nil
+}
+
+// sshCredentials are the keys of the kurun-sshd sidecar and the tunnel client, generated for each session
+type sshCredentials struct {
+	clientKey ssh.Signer
+	hostKey   ssh.Signer
+	// hostKeyPEM is the private host key passed to the sidecar
+	hostKeyPEM []byte
+}
+
+func newSSHCredentials() (*sshCredentials, error) {
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyDER, err := x509.MarshalPKCS8PrivateKey(hostKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sshCredentials{
+		clientKey:  clientSigner,
+		hostKey:    hostSigner,
+		hostKeyPEM: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: hostKeyDER}),
+	}, nil
+}
+
+// newSSHSecret returns the secret passing the credentials to the kurun-sshd sidecar, mounted by newSSHSidecarContainer
+func newSSHSecret(namespace, name string, labels map[string]string, credentials *sshCredentials) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    copyLabels(labels),
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"authorized_keys": ssh.MarshalAuthorizedKey(credentials.clientKey.PublicKey()),
+			"ssh_host_key":    credentials.hostKeyPEM,
+		},
+	}
+}
+
+// newSSHSidecarContainer returns the kurun-sshd container, only forwarding the connections of the tunnel client to the
+// control port of kurun-server, and the volume of its secret
+// It runs from the image of kurun-server, which is set by the caller like on the kurun-server container.
+func newSSHSidecarContainer(params tunnelServerParams, secretName string, controlPort corev1.ContainerPort) (corev1.Container, corev1.Volume) {
+	container := corev1.Container{
+		Name:            "kurun-sshd",
+		Image:           params.image,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command:         []string{"/kurun-sshd"},
+		Args: []string{
+			"--addr",
+			fmt.Sprintf(":%d", sshPort),
+			"--authorized-keys",
+			"/etc/kurun-ssh/authorized_keys",
+			"--host-key",
+			"/etc/kurun-ssh/ssh_host_key",
+			"--permit-target",
+			net.JoinHostPort("localhost", strconv.Itoa(int(controlPort.ContainerPort))),
+		},
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "ssh",
+				ContainerPort: sshPort,
+			},
+		},
+		Resources: params.resources,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "kurun-ssh",
+				MountPath: "/etc/kurun-ssh",
+				ReadOnly:  true,
+			},
+		},
+	}
+	if params.hardening {
+		container.SecurityContext = newRestrictedSecurityContext(params.runAsUser)
+	}
+	volume := corev1.Volume{
+		Name: "kurun-ssh",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secretName,
+			},
+		},
+	}
+	return container, volume
+}
+
+// sshSidecarTarget returns the URL of the control port of kurun-server reached from the kurun-sshd sidecar
+func sshSidecarTarget(controlPort corev1.ContainerPort) string {
+	return "wss://" + net.JoinHostPort("localhost", strconv.Itoa(int(controlPort.ContainerPort))) + "/"
+}
+
+// defaultSSHTarget returns the URL of the control port of the kurun-server service reached from your own sshd
+func defaultSSHTarget(target tunnelTarget) (string, error) {
+	if target.resources != "services" {
+		return "", errors.New("--ssh-target is required to connect to a pod with --transport ssh")
+	}
+	return fmt.Sprintf("wss://%s.%s.svc:%s/", target.name, target.namespace, target.port), nil
+}
+
+// sshClientConfig returns the config authenticating with the generated credentials of the sidecar if they're not nil,
+// otherwise with the key file or the SSH agent, verifying the host key with the known hosts; closeAgent closes the
+// connection to the agent, which signs each (re)connection with the config
+func sshClientConfig(params sshParams, credentials *sshCredentials, logger logr.Logger) (config *ssh.ClientConfig, closeAgent func(), err error) {
+	config = &ssh.ClientConfig{
+		User:    params.user,
+		Timeout: 30 * time.Second,
+	}
+	closeAgent = func() {}
+	defer func() {
+		if err != nil {
+			closeAgent()
+		}
+	}()
+
+	if credentials != nil {
+		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(credentials.clientKey)}
+		config.HostKeyCallback = ssh.FixedHostKey(credentials.hostKey.PublicKey())
+		return config, closeAgent, nil
+	}
+
+	if params.keyFile != "" {
+		key, err := os.ReadFile(params.keyFile)
+		if err != nil {
+			return nil, closeAgent, errors.WrapIfWithDetails(err, "failed to read SSH key", "path", params.keyFile)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, closeAgent, errors.WrapIfWithDetails(err, "failed to parse SSH key", "path", params.keyFile)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	} else if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, closeAgent, errors.WrapIf(err, "failed to connect to the SSH agent")
+		}
+		closeAgent = func() { _ = conn.Close() }
+		config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	} else {
+		return nil, closeAgent, errors.New("no SSH credentials, use --ssh-key or an SSH agent")
+	}
+
+	if params.insecureHostKey {
+		logger.Info("WARNING: the sshd host key is not verified, requests may be intercepted", "addr", params.addr)
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return config, closeAgent, nil
+	}
+	knownHosts := params.knownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, closeAgent, errors.WrapIf(err, "failed to find the known hosts file")
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, closeAgent, errors.WrapIfWithDetails(err, "failed to read known hosts", "path", knownHosts)
+	}
+	config.HostKeyCallback = hostKeyCallback
+	return config, closeAgent, nil
+}
+
+// runSSHTunnelClient relays the requests received from kurun-server through the sshd to the round tripper, and
+// reconnects when the connection is closed
+func runSSHTunnelClient(ctx context.Context, params sshParams, credentials *sshCredentials, maxFrameSize int, roundTripper http.RoundTripper, stats *tunnel.Stats, handleEvent tunnel.ConnectionEventHandler, logger logr.Logger) error {
+	config, closeAgent, err := sshClientConfig(params, credentials, logger)
+	if err != nil {
+		return err
+	}
+	defer closeAgent()
+
+	logger.V(1).Info("connecting to kurun-server through the sshd", "addr", params.addr, "target", params.target)
+	stats.RecordConnection()
+	return tunnel.RunClient(ctx, *tunnel.NewClientConfig(
+		params.addr,
+		roundTripper,
+		tunnel.WithLogger(logger),
+		tunnel.WithMaxFrameSize(maxFrameSize),
+		tunnel.WithReconnect(time.Second, 30*time.Second),
+		tunnel.WithConnectionEventHandler(func(event tunnel.ConnectionEvent) {
+			// each reconnection attempt dials the sshd again
+			if event.Type == tunnel.ConnectionEventReconnecting {
+				stats.RecordConnection()
+			}
+			handleEvent(event)
+		}),
+		tunnel.WithTransport(tunnelssh.Transport{
+			Config: config,
+			Logger: logger,
+			Target: params.target,
+			// the control port of kurun-server has a self-signed certificate, the sshd is authenticated by its host key
+			// and only forwards to the kurun-server next to it (or the one of --ssh-target through your own sshd)
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		}),
+	))
+}
@@ -0,0 +1,333 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	tunnelssh "github.com/banzaicloud/kurun/tunnel/ssh"
+	tunnelws "github.com/banzaicloud/kurun/tunnel/websocket"
+)
+
+func TestValidateSSHParams(t *testing.T) {
+	testCases := map[string]struct {
+		params sshParams
+		err    string
+	}{
+		"sidecar": {
+			params: sshParams{addr: "203.0.113.10:2222", sidecar: true},
+		},
+		"own sshd": {
+			params: sshParams{addr: "bastion.example.com:22", keyFile: "id_ed25519", knownHosts: "known_hosts"},
+		},
+		"own sshd without verifying the host key": {
+			params: sshParams{addr: "[::1]:22", insecureHostKey: true},
+		},
+		"missing address": {
+			params: sshParams{sidecar: true},
+			err:    "--ssh-addr is required",
+		},
+		"address without port": {
+			params: sshParams{addr: "bastion.example.com", sidecar: true},
+			err:    "invalid --ssh-addr",
+		},
+		"key file with sidecar": {
+			params: sshParams{addr: "203.0.113.10:2222", keyFile: "id_ed25519", sidecar: true},
+			err:    "require --ssh-sidecar=false",
+		},
+		"known hosts with sidecar": {
+			params: sshParams{addr: "203.0.113.10:2222", knownHosts: "known_hosts", sidecar: true},
+			err:    "require --ssh-sidecar=false",
+		},
+		"insecure host key with sidecar": {
+			params: sshParams{addr: "203.0.113.10:2222", insecureHostKey: true, sidecar: true},
+			err:    "require --ssh-sidecar=false",
+		},
+	}
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			err := validateSSHParams(testCase.params)
+			if testCase.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), testCase.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func newTestSSHKey(t *testing.T) (ssh.Signer, ed25519.PrivateKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer, key
+}
+
+// testSSHServer serves an in-process sshd on a loopback port and keeps its connections, so they can be dropped
+type testSSHServer struct {
+	addr  string
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startTestSSHServer(t *testing.T, hostKey ssh.Signer, authorizedKeys []ssh.PublicKey, permittedTargets ...string) *testSSHServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	server := tunnelssh.NewServer(hostKey, authorizedKeys, tunnelssh.WithPermittedTargets(permittedTargets))
+	s := &testSSHServer{addr: listener.Addr().String()}
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, netConn)
+			s.mu.Unlock()
+			go server.ServeConn(netConn)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, netConn := range s.conns {
+		_ = netConn.Close()
+	}
+	s.conns = nil
+}
+
+// requireSSHLogin checks the config logs in to the sshd
+func requireSSHLogin(t *testing.T, addr string, config *ssh.ClientConfig) {
+	client, err := ssh.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+}
+
+func TestSSHClientConfig(t *testing.T) {
+	hostKey, _ := newTestSSHKey(t)
+	clientKey, clientPrivateKey := newTestSSHKey(t)
+	server := startTestSSHServer(t, hostKey, []ssh.PublicKey{clientKey.PublicKey()})
+	dir := t.TempDir()
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(clientPrivateKey)
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, "id_ed25519")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	require.NoError(t, os.WriteFile(knownHostsFile, []byte(knownhosts.Line([]string{server.addr}, hostKey.PublicKey())+"\n"), 0o600))
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	t.Run("key file and known hosts", func(t *testing.T) {
+		config, closeAgent, err := sshClientConfig(sshParams{addr: server.addr, keyFile: keyFile, knownHosts: knownHostsFile, user: "kurun"}, nil, logr.Discard())
+		require.NoError(t, err)
+		defer closeAgent()
+		require.Equal(t, "kurun", config.User)
+		requireSSHLogin(t, server.addr, config)
+
+		// the host keys not in the known hosts are rejected
+		otherHostKey, _ := newTestSSHKey(t)
+		otherServer := startTestSSHServer(t, otherHostKey, []ssh.PublicKey{clientKey.PublicKey()})
+		_, err = ssh.Dial("tcp", otherServer.addr, config)
+		require.Error(t, err)
+	})
+
+	t.Run("insecure host key", func(t *testing.T) {
+		config, closeAgent, err := sshClientConfig(sshParams{addr: server.addr, insecureHostKey: true, keyFile: keyFile, knownHosts: "missing"}, nil, logr.Discard())
+		require.NoError(t, err)
+		defer closeAgent()
+		requireSSHLogin(t, server.addr, config)
+	})
+
+	t.Run("agent", func(t *testing.T) {
+		keyring := agent.NewKeyring()
+		require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: clientPrivateKey}))
+		listener, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_ = agent.ServeAgent(keyring, conn)
+				}()
+			}
+		}()
+		t.Setenv("SSH_AUTH_SOCK", listener.Addr().String())
+
+		config, closeAgent, err := sshClientConfig(sshParams{addr: server.addr, knownHosts: knownHostsFile}, nil, logr.Discard())
+		require.NoError(t, err)
+		defer closeAgent()
+		requireSSHLogin(t, server.addr, config)
+	})
+
+	t.Run("generated credentials", func(t *testing.T) {
+		credentials, err := newSSHCredentials()
+		require.NoError(t, err)
+		secret := newSSHSecret("default", "kurun-ssh", map[string]string{"app": "kurun"}, credentials)
+		require.Equal(t, corev1.SecretTypeOpaque, secret.Type)
+		// the sidecar reads the keys of the secret
+		sidecarHostKey, err := ssh.ParsePrivateKey(secret.Data["ssh_host_key"])
+		require.NoError(t, err)
+		authorizedKey, _, _, _, err := ssh.ParseAuthorizedKey(secret.Data["authorized_keys"])
+		require.NoError(t, err)
+		sidecar := startTestSSHServer(t, sidecarHostKey, []ssh.PublicKey{authorizedKey})
+
+		// the key file and the known hosts are not used
+		config, closeAgent, err := sshClientConfig(sshParams{addr: sidecar.addr, keyFile: "missing", knownHosts: "missing"}, credentials, logr.Discard())
+		require.NoError(t, err)
+		defer closeAgent()
+		requireSSHLogin(t, sidecar.addr, config)
+
+		// only the host key of the session is accepted
+		_, err = ssh.Dial("tcp", server.addr, config)
+		require.Error(t, err)
+	})
+
+	errorCases := map[string]struct {
+		params sshParams
+		err    string
+	}{
+		"no credentials":      {params: sshParams{knownHosts: knownHostsFile}, err: "no SSH credentials"},
+		"missing key file":    {params: sshParams{keyFile: filepath.Join(dir, "missing"), knownHosts: knownHostsFile}, err: "failed to read SSH key"},
+		"invalid key file":    {params: sshParams{keyFile: knownHostsFile, knownHosts: knownHostsFile}, err: "failed to parse SSH key"},
+		"missing known hosts": {params: sshParams{keyFile: keyFile, knownHosts: filepath.Join(dir, "missing")}, err: "failed to read known hosts"},
+	}
+	for name, testCase := range errorCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			_, _, err := sshClientConfig(testCase.params, nil, logr.Discard())
+			require.Error(t, err)
+			require.Contains(t, err.Error(), testCase.err)
+		})
+	}
+}
+
+func TestSSHSidecarContainer(t *testing.T) {
+	controlPort := corev1.ContainerPort{Name: "control", ContainerPort: 8333}
+	container, volume := newSSHSidecarContainer(tunnelServerParams{hardening: true, image: "kurun-server", runAsUser: defaultServerUser}, "kurun-ssh", controlPort)
+
+	require.Equal(t, []string{"/kurun-sshd"}, container.Command)
+	require.Equal(t, []string{
+		"--addr", ":2222",
+		"--authorized-keys", "/etc/kurun-ssh/authorized_keys",
+		"--host-key", "/etc/kurun-ssh/ssh_host_key",
+		"--permit-target", "localhost:8333",
+	}, container.Args)
+	require.Equal(t, []corev1.ContainerPort{{Name: "ssh", ContainerPort: sshPort}}, container.Ports)
+	require.NotNil(t, container.SecurityContext)
+	require.Equal(t, "kurun-ssh", volume.Secret.SecretName)
+	require.Equal(t, volume.Name, container.VolumeMounts[0].Name)
+	require.Equal(t, "wss://localhost:8333/", sshSidecarTarget(controlPort))
+}
+
+func TestRunSSHTunnelClient(t *testing.T) {
+	tunnelServer := tunnelws.NewServer()
+	controlServer := httptest.NewServer(tunnelServer)
+	defer controlServer.Close()
+
+	credentials, err := newSSHCredentials()
+	require.NoError(t, err)
+	server := startTestSSHServer(t, credentials.hostKey, []ssh.PublicKey{credentials.clientKey.PublicKey()}, strings.TrimPrefix(controlServer.URL, "http://"))
+	params := sshParams{
+		addr:   server.addr,
+		target: "ws" + strings.TrimPrefix(controlServer.URL, "http"),
+		user:   "kurun",
+	}
+
+	events := make(chan tunnel.ConnectionEvent, 16)
+	stats := tunnel.NewStats()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- runSSHTunnelClient(ctx, params, credentials, 0, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Proto:      req.Proto,
+				ProtoMajor: req.ProtoMajor,
+				ProtoMinor: req.ProtoMinor,
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader("downstream " + req.URL.Path)),
+			}, nil
+		}), stats, func(event tunnel.ConnectionEvent) {
+			events <- event
+		}, logr.Discard())
+	}()
+
+	nextEvent := func() tunnel.ConnectionEvent {
+		select {
+		case event := <-events:
+			return event
+		case err := <-clientErr:
+			t.Fatalf("tunnel client exited: %v", err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("no connection event")
+		}
+		return tunnel.ConnectionEvent{}
+	}
+	roundTrip := func(path string) {
+		reqCtx, cancelReq := context.WithTimeout(ctx, 5*time.Second)
+		defer cancelReq()
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, path, nil)
+		require.NoError(t, err)
+		resp, err := tunnelServer.RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "downstream "+path, string(body))
+	}
+
+	require.Equal(t, tunnel.ConnectionEventConnected, nextEvent().Type)
+	roundTrip("/before")
+
+	// the client reconnects with a backoff when the sshd drops the connection
+	server.dropConns()
+	require.Equal(t, tunnel.ConnectionEventDisconnected, nextEvent().Type)
+	event := nextEvent()
+	require.Equal(t, tunnel.ConnectionEventReconnecting, event.Type)
+	require.Equal(t, 1, event.Attempt)
+	require.Equal(t, time.Second, event.Backoff)
+	require.Equal(t, tunnel.ConnectionEventConnected, nextEvent().Type)
+	roundTrip("/after")
+	require.Equal(t, 1, stats.Summary().Reconnects)
+
+	cancel()
+	select {
+	case err := <-clientErr:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel client not stopped")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyTerminalResize notifies about changes of the terminal size
+func notifyTerminalResize() (<-chan os.Signal, func()) {
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	return resized, func() {
+		signal.Stop(resized)
+	}
+}
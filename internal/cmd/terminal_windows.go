@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"os"
+	"time"
+)
+
+// notifyTerminalResize notifies about possible changes of the terminal size
+// There is no resize signal on Windows, so the size is polled.
+func notifyTerminalResize() (<-chan os.Signal, func()) {
+	resized := make(chan os.Signal, 1)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case resized <- nil:
+				default:
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return resized, func() {
+		ticker.Stop()
+		close(stop)
+	}
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewTestCommand(rootParams *rootCommandParams) *cobra.Command {
+	var podParams podRunParams
+	var buildParams imageBuildParams
+	var jsonOutput bool
+	var reportFile string
+
+	cmd := &cobra.Command{
+		Use:   "test [flags] [package] [-- test binary flags...]",
+		Short: "Just like `go test` but the test binary is executed inside Kubernetes, e.g. to run integration tests using in-cluster APIs.",
+		Example: `  kurun test ./pkg/controller -- -test.v -test.run TestReconcile
+  kurun test --serviceaccount e2e-tests ./e2e`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if dash := cmd.ArgsLenAtDash(); dash > 1 || (dash < 0 && len(args) > 1) {
+				return errors.New("only a single package can be tested")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pkg := "."
+			testArguments := args
+			if dash := cmd.ArgsLenAtDash(); dash != 0 && len(args) > 0 {
+				pkg = args[0]
+				testArguments = args[1:]
+			}
+
+			// tests are executed in the root directory of the image, so testdata is available at the expected relative path
+			if info, err := os.Stat(filepath.Join(pkg, "testdata")); err == nil && info.IsDir() && !podParams.binaryOnly {
+				buildParams.includes = append(buildParams.includes, filepath.Join(pkg, "testdata")+":/testdata")
+			}
+			buildParams.testBinary = true
+
+			builder, err := newImageBuilder(rootParams, buildParams)
+			if err != nil {
+				return err
+			}
+
+			if !jsonOutput && reportFile == "" {
+				return buildAndRunInPod(cmd, rootParams, builder, []string{pkg}, podParams, testArguments)
+			}
+
+			reporter, err := newTestReporter(pkg, jsonOutput, reportFile)
+			if err != nil {
+				return err
+			}
+			podParams.stdout = reporter.Writer()
+			testArguments = append([]string{"-test.v=test2json"}, testArguments...)
+
+			runErr := buildAndRunInPod(cmd, rootParams, builder, []string{pkg}, podParams, testArguments)
+			if err := reporter.Close(); err != nil && runErr == nil {
+				return err
+			}
+			return runErr
+		},
+	}
+	cmd.PersistentFlags().BoolVar(&jsonOutput, "json", false, "Print the test results as go test -json events")
+	cmd.PersistentFlags().StringVar(&reportFile, "output", "", "Write a test report file, JUnit XML for .xml and go test -json events for .json files")
+	addPodRunFlags(cmd, &podParams)
+	addImageBuildFlags(cmd, &buildParams)
+
+	return cmd
+}
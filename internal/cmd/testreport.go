@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// testEvent is an event of the go test -json (test2json) output
+type testEvent struct {
+	Time    time.Time `json:",omitempty"`
+	Action  string
+	Package string  `json:",omitempty"`
+	Test    string  `json:",omitempty"`
+	Elapsed float64 `json:",omitempty"`
+	Output  string  `json:",omitempty"`
+}
+
+// testReporter converts the framed verbose output of a test binary to go test -json events
+// using the local test2json tool, echoes them and collects the results for report files.
+type testReporter struct {
+	printJSON bool
+	output    string
+
+	events  []testEvent
+	stdin   io.WriteCloser
+	command *exec.Cmd
+	done    chan error
+}
+
+func newTestReporter(pkg string, printJSON bool, output string) (*testReporter, error) {
+	switch strings.ToLower(filepath.Ext(output)) {
+	case "", ".xml", ".json":
+	default:
+		return nil, errors.NewWithDetails("unsupported test report format, use a .xml (JUnit) or .json file", "output", output)
+	}
+
+	test2jsonCommand := exec.Command("go", "tool", "test2json", "-t", "-p", pkg)
+	test2jsonCommand.Stderr = os.Stderr
+	stdin, err := test2jsonCommand.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := test2jsonCommand.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := test2jsonCommand.Start(); err != nil {
+		return nil, errors.WrapIf(err, "failed to start test2json")
+	}
+
+	r := &testReporter{
+		printJSON: printJSON,
+		output:    output,
+		stdin:     stdin,
+		command:   test2jsonCommand,
+		done:      make(chan error, 1),
+	}
+	go func() {
+		err := r.consume(stdout)
+		if err != nil {
+			// keep draining so the test run isn't blocked
+			_, _ = io.Copy(io.Discard, stdout)
+		}
+		r.done <- err
+	}()
+
+	return r, nil
+}
+
+// Writer returns the writer the test binary output should be written to
+func (r *testReporter) Writer() io.Writer {
+	return r.stdin
+}
+
+// Close waits for the remaining events to be processed and writes the report file
+func (r *testReporter) Close() error {
+	if err := r.stdin.Close(); err != nil {
+		return err
+	}
+	if err := <-r.done; err != nil {
+		return err
+	}
+	if err := r.command.Wait(); err != nil {
+		return errors.WrapIf(err, "test2json failed")
+	}
+
+	if r.output == "" {
+		return nil
+	}
+
+	file, err := os.Create(r.output)
+	if err != nil {
+		return errors.WrapIf(err, "failed to create test report")
+	}
+	defer file.Close()
+
+	if strings.ToLower(filepath.Ext(r.output)) == ".json" {
+		encoder := json.NewEncoder(file)
+		for _, event := range r.events {
+			if err := encoder.Encode(event); err != nil {
+				return err
+			}
+		}
+	} else if err := writeJUnitReport(file, r.events); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func (r *testReporter) consume(stdout io.Reader) error {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event testEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return errors.WrapIf(err, "failed to parse test event")
+		}
+		r.events = append(r.events, event)
+
+		if r.printJSON {
+			fmt.Fprintln(os.Stdout, scanner.Text())
+		} else if event.Action == "output" {
+			fmt.Fprint(os.Stdout, event.Output)
+		}
+	}
+	return scanner.Err()
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	TestCases []junitTestCase `xml:"testcase"`
+	SystemOut string          `xml:"system-out,omitempty"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message  string `xml:"message,attr"`
+	Contents string `xml:",chardata"`
+}
+
+// writeJUnitReport writes the test events as a JUnit XML report with a test suite per package
+func writeJUnitReport(w io.Writer, events []testEvent) error {
+	var suites []*junitTestSuite
+	suitesByPackage := make(map[string]*junitTestSuite)
+	outputs := make(map[string]*strings.Builder)
+
+	for _, event := range events {
+		suite, ok := suitesByPackage[event.Package]
+		if !ok {
+			suite = &junitTestSuite{Name: event.Package}
+			if !event.Time.IsZero() {
+				suite.Timestamp = event.Time.UTC().Format(time.RFC3339)
+			}
+			suitesByPackage[event.Package] = suite
+			suites = append(suites, suite)
+		}
+
+		key := event.Package + "\x00" + event.Test
+		if outputs[key] == nil {
+			outputs[key] = &strings.Builder{}
+		}
+
+		switch event.Action {
+		case "output":
+			outputs[key].WriteString(event.Output)
+
+		case "pass", "fail", "skip":
+			elapsed := fmt.Sprintf("%.3f", event.Elapsed)
+			if event.Test == "" {
+				suite.Time = elapsed
+				suite.SystemOut = outputs[key].String()
+				if event.Action == "fail" && suite.Failures == 0 {
+					// the package failed outside of the tests (e.g. panic in init or TestMain)
+					suite.Tests++
+					suite.Failures++
+					suite.TestCases = append(suite.TestCases, junitTestCase{
+						Name:      "TestMain",
+						Classname: event.Package,
+						Time:      elapsed,
+						Failure:   &junitMessage{Message: "Failed", Contents: outputs[key].String()},
+					})
+				}
+				continue
+			}
+
+			testCase := junitTestCase{
+				Name:      event.Test,
+				Classname: event.Package,
+				Time:      elapsed,
+			}
+			switch event.Action {
+			case "fail":
+				testCase.Failure = &junitMessage{Message: "Failed", Contents: outputs[key].String()}
+				suite.Failures++
+			case "skip":
+				testCase.Skipped = &junitMessage{Message: "Skipped", Contents: outputs[key].String()}
+				suite.Skipped++
+			default:
+				testCase.SystemOut = outputs[key].String()
+			}
+			suite.Tests++
+			suite.TestCases = append(suite.TestCases, testCase)
+		}
+	}
+
+	report := junitTestSuites{}
+	for _, suite := range suites {
+		report.Suites = append(report.Suites, *suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return errors.WrapIf(err, "failed to write JUnit report")
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
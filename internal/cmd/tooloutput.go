@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"emperror.dev/errors"
+)
+
+// toolOutputLimit is the size of the end of the output of a failed tool attached to its error
+const toolOutputLimit = 8 * 1024
+
+// toolOutput captures the output of an external tool run by kurun (e.g. go build or the container engine), it's
+// printed only at higher verbosity (-v), and the end of it is attached to the error of the tool, so the cause of
+// failures is visible in the error even if the output isn't printed (e.g. in JSON mode)
+type toolOutput struct {
+	buf []byte
+}
+
+// attachToolOutput sets the outputs of the command to print them according to the verbosity, and returns the
+// captured output
+func attachToolOutput(cmd *exec.Cmd) *toolOutput {
+	output := &toolOutput{}
+	if verboseCommands {
+		cmd.Stdout = commandStdout
+		cmd.Stderr = io.MultiWriter(os.Stderr, output)
+	} else {
+		// the same writer, so it's not written concurrently
+		cmd.Stdout = output
+		cmd.Stderr = output
+	}
+	return output
+}
+
+func (o *toolOutput) Write(p []byte) (int, error) {
+	o.buf = append(o.buf, p...)
+	if len(o.buf) > toolOutputLimit {
+		o.buf = o.buf[len(o.buf)-toolOutputLimit:]
+	}
+	return len(p), nil
+}
+
+// Wrap attaches the end of the output to the error of the tool
+func (o *toolOutput) Wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	output := strings.TrimSpace(string(o.buf))
+	if output == "" {
+		return err
+	}
+	return errors.WithDetails(err, "output", output)
+}
+
+// runTool runs the command of an external tool with its output captured by toolOutput
+func runTool(cmd *exec.Cmd) error {
+	output := attachToolOutput(cmd)
+	return output.Wrap(cmd.Run())
+}
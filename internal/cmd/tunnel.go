@@ -0,0 +1,307 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/yaml"
+)
+
+// NewTunnelCommand returns the commands managing kurun-servers declared by Tunnel custom resources
+func NewTunnelCommand(rootParams *rootCommandParams) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tunnel",
+		Short: "Manage kurun-servers declaratively with Tunnel custom resources",
+	}
+
+	cmd.AddCommand(
+		newTunnelInstallCommand(rootParams),
+		newTunnelControllerCommand(rootParams),
+		newTunnelCreateCommand(rootParams),
+		newTunnelAttachCommand(rootParams),
+		newTunnelDeleteCommand(rootParams),
+	)
+
+	return cmd
+}
+
+func newTunnelInstallCommand(rootParams *rootCommandParams) *cobra.Command {
+	var controllerImage string
+
+	cmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install the Tunnel CRD, and the tunnel controller if an image is specified",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			crd, err := newTunnelCRD()
+			if err != nil {
+				return err
+			}
+			objects := []client.Object{crd}
+			if controllerImage != "" {
+				objects = append(objects, newTunnelControllerObjects(rootParams.namespace, controllerImage)...)
+			}
+
+			kubeClient, err := newKubeClient(rootParams)
+			if err != nil {
+				return err
+			}
+			for _, obj := range objects {
+				setManagedByKurun(obj)
+				gvk, err := apiutil.GVKForObject(obj, kubeClient.Scheme())
+				if err != nil {
+					return err
+				}
+				if err := installObject(cmd.Context(), kubeClient, obj); err != nil {
+					return errors.WrapIfWithDetails(err, "failed to install resource", "kind", gvk.Kind, "name", client.ObjectKeyFromObject(obj))
+				}
+				fmt.Fprintf(os.Stdout, "%s/%s configured\n", strings.ToLower(gvk.Kind), obj.GetName())
+			}
+
+			if controllerImage == "" {
+				fmt.Fprintln(os.Stdout, "Run the tunnel controller with: kurun tunnel controller")
+			}
+
+			return nil
+		},
+	}
+
+	cmd.PersistentFlags().StringVar(&controllerImage, "controller-image", "", "Image of kurun to run the tunnel controller in the cluster with (by default only the CRD is installed)")
+
+	return cmd
+}
+
+func newTunnelControllerCommand(rootParams *rootCommandParams) *cobra.Command {
+	var allNamespaces bool
+
+	cmd := &cobra.Command{
+		Use:   "controller",
+		Short: "Run the tunnel controller reconciling the kurun-servers of Tunnels",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+
+			namespace := rootParams.namespace
+			if allNamespaces {
+				namespace = ""
+			}
+			return runTunnelController(ctx, rootParams, namespace, rootParams.logger)
+		},
+	}
+
+	cmd.PersistentFlags().BoolVar(&allNamespaces, "all-namespaces", false, "Reconcile Tunnels in all namespaces")
+
+	return cmd
+}
+
+func newTunnelCreateCommand(rootParams *rootCommandParams) *cobra.Command {
+	var fileName string
+
+	cmd := &cobra.Command{
+		Use:     "create -f tunnel.yaml",
+		Short:   "Create or update a Tunnel",
+		Example: "kurun tunnel create --namespace apps -f tunnel.yaml",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if fileName == "" {
+				return errors.New("-f is required")
+			}
+			cmd.SilenceUsage = true
+
+			var content []byte
+			var err error
+			if fileName == "-" {
+				content, err = io.ReadAll(os.Stdin)
+			} else {
+				content, err = os.ReadFile(fileName)
+			}
+			if err != nil {
+				return errors.WrapIf(err, "failed to read tunnel")
+			}
+
+			tunnel := &unstructured.Unstructured{}
+			if err := yaml.Unmarshal(content, &tunnel.Object); err != nil {
+				return errors.WrapIfWithDetails(err, "failed to parse tunnel", "file", fileName)
+			}
+			if gvk := tunnel.GroupVersionKind(); gvk != tunnelGVK {
+				return errors.NewWithDetails("not a tunnel", "file", fileName, "apiVersion", tunnel.GetAPIVersion(), "kind", gvk.Kind)
+			}
+			if _, err := getTunnelSpec(tunnel); err != nil {
+				return err
+			}
+			if tunnel.GetNamespace() == "" {
+				tunnel.SetNamespace(rootParams.namespace)
+			}
+			setManagedByKurun(tunnel)
+
+			kubeClient, err := newKubeClient(rootParams)
+			if err != nil {
+				return err
+			}
+			if err := installObject(cmd.Context(), kubeClient, tunnel); err != nil {
+				return errors.WrapIfWithDetails(err, "failed to create tunnel", "name", client.ObjectKeyFromObject(tunnel))
+			}
+			fmt.Fprintf(os.Stdout, "tunnel/%s configured\n", tunnel.GetName())
+
+			return nil
+		},
+	}
+
+	cmd.PersistentFlags().StringVarP(&fileName, "filename", "f", "", "File containing the Tunnel, or - for the standard input")
+
+	return cmd
+}
+
+func newTunnelAttachCommand(rootParams *rootCommandParams) *cobra.Command {
+	var clientParams tunnelClientParams
+
+	cmd := &cobra.Command{
+		Use:     "attach [flags] name upstream",
+		Short:   "Forward the requests of the kurun-server of a Tunnel to the upstream",
+		Example: "kurun tunnel attach --namespace apps myapp-dev localhost:8080",
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			downstreamURL, err := parseDownstreamURL(args[1])
+			if err != nil {
+				return err
+			}
+			if err := validateTunnelClientParams(&clientParams); err != nil {
+				return err
+			}
+			if clientParams.transport == grpcTunnelTransport {
+				return errors.New("--transport grpc cannot be used with tunnel attach, as the credentials of the session are generated for the kurun-server port-forward creates")
+			}
+			if clientParams.transport == sshTunnelTransport && clientParams.ssh.sidecar {
+				return errors.New("--transport ssh requires --ssh-sidecar=false with tunnel attach, as the sidecar runs next to the kurun-server port-forward creates")
+			}
+			cmd.SilenceUsage = true
+
+			logger := rootParams.logger
+
+			signalCtx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			ctx, cancel := context.WithCancelCause(signalCtx)
+			defer cancel(nil)
+
+			kubeConfig, err := getKubeConfig(rootParams)
+			if err != nil {
+				return err
+			}
+			kubeClient, err := client.New(kubeConfig, client.Options{})
+			if err != nil {
+				return err
+			}
+
+			status, err := waitForTunnel(ctx, kubeClient, client.ObjectKey{Namespace: rootParams.namespace, Name: args[0]}, rootParams.waitTimeout)
+			if err != nil {
+				return err
+			}
+
+			controlPort := corev1.ContainerPort{
+				Name:          "control",
+				ContainerPort: 8333,
+			}
+			kurunService, err := getAttachService(ctx, kubeConfig, rootParams.namespace, status.ServiceName, controlPort, logger)
+			if err != nil {
+				return err
+			}
+
+			stats, err := startTunnelClient(ctx, cancel, kubeConfig, serviceTunnelTarget(kurunService), downstreamURL, clientParams, rootParams.output, logger)
+			if err != nil {
+				return err
+			}
+
+			rootParams.output.Statusf("Forwarding %s.%s.svc -> %s", kurunService.Name, kurunService.Namespace, downstreamURL.String())
+
+			<-ctx.Done()
+
+			rootParams.output.SessionSummary(stats.Summary())
+
+			return tunnelExitError(ctx)
+		},
+	}
+
+	addTunnelClientFlags(cmd, &clientParams)
+
+	return cmd
+}
+
+func newTunnelDeleteCommand(rootParams *rootCommandParams) *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete [flags] name",
+		Short: "Delete a Tunnel and its kurun-server",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			kubeClient, err := newKubeClient(rootParams)
+			if err != nil {
+				return err
+			}
+
+			tunnel := newTunnelObject()
+			tunnel.SetNamespace(rootParams.namespace)
+			tunnel.SetName(args[0])
+			if err := deleteWithRetry(cmd.Context(), kubeClient, tunnel); err != nil {
+				return errors.WrapIfWithDetails(err, "failed to delete tunnel", "name", client.ObjectKeyFromObject(tunnel))
+			}
+			fmt.Fprintf(os.Stdout, "tunnel/%s deleted\n", tunnel.GetName())
+
+			return nil
+		},
+	}
+}
+
+// waitForTunnel waits until the controller reports the kurun-server of the latest spec of the Tunnel ready
+func waitForTunnel(ctx context.Context, kubeClient client.Client, key client.ObjectKey, timeout time.Duration) (tunnelStatus, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		tunnel := newTunnelObject()
+		if err := kubeClient.Get(ctx, key, tunnel); err != nil {
+			return tunnelStatus{}, errors.WrapIfWithDetails(err, "failed to get tunnel", "name", key)
+		}
+
+		status := getTunnelStatus(tunnel)
+		if status.Ready && status.ObservedGeneration >= tunnel.GetGeneration() {
+			return status, nil
+		}
+
+		if time.Now().After(deadline) {
+			if status.ObservedGeneration == 0 {
+				return status, errors.NewWithDetails("timeout waiting for tunnel, is the tunnel controller running?", "name", key)
+			}
+			return status, errors.NewWithDetails("timeout waiting for tunnel", "name", key, "message", status.Message)
+		}
+
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func newKubeClient(rootParams *rootCommandParams) (client.Client, error) {
+	kubeConfig, err := getKubeConfig(rootParams)
+	if err != nil {
+		return nil, err
+	}
+	return client.New(kubeConfig, client.Options{})
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// NewTunnelClientCommand returns the command connecting the tunnel client to a kurun-server pod or service deployed
+// by other means, e.g. from the manifests of the tunnel module
+func NewTunnelClientCommand(rootParams *rootCommandParams) *cobra.Command {
+	var (
+		clientParams tunnelClientParams
+		pod          string
+		port         string
+		selector     string
+		service      string
+		tlsSecret    string
+	)
+
+	cmd := &cobra.Command{
+		Use:     "tunnel-client [flags] (--pod name | --service name | --selector selector) downstream",
+		Short:   "Connect to a kurun-server pod or service through the API server proxy and forward its requests to the downstream",
+		Example: "kurun tunnel-client --namespace apps --service kurun-server --port control localhost:8080",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			targets := 0
+			for _, target := range []string{pod, selector, service} {
+				if target != "" {
+					targets++
+				}
+			}
+			if targets != 1 {
+				return errors.New("exactly one of --pod, --service and --selector must be specified")
+			}
+			if port == "" && selector == "" {
+				return errors.New("--port must be specified")
+			}
+			if err := validateTunnelClientParams(&clientParams); err != nil {
+				return err
+			}
+			if pod != "" && clientParams.transport != defaultTunnelTransport && clientParams.transport != sshTunnelTransport {
+				return errors.Errorf("--transport %s requires --service", clientParams.transport)
+			}
+			if clientParams.transport == sshTunnelTransport && clientParams.ssh.sidecar {
+				return errors.New("--transport ssh requires --ssh-sidecar=false with tunnel-client, as the sidecar runs next to the kurun-server port-forward creates")
+			}
+			if selector != "" {
+				if _, err := k8slabels.Parse(selector); err != nil {
+					return errors.WrapIf(err, "invalid --selector")
+				}
+				if clientParams.transport != defaultTunnelTransport {
+					return errors.Errorf("--selector cannot be used with --transport %s", clientParams.transport)
+				}
+			}
+			downstreamURL, err := parseDownstreamURL(args[0])
+			if err != nil {
+				return err
+			}
+			if tlsSecret != "" && clientParams.insecureDownstream {
+				return errors.New("--tlssecret cannot be used with --insecure-downstream")
+			}
+			if tlsSecret != "" && !strings.Contains(args[0], "://") {
+				// the downstream is verified with the CA of the secret
+				downstreamURL.Scheme = "https"
+			}
+			cmd.SilenceUsage = true
+
+			logger := rootParams.logger
+
+			signalCtx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			ctx, cancel := context.WithCancelCause(signalCtx)
+			defer cancel(nil)
+
+			kubeConfig, err := getKubeConfig(rootParams)
+			if err != nil {
+				return err
+			}
+			clientset, err := kubernetes.NewForConfig(kubeConfig)
+			if err != nil {
+				return err
+			}
+			permissions := tunnelPermissions
+			switch {
+			case pod != "":
+				permissions = podTunnelPermissions
+			case selector != "":
+				permissions = podSelectorTunnelPermissions
+			}
+			if err := checkPreflightPermissions(ctx, kubeConfig, rootParams.namespace, permissions, logger); err != nil {
+				return err
+			}
+
+			if tlsSecret != "" {
+				if clientParams.downstreamCAs, err = readDownstreamCAs(ctx, clientset, rootParams.namespace, tlsSecret); err != nil {
+					return err
+				}
+			}
+
+			target := tunnelTarget{
+				namespace: rootParams.namespace,
+				resources: "pods",
+				name:      pod,
+				port:      port,
+				selector:  selector,
+			}
+			if service != "" {
+				target.resources, target.name = "services", service
+				// only needed by the webhook timeout check and the transports of extensions
+				kurunService, err := clientset.CoreV1().Services(rootParams.namespace).Get(ctx, service, metav1.GetOptions{})
+				switch {
+				case err == nil:
+					target.service = kurunService
+				case clientParams.transport != defaultTunnelTransport && clientParams.transport != sshTunnelTransport:
+					return errors.WrapIfWithDetails(err, "failed to get service", "service", service)
+				default:
+					logger.V(1).Info("cannot get service", "service", service, "error", err.Error())
+				}
+			}
+
+			stats, err := startTunnelClient(ctx, cancel, kubeConfig, target, downstreamURL, clientParams, rootParams.output, logger)
+			if err != nil {
+				return err
+			}
+
+			if selector != "" {
+				rootParams.output.Statusf("Forwarding pods/%s.%s -> %s", selector, target.namespace, downstreamURL.String())
+			} else {
+				rootParams.output.Statusf("Forwarding %s/%s.%s -> %s", target.resources, target.name, target.namespace, downstreamURL.String())
+			}
+
+			<-ctx.Done()
+
+			rootParams.output.SessionSummary(stats.Summary())
+
+			return tunnelExitError(ctx)
+		},
+	}
+
+	cmd.PersistentFlags().StringVar(&pod, "pod", "", "kurun-server pod to connect to")
+	cmd.PersistentFlags().StringVarP(&port, "port", "p", "", "Control port of the service (name or number) or the pods (number), the port named control of the pods by default")
+	cmd.PersistentFlags().StringVar(&selector, "selector", "", "Label selector of kurun-server pods, e.g. app=kurun-server, a Ready pod is connected to, and another one when it goes away")
+	cmd.PersistentFlags().StringVar(&service, "service", "", "Service of kurun-server to connect to")
+	cmd.PersistentFlags().StringVar(&tlsSecret, "tlssecret", "", "Secret ([namespace/]name) with the CA certificate (ca.crt, or tls.crt without it) verifying the HTTPS downstream, downstreams without scheme are connected with HTTPS")
+	addTunnelClientFlags(cmd, &clientParams)
+	addOutputFlags(cmd, &rootParams.outputParams)
+
+	return cmd
+}
+
+// readDownstreamCAs returns the CA certificate of the TLS secret ([namespace/]name), or its certificate for secrets
+// without CA, as a certificate pool
+func readDownstreamCAs(ctx context.Context, clientset kubernetes.Interface, namespace, tlsSecret string) (*x509.CertPool, error) {
+	name := tlsSecret
+	if parts := strings.SplitN(tlsSecret, string(types.Separator), 2); len(parts) == 2 {
+		namespace, name = parts[0], parts[1]
+	}
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to get TLS secret", "secret", tlsSecret)
+	}
+	caCert := secret.Data[caCertKey]
+	if len(caCert) == 0 {
+		caCert = secret.Data[corev1.TLSCertKey]
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, errors.NewWithDetails("TLS secret has no valid CA certificate", "secret", tlsSecret)
+	}
+	return pool, nil
+}
@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"context"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	tunnelControllerName = "kurun-tunnel-controller"
+	tunnelLabel          = "kurun.banzaicloud.io/tunnel"
+)
+
+// runTunnelController reconciles the kurun-server Services and Deployments of Tunnels until the context is cancelled
+// If the namespace is empty, Tunnels of all namespaces are reconciled.
+func runTunnelController(ctx context.Context, rootParams *rootCommandParams, namespace string, logger logr.Logger) error {
+	ctrllog.SetLogger(logger)
+
+	kubeConfig, err := getKubeConfig(rootParams)
+	if err != nil {
+		return err
+	}
+
+	// only the resources of kurun are cached, instead of all the services and deployments of the cluster
+	managedBy := cache.ObjectSelector{Label: labels.SelectorFromSet(labels.Set{managedByLabel: managedByKurun})}
+	mgr, err := manager.New(kubeConfig, manager.Options{
+		Namespace:          namespace,
+		MetricsBindAddress: "0",
+		NewCache: cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: cache.SelectorsByObject{
+				&corev1.Service{}:    managedBy,
+				&appsv1.Deployment{}: managedBy,
+			},
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = builder.ControllerManagedBy(mgr).
+		For(newTunnelObject()).
+		Owns(&corev1.Service{}).
+		Owns(&appsv1.Deployment{}).
+		Complete(&tunnelReconciler{
+			apiReader: mgr.GetAPIReader(),
+			client:    mgr.GetClient(),
+			scheme:    mgr.GetScheme(),
+		})
+	if err != nil {
+		return errors.WrapIf(err, "failed to create tunnel controller")
+	}
+
+	return mgr.Start(ctx)
+}
+
+// tunnelReconciler creates the kurun-server of a Tunnel, points its webhooks to it, and reports whether it's ready in
+// the status
+// The resources are owned by the Tunnel, so they are garbage collected when it's deleted, the webhooks are restored by
+// the reconciler before that.
+type tunnelReconciler struct {
+	apiReader client.Reader
+	client    client.Client
+	scheme    *runtime.Scheme
+}
+
+func (r *tunnelReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	tunnel := newTunnelObject()
+	if err := r.client.Get(ctx, req.NamespacedName, tunnel); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if tunnel.GetDeletionTimestamp() != nil {
+		return reconcile.Result{}, r.reconcileWebhooks(ctx, tunnel, nil, 0)
+	}
+
+	status := tunnelStatus{
+		ObservedGeneration: tunnel.GetGeneration(),
+		ServiceName:        tunnel.GetName(),
+	}
+
+	deployment, err := r.reconcileServer(ctx, tunnel)
+	if err != nil {
+		status.Message = err.Error()
+	} else {
+		status.Ready = hasRolledOut(deployment)
+		if !status.Ready {
+			status.Message = "waiting for kurun-server to become available"
+		}
+	}
+
+	if current := getTunnelStatus(tunnel); current != status {
+		if statusErr := setTunnelStatus(tunnel, status); statusErr != nil {
+			return reconcile.Result{}, errors.Append(err, statusErr)
+		}
+		if statusErr := r.client.Status().Update(ctx, tunnel); statusErr != nil {
+			return reconcile.Result{}, errors.Append(err, errors.WrapIf(statusErr, "failed to update tunnel status"))
+		}
+	}
+
+	return reconcile.Result{}, err
+}
+
+// reconcileServer creates or updates the Service and Deployment of the Tunnel, points the webhooks of the Tunnel to the
+// Service, and returns the Deployment
+func (r *tunnelReconciler) reconcileServer(ctx context.Context, tunnel *unstructured.Unstructured) (*appsv1.Deployment, error) {
+	spec, err := getTunnelSpec(tunnel)
+	if err != nil {
+		return nil, err
+	}
+
+	controlPort := corev1.ContainerPort{
+		Name:          "control",
+		ContainerPort: 8333,
+	}
+	requestPort := corev1.ContainerPort{
+		Name:          "request",
+		ContainerPort: 8444,
+	}
+
+	deploymentName := tunnel.GetName() + "-kurun"
+	labels := map[string]string{
+		"app.kubernetes.io/name":      deploymentName,
+		"app.kubernetes.io/component": "tunnel-server",
+		tunnelLabel:                   tunnel.GetName(),
+	}
+
+	service := newKurunService(tunnel.GetNamespace(), tunnel.GetName(), labels, spec.ServicePort, requestPort, controlPort)
+	container, volumes := newTunnelServerContainer(spec.tunnelServerParams(), requestPort, controlPort)
+	deployment := newTunnelServerDeployment(tunnel.GetNamespace(), deploymentName, labels, container, volumes)
+
+	for _, obj := range []client.Object{service, deployment} {
+		setManagedByKurun(obj)
+		if err := controllerutil.SetControllerReference(tunnel, obj, r.scheme); err != nil {
+			return nil, err
+		}
+		if err := installObject(ctx, r.client, obj); err != nil {
+			return nil, errors.WrapIfWithDetails(err, "failed to reconcile kurun-server", "name", client.ObjectKeyFromObject(obj))
+		}
+	}
+
+	if err := r.reconcileWebhooks(ctx, tunnel, spec.Webhooks, int32(spec.ServicePort)); err != nil {
+		return nil, err
+	}
+
+	return deployment, nil
+}
+
+// newTunnelControllerObjects returns the resources running the tunnel controller in the namespace with the image
+// The controller reconciles Tunnels in all namespaces.
+func newTunnelControllerObjects(namespace, image string) []client.Object {
+	labels := map[string]string{
+		"app.kubernetes.io/name": tunnelControllerName,
+	}
+
+	serviceAccount := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      tunnelControllerName,
+			Namespace: namespace,
+		},
+	}
+
+	clusterRole := &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: tunnelControllerName,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{tunnelGVK.Group},
+				Resources: []string{"tunnels"},
+				Verbs:     []string{"get", "list", "watch", "update", "patch"}, // for the finalizer of the webhooks
+			},
+			{
+				APIGroups: []string{tunnelGVK.Group},
+				Resources: []string{"tunnels/status"},
+				Verbs:     []string{"get", "update", "patch"},
+			},
+			{
+				APIGroups: []string{tunnelGVK.Group},
+				Resources: []string{"tunnels/finalizers"}, // for setting the owner references with blockOwnerDeletion
+				Verbs:     []string{"update"},
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"services"},
+				Verbs:     []string{"get", "list", "watch", "create", "update", "patch", "delete"},
+			},
+			{
+				APIGroups: []string{"apps"},
+				Resources: []string{"deployments"},
+				Verbs:     []string{"get", "list", "watch", "create", "update", "patch", "delete"},
+			},
+			{
+				APIGroups: []string{"admissionregistration.k8s.io"},
+				Resources: []string{"mutatingwebhookconfigurations", "validatingwebhookconfigurations"},
+				Verbs:     []string{"get", "list", "update"},
+			},
+		},
+	}
+
+	clusterRoleBinding := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: tunnelControllerName,
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     tunnelControllerName,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      tunnelControllerName,
+				Namespace: namespace,
+			},
+		},
+	}
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      tunnelControllerName,
+			Namespace: namespace,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					NodeSelector: map[string]string{
+						corev1.LabelOSStable: linuxNodeOS,
+					},
+					ServiceAccountName: tunnelControllerName,
+					Containers: []corev1.Container{
+						{
+							Name:  "controller",
+							Image: image,
+							Args:  []string{"tunnel", "controller", "--all-namespaces"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return []client.Object{serviceAccount, clusterRole, clusterRoleBinding, deployment}
+}
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"emperror.dev/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// tunnelGVK is the kind of the Tunnel custom resource, which declares a kurun-server reconciled by the tunnel controller
+// Tunnels are handled as unstructured objects, so kurun does not need generated clients for them.
+var tunnelGVK = schema.GroupVersionKind{
+	Group:   "kurun.banzaicloud.io",
+	Version: "v1alpha1",
+	Kind:    "Tunnel",
+}
+
+// tunnelSpec is the desired state of a Tunnel
+type tunnelSpec struct {
+	AuthSecret  string                      `json:"authSecret,omitempty"`
+	ServerImage string                      `json:"serverImage,omitempty"`
+	ServicePort int                         `json:"servicePort,omitempty"`
+	TLSSecret   string                      `json:"tlsSecret,omitempty"`
+	Resources   corev1.ResourceRequirements `json:"resources,omitempty"`
+	Split       *tunnelSplitSpec            `json:"split,omitempty"`
+	Webhooks    []tunnelWebhookSpec         `json:"webhooks,omitempty"`
+}
+
+// tunnelSplitSpec selects the requests sent through the tunnel, the others are sent to the fallback
+type tunnelSplitSpec struct {
+	Fallback string   `json:"fallback"`
+	Headers  []string `json:"headers,omitempty"`
+	Percent  int      `json:"percent,omitempty"`
+}
+
+// tunnelWebhookSpec refers to an admission webhook pointed to the service of the Tunnel, e.g. a webhook of an
+// operator developed with the tunnel
+type tunnelWebhookSpec struct {
+	Configuration string `json:"configuration"`
+	Kind          string `json:"kind"`
+	Webhook       string `json:"webhook"`
+}
+
+// tunnelStatus is the observed state of a Tunnel
+type tunnelStatus struct {
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	Ready              bool   `json:"ready"`
+	ServiceName        string `json:"serviceName,omitempty"`
+	Message            string `json:"message,omitempty"`
+}
+
+func newTunnelObject() *unstructured.Unstructured {
+	tunnel := &unstructured.Unstructured{}
+	tunnel.SetGroupVersionKind(tunnelGVK)
+	return tunnel
+}
+
+// getTunnelSpec returns the spec of the Tunnel with the defaults applied
+func getTunnelSpec(tunnel *unstructured.Unstructured) (tunnelSpec, error) {
+	spec := tunnelSpec{}
+	if content, ok := tunnel.Object["spec"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(content, &spec); err != nil {
+			return spec, errors.WrapIfWithDetails(err, "invalid tunnel spec", "tunnel", tunnel.GetName())
+		}
+	}
+	if spec.ServerImage == "" {
+		spec.ServerImage = kurunServerImage
+	}
+	if spec.ServicePort == 0 {
+		spec.ServicePort = 80
+	}
+	if spec.Split != nil && spec.Split.Fallback == "" {
+		return spec, errors.NewWithDetails("split requires a fallback", "tunnel", tunnel.GetName())
+	}
+	return spec, nil
+}
+
+// getTunnelStatus returns the status of the Tunnel reported by the controller
+func getTunnelStatus(tunnel *unstructured.Unstructured) tunnelStatus {
+	status := tunnelStatus{}
+	if content, ok := tunnel.Object["status"].(map[string]interface{}); ok {
+		_ = runtime.DefaultUnstructuredConverter.FromUnstructured(content, &status)
+	}
+	return status
+}
+
+func setTunnelStatus(tunnel *unstructured.Unstructured, status tunnelStatus) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return err
+	}
+	tunnel.Object["status"] = content
+	return nil
+}
+
+// tunnelServerParams returns the kurun-server settings declared by the Tunnel
+func (spec tunnelSpec) tunnelServerParams() tunnelServerParams {
+	params := tunnelServerParams{
+		authSecret: spec.AuthSecret,
+		hardening:  true,
+		image:      spec.ServerImage,
+		runAsUser:  defaultServerUser,
+		resources:  spec.Resources,
+		tlsSecret:  spec.TLSSecret,
+	}
+	if spec.Split != nil {
+		params.splitFallback = spec.Split.Fallback
+		params.splitHeaders = spec.Split.Headers
+		params.splitPercent = spec.Split.Percent
+	}
+	return params
+}
+
+const tunnelCRDManifest = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: tunnels.kurun.banzaicloud.io
+spec:
+  group: kurun.banzaicloud.io
+  names:
+    kind: Tunnel
+    listKind: TunnelList
+    plural: tunnels
+    singular: tunnel
+  scope: Namespaced
+  versions:
+  - name: v1alpha1
+    served: true
+    storage: true
+    subresources:
+      status: {}
+    additionalPrinterColumns:
+    - name: Service
+      type: string
+      jsonPath: .status.serviceName
+    - name: Ready
+      type: boolean
+      jsonPath: .status.ready
+    - name: Age
+      type: date
+      jsonPath: .metadata.creationTimestamp
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            properties:
+              authSecret:
+                type: string
+              serverImage:
+                type: string
+              servicePort:
+                type: integer
+                minimum: 1
+                maximum: 65535
+              tlsSecret:
+                type: string
+              resources:
+                type: object
+                x-kubernetes-preserve-unknown-fields: true
+              split:
+                type: object
+                required: [fallback]
+                properties:
+                  fallback:
+                    type: string
+                  headers:
+                    type: array
+                    items:
+                      type: string
+                  percent:
+                    type: integer
+                    minimum: 0
+                    maximum: 100
+              webhooks:
+                type: array
+                items:
+                  type: object
+                  required: [kind, configuration, webhook]
+                  properties:
+                    kind:
+                      type: string
+                      enum: [mutating, validating]
+                    configuration:
+                      type: string
+                    webhook:
+                      type: string
+          status:
+            type: object
+            properties:
+              observedGeneration:
+                type: integer
+              ready:
+                type: boolean
+              serviceName:
+                type: string
+              message:
+                type: string
+`
+
+// newTunnelCRD returns the CustomResourceDefinition of Tunnels
+func newTunnelCRD() (*unstructured.Unstructured, error) {
+	crd := &unstructured.Unstructured{}
+	if err := yaml.Unmarshal([]byte(tunnelCRDManifest), &crd.Object); err != nil {
+		return nil, errors.WrapIf(err, "failed to parse tunnel CRD")
+	}
+	return crd, nil
+}
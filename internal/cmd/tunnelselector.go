@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podSelectorResolver resolves the kurun-server pod of the label selector before each connection of the tunnel
+// client, so the client follows the pods when the one it's connected to goes away
+// The pod connected last is kept while it's Ready, otherwise the newest Ready pod is selected.
+type podSelectorResolver struct {
+	clientset kubernetes.Interface
+	logger    logr.Logger
+	namespace string
+	// port is the control port of the pods, the container port named control (or 8333) is used if it's empty
+	port     string
+	selector string
+
+	current string
+}
+
+// Resolve returns the name and the control port of the pod to connect to
+func (r *podSelectorResolver) Resolve(ctx context.Context) (name string, port string, err error) {
+	pods, err := r.clientset.CoreV1().Pods(r.namespace).List(ctx, metav1.ListOptions{LabelSelector: r.selector})
+	if err != nil {
+		return "", "", errors.WrapIfWithDetails(err, "failed to list pods", "selector", r.selector)
+	}
+
+	var ready []*corev1.Pod
+	for i := range pods.Items {
+		if pod := &pods.Items[i]; pod.DeletionTimestamp == nil && podConditionTrue(pod, corev1.PodReady) {
+			ready = append(ready, pod)
+		}
+	}
+	if len(ready) == 0 {
+		return "", "", errors.NewWithDetails("no Ready pod matches the selector", "selector", r.selector, "namespace", r.namespace)
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[j].CreationTimestamp.Before(&ready[i].CreationTimestamp)
+	})
+
+	pod := ready[0]
+	for _, candidate := range ready {
+		if candidate.Name == r.current {
+			pod = candidate
+		}
+	}
+	if pod.Name != r.current {
+		r.logger.Info("connecting to kurun-server pod", "pod", pod.Name, "selector", r.selector)
+		r.current = pod.Name
+	}
+
+	if r.port != "" {
+		return pod.Name, r.port, nil
+	}
+	return pod.Name, strconv.Itoa(int(podControlPort(pod))), nil
+}
+
+// podControlPort returns the container port named control of the pod, or the default control port of kurun-server
+// (the API server proxy of pods takes only port numbers)
+func podControlPort(pod *corev1.Pod) int32 {
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name == "control" {
+				return port.ContainerPort
+			}
+		}
+	}
+	return 8333
+}
+
+func podConditionTrue(pod *corev1.Pod, conditionType corev1.PodConditionType) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
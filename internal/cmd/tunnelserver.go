@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/spf13/cobra"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/pointer"
+
+	tunnelws "github.com/banzaicloud/kurun/tunnel/websocket"
+)
+
+// defaultServerUser is the (non-root) user kurun-server runs as, the nonroot user of distroless images
+const defaultServerUser = 65532
+
+// grpcPort is the port of the gRPC server of kurun-server, accepting the tunnel clients of the grpc transport
+const grpcPort = 8334
+
+// tunnelServerParams are the settings of the kurun-server (tunnel server) container
+type tunnelServerParams struct {
+	authSecret       string
+	grpcSecret       string
+	hardening        bool
+	idleTimeout      time.Duration
+	image            string
+	maxFrameSize     int
+	offlineQueueSize int64
+	pingInterval     time.Duration
+	// readinessProbe makes kurun-server not ready while the tunnel clients report their downstreams unhealthy
+	readinessProbe     bool
+	resources          corev1.ResourceRequirements
+	runAsUser          int64
+	sessionGracePeriod time.Duration
+	splitFallback      string
+	splitHeaders       []string
+	splitPercent       int
+	tlsSecret          string
+	upstream           string
+}
+
+// defaultServerRequests and defaultServerLimits are the resources of the kurun-server container, small as it only
+// forwards requests, but set so the pod is admitted by policies requiring them
+func defaultServerRequests() map[string]string {
+	return map[string]string{"cpu": "10m", "memory": "32Mi"}
+}
+
+func defaultServerLimits() map[string]string {
+	return map[string]string{"memory": "128Mi"}
+}
+
+// addTunnelServerSecurityFlags registers the flags of the kurun-server container security settings
+func addTunnelServerSecurityFlags(cmd *cobra.Command, params *tunnelServerParams) {
+	cmd.PersistentFlags().BoolVar(&params.hardening, "server-hardening", true, "Run kurun-server as non-root with a read-only root filesystem, without capabilities and with the runtime default seccomp profile (restricted Pod Security Standard)")
+	cmd.PersistentFlags().Int64Var(&params.runAsUser, "server-run-as-user", defaultServerUser, "User ID to run kurun-server as when hardened")
+}
+
+// addRequestAuthFlag registers the flag of the secret containing the token required on the requests of kurun-server
+func addRequestAuthFlag(cmd *cobra.Command, params *tunnelServerParams) {
+	cmd.PersistentFlags().StringVar(&params.authSecret, "request-token-secret", "", "Require the bearer token in the token key of the secret on the requests sent to kurun-server")
+}
+
+// ipFamilyParams are the IP family settings of the kurun-server service for IPv6 and dual-stack clusters
+type ipFamilyParams struct {
+	family string
+	policy string
+}
+
+func addIPFamilyFlags(cmd *cobra.Command, params *ipFamilyParams) {
+	cmd.PersistentFlags().StringVar(&params.family, "ip-family", "", "Preferred (primary) IP family of the service: IPv4 or IPv6 (default: the cluster default)")
+	cmd.PersistentFlags().StringVar(&params.policy, "ip-family-policy", "", "IP family policy of the service: SingleStack, PreferDualStack or RequireDualStack (default: the cluster default)")
+}
+
+func validateIPFamilyParams(params ipFamilyParams) error {
+	switch corev1.IPFamily(params.family) {
+	case "", corev1.IPv4Protocol, corev1.IPv6Protocol:
+	default:
+		return errors.Errorf("invalid --ip-family value %q, must be IPv4 or IPv6", params.family)
+	}
+	switch corev1.IPFamilyPolicyType(params.policy) {
+	case "", corev1.IPFamilyPolicySingleStack, corev1.IPFamilyPolicyPreferDualStack, corev1.IPFamilyPolicyRequireDualStack:
+	default:
+		return errors.Errorf("invalid --ip-family-policy value %q, must be SingleStack, PreferDualStack or RequireDualStack", params.policy)
+	}
+	return nil
+}
+
+// setServiceIPFamilies sets the IP families of the service, the secondary family of dual-stack services is assigned
+// by the API server
+func setServiceIPFamilies(service *corev1.Service, params ipFamilyParams) {
+	if params.family != "" {
+		service.Spec.IPFamilies = []corev1.IPFamily{corev1.IPFamily(params.family)}
+	}
+	if params.policy != "" {
+		policy := corev1.IPFamilyPolicyType(params.policy)
+		service.Spec.IPFamilyPolicy = &policy
+	}
+}
+
+// newKurunService returns the service exposing the request and control ports of the kurun-server pods
+func newKurunService(namespace, name string, labels map[string]string, servicePort int, requestPort, controlPort corev1.ContainerPort) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    copyLabels(labels),
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "request",
+					Port:       int32(servicePort),
+					TargetPort: intstr.FromString(requestPort.Name),
+				},
+				{
+					Name:       "control",
+					Port:       controlPort.ContainerPort,
+					TargetPort: intstr.FromString(controlPort.Name),
+				},
+			},
+		},
+	}
+}
+
+// newTunnelServerContainer returns the kurun-server container and the volumes it requires
+func newTunnelServerContainer(params tunnelServerParams, requestPort, controlPort corev1.ContainerPort) (corev1.Container, []corev1.Volume) {
+	container := corev1.Container{
+		Name:            "tunnel-server",
+		Image:           params.image,
+		ImagePullPolicy: corev1.PullIfNotPresent, // HACK
+		Args: []string{
+			"--ctrl-srv-addr",
+			fmt.Sprintf(":%d", controlPort.ContainerPort), // all addresses of both IP families
+			"--ctrl-srv-self-signed",
+			"--req-srv-addr",
+			fmt.Sprintf(":%d", requestPort.ContainerPort),
+		},
+		Ports: []corev1.ContainerPort{
+			requestPort,
+			controlPort,
+		},
+		Resources: params.resources,
+	}
+
+	if params.hardening {
+		container.SecurityContext = newRestrictedSecurityContext(params.runAsUser)
+	}
+
+	if params.readinessProbe {
+		container.ReadinessProbe = &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path:   tunnelws.ReadinessPath,
+					Port:   intstr.FromString(controlPort.Name),
+					Scheme: corev1.URISchemeHTTPS, // self-signed, not verified by the kubelet
+				},
+			},
+			PeriodSeconds: 5,
+		}
+	}
+
+	if params.splitFallback != "" {
+		container.Args = append(container.Args, "--split-fallback", params.splitFallback)
+		for _, header := range params.splitHeaders {
+			container.Args = append(container.Args, "--split-header", header)
+		}
+		if params.splitPercent > 0 {
+			container.Args = append(container.Args, "--split-percent", strconv.Itoa(params.splitPercent))
+		}
+	}
+
+	if params.upstream != "" {
+		container.Args = append(container.Args, "--req-upstream", params.upstream)
+	}
+
+	if params.maxFrameSize > 0 {
+		container.Args = append(container.Args, "--max-frame-size", strconv.Itoa(params.maxFrameSize))
+	}
+
+	if params.pingInterval > 0 {
+		container.Args = append(container.Args, "--ping-interval", params.pingInterval.String())
+	}
+
+	if params.idleTimeout > 0 {
+		container.Args = append(container.Args, "--idle-timeout", params.idleTimeout.String())
+	}
+
+	if params.sessionGracePeriod > 0 {
+		container.Args = append(container.Args, "--session-grace-period", params.sessionGracePeriod.String())
+	}
+
+	if params.offlineQueueSize > 0 {
+		container.Args = append(container.Args, "--req-offline-queue-size", strconv.FormatInt(params.offlineQueueSize, 10))
+	}
+
+	volumes := []corev1.Volume{}
+
+	if params.tlsSecret != "" {
+		container.Args = append(
+			container.Args,
+			"--req-srv-cert",
+			"/etc/tls/tls.crt",
+			"--req-srv-key",
+			"/etc/tls/tls.key",
+			"-v",
+		)
+		container.VolumeMounts = []corev1.VolumeMount{
+			{
+				Name:      tlsVolumeNamePrefix + requestPort.Name,
+				MountPath: "/etc/tls",
+			},
+		}
+		volumes = append(volumes, corev1.Volume{
+			Name: tlsVolumeNamePrefix + requestPort.Name,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: params.tlsSecret,
+				},
+			},
+		})
+	}
+
+	if params.authSecret != "" {
+		container.Args = append(container.Args, "--req-auth-token-file", "/etc/kurun-auth/token")
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      "kurun-auth-token",
+			MountPath: "/etc/kurun-auth",
+			ReadOnly:  true,
+		})
+		volumes = append(volumes, corev1.Volume{
+			Name: "kurun-auth-token",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: params.authSecret,
+					Items: []corev1.KeyToPath{
+						{
+							Key:  "token",
+							Path: "token",
+						},
+					},
+				},
+			},
+		})
+	}
+
+	if params.grpcSecret != "" {
+		container.Args = append(
+			container.Args,
+			"--grpc-srv-addr",
+			fmt.Sprintf(":%d", grpcPort),
+			"--grpc-srv-cert",
+			"/etc/kurun-grpc/tls.crt",
+			"--grpc-srv-key",
+			"/etc/kurun-grpc/tls.key",
+			"--grpc-token-file",
+			"/etc/kurun-grpc/token",
+		)
+		container.Ports = append(container.Ports, corev1.ContainerPort{
+			Name:          "grpc",
+			ContainerPort: grpcPort,
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      "kurun-grpc",
+			MountPath: "/etc/kurun-grpc",
+			ReadOnly:  true,
+		})
+		volumes = append(volumes, corev1.Volume{
+			Name: "kurun-grpc",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: params.grpcSecret,
+				},
+			},
+		})
+	}
+
+	return container, volumes
+}
+
+// newTunnelServerDeployment returns the deployment running the kurun-server container
+func newTunnelServerDeployment(namespace, name string, labels map[string]string, container corev1.Container, volumes []corev1.Volume) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						container,
+					},
+					NodeSelector: map[string]string{
+						corev1.LabelOSStable: linuxNodeOS,
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+// newRestrictedSecurityContext returns a container security context complying with the restricted Pod Security Standard
+func newRestrictedSecurityContext(runAsUser int64) *corev1.SecurityContext {
+	return &corev1.SecurityContext{
+		RunAsNonRoot:             pointer.BoolPtr(true),
+		RunAsUser:                pointer.Int64Ptr(runAsUser),
+		RunAsGroup:               pointer.Int64Ptr(runAsUser),
+		ReadOnlyRootFilesystem:   pointer.BoolPtr(true),
+		AllowPrivilegeEscalation: pointer.BoolPtr(false),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
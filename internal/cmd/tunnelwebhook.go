@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+
+	"emperror.dev/errors"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// tunnelWebhookFinalizer keeps a Tunnel until the webhooks pointed to its service are restored
+	tunnelWebhookFinalizer = "kurun.banzaicloud.io/webhooks"
+	// originalClientConfigsAnnotation keeps the client configs of the webhooks of a configuration before they were
+	// pointed to the service of a Tunnel, as a JSON object of tunnelWebhookOriginals by webhook name
+	originalClientConfigsAnnotation = "kurun.banzaicloud.io/original-client-configs"
+)
+
+// tunnelWebhookOriginal is the client config of a webhook before it was pointed to the service of the Tunnel
+type tunnelWebhookOriginal struct {
+	ClientConfig admissionregistrationv1.WebhookClientConfig `json:"clientConfig"`
+	Tunnel       string                                      `json:"tunnel"`
+}
+
+// reconcileWebhooks points the webhooks of the Tunnel to the port of its service, and restores the webhooks it no
+// longer refers to (all of them when it's deleted) to their original client configs
+// The finalizer of the Tunnel is kept while it has patched webhooks, so they are restored before it goes away.
+func (r *tunnelReconciler) reconcileWebhooks(ctx context.Context, tunnel *unstructured.Unstructured, webhooks []tunnelWebhookSpec, servicePort int32) error {
+	tunnelKey := tunnel.GetNamespace() + "/" + tunnel.GetName()
+	deleted := tunnel.GetDeletionTimestamp() != nil
+	desired := make(map[tunnelWebhookSpec]bool, len(webhooks))
+	if !deleted {
+		for _, webhook := range webhooks {
+			desired[webhook] = true
+		}
+	}
+
+	if len(desired) == 0 && !controllerutil.ContainsFinalizer(tunnel, tunnelWebhookFinalizer) {
+		return nil // no webhooks have been pointed to the tunnel
+	}
+	if len(desired) > 0 && !controllerutil.ContainsFinalizer(tunnel, tunnelWebhookFinalizer) {
+		controllerutil.AddFinalizer(tunnel, tunnelWebhookFinalizer)
+		if err := r.client.Update(ctx, tunnel); err != nil {
+			return errors.WrapIf(err, "failed to add tunnel finalizer")
+		}
+	}
+
+	found := make(map[tunnelWebhookSpec]bool, len(desired))
+	var errs error
+	for _, kind := range []string{webhookKindMutating, webhookKindValidating} {
+		configurations, err := r.listWebhookConfigurations(ctx, kind)
+		if err != nil {
+			return err
+		}
+		for _, configuration := range configurations {
+			originals := map[string]tunnelWebhookOriginal{}
+			if value, ok := configuration.GetAnnotations()[originalClientConfigsAnnotation]; ok {
+				if err := json.Unmarshal([]byte(value), &originals); err != nil {
+					errs = errors.Append(errs, errors.WrapIfWithDetails(err, "invalid original client configs", "configuration", configuration.GetName()))
+					continue
+				}
+			}
+
+			changed := false
+			for name, clientConfig := range webhookClientConfigs(configuration) {
+				ref := tunnelWebhookSpec{Configuration: configuration.GetName(), Kind: kind, Webhook: name}
+				original, patched := originals[name]
+				switch {
+				case desired[ref]:
+					found[ref] = true
+					if patched && original.Tunnel != tunnelKey {
+						errs = errors.Append(errs, errors.NewWithDetails("webhook is pointed to another tunnel", "kind", kind, "configuration", ref.Configuration, "webhook", name, "tunnel", original.Tunnel))
+						continue
+					}
+					if !patched {
+						original = tunnelWebhookOriginal{ClientConfig: *clientConfig.DeepCopy(), Tunnel: tunnelKey}
+						originals[name] = original
+						changed = true
+					}
+					target := original.ClientConfig.DeepCopy()
+					target.URL = nil
+					target.Service = &admissionregistrationv1.ServiceReference{
+						Namespace: tunnel.GetNamespace(),
+						Name:      tunnel.GetName(),
+						Port:      &servicePort,
+					}
+					if original.ClientConfig.Service != nil {
+						target.Service.Path = original.ClientConfig.Service.Path
+					}
+					if !equality.Semantic.DeepEqual(clientConfig, target) {
+						*clientConfig = *target
+						changed = true
+					}
+				case patched && original.Tunnel == tunnelKey:
+					*clientConfig = original.ClientConfig
+					delete(originals, name)
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+
+			annotations := configuration.GetAnnotations()
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			if len(originals) == 0 {
+				delete(annotations, originalClientConfigsAnnotation)
+			} else {
+				value, err := json.Marshal(originals)
+				if err != nil {
+					return err
+				}
+				annotations[originalClientConfigsAnnotation] = string(value)
+			}
+			configuration.SetAnnotations(annotations)
+			if err := r.client.Update(ctx, configuration); err != nil {
+				errs = errors.Append(errs, errors.WrapIfWithDetails(err, "failed to update webhook configuration", "kind", kind, "configuration", configuration.GetName()))
+			}
+		}
+	}
+
+	for webhook := range desired {
+		if !found[webhook] {
+			errs = errors.Append(errs, errors.NewWithDetails("webhook not found", "kind", webhook.Kind, "configuration", webhook.Configuration, "webhook", webhook.Webhook))
+		}
+	}
+	if errs != nil {
+		return errs
+	}
+
+	if len(desired) == 0 && controllerutil.ContainsFinalizer(tunnel, tunnelWebhookFinalizer) {
+		controllerutil.RemoveFinalizer(tunnel, tunnelWebhookFinalizer)
+		if err := r.client.Update(ctx, tunnel); err != nil {
+			return errors.WrapIf(err, "failed to remove tunnel finalizer")
+		}
+	}
+	return nil
+}
+
+// listWebhookConfigurations lists the webhook configurations of the kind from the API server, they aren't cached,
+// as the controller only touches the few ones referred to by the Tunnels
+func (r *tunnelReconciler) listWebhookConfigurations(ctx context.Context, kind string) ([]client.Object, error) {
+	var configurations []client.Object
+	switch kind {
+	case webhookKindMutating:
+		list := &admissionregistrationv1.MutatingWebhookConfigurationList{}
+		if err := r.apiReader.List(ctx, list); err != nil {
+			return nil, errors.WrapIf(err, "failed to list mutating webhook configurations")
+		}
+		for i := range list.Items {
+			configurations = append(configurations, &list.Items[i])
+		}
+	case webhookKindValidating:
+		list := &admissionregistrationv1.ValidatingWebhookConfigurationList{}
+		if err := r.apiReader.List(ctx, list); err != nil {
+			return nil, errors.WrapIf(err, "failed to list validating webhook configurations")
+		}
+		for i := range list.Items {
+			configurations = append(configurations, &list.Items[i])
+		}
+	}
+	return configurations, nil
+}
+
+// webhookClientConfigs returns the client configs of the webhooks of the configuration by webhook name
+func webhookClientConfigs(configuration client.Object) map[string]*admissionregistrationv1.WebhookClientConfig {
+	clientConfigs := make(map[string]*admissionregistrationv1.WebhookClientConfig)
+	switch configuration := configuration.(type) {
+	case *admissionregistrationv1.MutatingWebhookConfiguration:
+		for i := range configuration.Webhooks {
+			clientConfigs[configuration.Webhooks[i].Name] = &configuration.Webhooks[i].ClientConfig
+		}
+	case *admissionregistrationv1.ValidatingWebhookConfiguration:
+		for i := range configuration.Webhooks {
+			clientConfigs[configuration.Webhooks[i].Name] = &configuration.Webhooks[i].ClientConfig
+		}
+	}
+	return clientConfigs
+}
@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+const defaultWaitTimeout = 60 * time.Second
+
+// waitForResource waits until the filter accepts the object (or an update of it)
+// On timeout the last observed status of the object is included in the error.
+func waitForResource(ctx context.Context, kubeCache cache.Cache, scheme *runtime.Scheme, obj client.Object, filter func(interface{}) bool, timeout time.Duration) error {
+	done := make(chan struct{}, 1)
+	informer, err := kubeCache.GetInformer(ctx, obj)
+	if err != nil {
+		return err
+	}
+
+	var lastObservedMu sync.Mutex
+	var lastObserved interface{}
+	observe := func(o interface{}) {
+		if o, ok := o.(client.Object); ok && o.GetNamespace() == obj.GetNamespace() && o.GetName() == obj.GetName() {
+			lastObservedMu.Lock()
+			lastObserved = o
+			lastObservedMu.Unlock()
+		}
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: observe,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			observe(newObj)
+		},
+	})
+
+	informer.AddEventHandler(toolscache.FilteringResourceEventHandler{
+		FilterFunc: filter,
+		Handler: toolscache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				select {
+				case done <- struct{}{}:
+				default:
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				select {
+				case done <- struct{}{}:
+				default:
+				}
+			},
+		},
+	})
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(timeout):
+		resourceType := "resource"
+		if gvk, err := apiutil.GVKForObject(obj, scheme); err == nil {
+			resourceType = strings.ToLower(gvk.Kind)
+		}
+
+		lastObservedMu.Lock()
+		defer lastObservedMu.Unlock()
+		return errors.WithDetails(
+			errors.Errorf("timeout waiting for %s after %s", resourceType, timeout),
+			"name", client.ObjectKeyFromObject(obj), "lastStatus", statusSummary(lastObserved),
+		)
+	}
+}
+
+// statusSummary returns the status of the object as compact JSON for debugging
+func statusSummary(obj interface{}) string {
+	if obj == nil {
+		return "<not observed>"
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	status, err := json.Marshal(content["status"])
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return string(status)
+}
+
+// resourceCondition checks whether the object reached the expected state
+type resourceCondition func(obj *unstructured.Unstructured) bool
+
+// parseWaitCondition parses a wait condition in the format of kubectl wait --for:
+// condition=<type>[=<status>] (status defaults to True) or jsonpath=<template>=<value>
+func parseWaitCondition(spec string) (resourceCondition, error) {
+	switch {
+	case strings.HasPrefix(spec, "condition="):
+		typeStatus := strings.SplitN(strings.TrimPrefix(spec, "condition="), "=", 2)
+		status := "True"
+		if len(typeStatus) == 2 {
+			status = typeStatus[1]
+		}
+		if typeStatus[0] == "" {
+			return nil, errors.Errorf("invalid wait condition %q", spec)
+		}
+		return conditionStatusIs(typeStatus[0], status), nil
+
+	case strings.HasPrefix(spec, "jsonpath="):
+		expression := strings.TrimPrefix(spec, "jsonpath=")
+		idx := strings.LastIndex(expression, "}=")
+		if idx < 0 {
+			return nil, errors.Errorf("invalid wait condition %q, expected jsonpath={.path}=value", spec)
+		}
+		template, value := expression[:idx+1], expression[idx+2:]
+
+		parser := jsonpath.New("wait")
+		if err := parser.Parse(template); err != nil {
+			return nil, errors.WrapIfWithDetails(err, "invalid JSONPath in wait condition", "condition", spec)
+		}
+		return func(obj *unstructured.Unstructured) bool {
+			results, err := parser.FindResults(obj.UnstructuredContent())
+			if err != nil || len(results) == 0 || len(results[0]) == 0 {
+				return false
+			}
+			return fmt.Sprint(results[0][0].Interface()) == value
+		}, nil
+
+	default:
+		return nil, errors.Errorf("invalid wait condition %q, expected condition=<type>[=<status>] or jsonpath={.path}=value", spec)
+	}
+}
+
+// defaultWaitCondition returns the condition of the kind marking the resource ready, or nil if there is none
+func defaultWaitCondition(kind string) resourceCondition {
+	switch kind {
+	case "Pod":
+		return conditionStatusIs("Ready", "True")
+	case "Deployment":
+		return conditionStatusIs("Available", "True")
+	case "Job":
+		return conditionStatusIs("Complete", "True")
+	default:
+		return nil
+	}
+}
+
+func conditionStatusIs(conditionType, status string) resourceCondition {
+	return func(obj *unstructured.Unstructured) bool {
+		conditions, _, _ := unstructured.NestedSlice(obj.UnstructuredContent(), "status", "conditions")
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if strings.EqualFold(fmt.Sprint(condition["type"]), conditionType) {
+				return strings.EqualFold(fmt.Sprint(condition["status"]), status)
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultWebhookTimeout is the timeout of admission webhooks without timeoutSeconds
+const defaultWebhookTimeout = 10 * time.Second
+
+// webhookLatencyWarningRatio is the ratio of the webhook timeout above which the latency of the downstream is warned
+// about, lower than 1 as the tunnel adds its own latency to the round trip of the API server
+const webhookLatencyWarningRatio = 0.7
+
+// findWebhookTimeout returns the shortest timeout of the admission webhooks calling the service and the names of
+// the webhooks, or zero if no webhook calls the service
+func findWebhookTimeout(ctx context.Context, clientset kubernetes.Interface, service *corev1.Service) (time.Duration, []string, error) {
+	var timeout time.Duration
+	var names []string
+	observe := func(name string, clientConfig admissionregistrationv1.WebhookClientConfig, timeoutSeconds *int32) {
+		ref := clientConfig.Service
+		if ref == nil || ref.Namespace != service.Namespace || ref.Name != service.Name {
+			return
+		}
+		webhookTimeout := defaultWebhookTimeout
+		if timeoutSeconds != nil {
+			webhookTimeout = time.Duration(*timeoutSeconds) * time.Second
+		}
+		if timeout == 0 || webhookTimeout < timeout {
+			timeout = webhookTimeout
+		}
+		names = append(names, name)
+	}
+
+	validating, err := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, nil, errors.WrapIf(err, "failed to list validating webhook configurations")
+	}
+	for _, config := range validating.Items {
+		for _, webhook := range config.Webhooks {
+			observe(config.Name+"/"+webhook.Name, webhook.ClientConfig, webhook.TimeoutSeconds)
+		}
+	}
+
+	mutating, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, nil, errors.WrapIf(err, "failed to list mutating webhook configurations")
+	}
+	for _, config := range mutating.Items {
+		for _, webhook := range config.Webhooks {
+			observe(config.Name+"/"+webhook.Name, webhook.ClientConfig, webhook.TimeoutSeconds)
+		}
+	}
+
+	return timeout, names, nil
+}
+
+// webhookLatencyWatcher warns when the latency of the downstream approaches the timeout of the webhooks calling it,
+// as the API server would fail the admission with "context deadline exceeded"
+type webhookLatencyWatcher struct {
+	logger   logr.Logger
+	next     http.RoundTripper
+	timeout  time.Duration
+	webhooks []string
+
+	mu         sync.Mutex
+	lastWarned time.Time
+}
+
+func (w *webhookLatencyWatcher) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := w.next.RoundTrip(r)
+	latency := time.Since(start)
+
+	if latency >= time.Duration(float64(w.timeout)*webhookLatencyWarningRatio) {
+		w.mu.Lock()
+		warn := time.Since(w.lastWarned) > 10*time.Second // don't flood the output of slow sessions
+		if warn {
+			w.lastWarned = time.Now()
+		}
+		w.mu.Unlock()
+		if warn {
+			w.logger.Info("WARNING: the downstream response time is close to the timeout of the admission webhooks, the API server may fail the requests with context deadline exceeded", "latency", latency.Round(time.Millisecond), "timeout", w.timeout, "webhooks", w.webhooks, "path", r.URL.Path)
+		}
+	}
+
+	return resp, err
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
-	"fmt"
-	"os"
+	"github.com/banzaicloud/kurun/cli"
+)
 
-	"github.com/banzaicloud/kurun/internal/cmd"
+// set by the release build
+var (
+	version    string
+	commitHash string
+	buildDate  string
 )
 
 func main() {
-	rootCmd := cmd.NewRootCommand()
-
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(2)
-	}
+	cli.Main(cli.BuildInfo{
+		Version:    version,
+		CommitHash: commitHash,
+		BuildDate:  buildDate,
+	})
 }
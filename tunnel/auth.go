@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AuthConfig configures the credentials required by the request handler, requests matching any of them are accepted
+type AuthConfig struct {
+	// BasicAuth maps the accepted basic auth usernames to their passwords
+	BasicAuth map[string]string
+	// BearerTokens are the accepted bearer tokens
+	BearerTokens []string
+	// Realm is the realm of the basic auth challenge, kurun by default
+	Realm string
+}
+
+func (c AuthConfig) authenticate(r *http.Request) bool {
+	if username, password, ok := r.BasicAuth(); ok {
+		expected, found := c.BasicAuth[username]
+		// the comparison is done even for unknown users, so the timing doesn't reveal them
+		return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 && found
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < len("Bearer ") || !strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimSpace(authorization[len("Bearer "):]))
+	authenticated := false
+	for _, expected := range c.BearerTokens {
+		if expected != "" && subtle.ConstantTimeCompare(token, []byte(expected)) == 1 {
+			authenticated = true
+		}
+	}
+	return authenticated
+}
+
+// AuthMiddleware rejects the requests without the credentials of the config with 401 Unauthorized
+// The Authorization header of the accepted requests is removed, so the credentials are not sent through the tunnel.
+func AuthMiddleware(config AuthConfig) Middleware {
+	realm := config.Realm
+	if realm == "" {
+		realm = "kurun"
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !config.authenticate(r) {
+				if len(config.BasicAuth) > 0 {
+					w.Header().Add("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+				}
+				if len(config.BearerTokens) > 0 {
+					w.Header().Add("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+				}
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			r = r.Clone(r.Context())
+			r.Header.Del("Authorization")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
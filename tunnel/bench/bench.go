@@ -0,0 +1,325 @@
+// Package bench drives request load through a local tunnel server and client pair, so the performance of the tunnel
+// protocol can be measured and compared release to release
+package bench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"emperror.dev/errors"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	"github.com/banzaicloud/kurun/tunnel/memory"
+	tunnelws "github.com/banzaicloud/kurun/tunnel/websocket"
+)
+
+// Transports of the tunnel pair
+const (
+	TransportMemory    = "memory"
+	TransportWebSocket = "websocket"
+)
+
+// connectTimeout limits the time waiting for the tunnel client to connect to the server
+const connectTimeout = 10 * time.Second
+
+// Config configures the load sent through the tunnel
+type Config struct {
+	// Concurrency is the number of the requests in flight, 1 by default
+	Concurrency int
+	// Duration is the time to send requests for, used if Requests is not set
+	Duration time.Duration
+	// MaxFrameSize is the maximal frame size of the tunnel, see tunnel.WithMaxFrameSize
+	MaxFrameSize int
+	// Requests is the number of the requests to send
+	Requests int
+	// RequestSize and ResponseSize are the sizes of the request and response bodies in bytes
+	RequestSize  int
+	ResponseSize int
+	// Transport is the transport of the tunnel pair, TransportMemory by default
+	Transport string
+}
+
+// Result is the outcome of a benchmark run
+type Result struct {
+	// AllocsPerRequest and BytesPerRequest are the heap allocations of the process per request, including the ones of
+	// the load generator
+	AllocsPerRequest float64
+	BytesPerRequest  float64
+	Duration         time.Duration
+	Errors           int
+	// Latencies are the percentiles of the latencies of the successful requests
+	Latencies Latencies
+	Requests  int
+}
+
+// Latencies are the percentiles of the request latencies
+type Latencies struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Throughput returns the number of the successful requests per second
+func (r Result) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Requests-r.Errors) / r.Duration.Seconds()
+}
+
+func (r Result) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "requests:    %d (%d errors) in %s\n", r.Requests, r.Errors, r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(&b, "throughput:  %.1f requests/s\n", r.Throughput())
+	fmt.Fprintf(&b, "latency:     p50 %s, p90 %s, p99 %s, max %s\n", r.Latencies.P50, r.Latencies.P90, r.Latencies.P99, r.Latencies.Max)
+	fmt.Fprintf(&b, "allocations: %.0f allocs/request, %.0f B/request\n", r.AllocsPerRequest, r.BytesPerRequest)
+	return b.String()
+}
+
+// Run starts a tunnel server and client pair, sends the requests of the config through it, and returns the measured
+// results
+func Run(ctx context.Context, config Config) (Result, error) {
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.Requests <= 0 && config.Duration <= 0 {
+		return Result{}, errors.New("either the number of requests or the duration must be specified")
+	}
+
+	pair, err := newTunnelPair(config, benchRoundTripper(config))
+	if err != nil {
+		return Result{}, err
+	}
+	defer pair.stop()
+	disconnect, err := pair.connect(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer disconnect()
+
+	return runLoad(ctx, config, pair.server)
+}
+
+// benchRoundTripper returns the round tripper of the tunnel client, responding with bodies of the configured size
+func benchRoundTripper(config Config) http.RoundTripper {
+	responseBody := bytes.Repeat([]byte("x"), config.ResponseSize)
+	return tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Proto:         req.Proto,
+			ProtoMajor:    req.ProtoMajor,
+			ProtoMinor:    req.ProtoMinor,
+			Body:          io.NopCloser(bytes.NewReader(responseBody)),
+			ContentLength: int64(len(responseBody)),
+		}, nil
+	})
+}
+
+// tunnelPair is a tunnel server and the means to connect tunnel clients to it
+type tunnelPair struct {
+	server    *tunnel.Server
+	runClient func(ctx context.Context) error
+	stop      func()
+}
+
+func newTunnelPair(config Config, roundTripper http.RoundTripper) (*tunnelPair, error) {
+	switch config.Transport {
+	case "", TransportMemory:
+		server := tunnel.NewServer(tunnel.WithMaxFrameSize(config.MaxFrameSize))
+		return &tunnelPair{
+			server: server,
+			runClient: func(ctx context.Context) error {
+				return tunnel.RunClient(ctx, *tunnel.NewClientConfig("memory", roundTripper,
+					tunnel.WithTransport(memory.Transport{Server: server}),
+					tunnel.WithMaxFrameSize(config.MaxFrameSize),
+				))
+			},
+			stop: server.Shutdown,
+		}, nil
+	case TransportWebSocket:
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, errors.WrapIf(err, "failed to listen for tunnel connections")
+		}
+		wsServer := tunnelws.NewServer(tunnelws.WithMaxFrameSize(config.MaxFrameSize))
+		httpServer := &http.Server{Handler: wsServer}
+		go func() {
+			_ = httpServer.Serve(listener)
+		}()
+		return &tunnelPair{
+			server: wsServer.Server,
+			runClient: func(ctx context.Context) error {
+				return tunnelws.RunClient(ctx, *tunnelws.NewClientConfig("ws://"+listener.Addr().String(), roundTripper,
+					tunnelws.WithMaxFrameSize(config.MaxFrameSize),
+				))
+			},
+			stop: func() {
+				wsServer.Shutdown()
+				_ = httpServer.Close()
+			},
+		}, nil
+	default:
+		return nil, errors.Errorf("unknown transport %q, expected %s or %s", config.Transport, TransportMemory, TransportWebSocket)
+	}
+}
+
+// connect starts a tunnel client, and returns once it's connected to the server, the returned function disconnects
+// it and waits until the server notices
+func (p *tunnelPair) connect(ctx context.Context) (func(), error) {
+	clients := p.server.ConnectedClients()
+	ctx, cancel := context.WithCancel(ctx)
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- p.runClient(ctx)
+	}()
+	disconnect := func() {
+		cancel()
+		<-clientErr
+		waitFor(connectTimeout, func() bool { return p.server.ConnectedClients() <= clients })
+	}
+
+	deadline := time.Now().Add(connectTimeout)
+	for p.server.ConnectedClients() <= clients {
+		select {
+		case err := <-clientErr:
+			cancel()
+			return nil, errors.WrapIf(err, "tunnel client failed to connect")
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			disconnect()
+			return nil, errors.New("timed out waiting for the tunnel client to connect")
+		}
+	}
+	return disconnect, nil
+}
+
+// waitFor polls the condition until it's true or the timeout elapses, and returns its last value
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// runLoad sends the requests through the tunnel server with the configured concurrency
+func runLoad(ctx context.Context, config Config, server *tunnel.Server) (Result, error) {
+	requestBody := bytes.Repeat([]byte("x"), config.RequestSize)
+	if config.Requests <= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Duration)
+		defer cancel()
+	}
+
+	var (
+		errorCount int64
+		latencies  = make([][]time.Duration, config.Concurrency)
+		remaining  = int64(config.Requests)
+		wg         sync.WaitGroup
+	)
+	next := func() bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		return config.Requests <= 0 || atomic.AddInt64(&remaining, -1) >= 0
+	}
+
+	var memBefore, memAfter runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&memBefore)
+	start := time.Now()
+
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for next() {
+				begin := time.Now()
+				if err := sendRequest(ctx, server, requestBody); err != nil {
+					if ctx.Err() != nil && config.Requests <= 0 {
+						return // the duration is over
+					}
+					atomic.AddInt64(&errorCount, 1)
+					continue
+				}
+				latencies[worker] = append(latencies[worker], time.Since(begin))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	duration := time.Since(start)
+	runtime.ReadMemStats(&memAfter)
+
+	var all []time.Duration
+	for _, workerLatencies := range latencies {
+		all = append(all, workerLatencies...)
+	}
+	result := Result{
+		Duration:  duration,
+		Errors:    int(errorCount),
+		Latencies: percentiles(all),
+		Requests:  len(all) + int(errorCount),
+	}
+	if result.Requests > 0 {
+		result.AllocsPerRequest = float64(memAfter.Mallocs-memBefore.Mallocs) / float64(result.Requests)
+		result.BytesPerRequest = float64(memAfter.TotalAlloc-memBefore.TotalAlloc) / float64(result.Requests)
+	}
+	if result.Requests == 0 {
+		return result, errors.New("no requests were sent")
+	}
+	return result, nil
+}
+
+func sendRequest(ctx context.Context, server *tunnel.Server, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://bench/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := server.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func percentiles(latencies []time.Duration) Latencies {
+	if len(latencies) == 0 {
+		return Latencies{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	return Latencies{
+		P50: at(0.5),
+		P90: at(0.9),
+		P99: at(0.99),
+		Max: latencies[len(latencies)-1],
+	}
+}
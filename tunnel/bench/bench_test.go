@@ -0,0 +1,49 @@
+package bench
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	for _, transport := range []string{TransportMemory, TransportWebSocket} {
+		t.Run(transport, func(t *testing.T) {
+			result, err := Run(context.Background(), Config{
+				Concurrency:  4,
+				MaxFrameSize: 1024,
+				Requests:     100,
+				RequestSize:  4096,
+				ResponseSize: 4096,
+				Transport:    transport,
+			})
+			require.NoError(t, err)
+			require.Equal(t, 100, result.Requests)
+			require.Zero(t, result.Errors)
+			require.LessOrEqual(t, result.Latencies.P50, result.Latencies.Max)
+		})
+	}
+}
+
+func TestSoak(t *testing.T) {
+	for _, transport := range []string{TransportMemory, TransportWebSocket} {
+		t.Run(transport, func(t *testing.T) {
+			rounds := 0
+			err := Soak(context.Background(), SoakConfig{
+				Duration: 500 * time.Millisecond,
+				Round: Config{
+					Concurrency: 8,
+					Duration:    50 * time.Millisecond,
+					Transport:   transport,
+				},
+			}, func(snapshot SoakSnapshot) {
+				rounds++
+				require.Equal(t, rounds, snapshot.Round)
+			})
+			require.NoError(t, err)
+			require.Greater(t, rounds, 1)
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// defaultGoroutineTolerance is the number of the goroutines allowed above the baseline after the rounds of a soak test
+const defaultGoroutineTolerance = 10
+
+// settleTimeout limits the time waiting for the goroutines and the requests of a round to finish
+const settleTimeout = 10 * time.Second
+
+// SoakConfig configures a soak test, which sends the load of Round through the tunnel again and again for Duration,
+// reconnecting the tunnel client after each round, and checks the server for leaks between the rounds
+type SoakConfig struct {
+	// Duration is the time to run the soak test for
+	Duration time.Duration
+	// GoroutineTolerance is the number of the goroutines allowed above the baseline measured before the first round,
+	// 10 by default
+	GoroutineTolerance int
+	// Round is the load of a round, the transport and the frame size of the tunnel pair are taken from it as well
+	Round Config
+}
+
+// SoakSnapshot is the state of the process after a round of a soak test
+type SoakSnapshot struct {
+	Elapsed         time.Duration
+	Goroutines      int
+	HeapAlloc       uint64
+	HeapObjects     uint64
+	PendingRequests int
+	Result          Result
+	Round           int
+}
+
+func (s SoakSnapshot) String() string {
+	return fmt.Sprintf("round %d (%s): %d requests (%d errors), %.1f requests/s, p99 %s, %d goroutines, %d KiB heap in %d objects, %d pending requests",
+		s.Round, s.Elapsed.Round(time.Second), s.Result.Requests, s.Result.Errors, s.Result.Throughput(), s.Result.Latencies.P99,
+		s.Goroutines, s.HeapAlloc/1024, s.HeapObjects, s.PendingRequests)
+}
+
+// LeakError is returned by Soak when the goroutines or the pending requests of the tunnel server don't return to the
+// baseline after a round
+type LeakError struct {
+	Baseline int
+	Snapshot SoakSnapshot
+	// Stacks are the stacks of the goroutines at the time of the detection
+	Stacks string
+}
+
+func (e *LeakError) Error() string {
+	if e.Snapshot.PendingRequests > 0 {
+		return fmt.Sprintf("%d requests left in the wait queue after round %d", e.Snapshot.PendingRequests, e.Snapshot.Round)
+	}
+	return fmt.Sprintf("%d goroutines after round %d, %d before the first round", e.Snapshot.Goroutines, e.Snapshot.Round, e.Baseline)
+}
+
+// Soak runs a soak test, the snapshots taken after the rounds are passed to the report function (if not nil)
+// A LeakError is returned if a leak is detected, the test stops when its duration is over or the context is done.
+func Soak(ctx context.Context, config SoakConfig, report func(SoakSnapshot)) error {
+	if config.Duration <= 0 {
+		return errors.New("the duration of the soak test must be specified")
+	}
+	if config.Round.Requests <= 0 && config.Round.Duration <= 0 {
+		return errors.New("either the number of requests or the duration of the rounds must be specified")
+	}
+	if config.GoroutineTolerance <= 0 {
+		config.GoroutineTolerance = defaultGoroutineTolerance
+	}
+
+	pair, err := newTunnelPair(config.Round, benchRoundTripper(config.Round))
+	if err != nil {
+		return err
+	}
+	defer pair.stop()
+
+	runtime.GC()
+	baseline := runtime.NumGoroutine()
+	start := time.Now()
+	for round := 1; time.Since(start) < config.Duration && ctx.Err() == nil; round++ {
+		disconnect, err := pair.connect(ctx)
+		if err != nil {
+			return errors.WithDetails(err, "round", round)
+		}
+		result, err := runLoad(ctx, config.Round, pair.server)
+		disconnect()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.WithDetails(err, "round", round)
+		}
+
+		// the goroutines of the connection and the requests exit asynchronously
+		waitFor(settleTimeout, func() bool {
+			return pair.server.PendingRequests() == 0 && runtime.NumGoroutine() <= baseline+config.GoroutineTolerance
+		})
+		snapshot := takeSnapshot(round, time.Since(start), result, pair)
+		if report != nil {
+			report(snapshot)
+		}
+		if snapshot.PendingRequests > 0 || snapshot.Goroutines > baseline+config.GoroutineTolerance {
+			return &LeakError{
+				Baseline: baseline,
+				Snapshot: snapshot,
+				Stacks:   goroutineStacks(),
+			}
+		}
+	}
+	return nil
+}
+
+func takeSnapshot(round int, elapsed time.Duration, result Result, pair *tunnelPair) SoakSnapshot {
+	var mem runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	return SoakSnapshot{
+		Elapsed:         elapsed,
+		Goroutines:      runtime.NumGoroutine(),
+		HeapAlloc:       mem.HeapAlloc,
+		HeapObjects:     mem.HeapObjects,
+		PendingRequests: pair.server.PendingRequests(),
+		Result:          result,
+		Round:           round,
+	}
+}
+
+func goroutineStacks() string {
+	var buf bytes.Buffer
+	_ = pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	return buf.String()
+}
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// maxPooledBufferSize limits the size of the buffers returned to the pool, so a few big messages don't keep their
+// memory allocated
+const maxPooledBufferSize = 1 << 20
+
+var (
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
+	bufioReaderPool = sync.Pool{
+		New: func() interface{} {
+			return bufio.NewReader(nil)
+		},
+	}
+)
+
+// message is a message of a tunnel connection read into pooled buffers, which are reused once it's released
+// The message has to be read completely before the next reader of the connection is created, as that invalidates the
+// current one.
+type message struct {
+	*bytes.Buffer
+	reader *bufio.Reader
+}
+
+func readMessage(r io.Reader) (*message, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	m := &message{Buffer: buf}
+	if _, err := buf.ReadFrom(r); err != nil {
+		m.release()
+		return nil, err
+	}
+	return m, nil
+}
+
+// bufferedReader returns a pooled buffered reader of the rest of the message, e.g. to parse HTTP messages
+func (m *message) bufferedReader() *bufio.Reader {
+	if m.reader == nil {
+		m.reader = bufioReaderPool.Get().(*bufio.Reader)
+		m.reader.Reset(m.Buffer)
+	}
+	return m.reader
+}
+
+// release returns the buffers to the pools, the message must not be used after it
+func (m *message) release() {
+	if m.reader != nil {
+		m.reader.Reset(nil)
+		bufioReaderPool.Put(m.reader)
+		m.reader = nil
+	}
+	if m.Buffer != nil {
+		if m.Buffer.Cap() <= maxPooledBufferSize {
+			bufferPool.Put(m.Buffer)
+		}
+		m.Buffer = nil
+	}
+}
+
+// releaseWithBody returns the body of the HTTP message parsed from the message, which releases the message when it's
+// closed, as the body is read from the buffers
+func (m *message) releaseWithBody(body io.ReadCloser) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		m.release()
+		return body
+	}
+	return &messageBody{
+		ReadCloser: body,
+		msg:        m,
+	}
+}
+
+type messageBody struct {
+	io.ReadCloser
+	msg  *message
+	once sync.Once
+}
+
+func (b *messageBody) Close() error {
+	// the HTTP bodies don't read their source after they are closed
+	err := b.ReadCloser.Close()
+	b.once.Do(b.msg.release)
+	return err
+}
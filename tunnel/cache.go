@@ -0,0 +1,302 @@
+package tunnel
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStatusHeader is set on the responses of the cache middleware to hit or miss
+const CacheStatusHeader = "X-Kurun-Cache"
+
+// defaultMaxCacheEntrySize is the size limit of the cached responses unless configured otherwise
+const defaultMaxCacheEntrySize = 1 << 20
+
+// CacheConfig configures the response cache of the request handler, so the repeated requests of cacheable responses
+// (e.g. static assets) are not sent through the tunnel each time
+type CacheConfig struct {
+	// KeyHeaders are the request headers distinguishing the cached responses besides the method and the URL, the
+	// responses varying on other headers (see the Vary header) are not cached
+	KeyHeaders []string
+	// MaxEntrySize is the size limit of the cached response bodies, 1MiB by default
+	MaxEntrySize int64
+	// MaxSize is the size limit of all cached response bodies, the least recently used ones are evicted beyond it
+	MaxSize int64
+}
+
+// CacheMiddleware serves the GET and HEAD requests from a shared LRU cache of the responses cacheable according to
+// their Cache-Control (or Expires) headers
+// Only the fresh responses with an explicit lifetime are cached, the requests with authorization or asking to bypass
+// caches (no-cache, no-store or max-age=0) are sent through.
+func CacheMiddleware(config CacheConfig) Middleware {
+	if config.MaxEntrySize <= 0 {
+		config.MaxEntrySize = defaultMaxCacheEntrySize
+	}
+	keyHeaders := make([]string, 0, len(config.KeyHeaders))
+	for _, name := range config.KeyHeaders {
+		keyHeaders = append(keyHeaders, http.CanonicalHeaderKey(name))
+	}
+	sort.Strings(keyHeaders)
+
+	cache := &responseCache{
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		maxSize:  config.MaxSize,
+		keyNames: keyHeaders,
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Authorization") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := cache.key(r)
+			reqDirectives := parseCacheControl(r.Header.Get("Cache-Control"))
+			_, noCache := reqDirectives["no-cache"]
+			_, noStore := reqDirectives["no-store"]
+			if !noCache && !noStore && reqDirectives["max-age"] != "0" {
+				if entry := cache.get(key, time.Now()); entry != nil {
+					entry.serve(w, r)
+					return
+				}
+			}
+
+			w.Header().Set(CacheStatusHeader, "miss")
+			if r.Method == http.MethodHead || noStore {
+				next.ServeHTTP(w, r)
+				return
+			}
+			recorder := &cacheRecorder{ResponseWriter: w, maxSize: config.MaxEntrySize}
+			next.ServeHTTP(recorder, r)
+			if entry := recorder.entry(cache.keyNames, time.Now()); entry != nil {
+				cache.put(key, entry)
+			}
+		})
+	}
+}
+
+type responseCache struct {
+	entries  map[string]*list.Element
+	keyNames []string
+	lru      *list.List
+	maxSize  int64
+	mutex    sync.Mutex
+	size     int64
+}
+
+// key returns the cache key of the request, the HEAD requests are served from the responses of the GET requests
+func (c *responseCache) key(r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(r.Host)
+	key.WriteString(r.URL.RequestURI())
+	for _, name := range c.keyNames {
+		key.WriteString("\n")
+		key.WriteString(name)
+		key.WriteString(": ")
+		key.WriteString(strings.Join(r.Header.Values(name), ", "))
+	}
+	return key.String()
+}
+
+func (c *responseCache) get(key string, now time.Time) *cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, found := c.entries[key]
+	if !found {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *responseCache) put(key string, entry *cacheEntry) {
+	if entry.size() > c.maxSize {
+		return
+	}
+	entry.key = key
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += entry.size()
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+type cacheEntry struct {
+	body    []byte
+	created time.Time
+	expires time.Time
+	header  http.Header
+	key     string
+	status  int
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.body))
+}
+
+func (e *cacheEntry) serve(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	for name, values := range e.header {
+		header[name] = values
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(e.created).Seconds())))
+	header.Set(CacheStatusHeader, "hit")
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(e.body)
+	}
+}
+
+// cacheRecorder records the response while it's written to the client, until it exceeds the size limit
+type cacheRecorder struct {
+	http.ResponseWriter
+	body     bytes.Buffer
+	header   http.Header
+	maxSize  int64
+	overflow bool
+	status   int
+}
+
+func (cr *cacheRecorder) WriteHeader(status int) {
+	if cr.status == 0 {
+		cr.status = status
+		cr.header = cr.ResponseWriter.Header().Clone()
+	}
+	cr.ResponseWriter.WriteHeader(status)
+}
+
+func (cr *cacheRecorder) Write(p []byte) (int, error) {
+	if cr.status == 0 {
+		cr.WriteHeader(http.StatusOK)
+	}
+	n, err := cr.ResponseWriter.Write(p)
+	if !cr.overflow {
+		if int64(cr.body.Len()+n) > cr.maxSize {
+			cr.overflow = true
+			cr.body = bytes.Buffer{}
+		} else {
+			cr.body.Write(p[:n])
+		}
+	}
+	if err != nil {
+		cr.overflow = true // incomplete
+	}
+	return n, err
+}
+
+// Flush keeps streaming responses working through the recorder
+func (cr *cacheRecorder) Flush() {
+	if flusher, ok := cr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// entry returns the cache entry of the recorded response, or nil if it's not cacheable
+func (cr *cacheRecorder) entry(keyNames []string, now time.Time) *cacheEntry {
+	if cr.overflow || cr.status != http.StatusOK {
+		return nil
+	}
+	header := cr.header
+	if header.Get("Set-Cookie") != "" || header.Get(DownstreamErrorHeader) != "" {
+		return nil
+	}
+	for _, vary := range header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if i := sort.SearchStrings(keyNames, name); i == len(keyNames) || keyNames[i] != name {
+				return nil // varies on a header which is not part of the key
+			}
+		}
+	}
+
+	lifetime, ok := responseLifetime(header, now)
+	if !ok || lifetime <= 0 {
+		return nil
+	}
+	header = header.Clone()
+	header.Del(CacheStatusHeader)
+	return &cacheEntry{
+		body:    cr.body.Bytes(),
+		created: now,
+		expires: now.Add(lifetime),
+		header:  header,
+		status:  cr.status,
+	}
+}
+
+// responseLifetime returns the time the response is fresh for according to its s-maxage or max-age directives, or
+// its Expires header, ok is false if the response must not be stored by shared caches
+func responseLifetime(header http.Header, now time.Time) (lifetime time.Duration, ok bool) {
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, found := directives[directive]; found {
+			return 0, false
+		}
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, found := directives[directive]; found {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			age, _ := strconv.ParseInt(header.Get("Age"), 10, 64)
+			return time.Duration(seconds-age) * time.Second, true
+		}
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		return expiresAt.Sub(date), true
+	}
+	return 0, false
+}
+
+// parseCacheControl parses the directives of a Cache-Control header, the directives without values are mapped to ""
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, arg := part, ""
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			name, arg = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		directives[strings.ToLower(name)] = arg
+	}
+	return directives
+}
@@ -0,0 +1,523 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+
+	"github.com/banzaicloud/kurun/tunnel/pkg/unwind"
+	"github.com/banzaicloud/kurun/tunnel/pkg/workplace"
+)
+
+func NewClientConfig(serverAddr string, roundTripper http.RoundTripper, options ...ClientConfigOption) *ClientConfig {
+	c := &ClientConfig{
+		logger:       logr.Discard(),
+		roundTripper: roundTripper,
+		serverAddr:   serverAddr,
+	}
+	for _, opt := range options {
+		if opt != nil {
+			opt.ApplyToClientConfig(c)
+		}
+	}
+	return c
+}
+
+type ClientConfig struct {
+	downstreamHealth   *DownstreamHealthChecker
+	eventHandler       ConnectionEventHandler
+	logger             logr.Logger
+	maxBackoff         time.Duration
+	maxFrameSize       int
+	minBackoff         time.Duration
+	pingInterval       time.Duration
+	pingTuner          *pingTuner
+	reconnectEnabled   bool
+	roundTripper       http.RoundTripper
+	serverAddr         string
+	sessionGracePeriod time.Duration
+	transport          Transport
+}
+
+type ClientConfigOption interface {
+	ApplyToClientConfig(*ClientConfig)
+}
+
+type ClientConfigOptionFunc func(cfg *ClientConfig)
+
+func (opt ClientConfigOptionFunc) ApplyToClientConfig(c *ClientConfig) {
+	opt(c)
+}
+
+// WithTransport sets the transport connecting the client to the server
+func WithTransport(transport Transport) ClientConfigOption {
+	return ClientConfigOptionFunc(func(cfg *ClientConfig) {
+		cfg.transport = transport
+	})
+}
+
+// RunClient connects to the server with the transport of the config, and sends the requests received from it to the
+// round tripper until the context is cancelled or the connection is closed (and not reconnected, see WithReconnect)
+func RunClient(ctx context.Context, cfg ClientConfig) (err error) {
+	if cfg.transport == nil {
+		return errors.New("no tunnel transport configured")
+	}
+
+	conn, err := cfg.transport.Dial(ctx, cfg.serverAddr)
+	if err != nil {
+		return err
+	}
+
+	var session *clientSession
+	if cfg.sessionGracePeriod > 0 {
+		sessionCtx, stopSession := context.WithCancel(ctx)
+		session = newClientSession(sessionCtx, cfg.sessionGracePeriod, cfg.logger)
+		defer func() {
+			stopSession()
+			session.wait()
+		}()
+	}
+
+	for {
+		cfg.emit(ConnectionEvent{Type: ConnectionEventConnected})
+		var idle time.Duration
+		idle, err = runClientConn(ctx, cfg, session, conn)
+		cfg.emit(ConnectionEvent{Type: ConnectionEventDisconnected, Err: err})
+		if !cfg.reconnectEnabled || ctx.Err() != nil {
+			return err
+		}
+		if cfg.pingTuner != nil && err != nil {
+			var event *ConnectionEvent
+			if cfg.pingInterval, event = cfg.pingTuner.adapt(cfg.pingInterval, idle); event != nil {
+				cfg.logger.Info("adapted tunnel keepalive", "event", event.String())
+				cfg.emit(*event)
+			}
+		}
+		if conn, err = cfg.reconnect(ctx, err); err != nil {
+			return ignoreCancelled(err)
+		}
+	}
+}
+
+// runClientConn sends the requests received on the connection to the round tripper until the context is cancelled
+// or the connection is closed, and returns the time the connection was idle for when it was closed
+// The requests are handled in the session if it's not nil, so their responses can be sent on the next connection.
+func runClientConn(ctx context.Context, cfg ClientConfig, session *clientSession, conn Conn) (time.Duration, error) {
+	logger := cfg.logger.WithValues("conn", conn)
+
+	c := &client{
+		conn:         newFrameMux(conn),
+		maxFrameSize: normalizeMaxFrameSize(cfg.maxFrameSize),
+		requests: &requestCancels{
+			cancels: make(map[requestID]context.CancelFunc),
+		},
+		roundTripper: cfg.roundTripper,
+		session:      session,
+	}
+	c.logger = logger.WithValues("client", c)
+	c.touch()
+	if pingInterval := cfg.pingInterval; pingInterval > 0 {
+		c.pingInterval = pingInterval
+		c.pingTicker = time.NewTicker(pingInterval)
+	}
+	if session != nil {
+		c.requests = &session.requests
+		if err := session.attach(c); err != nil {
+			c.stopPingTicker()
+			c.tryCloseConnection("tunnel client failed to send session")
+			return c.idle(), errors.WrapIf(err, "failed to send session ID")
+		}
+		defer session.detach(c)
+	}
+
+	go c.wp.Do(func() {
+		uc := unwind.WithHandler(func(reason interface{}) {
+			c.wp.Close(reasonToError(reason, "in ping loop"))
+		})
+		if err := uc.DoError(c.pingLoop); err != nil {
+			c.wp.Close(err)
+		}
+	})
+	if checker := cfg.downstreamHealth; checker != nil {
+		go c.wp.Do(func() {
+			uc := unwind.WithHandler(func(reason interface{}) {
+				c.wp.Close(reasonToError(reason, "in health report loop"))
+			})
+			if err := uc.DoError(func() error { return c.reportHealthLoop(checker) }); err != nil {
+				c.wp.Close(err)
+			}
+		})
+	}
+	go c.wp.Do(func() {
+		uc := unwind.WithHandler(func(reason interface{}) {
+			c.wp.Close(reasonToError(reason, "in reader loop"))
+		})
+		if err := uc.DoError(c.readLoop); err != nil {
+			c.wp.Close(err)
+		}
+	})
+
+	select {
+	case <-ctx.Done():
+		c.wp.Close(ignoreCancelled(ctx.Err()))
+	case <-c.wp.Closing():
+	}
+
+	err := c.wp.Wait()
+	return c.idle(), err
+}
+
+type client struct {
+	// lastActivity is the time (in Unix nanoseconds) a message was last sent or received on the connection, it's the
+	// first field to be 64-bit aligned for the atomic operations on 32-bit platforms
+	lastActivity int64
+	// conn is shared by the handlers of the requests writing their responses concurrently
+	conn         *frameMux
+	fragments    reassembler
+	logger       logr.Logger
+	maxFrameSize int
+	pingInterval time.Duration
+	pingTicker   *time.Ticker
+	// requests are the ones of the session if there's one
+	requests     *requestCancels
+	roundTripper http.RoundTripper
+	session      *clientSession
+	wp           workplace.Workplace
+}
+
+// touch records activity on the connection
+func (c *client) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// idle returns the time since the last activity on the connection
+func (c *client) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+func (c *client) pingTickerCh() <-chan time.Time {
+	if ticker := c.pingTicker; ticker != nil {
+		return ticker.C
+	}
+	return nil
+}
+
+// handleRequest sends the request to the round tripper, the request is cancelled with cancel when the server cancels
+// it or the client is closing
+func (c *client) handleRequest(reqID requestID, legacyFraming bool, req *http.Request, cancel context.CancelFunc) {
+	logger := c.logger.WithValues("id", reqID, "request", req)
+	logger.V(1).Info("handling request")
+
+	defer triggerWhenClosed(c.wp.Closing(), cancel)() // cancel request if client is closing
+
+	respItem := responseItem{
+		ctx:           req.Context(),
+		legacyFraming: legacyFraming,
+		reqID:         reqID,
+		resp:          c.roundTrip(logger, req),
+	}
+	if err := c.writeResponse(logger, respItem); err != nil {
+		c.wp.Close(err)
+	}
+}
+
+// roundTrip sends the request to the round tripper, the failures are returned as the responses reporting them to the
+// server (see DownstreamErrorHeader)
+func (c *client) roundTrip(logger logr.Logger, req *http.Request) *http.Response {
+	resp, err := c.roundTripper.RoundTrip(req)
+	if err != nil {
+		logger.Error(err, "round trip failed")
+		resp = NewDownstreamError(err).Response()
+	}
+	return resp
+}
+
+func (c *client) readLoop() error {
+	logger := c.logger.WithName("readLoop")
+	defer logger.V(1).Info("tunnel connection reader loop terminated")
+	defer c.fragments.releaseAll()
+
+	for {
+		if !c.wp.Open() {
+			logger.V(1).Info("client closing, terminating reader loop")
+			return nil
+		}
+
+		rdr, err := c.conn.NextReader()
+		if err != nil {
+			if !c.wp.Open() {
+				return nil // we're already closing
+			}
+			if isTemporaryError(err) {
+				logger.V(1).Error(err, "got temporary error when getting next reader")
+				continue
+			}
+			if closeError := new(ConnClosedError); errors.As(err, &closeError) {
+				logger.Info("tunnel connection closed by server", "reason", closeError.Reason)
+			} else {
+				logger.Error(err, "failed to get next reader")
+			}
+			return err
+		}
+		c.touch()
+		c.resetPingTicker()
+		// read all data before a new reader is created for the connection and the current reader is invalidated
+		msg, err := readMessage(rdr)
+		if err != nil {
+			logger.Error(err, "failed to read message data")
+			continue
+		}
+		c.handleMessage(logger, msg)
+	}
+}
+
+// handleMessage handles the message received from the server, and releases it when it's not needed anymore
+func (c *client) handleMessage(logger logr.Logger, msg *message) {
+	var reqID requestID
+	legacyFraming := isLegacyFrame(msg.Bytes())
+	if legacyFraming {
+		if err := binary.Read(msg, binary.LittleEndian, &reqID); err != nil {
+			logger.Error(err, "failed to read request ID")
+			msg.release()
+			return
+		}
+	} else {
+		header, err := readFrameHeader(msg)
+		if err != nil {
+			logger.Error(err, "failed to read frame header")
+			msg.release()
+			return
+		}
+		if header.Version != frameVersion {
+			logger.Info("dropping frame of unsupported version, is the tunnel server of a newer release?", "version", header.Version)
+			msg.release()
+			return
+		}
+		switch header.Type {
+		case frameTypeRequest:
+			reqID = header.RequestID
+			var complete bool
+			if msg, complete = c.fragments.add(header, msg); !complete {
+				return
+			}
+		case frameTypeCancel:
+			msg.release()
+			c.fragments.drop(header.RequestID)
+			if c.requests.cancel(header.RequestID) {
+				logger.V(1).Info("request cancelled by server", "id", header.RequestID)
+			}
+			return
+		default:
+			logger.V(1).Info("dropping frame of unknown type", "type", header.Type)
+			msg.release()
+			return
+		}
+	}
+	req, err := http.ReadRequest(msg.bufferedReader())
+	if err != nil {
+		logger.Error(err, "failed to read request", "id", reqID)
+		msg.release()
+		return
+	}
+	req.Body = msg.releaseWithBody(req.Body)
+
+	// registered before the request is handled, so the cancellations right after the request are not missed
+	ctx, cancel := requestContext(req)
+	req = req.WithContext(ctx)
+	c.requests.add(reqID, cancel)
+	if c.session != nil && !legacyFraming {
+		// handled across the connections of the session
+		c.session.handleRequest(c, reqID, req, cancel)
+		return
+	}
+	go c.wp.Do(func() {
+		uc := unwind.WithHandler(func(reason interface{}) {
+			c.wp.Close(reasonToError(reason, "while handling request"))
+		})
+		uc.Do(func() {
+			c.handleRequest(reqID, legacyFraming, req, cancel)
+		})
+	})
+}
+
+func (c *client) resetPingTicker() {
+	if ticker := c.pingTicker; ticker != nil {
+		ticker.Reset(c.pingInterval)
+	}
+}
+
+func (c *client) tryCloseConnection(reason string) {
+	if err := c.conn.Close(reason); err != nil {
+		c.logger.Error(err, "failed to close tunnel connection")
+	}
+}
+
+func (c *client) stopPingTicker() {
+	if ticker := c.pingTicker; ticker != nil {
+		ticker.Stop()
+	}
+}
+
+// pingLoop sends pings to the server when no responses were sent in the ping interval, and closes the connection when
+// the client is closing
+func (c *client) pingLoop() error {
+	logger := c.logger.WithName("pingLoop")
+	defer logger.V(1).Info("tunnel connection ping loop terminated")
+
+	defer c.tryCloseConnection("tunnel client terminating")
+	defer c.stopPingTicker()
+
+	for {
+		select {
+		case <-c.wp.Closing():
+			logger.V(1).Info("client closing, terminating ping loop")
+			return nil
+		case <-c.pingTickerCh():
+			logger.V(2).Info("sending ping")
+			if err := c.conn.Ping(); err != nil {
+				if isTemporaryError(err) {
+					logger.V(1).Error(err, "got temporary error when sending ping message")
+					continue
+				}
+				logger.Error(err, "failed to send ping message")
+				return err
+			}
+			c.touch()
+		}
+	}
+}
+
+// writeResponse writes the response to the connection, taking turns with the responses written concurrently
+func (c *client) writeResponse(logger logr.Logger, respItem responseItem) error {
+	for {
+		if !c.wp.Open() {
+			logger.Info("client closing, bailing on response")
+			return nil
+		}
+		err := writeResponse(c.conn, c.maxFrameSize, respItem)
+		if err != nil && respItem.ctx.Err() != nil {
+			// the response body can't be read after the request is cancelled, the server dropped the request
+			logger.V(1).Info("request cancelled while writing response", "error", err.Error())
+			c.requests.done(respItem.reqID)
+			return nil
+		}
+		if err != nil {
+			if !c.wp.Open() {
+				return nil // we're already closing
+			}
+			if isTemporaryError(err) {
+				logger.V(1).Error(err, "got temporary error when writing response to tunnel connection")
+				continue
+			}
+			logger.Error(err, "failed to write response to tunnel connection")
+			return err
+		}
+		c.requests.done(respItem.reqID)
+		c.touch()
+		c.resetPingTicker()
+		return nil
+	}
+}
+
+type responseItem struct {
+	// ctx is the context of the request, it's done when the request is cancelled
+	ctx context.Context
+	// legacyFraming is set for the requests of servers sending them without the frame envelope
+	legacyFraming bool
+	reqID         requestID
+	resp          *http.Response
+}
+
+// requestCancels tracks the requests being handled by the client, so they can be cancelled by the server
+type requestCancels struct {
+	cancels map[requestID]context.CancelFunc
+	mutex   sync.Mutex
+}
+
+func (r *requestCancels) add(id requestID, cancel context.CancelFunc) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cancels[id] = cancel
+}
+
+// cancel cancels the request, and returns whether it was being handled
+func (r *requestCancels) cancel(id requestID) bool {
+	r.mutex.Lock()
+	cancel, found := r.cancels[id]
+	delete(r.cancels, id)
+	r.mutex.Unlock()
+
+	if found {
+		cancel()
+	}
+	return found
+}
+
+// done releases the resources of the request once its response is sent
+func (r *requestCancels) done(id requestID) {
+	r.cancel(id)
+}
+
+// writeResponse writes the response to the connection, split into frames of at most maxFrameSize bytes if it's positive
+func writeResponse(conn Conn, maxFrameSize int, item responseItem) error {
+	var w io.WriteCloser
+	if item.legacyFraming {
+		// the legacy servers don't reassemble fragments
+		wc, err := conn.NextWriter()
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(wc, binary.LittleEndian, item.reqID); err != nil {
+			_ = wc.Close()
+			return err
+		}
+		w = wc
+	} else {
+		fw, err := newFrameWriter(conn, frameTypeResponse, item.reqID, maxFrameSize)
+		if err != nil {
+			return err
+		}
+		w = fw
+	}
+	if err := item.resp.Write(w); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func ignoreCancelled(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// triggerWhenClosed triggers the specified action when the specified channel is closed
+// The returned function can be used to unarm the trigger
+func triggerWhenClosed(ch <-chan struct{}, act func()) (unarm func()) {
+	unarmed := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case _, open := <-ch:
+				if !open {
+					act()
+					return
+				}
+			case <-unarmed:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(unarmed)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/yaml"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+// serverConfig is the config file of kurun-server (see the config flag), its settings override the flags, e.g.
+//
+//	control:
+//	  address: :10080
+//	request:
+//	  address: :8443
+//	  certFile: /etc/tls/tls.crt
+//	  keyFile: /etc/tls/tls.key
+//	auth:
+//	  tokenFile: /etc/kurun-auth/token
+//	limits:
+//	  responseHeaderTimeout: 30s
+//	middlewares:
+//	- type: log
+//	quotas:
+//	  default:
+//	    requestsPerSecond: 20
+//	  tunnels:
+//	    alice:
+//	      maxConcurrent: 50
+//
+// The config is reloaded on SIGHUP and when the files change, the addresses and whether the servers use TLS are only
+// changed by a restart.
+type serverConfig struct {
+	Auth    *authSpec      `json:"auth,omitempty"`
+	Control listenerConfig `json:"control,omitempty"`
+	Limits  limitsConfig   `json:"limits,omitempty"`
+	// Middlewares are added to the middleware stack after the ones of the flags
+	Middlewares []middlewareSpec `json:"middlewares,omitempty"`
+	// Quotas are the quotas of the tunnels with the tunnel-id flag
+	Quotas  *quotasConfig  `json:"quotas,omitempty"`
+	Request listenerConfig `json:"request,omitempty"`
+}
+
+// listenerConfig is the address and the TLS certificate of a server
+type listenerConfig struct {
+	Address  string `json:"address,omitempty"`
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+// quotasConfig are the default quota of the tunnels (overriding the flags), and the quotas of the tunnels by their IDs
+type quotasConfig struct {
+	Default *quotaSpec           `json:"default,omitempty"`
+	Tunnels map[string]quotaSpec `json:"tunnels,omitempty"`
+}
+
+// quotaSpec is the quota of a tunnel, see tunnel.TunnelQuota
+type quotaSpec struct {
+	Burst             int     `json:"burst,omitempty"`
+	BytesPerSecond    int64   `json:"bytesPerSecond,omitempty"`
+	MaxConcurrent     int     `json:"maxConcurrent,omitempty"`
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+}
+
+func (s quotaSpec) tunnelQuota() tunnel.TunnelQuota {
+	return tunnel.TunnelQuota{
+		Burst:             s.Burst,
+		BytesPerSecond:    s.BytesPerSecond,
+		MaxConcurrent:     s.MaxConcurrent,
+		RequestsPerSecond: s.RequestsPerSecond,
+	}
+}
+
+// limitsConfig are the limits of the requests, the durations are given like 30s or 1m
+type limitsConfig struct {
+	FlushInterval         string `json:"flushInterval,omitempty"`
+	ResponseHeaderTimeout string `json:"responseHeaderTimeout,omitempty"`
+}
+
+func loadServerConfig(path string) (serverConfig, error) {
+	config := serverConfig{}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return config, errors.WrapIfWithDetails(err, "failed to read config", "path", path)
+	}
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return config, errors.WrapIfWithDetails(err, "failed to parse config", "path", path)
+	}
+	return config, nil
+}
+
+// apply overrides the params of the flags with the settings of the config
+func (c serverConfig) apply(params *Params) error {
+	if c.Control.Address != "" {
+		params.controlServerAddress = c.Control.Address
+	}
+	if c.Control.CertFile != "" || c.Control.KeyFile != "" {
+		params.controlServerCertFile, params.controlServerKeyFile = c.Control.CertFile, c.Control.KeyFile
+	}
+	if c.Request.Address != "" {
+		params.requestServerAddress = c.Request.Address
+	}
+	if c.Request.CertFile != "" || c.Request.KeyFile != "" {
+		params.requestServerCertFile, params.requestServerKeyFile = c.Request.CertFile, c.Request.KeyFile
+	}
+	if c.Auth != nil {
+		params.auth = *c.Auth
+	}
+	for _, limit := range []struct {
+		name  string
+		value string
+		param *time.Duration
+	}{
+		{name: "flushInterval", value: c.Limits.FlushInterval, param: &params.requestFlushInterval},
+		{name: "responseHeaderTimeout", value: c.Limits.ResponseHeaderTimeout, param: &params.responseHeaderTimeout},
+	} {
+		if limit.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(limit.value)
+		if err != nil {
+			return errors.WrapIfWithDetails(err, "invalid limit in config", "limit", limit.name)
+		}
+		*limit.param = value
+	}
+	if c.Quotas != nil {
+		if c.Quotas.Default != nil {
+			params.tunnelQuota = c.Quotas.Default.tunnelQuota()
+		}
+		params.tunnelQuotas = make(map[string]tunnel.TunnelQuota, len(c.Quotas.Tunnels))
+		for id, spec := range c.Quotas.Tunnels {
+			params.tunnelQuotas[id] = spec.tunnelQuota()
+		}
+	}
+	params.configMiddlewares = c.Middlewares
+	return nil
+}
+
+// watchedFiles returns the files the settings are read from, the config is reloaded when any of them changes
+func (params Params) watchedFiles() []string {
+	files := []string{
+		params.configFile,
+		params.controlServerCertFile,
+		params.controlServerKeyFile,
+		params.requestServerCertFile,
+		params.requestServerKeyFile,
+		params.requestMiddlewareConfig,
+		params.auth.TokenFile,
+		params.auth.BasicAuthFile,
+		params.tunnelTokensFile,
+	}
+	for _, spec := range params.configMiddlewares {
+		if spec.Auth != nil {
+			files = append(files, spec.Auth.TokenFile, spec.Auth.BasicAuthFile)
+		}
+	}
+	for _, value := range params.routeServers {
+		if spec, err := parseRouteServerSpec(value); err == nil {
+			files = append(files, spec.certFile, spec.keyFile)
+		}
+	}
+	for _, value := range params.errorBodies {
+		if _, path, err := parseErrorKindValue("req-error-body", value, errorKinds); err == nil {
+			files = append(files, path)
+		}
+	}
+	result := files[:0]
+	for _, file := range files {
+		if file != "" {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// watchConfig calls reload on SIGHUP, and when any of the files changes (checked at the interval, zero disables
+// checking), until the context is cancelled
+// The files are polled instead of being watched, as the ConfigMaps and Secrets mounted into pods are updated by
+// swapping symlinks.
+func watchConfig(ctx context.Context, interval time.Duration, files func() []string, reload func() error, logger logr.Logger) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var tickerCh <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tickerCh = ticker.C
+	}
+
+	versions := fileVersions(files())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			logger.Info("SIGHUP received, reloading config")
+		case <-tickerCh:
+			if current := fileVersions(files()); current == versions {
+				continue
+			}
+			logger.Info("config files changed, reloading config")
+		}
+		if err := reload(); err != nil {
+			logger.Error(err, "failed to reload config, keeping the previous one")
+		} else {
+			logger.Info("config reloaded")
+		}
+		// the failed versions are not retried until they change again
+		versions = fileVersions(files())
+	}
+}
+
+// fileVersions returns the modification times and the sizes of the files, so changes can be detected by comparing them
+func fileVersions(files []string) string {
+	versions := ""
+	for _, file := range files {
+		versions += file + "="
+		if info, err := os.Stat(file); err == nil {
+			versions += info.ModTime().String() + "/" + strconv.FormatInt(info.Size(), 10)
+		}
+		versions += "\n"
+	}
+	return versions
+}
+
+// certificateFile is a TLS certificate loaded from files, reloaded with the config
+type certificateFile struct {
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+}
+
+func loadCertificateFile(certFile, keyFile string) (*certificateFile, error) {
+	c := &certificateFile{}
+	return c, c.load(certFile, keyFile)
+}
+
+func (c *certificateFile) load(certFile, keyFile string) error {
+	cert, err := readCertificate(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.set(cert)
+	return nil
+}
+
+func (c *certificateFile) set(cert *tls.Certificate) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert = cert
+}
+
+func readCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to load TLS certificate", "cert", certFile, "key", keyFile)
+	}
+	return &cert, nil
+}
+
+// GetCertificate returns the current certificate for tls.Config
+func (c *certificateFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+// reloadableHandler serves the requests with the handler set last, so the handlers can be rebuilt with the reloaded
+// config without restarting the server
+type reloadableHandler struct {
+	mutex   sync.RWMutex
+	handler http.Handler
+}
+
+func (h *reloadableHandler) set(handler http.Handler) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.handler = handler
+}
+
+func (h *reloadableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.RLock()
+	handler := h.handler
+	h.mutex.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+// reloader reloads the settings of the request handlers, the tunnel tokens and quotas, and the certificates of the
+// servers with the config, the rest requires a restart
+// Everything is loaded and validated before any of it is swapped in, so a failed reload keeps the previous settings
+// as a whole.
+type reloader struct {
+	controlServerCert *certificateFile
+	// current are the params of the latest reload, only accessed by the goroutine of watchConfig
+	current           Params
+	flagParams        Params
+	logger            logr.Logger
+	newRequestHandler func(settings requestSettings, roundTripper http.RoundTripper) http.Handler
+	quotas            *tunnel.TunnelQuotas
+	// requestServers are the default request server followed by the servers of the routeSpecs
+	requestServers []*requestServer
+	routeSpecs     []routeServerSpec
+	tokens         *tunnelTokens
+}
+
+// watchedFiles returns the files of the current params
+func (r *reloader) watchedFiles() []string {
+	return r.current.watchedFiles()
+}
+
+func (r *reloader) reload() error {
+	params := r.flagParams
+	if params.configFile != "" {
+		config, err := loadServerConfig(params.configFile)
+		if err != nil {
+			return err
+		}
+		if err := config.apply(&params); err != nil {
+			return err
+		}
+	}
+	if params.controlServerAddress != r.current.controlServerAddress ||
+		params.requestServerAddress != r.current.requestServerAddress ||
+		(params.controlServerCertFile != "") != (r.current.controlServerCertFile != "") ||
+		(params.requestServerCertFile != "") != (r.current.requestServerCertFile != "") {
+		r.logger.Info("WARNING: the addresses and whether the servers use TLS are only changed by a restart")
+	}
+
+	settings, err := buildRequestSettings(params, r.logger)
+	if err != nil {
+		return err
+	}
+	if err := validateTunnelQuotas(params); err != nil {
+		return err
+	}
+	var tokens map[string]string
+	if params.tunnelID == tunnelByToken {
+		if tokens, err = readTunnelTokens(params.tunnelTokensFile); err != nil {
+			return err
+		}
+	}
+	certificates := make(map[*certificateFile]*tls.Certificate)
+	readCertificateOf := func(certificate *certificateFile, certFile, keyFile string) error {
+		if certificate == nil || certFile == "" {
+			return nil
+		}
+		cert, err := readCertificate(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		certificates[certificate] = cert
+		return nil
+	}
+	if err := readCertificateOf(r.controlServerCert, params.controlServerCertFile, params.controlServerKeyFile); err != nil {
+		return err
+	}
+	if err := readCertificateOf(r.requestServers[0].certificate, params.requestServerCertFile, params.requestServerKeyFile); err != nil {
+		return err
+	}
+	for i, spec := range r.routeSpecs {
+		if err := readCertificateOf(r.requestServers[i+1].certificate, spec.certFile, spec.keyFile); err != nil {
+			return err
+		}
+	}
+
+	if tokens != nil {
+		r.tokens.set(tokens)
+	}
+	r.quotas.SetQuotas(params.tunnelQuota, params.tunnelQuotas)
+	for certificate, cert := range certificates {
+		certificate.set(cert)
+	}
+	for _, server := range r.requestServers {
+		server.handler.set(r.newRequestHandler(settings, server.roundTripper))
+	}
+	r.current = params
+	return nil
+}
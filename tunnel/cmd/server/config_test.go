@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	"github.com/banzaicloud/kurun/tunnel/pkg/tlstools"
+	tunnelws "github.com/banzaicloud/kurun/tunnel/websocket"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+// writeCertificate writes a new self-signed certificate and its key to the files, and returns its leaf
+func writeCertificate(t *testing.T, certFile, keyFile string) []byte {
+	caCert, caKey, err := tlstools.GenerateSelfSignedCA()
+	require.NoError(t, err)
+	cert, err := tlstools.GenerateTLSCert(caCert, caKey, big.NewInt(1), []string{"localhost"}, nil)
+	require.NoError(t, err)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	writeFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})))
+	writeFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})))
+	return cert.Certificate[0]
+}
+
+func TestServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	writeFile(t, path, `
+control:
+  address: :10080
+request:
+  certFile: /etc/tls/tls.crt
+  keyFile: /etc/tls/tls.key
+auth:
+  tokenFile: /etc/kurun-auth/token
+limits:
+  responseHeaderTimeout: 30s
+middlewares:
+- type: log
+quotas:
+  default:
+    requestsPerSecond: 20
+  tunnels:
+    alice:
+      maxConcurrent: 50
+`)
+	config, err := loadServerConfig(path)
+	require.NoError(t, err)
+
+	params := Params{
+		controlServerAddress:  ":8081",
+		requestFlushInterval:  time.Second,
+		requestServerAddress:  ":8080",
+		responseHeaderTimeout: time.Minute,
+		tunnelQuota:           tunnel.TunnelQuota{Burst: 5},
+	}
+	require.NoError(t, config.apply(&params))
+	require.Equal(t, ":10080", params.controlServerAddress)
+	require.Equal(t, ":8080", params.requestServerAddress)
+	require.Equal(t, "/etc/tls/tls.crt", params.requestServerCertFile)
+	require.Equal(t, "/etc/tls/tls.key", params.requestServerKeyFile)
+	require.Equal(t, "/etc/kurun-auth/token", params.auth.TokenFile)
+	require.Equal(t, time.Second, params.requestFlushInterval)
+	require.Equal(t, 30*time.Second, params.responseHeaderTimeout)
+	require.Equal(t, []middlewareSpec{{Type: middlewareTypeLog}}, params.configMiddlewares)
+	require.Equal(t, tunnel.TunnelQuota{RequestsPerSecond: 20}, params.tunnelQuota)
+	require.Equal(t, map[string]tunnel.TunnelQuota{"alice": {MaxConcurrent: 50}}, params.tunnelQuotas)
+	params.configFile = path
+	require.ElementsMatch(t, []string{path, "/etc/tls/tls.crt", "/etc/tls/tls.key", "/etc/kurun-auth/token"}, params.watchedFiles())
+
+	// the unknown fields are rejected, so typos don't go unnoticed
+	writeFile(t, path, "request:\n  adress: :8443\n")
+	_, err = loadServerConfig(path)
+	require.Error(t, err)
+
+	writeFile(t, path, "limits:\n  flushInterval: 1 second\n")
+	config, err = loadServerConfig(path)
+	require.NoError(t, err)
+	require.Error(t, config.apply(&params))
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	tokensFile := filepath.Join(dir, "tokens")
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeFile(t, configFile, "limits:\n  responseHeaderTimeout: 30s\n")
+	writeFile(t, tokensFile, "alice:first\n")
+	firstCert := writeCertificate(t, certFile, keyFile)
+
+	flagParams := Params{
+		configFile:            configFile,
+		errorFormat:           "text",
+		requestServerCertFile: certFile,
+		requestServerKeyFile:  keyFile,
+		tunnelID:              tunnelByToken,
+		tunnelTokensFile:      tokensFile,
+	}
+	params := flagParams
+	config, err := loadServerConfig(configFile)
+	require.NoError(t, err)
+	require.NoError(t, config.apply(&params))
+
+	tokens := &tunnelTokens{}
+	require.NoError(t, tokens.load(tokensFile))
+	server, err := newRequestServer(":0", certFile, keyFile, http.DefaultTransport)
+	require.NoError(t, err)
+	r := &reloader{
+		current:    params,
+		flagParams: flagParams,
+		logger:     logr.Discard(),
+		// the handlers answer with the response header timeout of their settings
+		newRequestHandler: func(settings requestSettings, _ http.RoundTripper) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte(settings.responseHeaderTimeout.String()))
+			})
+		},
+		quotas:         tunnel.NewTunnelQuotas(params.tunnelQuota, params.tunnelQuotas),
+		requestServers: []*requestServer{server},
+		tokens:         tokens,
+	}
+
+	// the current settings of the request handler, the tunnel tokens and the certificate
+	check := func(responseHeaderTimeout, token string, cert []byte) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		server.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, responseHeaderTimeout, rec.Body.String())
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(tunnelws.TunnelTokenHeader, token)
+		id, err := tokens.identify(req)
+		require.NoError(t, err)
+		require.Equal(t, "alice", id)
+
+		current, err := server.certificate.GetCertificate(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		require.Equal(t, cert, current.Certificate[0])
+	}
+	require.NoError(t, r.reload())
+	check("30s", "first", firstCert)
+
+	writeFile(t, configFile, "limits:\n  responseHeaderTimeout: 45s\n")
+	writeFile(t, tokensFile, "alice:second\n")
+	secondCert := writeCertificate(t, certFile, keyFile)
+	require.NoError(t, r.reload())
+	check("45s", "second", secondCert)
+	require.Contains(t, r.watchedFiles(), tokensFile)
+
+	// nothing is swapped in if anything fails to be loaded, e.g. the last certificate
+	writeFile(t, configFile, "limits:\n  responseHeaderTimeout: 1m\n")
+	writeFile(t, tokensFile, "alice:third\n")
+	writeFile(t, certFile, "invalid")
+	require.Error(t, r.reload())
+	check("45s", "second", secondCert)
+
+	writeCertificate(t, certFile, keyFile)
+	writeFile(t, tokensFile, "invalid\n")
+	require.Error(t, r.reload())
+	check("45s", "second", secondCert)
+
+	writeFile(t, tokensFile, "alice:third\n")
+	writeFile(t, configFile, "limits:\n  responseHeaderTimeout: -1m\n")
+	require.Error(t, r.reload())
+	check("45s", "second", secondCert)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"emperror.dev/errors"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+var errorKinds = []string{tunnel.ErrorKindDownstream, tunnel.ErrorKindInternal, tunnel.ErrorKindNoClient, tunnel.ErrorKindQuota, tunnel.ErrorKindTimeout}
+
+// parseErrorResponses returns the error responses configured by the format, the kind=code status and the kind=path body
+// flag values
+// Body templates of .html files are HTML escaped and served as text/html.
+func parseErrorResponses(format string, hideDetails bool, statuses, downstreamStatuses, bodies []string) (tunnel.ErrorResponses, error) {
+	config := tunnel.ErrorResponses{
+		DownstreamStatusCodes: make(map[string]int),
+		HideDetails:           hideDetails,
+		Responses:             make(map[string]tunnel.ErrorResponse),
+	}
+
+	switch format {
+	case "json":
+		config.JSON = true
+	case "text":
+	default:
+		return config, errors.Errorf("invalid req-error-format value %q, must be text or json", format)
+	}
+
+	for _, value := range statuses {
+		kind, statusCode, err := parseErrorStatusValue("req-error-status", value, errorKinds)
+		if err != nil {
+			return config, err
+		}
+		response := config.Responses[kind]
+		response.StatusCode = statusCode
+		config.Responses[kind] = response
+	}
+
+	for _, value := range downstreamStatuses {
+		kind, statusCode, err := parseErrorStatusValue("req-downstream-error-status", value, tunnel.DownstreamErrorKinds)
+		if err != nil {
+			return config, err
+		}
+		config.DownstreamStatusCodes[kind] = statusCode
+	}
+
+	for _, value := range bodies {
+		kind, path, err := parseErrorKindValue("req-error-body", value, errorKinds)
+		if err != nil {
+			return config, err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return config, errors.WrapIfWithDetails(err, "failed to read error body template", "path", path)
+		}
+		response := config.Responses[kind]
+		if ext := strings.ToLower(filepath.Ext(path)); ext == ".html" || ext == ".htm" {
+			response.Body, err = htmltemplate.New(kind).Parse(string(content))
+			response.ContentType = "text/html; charset=utf-8"
+		} else {
+			response.Body, err = template.New(kind).Parse(string(content))
+		}
+		if err != nil {
+			return config, errors.WrapIfWithDetails(err, "failed to parse error body template", "path", path)
+		}
+		config.Responses[kind] = response
+	}
+
+	return config, nil
+}
+
+func parseErrorStatusValue(flag, value string, kinds []string) (string, int, error) {
+	kind, code, err := parseErrorKindValue(flag, value, kinds)
+	if err != nil {
+		return "", 0, err
+	}
+	statusCode, err := strconv.Atoi(code)
+	if err != nil || statusCode < 400 || statusCode > 599 {
+		return "", 0, errors.Errorf("invalid %s value %q, the status code must be between 400 and 599", flag, value)
+	}
+	return kind, statusCode, nil
+}
+
+func parseErrorKindValue(flag, value string, kinds []string) (string, string, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return "", "", errors.Errorf("invalid %s value %q, expected kind=value", flag, value)
+	}
+	for _, kind := range kinds {
+		if parts[0] == kind {
+			return parts[0], parts[1], nil
+		}
+	}
+	return "", "", errors.Errorf("invalid %s value %q, the kind must be one of %s", flag, value, strings.Join(kinds, ", "))
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrorResponsesFormat(t *testing.T) {
+	config, err := parseErrorResponses("text", false, nil, nil, nil)
+	require.NoError(t, err)
+	require.False(t, config.JSON)
+
+	config, err = parseErrorResponses("json", false, nil, nil, nil)
+	require.NoError(t, err)
+	require.True(t, config.JSON)
+
+	_, err = parseErrorResponses("xml", false, nil, nil, nil)
+	require.EqualError(t, err, `invalid req-error-format value "xml", must be text or json`)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	"github.com/banzaicloud/kurun/tunnel/connector"
+	tunnelgrpc "github.com/banzaicloud/kurun/tunnel/grpc"
+)
+
+// newGRPCServer returns the gRPC server accepting the clients of the tunnel server, with the TLS config if it's not nil
+// and requiring the token of the file if it's specified
+func newGRPCServer(tlsConfig *tls.Config, tokenFile string, tunnelServer *tunnel.Server, logger logr.Logger) (*grpc.Server, error) {
+	options := []tunnelgrpc.ServerOption{tunnelgrpc.WithLogger(logger)}
+	if tokenFile != "" {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, errors.WrapIfWithDetails(err, "failed to read grpc-token-file", "path", tokenFile)
+		}
+		if strings.TrimSpace(string(token)) == "" {
+			return nil, errors.NewWithDetails("grpc-token-file is empty", "path", tokenFile)
+		}
+		options = append(options, tunnelgrpc.WithToken(strings.TrimSpace(string(token))))
+	}
+
+	var serverOptions []grpc.ServerOption
+	if tlsConfig != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(serverOptions...)
+	connector.RegisterConnectorServer(grpcServer, tunnelgrpc.NewServer(tunnelServer, options...))
+	return grpcServer, nil
+}
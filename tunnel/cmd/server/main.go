@@ -8,12 +8,19 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"time"
 
 	"emperror.dev/errors"
+	"github.com/go-logr/logr"
 	"github.com/go-logr/stdr"
 	"github.com/spf13/pflag"
+	"google.golang.org/grpc"
 
 	"github.com/banzaicloud/kurun/tunnel"
 	"github.com/banzaicloud/kurun/tunnel/pkg/tlstools"
@@ -21,29 +28,133 @@ import (
 )
 
 type Params struct {
+	configCheckInterval time.Duration
+	configFile          string
+	// configMiddlewares are the middlewares of the config file
+	configMiddlewares       []middlewareSpec
 	controlServerAddress    string
 	controlServerSelfSigned bool
 	controlServerCertFile   string
 	controlServerKeyFile    string
+	grpcServerAddress       string
+	grpcServerCertFile      string
+	grpcServerKeyFile       string
+	grpcTokenFile           string
 	requestServerAddress    string
 	requestServerCertFile   string
 	requestServerKeyFile    string
-	logVerbosity            int
+	routeServers            []string
+	errorBodies             []string
+	errorDownstreamStatuses []string
+	errorFormat             string
+	errorHideDetails        bool
+	errorStatuses           []string
+	idleTimeout             time.Duration
+	noClientTimeout         time.Duration
+	offlineQueue            tunnel.OfflineQueueConfig
+	pingInterval            time.Duration
+	requestFlushInterval    time.Duration
+	requestHeaders          []string
+	requestLog              bool
+	requestMiddlewareConfig string
+	responseHeaders         []string
+	responseHeaderTimeout   time.Duration
+	sessionGracePeriod      time.Duration
+	auth                    authSpec
+	cache                   cacheSpec
+	cors                    corsSpec
+	splitFallback           string
+	splitHeaders            []string
+	splitPercent            int
+	tunnelDomain            string
+	tunnelExpiry            time.Duration
+	tunnelID                string
+	tunnelMatch             string
+	tunnelQuota             tunnel.TunnelQuota
+	// tunnelQuotas are the quotas of the tunnels of the config file by their IDs
+	tunnelQuotas     map[string]tunnel.TunnelQuota
+	tunnelTokensFile string
+	upstream         string
+	maxFrameSize     int
+	logVerbosity     int
 }
 
 func run() error {
 	params := Params{}
 
+	pflag.StringVar(&params.configFile, "config", "", "path of the YAML config file, its settings override the flags, it's reloaded on SIGHUP and when it (or a file it refers to) changes")
+	pflag.DurationVar(&params.configCheckInterval, "config-check-interval", 10*time.Second, "interval of checking the config, credential and certificate files for changes to reload them (zero disables checking, SIGHUP reloads them anyway)")
 	pflag.StringVar(&params.controlServerAddress, "ctrl-srv-addr", ":10080", "control server address")
 	pflag.BoolVar(&params.controlServerSelfSigned, "ctrl-srv-self-signed", false, "generate self-signed TLS certificate for control server")
 	pflag.StringVar(&params.controlServerCertFile, "ctrl-srv-cert", "", "path of the control server TLS certificate file")
 	pflag.StringVar(&params.controlServerKeyFile, "ctrl-srv-key", "", "path of the control server TLS private key file")
+	pflag.StringVar(&params.grpcServerAddress, "grpc-srv-addr", "", "address of the server accepting the tunnel clients with gRPC, the requests are sent to the clients of both servers (empty disables it)")
+	pflag.StringVar(&params.grpcServerCertFile, "grpc-srv-cert", "", "path of the gRPC server TLS certificate file (default the certificate of the control server)")
+	pflag.StringVar(&params.grpcServerKeyFile, "grpc-srv-key", "", "path of the gRPC server TLS private key file")
+	pflag.StringVar(&params.grpcTokenFile, "grpc-token-file", "", "path of the file containing the token required from the gRPC tunnel clients")
+	pflag.DurationVar(&params.pingInterval, "ping-interval", 0, "interval of the pings sent to the tunnel clients to keep their connections alive, e.g. through NATs and firewalls dropping idle connections (zero disables pinging)")
+	pflag.DurationVar(&params.idleTimeout, "idle-timeout", 0, "time after which the connections of the tunnel clients are closed when nothing (including pings and pongs) is received from them, should be a few times the ping interval (zero means no timeout)")
+	pflag.DurationVar(&params.sessionGracePeriod, "session-grace-period", 0, "time the requests sent to a tunnel client are kept after its connection is lost, so they are answered if the client resumes its session in time (zero fails them right away)")
 	pflag.StringVar(&params.requestServerAddress, "req-srv-addr", ":80", "control server address")
 	pflag.StringVar(&params.requestServerCertFile, "req-srv-cert", "", "path of the request server TLS certificate file")
 	pflag.StringVar(&params.requestServerKeyFile, "req-srv-key", "", "path of the request server TLS private key file")
+	pflag.StringArrayVar(&params.routeServers, "req-srv-route", nil, "additional request server (name=<route>,addr=<address>[,cert=<path>,key=<path>]) sending its requests through the tunnel with the route, so the clients can send them to another downstream")
+	pflag.DurationVar(&params.requestFlushInterval, "req-flush-interval", 0, "interval to flush the response bodies to the clients while copying them (negative means after each write, zero disables periodic flushing)")
+	pflag.StringVar(&params.requestMiddlewareConfig, "req-middleware-config", "", "path of the YAML file configuring the middleware stack of the request server")
+	pflag.StringSliceVar(&params.cors.AllowedOrigins, "cors-allowed-origin", nil, "origin allowed to make cross-origin requests to the request server (* allows any origin)")
+	pflag.StringSliceVar(&params.cors.AllowedMethods, "cors-allowed-method", nil, "method allowed in cross-origin requests (default GET, HEAD and POST)")
+	pflag.StringSliceVar(&params.cors.AllowedHeaders, "cors-allowed-header", nil, "request header allowed in cross-origin requests (default the headers requested by the preflight)")
+	pflag.StringSliceVar(&params.cors.ExposedHeaders, "cors-exposed-header", nil, "response header exposed to cross-origin callers")
+	pflag.BoolVar(&params.cors.AllowCredentials, "cors-allow-credentials", false, "allow cross-origin requests with credentials, the allowed origins must be listed then (not *)")
+	pflag.IntVar(&params.cors.MaxAgeSeconds, "cors-max-age", 0, "seconds the browsers may cache the preflight results for")
+	pflag.StringVar(&params.auth.TokenFile, "req-auth-token-file", "", "path of the file containing the bearer tokens (one per line) required on the requests")
+	pflag.StringVar(&params.auth.BasicAuthFile, "req-auth-basic-file", "", "path of the file containing the basic auth credentials (username:password per line) accepted on the requests")
+	pflag.Int64Var(&params.cache.MaxSize, "req-cache-size", 0, "size of the cache of the responses to GET requests in bytes, cacheable responses (by Cache-Control) are served from it without the tunnel (zero disables caching)")
+	pflag.Int64Var(&params.cache.MaxEntrySize, "req-cache-max-entry-size", 0, "size limit of the cached responses in bytes (default 1MiB)")
+	pflag.StringSliceVar(&params.cache.KeyHeaders, "req-cache-key-header", nil, "request header distinguishing the cached responses besides the URL, e.g. Accept-Encoding")
+	pflag.BoolVar(&params.requestLog, "req-log", false, "log the requests served by the request server")
+	pflag.StringSliceVar(&params.requestHeaders, "req-header", nil, "header (name=value) to set on the requests served by the request server")
+	pflag.StringSliceVar(&params.responseHeaders, "resp-header", nil, "header (name=value) to set on the responses of the request server")
+	pflag.DurationVar(&params.responseHeaderTimeout, "req-response-header-timeout", 0, "time to wait for the tunnel client to respond to a request (zero means no timeout)")
+	pflag.DurationVar(&params.noClientTimeout, "req-no-client-timeout", 0, "time requests wait for a tunnel client to connect when none is connected (zero means until the request is cancelled)")
+	pflag.Int64Var(&params.offlineQueue.MaxSize, "req-offline-queue-size", 0, "size of the queue of the requests received while no tunnel client is connected in bytes, they are responded with 202 Accepted and sent to the next client connecting (zero disables queueing)")
+	pflag.DurationVar(&params.offlineQueue.MaxAge, "req-offline-queue-max-age", 0, "time the requests are kept in the offline queue for (default 5m)")
+	pflag.StringSliceVar(&params.offlineQueue.Methods, "req-offline-queue-method", nil, "method of the requests queued while no tunnel client is connected (default POST)")
+	pflag.DurationVar(&params.offlineQueue.ReplayTimeout, "req-offline-queue-replay-timeout", 0, "time limit of sending a queued request to the tunnel client once it connects (default 1m)")
+	pflag.BoolVar(&params.errorHideDetails, "req-error-hide-details", false, "omit the error messages from the error responses")
+	pflag.StringSliceVar(&params.errorStatuses, "req-error-status", nil, "status code (kind=code) of the error responses of a kind of error: downstream, internal, no-client, quota or timeout")
+	pflag.StringSliceVar(&params.errorDownstreamStatuses, "req-downstream-error-status", nil, "status code (kind=code) of the error responses of a kind of failure to reach the downstream: connection, connection-refused, dns or timeout, overriding req-error-status")
+	pflag.StringVar(&params.errorFormat, "req-error-format", "text", "format of the bodies of the error responses without a req-error-body template: text (JSON for the clients accepting only JSON with the Accept header) or json")
+	pflag.StringSliceVar(&params.errorBodies, "req-error-body", nil, "path of the Go template file (kind=path) of the error responses of a kind of error, .html files are served as HTML")
+	pflag.StringVar(&params.splitFallback, "split-fallback", "", "URL to send requests not selected for the tunnel to")
+	pflag.StringSliceVar(&params.splitHeaders, "split-header", nil, "header (name=value) selecting requests for the tunnel when splitting traffic")
+	pflag.IntVar(&params.splitPercent, "split-percent", 0, "percentage of requests to send through the tunnel when splitting traffic")
+	pflag.StringVar(&params.tunnelID, "tunnel-id", "", "serve several independent tunnels, identifying the tunnels of the clients by: token (of their X-Kurun-Tunnel-Token header, see tunnel-tokens-file), by default a single tunnel is served")
+	pflag.StringVar(&params.tunnelTokensFile, "tunnel-tokens-file", "", "path of the file containing the tokens of the tunnels (id:token per line) with tunnel-id token")
+	pflag.StringVar(&params.tunnelMatch, "tunnel-match", tunnelByPath, "how the requests are matched to the tunnels with tunnel-id: host (by the subdomain of tunnel-domain in their Host header) or path (by the first segment of their path, removed from the requests)")
+	pflag.StringVar(&params.tunnelDomain, "tunnel-domain", "", "domain of the subdomains identifying the tunnels of the requests (e.g. tunnels.example.com), with tunnel-match host")
+	pflag.DurationVar(&params.tunnelExpiry, "tunnel-expiry", time.Hour, "remove the tunnels no client has been connected to for this long with tunnel-id, failing the requests waiting for their clients (zero keeps them)")
+	pflag.Float64Var(&params.tunnelQuota.RequestsPerSecond, "tunnel-rate", 0, "requests per second allowed to each tunnel with tunnel-id, the requests beyond it are rejected with 429 Too Many Requests (zero means no limit)")
+	pflag.IntVar(&params.tunnelQuota.Burst, "tunnel-burst", 0, "requests allowed to each tunnel at once above tunnel-rate (default tunnel-rate rounded up)")
+	pflag.IntVar(&params.tunnelQuota.MaxConcurrent, "tunnel-max-concurrent", 0, "requests of each tunnel allowed in flight with tunnel-id, the requests beyond it are rejected with 429 Too Many Requests (zero means no limit)")
+	pflag.Int64Var(&params.tunnelQuota.BytesPerSecond, "tunnel-bandwidth", 0, "bandwidth of the request and the response bodies of each tunnel with tunnel-id in bytes per second in each direction (zero means no limit)")
+	pflag.StringVar(&params.upstream, "req-upstream", "", "URL to send the requests to instead of the tunnel, e.g. the port forwarded by an SSH tunnel client")
+	pflag.IntVar(&params.maxFrameSize, "max-frame-size", 0, "maximal size of the frames sent to the tunnel clients in bytes, bigger requests are split into fragments (zero means the default of 64KiB)")
 	pflag.CountVarP(&params.logVerbosity, "verbose", "v", "logging verbosity")
 	pflag.Parse()
 
+	// the settings of the config file are applied to the flags again on each reload
+	flagParams := params
+	if params.configFile != "" {
+		config, err := loadServerConfig(params.configFile)
+		if err != nil {
+			return err
+		}
+		if err := config.apply(&params); err != nil {
+			return err
+		}
+	}
+
 	// check params
 
 	controlServerCertSet := params.controlServerCertFile != ""
@@ -65,7 +176,6 @@ func run() error {
 
 	requestServerCertSet := params.requestServerCertFile != ""
 	requestServerKeySet := params.requestServerKeyFile != ""
-	requestServerTLS := requestServerCertSet && requestServerKeySet
 
 	if requestServerCertSet != requestServerKeySet {
 		specified, notSpecified := "req-srv-cert", "req-srv-key"
@@ -75,40 +185,183 @@ func run() error {
 		return errors.Errorf("if %s is specified %s must be specified too", specified, notSpecified)
 	}
 
+	grpcServerCertSet := params.grpcServerCertFile != ""
+	grpcServerKeySet := params.grpcServerKeyFile != ""
+
+	if grpcServerCertSet != grpcServerKeySet {
+		specified, notSpecified := "grpc-srv-cert", "grpc-srv-key"
+		if grpcServerKeySet {
+			specified, notSpecified = notSpecified, specified
+		}
+		return errors.Errorf("if %s is specified %s must be specified too", specified, notSpecified)
+	}
+
+	if params.grpcServerAddress == "" && (grpcServerCertSet || params.grpcTokenFile != "") {
+		return errors.New("grpc-srv-cert, grpc-srv-key and grpc-token-file require grpc-srv-addr to be specified")
+	}
+
+	routeSpecs := []routeServerSpec{}
+	for _, value := range params.routeServers {
+		spec, err := parseRouteServerSpec(value)
+		if err != nil {
+			return err
+		}
+		routeSpecs = append(routeSpecs, spec)
+	}
+
+	splitMatchers := []tunnel.RequestMatcher{}
+	for _, header := range params.splitHeaders {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.Errorf("invalid split-header value %q, expected name=value", header)
+		}
+		splitMatchers = append(splitMatchers, tunnel.HeaderMatcher(parts[0], parts[1]))
+	}
+
+	if params.offlineQueue.MaxSize <= 0 && (params.offlineQueue.MaxAge != 0 || len(params.offlineQueue.Methods) > 0 || params.offlineQueue.ReplayTimeout != 0) {
+		return errors.New("offline queue flags require req-offline-queue-size to be specified")
+	}
+
+	if params.splitPercent < 0 || params.splitPercent > 100 {
+		return errors.Errorf("split-percent must be between 0 and 100, got %d", params.splitPercent)
+	}
+	if params.splitPercent > 0 {
+		splitMatchers = append(splitMatchers, tunnel.PercentageMatcher(params.splitPercent))
+	}
+
+	var splitFallbackURL *url.URL
+	if params.splitFallback != "" {
+		var err error
+		splitFallbackURL, err = url.Parse(params.splitFallback)
+		if err != nil {
+			return errors.WrapIf(err, "failed to parse split-fallback URL")
+		}
+		if len(splitMatchers) == 0 {
+			return errors.New("split-fallback requires split-header or split-percent to be specified")
+		}
+	} else if len(splitMatchers) > 0 {
+		return errors.New("split-header and split-percent require split-fallback to be specified")
+	}
+
+	var upstreamURL *url.URL
+	if params.upstream != "" {
+		var err error
+		upstreamURL, err = url.Parse(params.upstream)
+		if err != nil {
+			return errors.WrapIf(err, "failed to parse req-upstream URL")
+		}
+	}
+
+	tokens := &tunnelTokens{}
+	var identifyTunnel tunnelws.TunnelIdentifier
+	var matchTunnel tunnel.TunnelMatcher
+	if params.tunnelID != "" {
+		if upstreamURL != nil {
+			return errors.New("tunnel-id and req-upstream can't be specified together")
+		}
+		if params.grpcServerAddress != "" {
+			return errors.New("tunnel-id and grpc-srv-addr can't be specified together")
+		}
+		if params.tunnelID != tunnelByToken {
+			return errors.Errorf("invalid tunnel-id value %q, expected %s, the clients are identified by their tokens, so they can't claim the tunnels of others", params.tunnelID, tunnelByToken)
+		}
+		if params.tunnelTokensFile == "" {
+			return errors.New("tunnel-id token requires tunnel-tokens-file to be specified")
+		}
+		if err := tokens.load(params.tunnelTokensFile); err != nil {
+			return err
+		}
+		if params.tunnelExpiry < 0 {
+			return errors.Errorf("tunnel-expiry must not be negative, got %s", params.tunnelExpiry)
+		}
+		identifyTunnel = tokens.identify
+		var err error
+		matchTunnel, err = tunnelMatcher("tunnel-match", params.tunnelMatch, params.tunnelDomain)
+		if err != nil {
+			return err
+		}
+	} else if params.tunnelTokensFile != "" || params.tunnelDomain != "" || params.tunnelQuota != (tunnel.TunnelQuota{}) || len(params.tunnelQuotas) > 0 {
+		return errors.New("tunnel flags and quotas require tunnel-id to be specified")
+	}
+	if err := validateTunnelQuotas(params); err != nil {
+		return err
+	}
+
+	if params.pingInterval < 0 {
+		return errors.Errorf("ping-interval must not be negative, got %s", params.pingInterval)
+	}
+	if params.idleTimeout < 0 {
+		return errors.Errorf("idle-timeout must not be negative, got %s", params.idleTimeout)
+	}
+	if params.idleTimeout > 0 && (params.pingInterval <= 0 || params.pingInterval >= params.idleTimeout) {
+		return errors.New("idle-timeout requires a shorter ping-interval to be specified, so the connections of idle tunnels are kept")
+	}
+	if params.sessionGracePeriod < 0 {
+		return errors.Errorf("session-grace-period must not be negative, got %s", params.sessionGracePeriod)
+	}
+
 	// start servers
 
 	stdr.SetVerbosity(params.logVerbosity)
 	logger := stdr.New(log.New(os.Stdout, "", log.LstdFlags|log.LUTC))
 
-	tunnelServer := tunnelws.NewServer(tunnelws.WithLogger(logger))
+	settings, err := buildRequestSettings(params, logger)
+	if err != nil {
+		return err
+	}
+
+	tunnelServerOptions := []tunnelws.ServerOption{
+		tunnelws.WithLogger(logger),
+		tunnelws.WithClientWaitTimeout(params.noClientTimeout),
+		tunnelws.WithMaxFrameSize(params.maxFrameSize),
+		tunnelws.WithOfflineQueue(params.offlineQueue),
+		tunnelws.WithPingInterval(params.pingInterval),
+		tunnelws.WithIdleTimeout(params.idleTimeout),
+		tunnelws.WithSessionGracePeriod(params.sessionGracePeriod),
+	}
+	var tunnelServer http.Handler
+	var multiServer *tunnelws.MultiServer
+	var requestRoundTripper http.RoundTripper
+	// singleServer is the tunnel server shared with the gRPC server, which serves a single tunnel
+	var singleServer *tunnelws.Server
+	quotas := tunnel.NewTunnelQuotas(params.tunnelQuota, params.tunnelQuotas)
+	if identifyTunnel != nil {
+		multiServer = tunnelws.NewMultiServer(identifyTunnel, tunnelServerOptions...)
+		tunnelServer = metricsHandler(multiServer, quotas, multiServer)
+		requestRoundTripper = multiServer.RoundTripper(matchTunnel, quotas)
+	} else {
+		singleServer = tunnelws.NewServer(tunnelServerOptions...)
+		tunnelServer, requestRoundTripper = singleServer, singleServer
+		if upstreamURL != nil {
+			requestRoundTripper = upstreamRoundTripper(upstreamURL)
+		}
+	}
 
 	controlServer := &http.Server{
 		Addr:    params.controlServerAddress,
 		Handler: tunnelServer,
 	}
 
-	if controlServerTLS {
-		certs := []tls.Certificate{}
-		if controlServerTLSFromFiles {
-			cert, err := tls.LoadX509KeyPair(params.controlServerCertFile, params.controlServerKeyFile)
-			if err != nil {
-				return err
-			}
-			certs = append(certs, cert)
+	var controlServerCert *certificateFile
+	if controlServerTLSFromFiles {
+		controlServerCert, err = loadCertificateFile(params.controlServerCertFile, params.controlServerKeyFile)
+		if err != nil {
+			return err
 		}
-		if params.controlServerSelfSigned {
-			caCert, caKey, err := tlstools.GenerateSelfSignedCA()
-			if err != nil {
-				return err
-			}
-			cert, err := tlstools.GenerateTLSCert(caCert, caKey, big.NewInt(1), []string{"localhost"}, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::")})
-			if err != nil {
-				return err
-			}
-			certs = append(certs, cert)
+		controlServer.TLSConfig = &tls.Config{
+			GetCertificate: controlServerCert.GetCertificate,
+		}
+	} else if params.controlServerSelfSigned {
+		caCert, caKey, err := tlstools.GenerateSelfSignedCA()
+		if err != nil {
+			return err
+		}
+		cert, err := tlstools.GenerateTLSCert(caCert, caKey, big.NewInt(1), []string{"localhost"}, tlstools.LocalIPAddresses())
+		if err != nil {
+			return err
 		}
 		controlServer.TLSConfig = &tls.Config{
-			Certificates: certs,
+			Certificates: []tls.Certificate{cert},
 		}
 	}
 
@@ -128,27 +381,121 @@ func run() error {
 		}
 	}()
 
-	requestServer := http.Server{
-		Addr:    params.requestServerAddress,
-		Handler: tunnel.NewRequestHandler(tunnelServer),
-	}
+	// the gRPC server error channel is nil without the gRPC server, so it's never selected
+	var grpcServer *grpc.Server
+	var grpcServerErr chan error
+	if params.grpcServerAddress != "" {
+		tlsConfig := controlServer.TLSConfig
+		if grpcServerCertSet {
+			cert, err := tls.LoadX509KeyPair(params.grpcServerCertFile, params.grpcServerKeyFile)
+			if err != nil {
+				return err
+			}
+			tlsConfig = &tls.Config{
+				Certificates: []tls.Certificate{cert},
+			}
+		}
+		grpcServer, err = newGRPCServer(tlsConfig, params.grpcTokenFile, singleServer.Server, logger)
+		if err != nil {
+			return err
+		}
+		listener, err := net.Listen("tcp", params.grpcServerAddress)
+		if err != nil {
+			return errors.WrapIfWithDetails(err, "failed to listen on grpc-srv-addr", "address", params.grpcServerAddress)
+		}
 
-	requestServerErr := make(chan error, 1)
-	go func() {
-		defer close(requestServerErr)
+		grpcServerErr = make(chan error, 1)
+		go func() {
+			defer close(grpcServerErr)
 
-		var err error
-		if requestServerTLS {
-			err = requestServer.ListenAndServeTLS(params.requestServerCertFile, params.requestServerKeyFile)
-		} else {
-			err = requestServer.ListenAndServe()
+			if err := grpcServer.Serve(listener); err != nil {
+				grpcServerErr <- err
+			}
+		}()
+	}
+
+	newRequestHandler := func(settings requestSettings, roundTripper http.RoundTripper) http.Handler {
+		var requestHandler http.Handler = tunnel.NewRequestHandler(roundTripper,
+			tunnel.WithFlushInterval(settings.flushInterval),
+			tunnel.WithResponseHeaderTimeout(settings.responseHeaderTimeout),
+			tunnel.WithErrorResponses(settings.errorResponses),
+		)
+		requestHandler = tunnel.ChainMiddlewares(requestHandler, settings.middlewares...)
+		if splitFallbackURL != nil {
+			// the fallback (e.g. the in-cluster workload) gets the requests with their credentials, the ones of the
+			// request server only protect the requests sent through the tunnel
+			fallbackHandler := tunnel.ChainMiddlewares(httputil.NewSingleHostReverseProxy(splitFallbackURL), settings.fallbackMiddlewares...)
+			requestHandler = tunnel.NewSplitHandler(requestHandler, fallbackHandler, splitMatchers...)
 		}
+		return requestHandler
+	}
 
-		if err = ignoreServerClosed(err); err != nil {
-			requestServerErr <- err
+	defaultRoundTripper := requestRoundTripper
+	if len(routeSpecs) > 0 {
+		// so the callers of the default port can't reach the downstreams of the routes
+		defaultRoundTripper = tunnel.SetRoute("", requestRoundTripper)
+	}
+	defaultRequestServer, err := newRequestServer(params.requestServerAddress, params.requestServerCertFile, params.requestServerKeyFile, defaultRoundTripper)
+	if err != nil {
+		return err
+	}
+	requestServers := []*requestServer{defaultRequestServer}
+	for _, spec := range routeSpecs {
+		server, err := newRequestServer(spec.address, spec.certFile, spec.keyFile, tunnel.SetRoute(spec.name, requestRoundTripper))
+		if err != nil {
+			return err
 		}
+		requestServers = append(requestServers, server)
+	}
+	for _, server := range requestServers {
+		server.handler.set(newRequestHandler(settings, server.roundTripper))
+	}
+
+	configReloader := &reloader{
+		controlServerCert: controlServerCert,
+		current:           params,
+		flagParams:        flagParams,
+		logger:            logger,
+		newRequestHandler: newRequestHandler,
+		quotas:            quotas,
+		requestServers:    requestServers,
+		routeSpecs:        routeSpecs,
+		tokens:            tokens,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go watchConfig(ctx, params.configCheckInterval, configReloader.watchedFiles, configReloader.reload, logger)
+	if multiServer != nil && params.tunnelExpiry > 0 {
+		go multiServer.ExpireTunnels(ctx, params.tunnelExpiry)
+	}
+
+	requestServerErr := make(chan error, len(requestServers))
+	var requestServersDone sync.WaitGroup
+	for _, server := range requestServers {
+		server := server
+		requestServersDone.Add(1)
+		go func() {
+			defer requestServersDone.Done()
+
+			if err := ignoreServerClosed(server.listenAndServe()); err != nil {
+				requestServerErr <- err
+			}
+		}()
+	}
+	go func() {
+		requestServersDone.Wait()
+		close(requestServerErr)
 	}()
 
+	shutdownRequestServers := func() error {
+		var err error
+		for _, server := range requestServers {
+			err = errors.Append(err, ignoreServerClosed(server.Shutdown(context.Background())))
+		}
+		return err
+	}
+
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 
@@ -158,24 +505,122 @@ func run() error {
 	select {
 	case err := <-controlServerErr:
 		lastErr = errors.Append(lastErr, err)
-		lastErr = errors.Append(lastErr, ignoreServerClosed(requestServer.Shutdown(context.Background())))
+		lastErr = errors.Append(lastErr, shutdownRequestServers())
 	case err := <-requestServerErr:
 		lastErr = errors.Append(lastErr, err)
+		lastErr = errors.Append(lastErr, shutdownRequestServers())
+		lastErr = errors.Append(lastErr, ignoreServerClosed(controlServer.Shutdown(context.Background())))
+	case err := <-grpcServerErr:
+		lastErr = errors.Append(lastErr, err)
+		lastErr = errors.Append(lastErr, shutdownRequestServers())
 		lastErr = errors.Append(lastErr, ignoreServerClosed(controlServer.Shutdown(context.Background())))
 	case <-interrupt:
 		fmt.Fprintln(os.Stdout, "Shutting down...")
-		lastErr = errors.Append(lastErr, ignoreServerClosed(requestServer.Shutdown(context.Background())))
+		lastErr = errors.Append(lastErr, shutdownRequestServers())
 		lastErr = errors.Append(lastErr, ignoreServerClosed(controlServer.Shutdown(context.Background())))
 	}
 
 	cerr := <-controlServerErr
 	lastErr = errors.Append(lastErr, cerr)
-	rerr := <-requestServerErr
-	lastErr = errors.Append(lastErr, rerr)
+	for rerr := range requestServerErr {
+		lastErr = errors.Append(lastErr, rerr)
+	}
+	if grpcServer != nil {
+		// the streams of the tunnel clients don't end by themselves, so they aren't waited for
+		grpcServer.Stop()
+		for gerr := range grpcServerErr {
+			lastErr = errors.Append(lastErr, gerr)
+		}
+	}
 
 	return lastErr
 }
 
+// requestSettings are the settings of the request handlers rebuilt when the config is reloaded
+type requestSettings struct {
+	errorResponses tunnel.ErrorResponses
+	// fallbackMiddlewares are the middlewares without authentication for the requests sent to the split fallback
+	fallbackMiddlewares   []tunnel.Middleware
+	flushInterval         time.Duration
+	middlewares           []tunnel.Middleware
+	responseHeaderTimeout time.Duration
+}
+
+func buildRequestSettings(params Params, logger logr.Logger) (requestSettings, error) {
+	settings := requestSettings{
+		flushInterval:         params.requestFlushInterval,
+		responseHeaderTimeout: params.responseHeaderTimeout,
+	}
+
+	var err error
+	settings.errorResponses, err = parseErrorResponses(params.errorFormat, params.errorHideDetails, params.errorStatuses, params.errorDownstreamStatuses, params.errorBodies)
+	if err != nil {
+		return settings, err
+	}
+
+	if params.responseHeaderTimeout < 0 {
+		return settings, errors.Errorf("req-response-header-timeout must not be negative, got %s", params.responseHeaderTimeout)
+	}
+
+	middlewareSpecs := []middlewareSpec{}
+	if params.requestLog {
+		middlewareSpecs = append(middlewareSpecs, middlewareSpec{Type: middlewareTypeLog})
+	}
+	if len(params.cors.AllowedOrigins) > 0 {
+		if params.cors.corsConfig().Validate() != nil {
+			return settings, errors.New("cors-allow-credentials cannot be used with the * cors-allowed-origin, the allowed origins must be listed")
+		}
+		cors := params.cors
+		middlewareSpecs = append(middlewareSpecs, middlewareSpec{Type: middlewareTypeCORS, CORS: &cors})
+	} else if params.cors.AllowCredentials || len(params.cors.AllowedMethods) > 0 || len(params.cors.AllowedHeaders) > 0 || len(params.cors.ExposedHeaders) > 0 {
+		return settings, errors.New("cors flags require cors-allowed-origin to be specified")
+	}
+	// after CORS, as browsers send the preflight requests without credentials
+	if params.auth.TokenFile != "" || params.auth.BasicAuthFile != "" {
+		auth := params.auth
+		middlewareSpecs = append(middlewareSpecs, middlewareSpec{Type: middlewareTypeAuth, Auth: &auth})
+	}
+	// after auth, so the cached responses are served to authorized callers only
+	if params.cache.MaxSize > 0 {
+		cache := params.cache
+		middlewareSpecs = append(middlewareSpecs, middlewareSpec{Type: middlewareTypeCache, Cache: &cache})
+	} else if params.cache.MaxEntrySize != 0 || len(params.cache.KeyHeaders) > 0 {
+		return settings, errors.New("cache flags require req-cache-size to be specified")
+	}
+	if params.requestMiddlewareConfig != "" {
+		specs, err := loadMiddlewareConfig(params.requestMiddlewareConfig)
+		if err != nil {
+			return settings, err
+		}
+		middlewareSpecs = append(middlewareSpecs, specs...)
+	}
+	middlewareSpecs = append(middlewareSpecs, params.configMiddlewares...)
+	if len(params.requestHeaders) > 0 || len(params.responseHeaders) > 0 {
+		requestHeaders, err := parseHeaderValues("req-header", params.requestHeaders)
+		if err != nil {
+			return settings, err
+		}
+		responseHeaders, err := parseHeaderValues("resp-header", params.responseHeaders)
+		if err != nil {
+			return settings, err
+		}
+		middlewareSpecs = append(middlewareSpecs, middlewareSpec{Type: middlewareTypeHeader, RequestHeaders: requestHeaders, ResponseHeaders: responseHeaders})
+	}
+
+	settings.middlewares, err = buildMiddlewares(middlewareSpecs, logger)
+	if err != nil {
+		return settings, err
+	}
+	fallbackSpecs := make([]middlewareSpec, 0, len(middlewareSpecs))
+	for _, spec := range middlewareSpecs {
+		if spec.Type != middlewareTypeAuth {
+			fallbackSpecs = append(fallbackSpecs, spec)
+		}
+	}
+	settings.fallbackMiddlewares, err = buildMiddlewares(fallbackSpecs, logger)
+	return settings, err
+}
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/yaml"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+const (
+	middlewareTypeAuth   = "auth"
+	middlewareTypeCache  = "cache"
+	middlewareTypeCORS   = "cors"
+	middlewareTypeHeader = "header"
+	middlewareTypeLog    = "log"
+)
+
+// middlewareConfig is the middleware stack of the request server in the config file, e.g.
+//
+//	middlewares:
+//	- type: log
+//	- type: cors
+//	  cors:
+//	    allowedOrigins: ["http://localhost:3000"]
+//	- type: auth
+//	  auth:
+//	    tokenFile: /etc/kurun-auth/token
+//	- type: cache
+//	  cache:
+//	    maxSize: 67108864
+//	- type: header
+//	  requestHeaders:
+//	    X-Forwarded-By: kurun
+type middlewareConfig struct {
+	Middlewares []middlewareSpec `json:"middlewares"`
+}
+
+// middlewareSpec configures a middleware of the request server
+type middlewareSpec struct {
+	Type            string            `json:"type"`
+	Auth            *authSpec         `json:"auth,omitempty"`
+	Cache           *cacheSpec        `json:"cache,omitempty"`
+	CORS            *corsSpec         `json:"cors,omitempty"`
+	RequestHeaders  map[string]string `json:"requestHeaders,omitempty"`
+	ResponseHeaders map[string]string `json:"responseHeaders,omitempty"`
+}
+
+// authSpec configures the auth middleware, the credentials are read from files (e.g. mounted secrets), so they don't
+// show up in the pod spec
+type authSpec struct {
+	// BasicAuthFile contains username:password lines
+	BasicAuthFile string `json:"basicAuthFile,omitempty"`
+	// TokenFile contains bearer tokens, one per line
+	TokenFile string `json:"tokenFile,omitempty"`
+	Realm     string `json:"realm,omitempty"`
+}
+
+func (spec authSpec) authConfig() (tunnel.AuthConfig, error) {
+	config := tunnel.AuthConfig{
+		Realm: spec.Realm,
+	}
+	if spec.TokenFile != "" {
+		lines, err := readCredentialLines(spec.TokenFile)
+		if err != nil {
+			return config, err
+		}
+		config.BearerTokens = lines
+	}
+	if spec.BasicAuthFile != "" {
+		lines, err := readCredentialLines(spec.BasicAuthFile)
+		if err != nil {
+			return config, err
+		}
+		config.BasicAuth = make(map[string]string, len(lines))
+		for i, line := range lines {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return config, errors.NewWithDetails("invalid basic auth credential, expected username:password", "path", spec.BasicAuthFile, "line", i+1)
+			}
+			config.BasicAuth[parts[0]] = parts[1]
+		}
+	}
+	if len(config.BearerTokens) == 0 && len(config.BasicAuth) == 0 {
+		return config, errors.New("auth middleware requires at least one token or basic auth credential")
+	}
+	return config, nil
+}
+
+// readCredentialLines returns the non-empty lines of the file
+func readCredentialLines(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to read credentials", "path", path)
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// cacheSpec configures the cache middleware
+type cacheSpec struct {
+	KeyHeaders   []string `json:"keyHeaders,omitempty"`
+	MaxEntrySize int64    `json:"maxEntrySize,omitempty"`
+	MaxSize      int64    `json:"maxSize"`
+}
+
+func (spec cacheSpec) cacheConfig() tunnel.CacheConfig {
+	return tunnel.CacheConfig{
+		KeyHeaders:   spec.KeyHeaders,
+		MaxEntrySize: spec.MaxEntrySize,
+		MaxSize:      spec.MaxSize,
+	}
+}
+
+// corsSpec configures the cors middleware
+type corsSpec struct {
+	AllowCredentials bool     `json:"allowCredentials,omitempty"`
+	AllowedHeaders   []string `json:"allowedHeaders,omitempty"`
+	AllowedMethods   []string `json:"allowedMethods,omitempty"`
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	ExposedHeaders   []string `json:"exposedHeaders,omitempty"`
+	MaxAgeSeconds    int      `json:"maxAgeSeconds,omitempty"`
+}
+
+func (spec corsSpec) corsConfig() tunnel.CORSConfig {
+	return tunnel.CORSConfig{
+		AllowCredentials: spec.AllowCredentials,
+		AllowedHeaders:   spec.AllowedHeaders,
+		AllowedMethods:   spec.AllowedMethods,
+		AllowedOrigins:   spec.AllowedOrigins,
+		ExposedHeaders:   spec.ExposedHeaders,
+		MaxAge:           time.Duration(spec.MaxAgeSeconds) * time.Second,
+	}
+}
+
+func loadMiddlewareConfig(path string) ([]middlewareSpec, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to read middleware config", "path", path)
+	}
+	config := middlewareConfig{}
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to parse middleware config", "path", path)
+	}
+	return config.Middlewares, nil
+}
+
+// buildMiddlewares returns the middlewares of the specs in the same order
+func buildMiddlewares(specs []middlewareSpec, logger logr.Logger) ([]tunnel.Middleware, error) {
+	middlewares := make([]tunnel.Middleware, 0, len(specs))
+	for i, spec := range specs {
+		switch spec.Type {
+		case middlewareTypeLog:
+			middlewares = append(middlewares, tunnel.LoggingMiddleware(logger.WithName("requests")))
+		case middlewareTypeAuth:
+			if spec.Auth == nil {
+				return nil, errors.NewWithDetails("auth middleware requires auth settings", "index", i)
+			}
+			config, err := spec.Auth.authConfig()
+			if err != nil {
+				return nil, errors.WithDetails(err, "index", i)
+			}
+			middlewares = append(middlewares, tunnel.AuthMiddleware(config))
+		case middlewareTypeCache:
+			if spec.Cache == nil || spec.Cache.MaxSize <= 0 {
+				return nil, errors.NewWithDetails("cache middleware requires a positive max size", "index", i)
+			}
+			middlewares = append(middlewares, tunnel.CacheMiddleware(spec.Cache.cacheConfig()))
+		case middlewareTypeCORS:
+			if spec.CORS == nil || len(spec.CORS.AllowedOrigins) == 0 {
+				return nil, errors.NewWithDetails("cors middleware requires allowed origins", "index", i)
+			}
+			if err := spec.CORS.corsConfig().Validate(); err != nil {
+				return nil, errors.WithDetails(err, "index", i)
+			}
+			middlewares = append(middlewares, tunnel.CORSMiddleware(spec.CORS.corsConfig()))
+		case middlewareTypeHeader:
+			middlewares = append(middlewares, tunnel.HeaderMiddleware(toHeader(spec.RequestHeaders), toHeader(spec.ResponseHeaders)))
+		default:
+			return nil, errors.NewWithDetails("unknown middleware type", "index", i, "type", spec.Type)
+		}
+	}
+	return middlewares, nil
+}
+
+// parseHeaderValues parses name=value pairs of the flag into a header map
+func parseHeaderValues(flag string, values []string) (map[string]string, error) {
+	headers := make(map[string]string, len(values))
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid %s value %q, expected name=value", flag, value)
+		}
+		headers[parts[0]] = parts[1]
+	}
+	return headers, nil
+}
+
+func toHeader(values map[string]string) http.Header {
+	if len(values) == 0 {
+		return nil
+	}
+	header := make(http.Header, len(values))
+	for name, value := range values {
+		header.Set(name, value)
+	}
+	return header
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"emperror.dev/errors"
+)
+
+// routeServerSpec is an additional request server, its requests are sent through the tunnel with its route so the
+// clients can send them to another downstream
+type routeServerSpec struct {
+	name     string
+	address  string
+	certFile string
+	keyFile  string
+}
+
+// parseRouteServerSpec parses the value of a req-srv-route flag: name=<route>,addr=<address> with the optional
+// cert=<path>,key=<path> of its TLS certificate
+func parseRouteServerSpec(value string) (routeServerSpec, error) {
+	spec := routeServerSpec{}
+	for _, field := range strings.Split(value, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return spec, errors.Errorf("invalid req-srv-route field %q, expected key=value", field)
+		}
+		switch parts[0] {
+		case "name":
+			spec.name = parts[1]
+		case "addr":
+			spec.address = parts[1]
+		case "cert":
+			spec.certFile = parts[1]
+		case "key":
+			spec.keyFile = parts[1]
+		default:
+			return spec, errors.Errorf("unknown req-srv-route field %q, expected name, addr, cert or key", parts[0])
+		}
+	}
+	if spec.name == "" || spec.address == "" {
+		return spec, errors.Errorf("invalid req-srv-route value %q, name and addr must be specified", value)
+	}
+	if (spec.certFile != "") != (spec.keyFile != "") {
+		return spec, errors.Errorf("invalid req-srv-route value %q, cert and key must be specified together", value)
+	}
+	return spec, nil
+}
+
+// requestServer is a server of the requests sent through the tunnel, serving TLS if its certificate is set
+type requestServer struct {
+	*http.Server
+	// certificate is nil without TLS
+	certificate *certificateFile
+	// handler serves the requests with the handler of the round tripper built with the current settings
+	handler      *reloadableHandler
+	roundTripper http.RoundTripper
+}
+
+// newRequestServer returns a server of the requests sent with the round tripper, its handler has to be set before
+// serving
+func newRequestServer(addr, certFile, keyFile string, roundTripper http.RoundTripper) (*requestServer, error) {
+	handler := &reloadableHandler{}
+	server := &requestServer{
+		Server: &http.Server{
+			Addr:    addr,
+			Handler: handler,
+		},
+		handler:      handler,
+		roundTripper: roundTripper,
+	}
+	if certFile != "" && keyFile != "" {
+		certificate, err := loadCertificateFile(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.certificate = certificate
+		server.TLSConfig = &tls.Config{
+			GetCertificate: certificate.GetCertificate,
+		}
+	}
+	return server, nil
+}
+
+func (s *requestServer) listenAndServe() error {
+	if s.certificate != nil {
+		return s.ListenAndServeTLS("", "")
+	}
+	return s.ListenAndServe()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"emperror.dev/errors"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	tunnelws "github.com/banzaicloud/kurun/tunnel/websocket"
+)
+
+// The ways of identifying the tunnels of the clients (see the tunnel-id flag) and matching the requests to them (see the
+// tunnel-match flag) when the server serves several tunnels, the clients are identified by their tokens only, so they
+// can't claim the tunnels of others
+const (
+	tunnelByHost  = "host"
+	tunnelByPath  = "path"
+	tunnelByToken = "token"
+)
+
+// tunnelMatcher returns the matcher of the way, by the subdomain of the domain or by the first segment of the path
+func tunnelMatcher(flag, by, domain string) (tunnel.TunnelMatcher, error) {
+	switch by {
+	case tunnelByHost:
+		if domain == "" {
+			return nil, errors.Errorf("%s %s requires tunnel-domain to be specified", flag, by)
+		}
+		return tunnel.HostTunnelMatcher(domain), nil
+	case tunnelByPath:
+		return tunnel.PathTunnelMatcher(), nil
+	default:
+		return nil, errors.Errorf("invalid %s value %q, expected %s or %s", flag, by, tunnelByHost, tunnelByPath)
+	}
+}
+
+// tunnelTokens identifies the tunnels of the clients by the tokens of the tokens file, reloaded with the config
+type tunnelTokens struct {
+	mutex      sync.RWMutex
+	identifier tunnelws.TunnelIdentifier
+}
+
+// load reads the tokens file
+func (t *tunnelTokens) load(path string) error {
+	tokens, err := readTunnelTokens(path)
+	if err != nil {
+		return err
+	}
+	t.set(tokens)
+	return nil
+}
+
+func (t *tunnelTokens) set(tokens map[string]string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.identifier = tunnelws.TokenTunnelIdentifier(tokens)
+}
+
+// readTunnelTokens reads the tokens of the tunnels by their IDs from the tokens file, it contains id:token lines
+func readTunnelTokens(path string) (map[string]string, error) {
+	lines, err := readCredentialLines(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]string, len(lines))
+	ids := make(map[string]string, len(lines))
+	for i, line := range lines {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.NewWithDetails("invalid tunnel token, expected id:token", "path", path, "line", i+1)
+		}
+		if id, ok := ids[parts[1]]; ok && id != parts[0] {
+			return nil, errors.NewWithDetails("the same token identifies several tunnels", "path", path, "line", i+1)
+		}
+		ids[parts[1]] = parts[0]
+		tokens[parts[0]] = parts[1]
+	}
+	if len(tokens) == 0 {
+		return nil, errors.NewWithDetails("no tunnel tokens", "path", path)
+	}
+	return tokens, nil
+}
+
+func (t *tunnelTokens) identify(r *http.Request) (string, error) {
+	t.mutex.RLock()
+	identify := t.identifier
+	t.mutex.RUnlock()
+	return identify(r)
+}
+
+// validateTunnelQuotas checks the quotas of the flags and the config
+func validateTunnelQuotas(params Params) error {
+	quotas := map[string]tunnel.TunnelQuota{"": params.tunnelQuota}
+	for id, quota := range params.tunnelQuotas {
+		quotas[id] = quota
+	}
+	for id, quota := range quotas {
+		if quota.RequestsPerSecond < 0 || quota.Burst < 0 || quota.MaxConcurrent < 0 || quota.BytesPerSecond < 0 {
+			if id == "" {
+				return errors.New("tunnel-rate, tunnel-burst, tunnel-max-concurrent and tunnel-bandwidth must not be negative")
+			}
+			return errors.Errorf("the quota of tunnel %q must not be negative", id)
+		}
+	}
+	return nil
+}
+
+// metricsPath is the path of the metrics of the tunnels on the control server with the tunnel-id flag
+const metricsPath = "/metrics"
+
+// metricsHandler serves the metrics of the tunnels labeled by their IDs in the Prometheus text format on metricsPath,
+// and the other requests (including the connections of the clients) with next
+func metricsHandler(multiServer *tunnelws.MultiServer, quotas *tunnel.TunnelQuotas, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != metricsPath || r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintf(w, "# HELP kurun_tunnel_connected_clients Tunnel clients connected to the tunnel.\n# TYPE kurun_tunnel_connected_clients gauge\n")
+		for _, id := range multiServer.Tunnels() {
+			if server := multiServer.Tunnel(id); server != nil {
+				fmt.Fprintf(w, "kurun_tunnel_connected_clients{tunnel=\"%s\"} %d\n", tunnel.EscapeMetricLabel(id), server.ConnectedClients())
+			}
+		}
+		_ = quotas.WriteMetrics(w)
+	})
+}
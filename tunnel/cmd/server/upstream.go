@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+// upstreamRoundTripper sends the requests to the upstream instead of the tunnel, e.g. to the port forwarded by an SSH
+// tunnel client, the failures are reported as downstream errors like the ones of the tunnel clients
+func upstreamRoundTripper(upstream *url.URL) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	return tunnel.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		r = r.Clone(r.Context())
+		r.URL.Scheme = upstream.Scheme
+		r.URL.Host = upstream.Host
+		if upstream.Path != "" {
+			r.URL.Path = path.Join(upstream.Path, r.URL.Path)
+		}
+		r.RequestURI = ""
+
+		resp, err := transport.RoundTrip(r)
+		if err != nil {
+			return nil, tunnel.NewDownstreamError(err)
+		}
+		return resp, nil
+	})
+}
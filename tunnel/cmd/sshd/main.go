@@ -0,0 +1,111 @@
+// kurun-sshd is the SSH server of the ssh transport, running next to kurun-server and only forwarding the connections
+// of the authorized tunnel clients to the permitted targets, e.g. the control server of kurun-server
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/stdr"
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh"
+
+	tunnelssh "github.com/banzaicloud/kurun/tunnel/ssh"
+)
+
+type Params struct {
+	address            string
+	authorizedKeysFile string
+	hostKeyFile        string
+	logVerbosity       int
+	permittedTargets   []string
+}
+
+func run() error {
+	params := Params{}
+
+	pflag.StringVar(&params.address, "addr", ":2222", "SSH server address")
+	pflag.StringVar(&params.authorizedKeysFile, "authorized-keys", "", "path of the authorized_keys file of the public keys accepted from the clients")
+	pflag.StringVar(&params.hostKeyFile, "host-key", "", "path of the private host key file")
+	pflag.StringSliceVar(&params.permittedTargets, "permit-target", nil, "address (host:port) the clients may forward connections to")
+	pflag.CountVarP(&params.logVerbosity, "verbose", "v", "logging verbosity")
+	pflag.Parse()
+
+	if params.authorizedKeysFile == "" || params.hostKeyFile == "" {
+		return errors.New("authorized-keys and host-key must be specified")
+	}
+	if len(params.permittedTargets) == 0 {
+		return errors.New("at least one permit-target must be specified")
+	}
+
+	stdr.SetVerbosity(params.logVerbosity)
+	logger := stdr.New(log.New(os.Stdout, "", log.LstdFlags|log.LUTC))
+
+	hostKeyPEM, err := os.ReadFile(params.hostKeyFile)
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to read host-key", "path", params.hostKeyFile)
+	}
+	hostKey, err := ssh.ParsePrivateKey(hostKeyPEM)
+	if err != nil {
+		return errors.WrapIfWithDetails(err, "failed to parse host-key", "path", params.hostKeyFile)
+	}
+	authorizedKeys, err := readAuthorizedKeys(params.authorizedKeysFile)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", params.address)
+	if err != nil {
+		return err
+	}
+	server := tunnelssh.NewServer(hostKey, authorizedKeys, tunnelssh.WithLogger(logger), tunnelssh.WithPermittedTargets(params.permittedTargets))
+	logger.Info("SSH server listening", "addr", listener.Addr().String(), "permittedTargets", params.permittedTargets)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-interrupt:
+		fmt.Fprintln(os.Stdout, "Shutting down...")
+		return listener.Close()
+	}
+}
+
+// readAuthorizedKeys returns the public keys of the authorized_keys file
+func readAuthorizedKeys(path string) ([]ssh.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to read authorized-keys", "path", path)
+	}
+	var keys []ssh.PublicKey
+	for rest := bytes.TrimSpace(content); len(rest) > 0; rest = bytes.TrimSpace(rest) {
+		var key ssh.PublicKey
+		key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, errors.WrapIfWithDetails(err, "failed to parse authorized-keys", "path", path)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.NewWithDetails("authorized-keys is empty", "path", path)
+	}
+	return keys, nil
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+	}
+}
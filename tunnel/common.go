@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+	"unsafe"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+)
+
+// WithLogger sets the logger of a tunnel client or server
+type WithLogger logr.Logger
+
+func (opt WithLogger) ApplyToClientConfig(c *ClientConfig) {
+	c.logger = logr.Logger(opt)
+}
+
+func (opt WithLogger) ApplyToServer(s *Server) {
+	s.logger = logr.Logger(opt).WithValues("server", s)
+}
+
+// WithMaxFrameSize sets the maximal size of the frames sent by a tunnel client or server in bytes, the bigger messages
+// are split into fragments reassembled by the peer, 64KiB by default
+// The sizes below 1KiB are raised to it.
+type WithMaxFrameSize int
+
+func (opt WithMaxFrameSize) ApplyToClientConfig(c *ClientConfig) {
+	c.maxFrameSize = int(opt)
+}
+
+func (opt WithMaxFrameSize) ApplyToServer(s *Server) {
+	s.maxFrameSize = int(opt)
+}
+
+// WithPingInterval sets the interval of the pings sent by a tunnel client or server to keep the connection alive, e.g.
+// through NATs and firewalls dropping idle connections, zero disables them
+// The clients only ping the server when nothing was received in the interval.
+type WithPingInterval time.Duration
+
+func (opt WithPingInterval) ApplyToClientConfig(c *ClientConfig) {
+	c.pingInterval = time.Duration(opt)
+}
+
+func (opt WithPingInterval) ApplyToServer(s *Server) {
+	s.pingInterval = time.Duration(opt)
+}
+
+func isTemporaryError(err error) bool {
+	if e := new(net.Error); errors.As(err, e) {
+		return (*e).Temporary()
+	}
+	return false
+}
+
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if e := new(net.Error); errors.As(err, e) {
+		return (*e).Timeout()
+	}
+	return false
+}
+
+type requestID = uint64
+
+func getRequestID(r *http.Request) requestID {
+	return uint64(uintptr(unsafe.Pointer(r)))
+}
+
+func reasonToError(reason interface{}, context string) (err error) {
+	if reason == nil {
+		err = errors.Errorf("goexit %s", context)
+	} else {
+		msg := "panic %s"
+		if e, ok := reason.(error); ok {
+			err = errors.WithMessagef(e, msg, context)
+		} else {
+			err = errors.WithDetails(errors.Errorf(msg, context), "reason", reason)
+		}
+	}
+	return
+}
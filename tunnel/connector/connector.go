@@ -0,0 +1,5 @@
+// Package connector is the gRPC service connecting the tunnel clients to the tunnel server, generated from
+// connector.proto
+package connector
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative connector.proto
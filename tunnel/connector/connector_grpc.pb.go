@@ -0,0 +1,143 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v3.21.12
+// source: connector.proto
+
+package connector
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Connector_Connect_FullMethodName = "/kurun.tunnel.connector.Connector/Connect"
+)
+
+// ConnectorClient is the client API for Connector service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ConnectorClient interface {
+	// Connect streams the frames of a tunnel connection in both directions, until either side closes it
+	Connect(ctx context.Context, opts ...grpc.CallOption) (Connector_ConnectClient, error)
+}
+
+type connectorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewConnectorClient(cc grpc.ClientConnInterface) ConnectorClient {
+	return &connectorClient{cc}
+}
+
+func (c *connectorClient) Connect(ctx context.Context, opts ...grpc.CallOption) (Connector_ConnectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Connector_ServiceDesc.Streams[0], Connector_Connect_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &connectorConnectClient{stream}
+	return x, nil
+}
+
+type Connector_ConnectClient interface {
+	Send(*Frame) error
+	Recv() (*Frame, error)
+	grpc.ClientStream
+}
+
+type connectorConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *connectorConnectClient) Send(m *Frame) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *connectorConnectClient) Recv() (*Frame, error) {
+	m := new(Frame)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ConnectorServer is the server API for Connector service.
+// All implementations must embed UnimplementedConnectorServer
+// for forward compatibility
+type ConnectorServer interface {
+	// Connect streams the frames of a tunnel connection in both directions, until either side closes it
+	Connect(Connector_ConnectServer) error
+	mustEmbedUnimplementedConnectorServer()
+}
+
+// UnimplementedConnectorServer must be embedded to have forward compatible implementations.
+type UnimplementedConnectorServer struct {
+}
+
+func (UnimplementedConnectorServer) Connect(Connector_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedConnectorServer) mustEmbedUnimplementedConnectorServer() {}
+
+// UnsafeConnectorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ConnectorServer will
+// result in compilation errors.
+type UnsafeConnectorServer interface {
+	mustEmbedUnimplementedConnectorServer()
+}
+
+func RegisterConnectorServer(s grpc.ServiceRegistrar, srv ConnectorServer) {
+	s.RegisterService(&Connector_ServiceDesc, srv)
+}
+
+func _Connector_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ConnectorServer).Connect(&connectorConnectServer{stream})
+}
+
+type Connector_ConnectServer interface {
+	Send(*Frame) error
+	Recv() (*Frame, error)
+	grpc.ServerStream
+}
+
+type connectorConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *connectorConnectServer) Send(m *Frame) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *connectorConnectServer) Recv() (*Frame, error) {
+	m := new(Frame)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Connector_ServiceDesc is the grpc.ServiceDesc for Connector service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Connector_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kurun.tunnel.connector.Connector",
+	HandlerType: (*ConnectorServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _Connector_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "connector.proto",
+}
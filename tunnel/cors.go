@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// CORSConfig configures the cross-origin resource sharing of the request handler, so browsers can call the tunneled
+// service from other origins
+type CORSConfig struct {
+	// AllowCredentials allows requests with credentials (cookies, authorization headers), it can't be used with the *
+	// origin, see Validate
+	AllowCredentials bool
+	// AllowedHeaders are the request headers allowed in cross-origin requests, if empty the headers requested by the
+	// preflight are allowed
+	AllowedHeaders []string
+	// AllowedMethods are the methods allowed in cross-origin requests, GET, HEAD and POST by default
+	AllowedMethods []string
+	// AllowedOrigins are the origins (e.g. https://app.example.com) allowed to make cross-origin requests, * allows
+	// any origin
+	AllowedOrigins []string
+	// ExposedHeaders are the response headers the browsers expose to the callers
+	ExposedHeaders []string
+	// MaxAge is the time the result of a preflight can be cached by the browsers, zero means the browser default
+	MaxAge time.Duration
+}
+
+// Validate rejects the credentials allowed for any origin, as that would let any site make authenticated requests
+// with the cookies of the users
+func (c CORSConfig) Validate() error {
+	if c.AllowCredentials && c.allowsAnyOrigin() {
+		return errors.New("CORS credentials cannot be allowed for any origin (*), the allowed origins must be listed")
+	}
+	return nil
+}
+
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CORSConfig) allowsAnyOrigin() bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// CORSMiddleware adds the CORS headers to the responses of the allowed origins, and answers the preflight requests
+// without sending them through the tunnel
+// Credentials are not allowed if the config is invalid (see CORSConfig.Validate), so any origin is allowed without them.
+func CORSMiddleware(config CORSConfig) Middleware {
+	if config.Validate() != nil {
+		config.AllowCredentials = false
+	}
+	allowedMethods := config.AllowedMethods
+	if len(allowedMethods) == 0 {
+		allowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !config.allowsOrigin(origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			headers := make(http.Header)
+			if config.allowsAnyOrigin() {
+				headers.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				headers.Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			if config.AllowCredentials {
+				headers.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				headers.Set("Access-Control-Allow-Methods", strings.Join(allowedMethods, ", "))
+				if len(config.AllowedHeaders) > 0 {
+					headers.Set("Access-Control-Allow-Headers", strings.Join(config.AllowedHeaders, ", "))
+				} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+					headers.Set("Access-Control-Allow-Headers", requested)
+					w.Header().Add("Vary", "Access-Control-Request-Headers")
+				}
+				if config.MaxAge > 0 {
+					headers.Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge.Seconds())))
+				}
+				for name, values := range headers {
+					w.Header()[name] = values
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if len(config.ExposedHeaders) > 0 {
+				headers.Set("Access-Control-Expose-Headers", strings.Join(config.ExposedHeaders, ", "))
+			}
+			// the headers replace the CORS headers of the downstream, browsers reject duplicate values
+			next.ServeHTTP(&headerSetter{ResponseWriter: w, headers: headers}, r)
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DuplicateStatusHeader is set on the responses of the duplicate requests dropped by DuplicateFilter
+const DuplicateStatusHeader = "X-Kurun-Duplicate"
+
+// IdempotencyKeyHeader identifies the retries of a request, the requests with it are deduplicated by its value
+// instead of the hash of their bodies
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// defaultMaxDuplicateEntrySize is the size limit of the request and response bodies of DuplicateFilter unless
+// configured otherwise
+const defaultMaxDuplicateEntrySize = 1 << 20
+
+// DuplicateFilter drops the duplicates of the requests sent through a round tripper, e.g. the webhook deliveries
+// retried by their senders or sent again by the tunnel server due to connection churn, so the downstream handles them
+// once
+// The requests are identified by their method, route, URL and Idempotency-Key header, and the hash of their bodies
+// without the header. The duplicates received while the original request is handled wait for it, and get a copy of
+// its response. Only the successful responses (below 500) are kept, so the requests failing in the downstream can be
+// retried.
+type DuplicateFilter struct {
+	// MaxEntrySize is the size limit of the request bodies hashed and of the response bodies kept for the duplicates,
+	// the bigger requests and the requests of the bigger responses are not deduplicated, 1MiB by default
+	MaxEntrySize int64
+	// Windows are the times the responses are kept for the duplicates by the methods of the requests, e.g. POST, the
+	// requests of other methods are sent through
+	Windows map[string]time.Duration
+}
+
+// Enabled returns whether any requests are deduplicated
+func (f DuplicateFilter) Enabled() bool {
+	for _, window := range f.Windows {
+		if window > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RoundTripper returns a round tripper dropping the duplicates of the requests sent through the next one
+func (f DuplicateFilter) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if f.MaxEntrySize <= 0 {
+		f.MaxEntrySize = defaultMaxDuplicateEntrySize
+	}
+	d := &duplicates{
+		config:  f,
+		entries: make(map[string]*duplicateEntry),
+		next:    next,
+	}
+	return RoundTripperFunc(d.roundTrip)
+}
+
+type duplicates struct {
+	config  DuplicateFilter
+	entries map[string]*duplicateEntry
+	mutex   sync.Mutex
+	next    http.RoundTripper
+}
+
+type duplicateEntry struct {
+	// done is closed when the response of the original request is received
+	done    chan struct{}
+	expires time.Time
+	// resp is the response of the original request, nil if it's not kept
+	resp *recordedResponse
+}
+
+type recordedResponse struct {
+	body       []byte
+	header     http.Header
+	statusCode int
+}
+
+func (d *duplicates) roundTrip(r *http.Request) (*http.Response, error) {
+	window := d.config.Windows[r.Method]
+	if window <= 0 {
+		return d.next.RoundTrip(r)
+	}
+	key, ok := d.key(r)
+	if !ok {
+		return d.next.RoundTrip(r)
+	}
+
+	now := time.Now()
+	d.mutex.Lock()
+	entry, found := d.entries[key]
+	if found && isClosed(entry.done) && now.After(entry.expires) {
+		found = false
+	}
+	if !found {
+		d.removeExpired(now)
+		entry = &duplicateEntry{done: make(chan struct{})}
+		d.entries[key] = entry
+	}
+	d.mutex.Unlock()
+
+	if found {
+		select {
+		case <-entry.done:
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+		if entry.resp != nil {
+			return entry.resp.response(r), nil
+		}
+		// the original request failed or its response is too big to keep
+		return d.next.RoundTrip(r)
+	}
+
+	resp, err := d.next.RoundTrip(r)
+	if err == nil && resp.StatusCode < http.StatusInternalServerError && resp.Body != nil {
+		var body []byte
+		if body, resp.Body, ok = readLimited(resp.Body, d.config.MaxEntrySize); ok {
+			entry.resp = &recordedResponse{
+				body:       body,
+				header:     resp.Header.Clone(),
+				statusCode: resp.StatusCode,
+			}
+		}
+	}
+
+	d.mutex.Lock()
+	if entry.resp != nil {
+		entry.expires = time.Now().Add(window)
+	} else if d.entries[key] == entry {
+		delete(d.entries, key)
+	}
+	close(entry.done)
+	d.mutex.Unlock()
+
+	return resp, err
+}
+
+// key returns the key identifying the duplicates of the request, false if its body is too big to be hashed
+func (d *duplicates) key(r *http.Request) (string, bool) {
+	hash := sha256.New()
+	for _, value := range []string{r.Method, r.Header.Get(RouteHeader), r.URL.RequestURI(), r.Header.Get(IdempotencyKeyHeader)} {
+		_, _ = io.WriteString(hash, value)
+		_, _ = hash.Write([]byte{0})
+	}
+	if r.Header.Get(IdempotencyKeyHeader) == "" && r.Body != nil && r.Body != http.NoBody {
+		body, rest, ok := readLimited(r.Body, d.config.MaxEntrySize)
+		r.Body = rest
+		if !ok {
+			return "", false
+		}
+		_, _ = hash.Write(body)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), true
+}
+
+// removeExpired removes the entries expired by now, the mutex must be held
+func (d *duplicates) removeExpired(now time.Time) {
+	for key, entry := range d.entries {
+		if isClosed(entry.done) && now.After(entry.expires) {
+			delete(d.entries, key)
+		}
+	}
+}
+
+// response returns a copy of the recorded response for the request
+func (rr *recordedResponse) response(r *http.Request) *http.Response {
+	header := rr.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set(DuplicateStatusHeader, "true")
+	return &http.Response{
+		Body:          io.NopCloser(bytes.NewReader(rr.body)),
+		ContentLength: int64(len(rr.body)),
+		Header:        header,
+		Proto:         r.Proto,
+		ProtoMajor:    r.ProtoMajor,
+		ProtoMinor:    r.ProtoMinor,
+		Request:       r,
+		Status:        strconv.Itoa(rr.statusCode) + " " + http.StatusText(rr.statusCode),
+		StatusCode:    rr.statusCode,
+	}
+}
+
+// readLimited reads the body if it's at most limit bytes, and returns the body to read instead of it, which is the
+// read data followed by the rest of the body if it's bigger
+func readLimited(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser, bool) {
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		// the failed reads are repeated by the reader of the rest
+		return nil, readCloser{Reader: io.MultiReader(bytes.NewReader(data), body), Closer: body}, false
+	}
+	_ = body.Close()
+	return data, io.NopCloser(bytes.NewReader(data)), true
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,332 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+
+	"emperror.dev/errors"
+)
+
+// DownstreamErrorHeader marks the responses generated by tunnel clients when the downstream can't be reached, its
+// value is the kind of the failure (e.g. DownstreamErrorKindTimeout)
+const DownstreamErrorHeader = "X-Kurun-Downstream-Error"
+
+// Kinds of the failures to reach the downstream, DownstreamErrorKindConnection is any other connection failure
+const (
+	DownstreamErrorKindConnection        = "connection"
+	DownstreamErrorKindConnectionRefused = "connection-refused"
+	DownstreamErrorKindDNS               = "dns"
+	DownstreamErrorKindTimeout           = "timeout"
+)
+
+// DownstreamErrorKinds are the kinds of the failures to reach the downstream
+var DownstreamErrorKinds = []string{DownstreamErrorKindConnection, DownstreamErrorKindConnectionRefused, DownstreamErrorKindDNS, DownstreamErrorKindTimeout}
+
+const (
+	// ErrNoClient is returned when no tunnel client is connected to serve the request
+	ErrNoClient = errors.Sentinel("no tunnel client connected")
+	// ErrClientDisconnected is returned when the connection of the tunnel client handling the request is lost, and its
+	// session is not resumed in the grace period (see WithSessionGracePeriod)
+	ErrClientDisconnected = errors.Sentinel("tunnel client disconnected while handling the request")
+	// ErrResponseHeaderTimeout is returned when the response headers are not received in time
+	ErrResponseHeaderTimeout = errors.Sentinel("timeout awaiting response headers")
+)
+
+// DownstreamError is the failure of the tunnel client to send the request to the downstream
+type DownstreamError struct {
+	Kind    string
+	Message string
+}
+
+func (e *DownstreamError) Error() string {
+	return "downstream request failed: " + e.Message
+}
+
+// Timeout returns whether the downstream did not respond in time
+func (e *DownstreamError) Timeout() bool {
+	return e.Kind == DownstreamErrorKindTimeout
+}
+
+// NewDownstreamError returns the downstream error of the failure of the round tripper sending the request to the
+// downstream, classified by its kind
+func NewDownstreamError(err error) *DownstreamError {
+	var downstreamErr *DownstreamError
+	if errors.As(err, &downstreamErr) {
+		return downstreamErr
+	}
+	return &DownstreamError{
+		Kind:    downstreamErrorKind(err),
+		Message: err.Error(),
+	}
+}
+
+func downstreamErrorKind(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return DownstreamErrorKindDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DownstreamErrorKindConnectionRefused
+	case isTimeoutError(err):
+		return DownstreamErrorKindTimeout
+	default:
+		return DownstreamErrorKindConnection
+	}
+}
+
+// downstreamErrorBody is the JSON body of the responses reporting downstream errors
+type downstreamErrorBody struct {
+	Error string `json:"error"`
+	Kind  string `json:"kind"`
+}
+
+// Response returns the 503 response reporting the error to the tunnel server (see DownstreamErrorHeader), with a JSON
+// body of the kind and the message of the error
+func (e *DownstreamError) Response() *http.Response {
+	body, _ := json.Marshal(downstreamErrorBody{Error: e.Message, Kind: e.Kind})
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header: http.Header{
+			"Content-Type":        []string{"application/json"},
+			DownstreamErrorHeader: []string{e.Kind},
+		},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+// WriteResponse writes the response reporting the error (see Response)
+func (e *DownstreamError) WriteResponse(w http.ResponseWriter) {
+	resp := e.Response()
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// downstreamErrorFromResponse returns the downstream error reported by the response of the tunnel client, if any
+// The body of the response is consumed in that case, the plain text bodies of older clients are accepted too.
+func downstreamErrorFromResponse(resp *http.Response) *DownstreamError {
+	kind := resp.Header.Get(DownstreamErrorHeader)
+	if kind == "" {
+		return nil
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		var body downstreamErrorBody
+		if err := json.Unmarshal(message, &body); err == nil {
+			message = []byte(body.Error)
+		}
+	}
+	return &DownstreamError{
+		Kind:    kind,
+		Message: string(bytes.TrimSpace(message)),
+	}
+}
+
+// Kinds of the errors of the request handler for ErrorResponses
+const (
+	ErrorKindDownstream = "downstream"
+	ErrorKindInternal   = "internal"
+	ErrorKindNoClient   = "no-client"
+	ErrorKindQuota      = "quota"
+	ErrorKindTimeout    = "timeout"
+)
+
+// ErrorKind returns the kind of the error returned by the tunnel or ModifyResponse
+func ErrorKind(err error) string {
+	var downstreamErr *DownstreamError
+	switch {
+	case errors.Is(err, ErrNoClient), errors.Is(err, ErrClientDisconnected):
+		return ErrorKindNoClient
+	case errors.Is(err, ErrQuotaExceeded):
+		return ErrorKindQuota
+	case errors.Is(err, ErrResponseHeaderTimeout):
+		return ErrorKindTimeout
+	case errors.As(err, &downstreamErr):
+		if downstreamErr.Timeout() {
+			return ErrorKindTimeout
+		}
+		return ErrorKindDownstream
+	default:
+		return ErrorKindInternal
+	}
+}
+
+// ErrorResponse is the response sent to the client for a kind of error
+type ErrorResponse struct {
+	StatusCode int
+	// Body is executed with ErrorResponseData, use html/template for HTML bodies, the responses without a body get the
+	// default one
+	Body        ErrorBodyTemplate
+	ContentType string
+}
+
+// ErrorBodyTemplate is implemented by text/template and html/template templates
+type ErrorBodyTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// ErrorResponseData is the data available to the body templates of the error responses
+type ErrorResponseData struct {
+	// DownstreamKind is the kind of the failure to reach the downstream (e.g. DownstreamErrorKindDNS), empty for
+	// the other errors
+	DownstreamKind string `json:"downstreamKind,omitempty"`
+	// Error is the error message, empty if the details are hidden
+	Error      string `json:"error,omitempty"`
+	Kind       string `json:"kind"`
+	Method     string `json:"method"`
+	StatusCode int    `json:"status"`
+	URL        string `json:"url"`
+}
+
+// ErrorResponses configures the responses sent to the clients on errors, see ErrorResponseHandler
+type ErrorResponses struct {
+	// DownstreamStatusCodes maps the kinds of the failures to reach the downstream (e.g. DownstreamErrorKindDNS) to
+	// the status codes of their responses, overriding the ones of their error kinds
+	DownstreamStatusCodes map[string]int
+	// HideDetails omits the error messages from the responses, so the internals of the tunnel and the downstream
+	// are not revealed to the clients
+	HideDetails bool
+	// JSON sends the default responses with JSON bodies (see JSONErrorBody) instead of plain text ones, which are sent
+	// to the clients accepting JSON (with the Accept header) without it too
+	JSON bool
+	// Responses maps the kinds of errors (e.g. ErrorKindTimeout) to their responses, the kinds without a response
+	// get the default
+	Responses map[string]ErrorResponse
+}
+
+var defaultErrorBody = template.Must(template.New("error").Parse(`{{.StatusCode}} {{.Kind}} error{{with .DownstreamKind}} ({{.}}){{end}}{{with .Error}}: {{.}}{{end}}` + "\n"))
+
+// JSONErrorBody is the body of the error responses encoding ErrorResponseData as a JSON object, e.g.
+// {"downstreamKind":"dns","error":"...","kind":"downstream","method":"GET","status":502,"url":"/"}
+var JSONErrorBody ErrorBodyTemplate = jsonErrorBody{}
+
+type jsonErrorBody struct{}
+
+func (jsonErrorBody) Execute(w io.Writer, data interface{}) error {
+	return json.NewEncoder(w).Encode(data)
+}
+
+// DefaultErrorResponses returns the default responses of the kinds of errors, with plain text bodies
+func DefaultErrorResponses() map[string]ErrorResponse {
+	statusCodes := map[string]int{
+		ErrorKindDownstream: http.StatusBadGateway,
+		ErrorKindInternal:   http.StatusInternalServerError,
+		ErrorKindNoClient:   http.StatusServiceUnavailable,
+		ErrorKindQuota:      http.StatusTooManyRequests,
+		ErrorKindTimeout:    http.StatusGatewayTimeout,
+	}
+	responses := make(map[string]ErrorResponse, len(statusCodes))
+	for kind, statusCode := range statusCodes {
+		responses[kind] = ErrorResponse{
+			StatusCode:  statusCode,
+			Body:        defaultErrorBody,
+			ContentType: "text/plain; charset=utf-8",
+		}
+	}
+	return responses
+}
+
+// ErrorResponseHandler returns an error handler for RequestHandler sending the configured responses
+func ErrorResponseHandler(config ErrorResponses) func(http.ResponseWriter, *http.Request, error) {
+	responses := DefaultErrorResponses()
+	for kind, response := range responses {
+		// the default bodies are selected for each request
+		response.Body = nil
+		response.ContentType = ""
+		responses[kind] = response
+	}
+	for kind, response := range config.Responses {
+		defaultResponse, ok := responses[kind]
+		if !ok { // not returned by ErrorKind
+			continue
+		}
+		if response.StatusCode == 0 {
+			response.StatusCode = defaultResponse.StatusCode
+		}
+		if response.Body == nil {
+			response.ContentType = ""
+		} else if response.ContentType == "" {
+			response.ContentType = errorBodyContentType(response.Body)
+		}
+		responses[kind] = response
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		kind := ErrorKind(err)
+		response := responses[kind]
+
+		data := ErrorResponseData{
+			Kind:       kind,
+			Method:     r.Method,
+			StatusCode: response.StatusCode,
+			URL:        r.URL.String(),
+		}
+		var downstreamErr *DownstreamError
+		if errors.As(err, &downstreamErr) {
+			data.DownstreamKind = downstreamErr.Kind
+			if statusCode := config.DownstreamStatusCodes[downstreamErr.Kind]; statusCode != 0 {
+				data.StatusCode = statusCode
+			}
+		}
+		if !config.HideDetails {
+			data.Error = err.Error()
+		}
+
+		if response.Body == nil {
+			response.Body = ErrorBodyTemplate(defaultErrorBody)
+			if config.JSON || acceptsJSON(r) {
+				response.Body = JSONErrorBody
+			}
+			response.ContentType = errorBodyContentType(response.Body)
+		}
+
+		body := &bytes.Buffer{}
+		if err := response.Body.Execute(body, data); err != nil {
+			body.Reset()
+			_ = defaultErrorBody.Execute(body, data)
+		}
+
+		w.Header().Set("Content-Type", response.ContentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(data.StatusCode)
+		_, _ = w.Write(body.Bytes())
+	}
+}
+
+// errorBodyContentType returns the content type of the body templates without one, JSONErrorBody is served as JSON
+func errorBodyContentType(body ErrorBodyTemplate) string {
+	if _, ok := body.(jsonErrorBody); ok {
+		return "application/json"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// acceptsJSON returns whether the Accept header of the request lists JSON, the clients accepting any media type get
+// plain text
+func acceptsJSON(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil || mediaType != "application/json" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ConnectionEventType is the type of the connection lifecycle events of the tunnel client
+type ConnectionEventType string
+
+const (
+	// ConnectionEventConnected is emitted when the client is connected to the server
+	ConnectionEventConnected ConnectionEventType = "connected"
+	// ConnectionEventDisconnected is emitted when the connection to the server is closed
+	ConnectionEventDisconnected ConnectionEventType = "disconnected"
+	// ConnectionEventReconnecting is emitted before each reconnection attempt, see WithReconnect
+	ConnectionEventReconnecting ConnectionEventType = "reconnecting"
+	// ConnectionEventPingAdapted is emitted when the ping interval is lowered after a connection was dropped for being
+	// idle, see WithAdaptivePing
+	ConnectionEventPingAdapted ConnectionEventType = "ping-adapted"
+	// ConnectionEventKeepaliveFailed is emitted when the connections are dropped for being idle even with the most
+	// frequent pings, the path to the server is not suitable for long-lived connections, see WithAdaptivePing
+	ConnectionEventKeepaliveFailed ConnectionEventType = "keepalive-failed"
+)
+
+// ConnectionEvent is a connection lifecycle event of the tunnel client
+type ConnectionEvent struct {
+	Type ConnectionEventType
+	// Attempt is the number of the reconnection attempt since the client was connected, starting at 1
+	Attempt int
+	// Backoff is the time the client waits before the reconnection attempt
+	Backoff time.Duration
+	// Err is the reason of the disconnection or of the failure of the previous reconnection attempt, it's nil when the
+	// client was stopped
+	Err error
+	// Idle is the time the dropped connection was idle for, set on the events of WithAdaptivePing
+	Idle time.Duration
+	// PingInterval is the ping interval of the next connections, set on the events of WithAdaptivePing
+	PingInterval time.Duration
+}
+
+func (e ConnectionEvent) String() string {
+	switch e.Type {
+	case ConnectionEventReconnecting:
+		s := fmt.Sprintf("reconnecting in %s (attempt %d)", e.Backoff, e.Attempt)
+		if e.Err != nil {
+			s += ": " + e.Err.Error()
+		}
+		return s
+	case ConnectionEventDisconnected:
+		if e.Err != nil {
+			return "disconnected: " + e.Err.Error()
+		}
+	case ConnectionEventPingAdapted:
+		return fmt.Sprintf("pinging every %s, the connection was dropped after being idle for %s", e.PingInterval, e.Idle.Round(time.Second))
+	case ConnectionEventKeepaliveFailed:
+		if e.Err != nil {
+			return "keepalive failed: " + e.Err.Error()
+		}
+	}
+	return string(e.Type)
+}
+
+// ConnectionEventHandler handles the connection lifecycle events of the tunnel client
+// It's called synchronously by the client, so it must not block.
+type ConnectionEventHandler func(ConnectionEvent)
+
+// WithConnectionEventHandler sets the handler of the connection lifecycle events of the client, e.g. to show the
+// state of the tunnel
+func WithConnectionEventHandler(handler ConnectionEventHandler) ClientConfigOption {
+	return ClientConfigOptionFunc(func(cfg *ClientConfig) {
+		cfg.eventHandler = handler
+	})
+}
+
+// WithReconnect makes the client reconnect to the server when the connection is closed, until the context is
+// cancelled, the attempts are delayed with an exponential backoff from minBackoff to maxBackoff
+// The client doesn't reconnect if it fails to connect in the first place.
+func WithReconnect(minBackoff, maxBackoff time.Duration) ClientConfigOption {
+	return ClientConfigOptionFunc(func(cfg *ClientConfig) {
+		cfg.reconnectEnabled = true
+		cfg.minBackoff = minBackoff
+		cfg.maxBackoff = maxBackoff
+	})
+}
+
+func (cfg ClientConfig) emit(event ConnectionEvent) {
+	if cfg.eventHandler != nil {
+		cfg.eventHandler(event)
+	}
+}
+
+// reconnect dials the server until it succeeds or the context is cancelled
+func (cfg ClientConfig) reconnect(ctx context.Context, reason error) (Conn, error) {
+	backoff := cfg.minBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		cfg.emit(ConnectionEvent{
+			Type:    ConnectionEventReconnecting,
+			Attempt: attempt,
+			Backoff: backoff,
+			Err:     reason,
+		})
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		conn, err := cfg.transport.Dial(ctx, cfg.serverAddr)
+		if err == nil {
+			return conn, nil
+		}
+		cfg.logger.V(1).Info("failed to reconnect to tunnel server", "attempt", attempt, "error", err.Error())
+		reason = err
+		if backoff *= 2; cfg.maxBackoff > 0 && backoff > cfg.maxBackoff {
+			backoff = cfg.maxBackoff
+		}
+	}
+}
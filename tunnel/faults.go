@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// ErrInjectedFault is returned for the requests failed by fault injection
+const ErrInjectedFault = errors.Sentinel("injected fault")
+
+// FaultInjection degrades the requests sent through a round tripper, so the behavior of the callers (e.g. timeouts)
+// can be tested against the real downstream
+type FaultInjection struct {
+	// BytesPerSecond limits the bandwidth of the request and the response bodies in each direction, shared by the
+	// concurrent requests, zero means no limit
+	BytesPerSecond int64
+	// ErrorRate is the ratio (between 0 and 1) of the requests failed with ErrInjectedFault
+	ErrorRate float64
+	// Latency is added to each request before it's sent
+	Latency time.Duration
+}
+
+// Enabled returns whether any fault is injected
+func (fi FaultInjection) Enabled() bool {
+	return fi.BytesPerSecond > 0 || fi.ErrorRate > 0 || fi.Latency > 0
+}
+
+// RoundTripper returns a round tripper injecting the faults into the requests sent through the next one
+func (fi FaultInjection) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	var upLimiter, downLimiter *bandwidthLimiter
+	if fi.BytesPerSecond > 0 {
+		upLimiter = &bandwidthLimiter{bytesPerSecond: fi.BytesPerSecond}
+		downLimiter = &bandwidthLimiter{bytesPerSecond: fi.BytesPerSecond}
+	}
+
+	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if fi.Latency > 0 {
+			if err := sleepContext(r.Context(), fi.Latency); err != nil {
+				return nil, err
+			}
+		}
+		if fi.ErrorRate > 0 && rand.Float64() < fi.ErrorRate {
+			return nil, ErrInjectedFault
+		}
+
+		if upLimiter != nil && r.Body != nil && r.Body != http.NoBody {
+			r.Body = &throttledReadCloser{ReadCloser: r.Body, ctx: r.Context(), limiter: upLimiter}
+		}
+		resp, err := next.RoundTrip(r)
+		if err != nil {
+			return resp, err
+		}
+		if downLimiter != nil {
+			resp.Body = &throttledReadCloser{ReadCloser: resp.Body, ctx: r.Context(), limiter: downLimiter}
+		}
+		return resp, nil
+	})
+}
+
+// bandwidthLimiter schedules the transfer of the bytes, so they don't exceed the bandwidth
+type bandwidthLimiter struct {
+	mu             sync.Mutex
+	bytesPerSecond int64
+	next           time.Time
+}
+
+// chunkSize is the maximal number of bytes transferred at once, so the transfer is smooth
+func (l *bandwidthLimiter) chunkSize() int {
+	if size := l.bytesPerSecond / 10; size > 0 {
+		return int(size)
+	}
+	return 1
+}
+
+// wait waits until the transfer of n bytes is allowed
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.bytesPerSecond))
+	l.mu.Unlock()
+
+	return sleepContext(ctx, delay)
+}
+
+type throttledReadCloser struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *bandwidthLimiter
+}
+
+func (t *throttledReadCloser) Read(p []byte) (int, error) {
+	if size := t.limiter.chunkSize(); len(p) > size {
+		p = p[:size]
+	}
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := t.limiter.wait(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
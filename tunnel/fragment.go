@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"io"
+	"sync"
+)
+
+// frameFlagMore marks the fragments of a message followed by more fragments, the fragments of a message have the same
+// type and request ID
+const frameFlagMore uint16 = 1 << 0
+
+// minFrameSize is the smallest maximal frame size, so the fragments are not dominated by their headers
+const minFrameSize = 1024
+
+// defaultMaxFrameSize is the maximal frame size unless configured otherwise, the fragments of the messages written
+// concurrently are interleaved, so it limits the time a message waits for the others
+const defaultMaxFrameSize = 64 * 1024
+
+// normalizeMaxFrameSize returns the maximal frame size to use for the configured one, zero means the default
+func normalizeMaxFrameSize(size int) int {
+	if size <= 0 {
+		return defaultMaxFrameSize
+	}
+	if size < minFrameSize {
+		return minFrameSize
+	}
+	return size
+}
+
+// newFrameWriter returns the writer of a message of the type, the message is split into fragments of at most
+// maxFrameSize bytes (including the headers) if it's positive
+func newFrameWriter(conn Conn, typ frameType, reqID requestID, maxFrameSize int) (io.WriteCloser, error) {
+	if maxFrameSize <= 0 {
+		wc, err := conn.NextWriter()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFrameHeader(wc, typ, 0, reqID); err != nil {
+			_ = wc.Close()
+			return nil, err
+		}
+		return wc, nil
+	}
+
+	maxPayload := maxFrameSize - frameHeaderSize
+	return &fragmentWriter{
+		buf:        make([]byte, 0, maxPayload),
+		conn:       conn,
+		maxPayload: maxPayload,
+		reqID:      reqID,
+		typ:        typ,
+	}, nil
+}
+
+// fragmentWriter buffers the payload of a fragment, and sends it once it's full and more data is written, or the
+// writer is closed
+type fragmentWriter struct {
+	buf        []byte
+	conn       Conn
+	maxPayload int
+	reqID      requestID
+	typ        frameType
+}
+
+func (w *fragmentWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == w.maxPayload {
+			// more data follows, so the buffered fragment is not the last one
+			if err := w.writeFragment(frameFlagMore); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):w.maxPayload], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *fragmentWriter) Close() error {
+	return w.writeFragment(0)
+}
+
+func (w *fragmentWriter) writeFragment(flags uint16) error {
+	wc, err := w.conn.NextWriter()
+	if err != nil {
+		return err
+	}
+	if err := writeFrameHeader(wc, w.typ, flags, w.reqID); err != nil {
+		_ = wc.Close()
+		return err
+	}
+	if _, err := wc.Write(w.buf); err != nil {
+		_ = wc.Close()
+		return err
+	}
+	w.buf = w.buf[:0]
+	return wc.Close()
+}
+
+// reassembler collects the fragments of the messages split by the peer
+type reassembler struct {
+	mutex   sync.Mutex
+	pending map[requestID]*message
+}
+
+// add adds the rest of the frame to the message of the request, and returns the message once it's complete
+// The frame is released or becomes part of the returned message.
+func (r *reassembler) add(header frameHeader, frame *message) (*message, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	pending, found := r.pending[header.RequestID]
+	if !found {
+		if header.Flags&frameFlagMore == 0 {
+			return frame, true
+		}
+		if r.pending == nil {
+			r.pending = make(map[requestID]*message)
+		}
+		r.pending[header.RequestID] = frame
+		return nil, false
+	}
+
+	_, _ = frame.WriteTo(pending.Buffer)
+	frame.release()
+	if header.Flags&frameFlagMore != 0 {
+		return nil, false
+	}
+	delete(r.pending, header.RequestID)
+	return pending, true
+}
+
+// drop drops the fragments of the request received so far
+func (r *reassembler) drop(id requestID) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if pending, found := r.pending[id]; found {
+		delete(r.pending, id)
+		pending.release()
+	}
+}
+
+// releaseAll drops the fragments of all requests, when the connection is closed
+func (r *reassembler) releaseAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, pending := range r.pending {
+		delete(r.pending, id)
+		pending.release()
+	}
+}
@@ -0,0 +1,128 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// frameVersion is the version of the frame envelope, the frames of other versions are dropped by the receivers
+// The versions are never multiples of 8, see isLegacyFrame.
+const frameVersion uint8 = 1
+
+// frameHeaderSize is the size of the encoded frame header
+const frameHeaderSize = 12
+
+// frameType is the type of the messages sent through the tunnel, the frames of unknown types are dropped by the
+// receivers, so new types can be added without breaking older peers
+type frameType uint8
+
+const (
+	// frameTypeRequest is sent by the server, its body is the HTTP/1.1 serialization of the request
+	frameTypeRequest frameType = 1
+	// frameTypeResponse is sent by the client, its body is the HTTP/1.1 serialization of the response
+	frameTypeResponse frameType = 2
+	// frameTypeCancel is sent by the server when the request is cancelled (e.g. the caller disconnected), so the client
+	// aborts the downstream request, it has no body
+	frameTypeCancel frameType = 3
+	// frameTypeSession is sent by the client first on each connection of a resumable session, its body is the session
+	// ID, see WithSessionGracePeriod
+	frameTypeSession frameType = 4
+	// frameTypeHealth is sent by the client first on each connection and whenever the health of its downstream changes,
+	// its body is 1 if the downstream is healthy, 0 otherwise, see WithDownstreamHealth
+	frameTypeHealth frameType = 5
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameTypeRequest:
+		return "request"
+	case frameTypeResponse:
+		return "response"
+	case frameTypeCancel:
+		return "cancel"
+	case frameTypeSession:
+		return "session"
+	case frameTypeHealth:
+		return "health"
+	default:
+		return "unknown"
+	}
+}
+
+// frameHeader is the envelope of the messages sent through the tunnel, followed by the body of the frame
+// It's encoded as the version (1 byte), the type (1 byte), the flags (2 bytes) and the request ID (8 bytes) in network
+// byte order.
+type frameHeader struct {
+	Version uint8
+	Type    frameType
+	// Flags modify the handling of the frame depending on its type, the unknown ones are ignored
+	Flags     uint16
+	RequestID requestID
+}
+
+// isLegacyFrame returns whether the message was sent by a server before the frame envelope, those start with the
+// little endian request ID, which is the address of the request, so the first byte is a multiple of 8
+func isLegacyFrame(msg []byte) bool {
+	return len(msg) > 0 && msg[0]%8 == 0
+}
+
+func writeFrameHeader(w io.Writer, typ frameType, flags uint16, reqID requestID) error {
+	var buf [frameHeaderSize]byte
+	buf[0] = frameVersion
+	buf[1] = uint8(typ)
+	binary.BigEndian.PutUint16(buf[2:4], flags)
+	binary.BigEndian.PutUint64(buf[4:12], reqID)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readFrameHeader(r io.Reader) (header frameHeader, err error) {
+	var buf [frameHeaderSize]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		return
+	}
+	header.Version = buf[0]
+	header.Type = frameType(buf[1])
+	header.Flags = binary.BigEndian.Uint16(buf[2:4])
+	header.RequestID = binary.BigEndian.Uint64(buf[4:12])
+	return
+}
+
+// requestTimeoutHeader carries the time left until the deadline of the request in milliseconds, so the client applies
+// the same deadline to the downstream request
+// The time left is sent instead of the deadline, so the clocks of the server and the client may differ. The client
+// removes the header before sending the request downstream.
+const requestTimeoutHeader = "X-Kurun-Request-Timeout"
+
+// withRequestTimeout returns the request with the time left until its deadline in requestTimeoutHeader, the header
+// sent by the caller is removed
+func withRequestTimeout(r *http.Request) *http.Request {
+	deadline, hasDeadline := r.Context().Deadline()
+	if !hasDeadline && r.Header.Get(requestTimeoutHeader) == "" {
+		return r
+	}
+	r = r.Clone(r.Context())
+	r.Header.Del(requestTimeoutHeader)
+	if hasDeadline {
+		timeout := time.Until(deadline).Milliseconds()
+		if timeout < 1 {
+			timeout = 1
+		}
+		r.Header.Set(requestTimeoutHeader, strconv.FormatInt(timeout, 10))
+	}
+	return r
+}
+
+// requestContext returns the context of the request received by the client with the timeout sent by the server
+func requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	value := r.Header.Get(requestTimeoutHeader)
+	r.Header.Del(requestTimeoutHeader)
+	if timeout, err := strconv.ParseInt(value, 10, 64); err == nil && timeout > 0 {
+		return context.WithTimeout(r.Context(), time.Duration(timeout)*time.Millisecond)
+	}
+	return context.WithCancel(r.Context())
+}
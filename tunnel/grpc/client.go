@@ -0,0 +1,77 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+func NewClientConfig(serverAddr string, roundTripper http.RoundTripper, options ...ClientConfigOption) *ClientConfig {
+	c := &ClientConfig{
+		logger:       logr.Discard(),
+		roundTripper: roundTripper,
+		serverAddr:   serverAddr,
+	}
+	for _, opt := range options {
+		if opt != nil {
+			opt.ApplyToClientConfig(c)
+		}
+	}
+	return c
+}
+
+type ClientConfig struct {
+	clientOptions []tunnel.ClientConfigOption
+	logger        logr.Logger
+	roundTripper  http.RoundTripper
+	// serverAddr is the gRPC target of the server, e.g. host:port
+	serverAddr string
+	tlsConfig  *tls.Config
+	token      string
+}
+
+type ClientConfigOption interface {
+	ApplyToClientConfig(*ClientConfig)
+}
+
+type ClientConfigOptionFunc func(cfg *ClientConfig)
+
+func (opt ClientConfigOptionFunc) ApplyToClientConfig(c *ClientConfig) {
+	opt(c)
+}
+
+// WithTLSConfig secures the connection to the server, it's not encrypted without it
+func WithTLSConfig(tlsConfig *tls.Config) ClientConfigOption {
+	return ClientConfigOptionFunc(func(cfg *ClientConfig) {
+		cfg.tlsConfig = tlsConfig
+	})
+}
+
+// WithConnectionEventHandler sets the handler of the connection lifecycle events, see tunnel.WithConnectionEventHandler
+func WithConnectionEventHandler(handler tunnel.ConnectionEventHandler) ClientConfigOption {
+	return ClientConfigOptionFunc(func(cfg *ClientConfig) {
+		cfg.clientOptions = append(cfg.clientOptions, tunnel.WithConnectionEventHandler(handler))
+	})
+}
+
+// WithReconnect makes the client reconnect when the connection is closed, see tunnel.WithReconnect
+func WithReconnect(minBackoff, maxBackoff time.Duration) ClientConfigOption {
+	return ClientConfigOptionFunc(func(cfg *ClientConfig) {
+		cfg.clientOptions = append(cfg.clientOptions, tunnel.WithReconnect(minBackoff, maxBackoff))
+	})
+}
+
+// RunClient runs a tunnel client connected to the server with the gRPC transport, see tunnel.RunClient
+func RunClient(ctx context.Context, cfg ClientConfig) error {
+	transport := Transport{
+		TLSConfig: cfg.tlsConfig,
+		Token:     cfg.token,
+	}
+	options := append(cfg.clientOptions[:len(cfg.clientOptions):len(cfg.clientOptions)], tunnel.WithLogger(cfg.logger), tunnel.WithTransport(transport))
+	return tunnel.RunClient(ctx, *tunnel.NewClientConfig(cfg.serverAddr, cfg.roundTripper, options...))
+}
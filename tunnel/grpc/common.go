@@ -0,0 +1,39 @@
+package grpc
+
+import (
+	"github.com/go-logr/logr"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+// TokenMetadataKey is the key of the metadata of the streams carrying the token of the tunnel clients
+const TokenMetadataKey = "kurun-tunnel-token"
+
+type WithLogger logr.Logger
+
+func (opt WithLogger) ApplyToClientConfig(c *ClientConfig) {
+	c.logger = logr.Logger(opt)
+}
+
+func (opt WithLogger) ApplyToServer(s *Server) {
+	s.logger = logr.Logger(opt)
+}
+
+// WithMaxFrameSize sets the maximal size of the frames sent by a tunnel client, see tunnel.WithMaxFrameSize
+// The frames of the server are set on the tunnel server, which is shared by the transports.
+type WithMaxFrameSize int
+
+func (opt WithMaxFrameSize) ApplyToClientConfig(c *ClientConfig) {
+	c.clientOptions = append(c.clientOptions, tunnel.WithMaxFrameSize(opt))
+}
+
+// WithToken is the token the tunnel clients authenticate with, the server accepts any client without it
+type WithToken string
+
+func (opt WithToken) ApplyToClientConfig(c *ClientConfig) {
+	c.token = string(opt)
+}
+
+func (opt WithToken) ApplyToServer(s *Server) {
+	s.token = string(opt)
+}
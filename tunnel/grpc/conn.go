@@ -0,0 +1,165 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	"github.com/banzaicloud/kurun/tunnel/connector"
+)
+
+// closeTimeout limits the time spent on sending the close frame to the peer
+const closeTimeout = 5 * time.Second
+
+// Transport dials the tunnel servers with gRPC, the addresses are gRPC targets, e.g. host:port
+type Transport struct {
+	// DialOptions are added to the options of the connections, e.g. keepalive parameters
+	DialOptions []grpc.DialOption
+	// TLSConfig secures the connections, they are not encrypted if it's nil
+	TLSConfig *tls.Config
+	// Token is sent in the metadata of the streams, for servers requiring it
+	Token string
+}
+
+func (t Transport) Dial(ctx context.Context, addr string) (tunnel.Conn, error) {
+	creds := insecure.NewCredentials()
+	if t.TLSConfig != nil {
+		creds = credentials.NewTLS(t.TLSConfig.Clone())
+	}
+	// the connection is established by the stream, which fails right away if the server can't be reached
+	options := append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, t.DialOptions...)
+	clientConn, err := grpc.DialContext(ctx, addr, options...)
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to dial tunnel server", "addr", addr)
+	}
+
+	// the stream outlives the context of dialing, it's cancelled when the connection is closed
+	streamCtx, cancel := context.WithCancel(context.Background())
+	if t.Token != "" {
+		streamCtx = metadata.AppendToOutgoingContext(streamCtx, TokenMetadataKey, t.Token)
+	}
+	stream, err := connector.NewConnectorClient(clientConn).Connect(streamCtx)
+	if err != nil {
+		cancel()
+		_ = clientConn.Close()
+		return nil, errors.WrapIfWithDetails(err, "failed to connect to tunnel server", "addr", addr)
+	}
+
+	return newConn(stream, func() {
+		_ = stream.CloseSend()
+		cancel()
+		_ = clientConn.Close()
+	}), nil
+}
+
+// frameStream is implemented by the client and the server streams of the Connector service
+type frameStream interface {
+	Send(*connector.Frame) error
+	Recv() (*connector.Frame, error)
+}
+
+// newConn returns the tunnel connection of the stream, closeStream ends the stream (once)
+func newConn(stream frameStream, closeStream func()) *conn {
+	var once sync.Once
+	return &conn{
+		closeStream: func() { once.Do(closeStream) },
+		stream:      stream,
+	}
+}
+
+// conn sends the messages of the tunnel in data frames
+type conn struct {
+	closeStream func()
+	stream      frameStream
+
+	// writeMu serializes the frames and guards closed, so nothing is sent on a closed stream
+	writeMu sync.Mutex
+	closed  bool
+}
+
+func (c *conn) NextReader() (io.Reader, error) {
+	for {
+		frame, err := c.stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) || status.Code(err) == codes.Canceled {
+				return nil, errors.WithStack(&tunnel.ConnClosedError{})
+			}
+			return nil, err
+		}
+		switch kind := frame.Kind.(type) {
+		case *connector.Frame_Data:
+			return bytes.NewReader(kind.Data), nil
+		case *connector.Frame_Ping:
+			continue
+		case *connector.Frame_Close:
+			return nil, errors.WithStack(&tunnel.ConnClosedError{Reason: kind.Close.GetReason()})
+		default:
+			return nil, errors.Errorf("unexpected frame kind %T", kind)
+		}
+	}
+}
+
+func (c *conn) NextWriter() (io.WriteCloser, error) {
+	return &messageWriter{conn: c, buffer: &bytes.Buffer{}}, nil
+}
+
+func (c *conn) Ping() error {
+	return c.send(&connector.Frame{Kind: &connector.Frame_Ping{Ping: &connector.Ping{}}})
+}
+
+func (c *conn) Close(reason string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	// ending the stream unblocks the close frame if the peer doesn't receive it in time
+	timer := time.AfterFunc(closeTimeout, c.closeStream)
+	defer timer.Stop()
+	err := c.stream.Send(&connector.Frame{Kind: &connector.Frame_Close{Close: &connector.Close{Reason: reason}}})
+	c.closeStream()
+	return err
+}
+
+func (c *conn) send(frame *connector.Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return errors.New("connection closed")
+	}
+	return c.stream.Send(frame)
+}
+
+type messageWriter struct {
+	conn   *conn
+	buffer *bytes.Buffer
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.buffer == nil {
+		return 0, errors.New("write to closed message writer")
+	}
+	return w.buffer.Write(p)
+}
+
+func (w *messageWriter) Close() error {
+	if w.buffer == nil {
+		return nil
+	}
+	data := w.buffer.Bytes()
+	w.buffer = nil
+	return w.conn.send(&connector.Frame{Kind: &connector.Frame_Data{Data: data}})
+}
@@ -0,0 +1,110 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	"github.com/banzaicloud/kurun/tunnel/connector"
+)
+
+// startTunnel starts a tunnel server accepting the clients with gRPC on a loopback port, and returns its address
+func startTunnel(t *testing.T, tunnelServer *tunnel.Server, options ...ServerOption) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer()
+	connector.RegisterConnectorServer(grpcServer, NewServer(tunnelServer, options...))
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+	return listener.Addr().String()
+}
+
+func TestTransport(t *testing.T) {
+	tunnelServer := tunnel.NewServer()
+	addr := startTunnel(t, tunnelServer, WithToken("secret"))
+
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	roundTripper := tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Proto:         req.Proto,
+			ProtoMajor:    req.ProtoMajor,
+			ProtoMinor:    req.ProtoMinor,
+			Header:        http.Header{"X-Path": []string{req.URL.Path}},
+			Body:          io.NopCloser(bytes.NewReader(append(body, data...))),
+			ContentLength: int64(len(body) + len(data)),
+		}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- RunClient(ctx, *NewClientConfig(addr, roundTripper, WithToken("secret")))
+	}()
+
+	// the request waits for the client to connect
+	req, err := http.NewRequest(http.MethodPost, "/path", bytes.NewReader([]byte("request")))
+	require.NoError(t, err)
+	resp, err := tunnelServer.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "/path", resp.Header.Get("X-Path"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte("request"), data...), body)
+	require.Equal(t, 1, tunnelServer.ConnectedClients())
+
+	// the client is disconnected with the reason of the server once it's shut down
+	tunnelServer.Shutdown()
+	select {
+	case err := <-clientErr:
+		var closeErr *tunnel.ConnClosedError
+		require.ErrorAs(t, err, &closeErr)
+		require.NotEmpty(t, closeErr.Reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel client not disconnected")
+	}
+}
+
+func TestTransportInvalidToken(t *testing.T) {
+	addr := startTunnel(t, tunnel.NewServer(), WithToken("secret"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, token := range []string{"", "invalid"} {
+		err := RunClient(ctx, *NewClientConfig(addr, http.DefaultTransport, WithToken(token)))
+		require.Error(t, err, token)
+		require.Contains(t, err.Error(), "invalid tunnel token", token)
+	}
+}
+
+func TestTransportUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = Transport{}.Dial(ctx, addr)
+	require.Error(t, err)
+	require.NoError(t, ctx.Err(), "the dial should fail right away")
+}
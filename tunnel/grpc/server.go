@@ -0,0 +1,88 @@
+// Package grpc implements a transport of the tunnel over the bidirectional streams of the Connector gRPC service, for
+// tunnel servers exposed directly (e.g. by a LoadBalancer), where HTTP/2 does the flow control and the multiplexing of
+// the connections instead of the WebSocket framing
+// The messages of the tunnel are sent in the data frames of the streams.
+package grpc
+
+import (
+	"context"
+	"crypto/subtle"
+
+	"github.com/go-logr/logr"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	"github.com/banzaicloud/kurun/tunnel/connector"
+)
+
+// NewServer returns the Connector service passing the connections of the clients to the tunnel server, register it
+// on a gRPC server with connector.RegisterConnectorServer
+func NewServer(tunnelServer *tunnel.Server, options ...ServerOption) *Server {
+	s := &Server{
+		logger:       logr.Discard(),
+		tunnelServer: tunnelServer,
+	}
+	for _, opt := range options {
+		if opt != nil {
+			opt.ApplyToServer(s)
+		}
+	}
+	return s
+}
+
+// Server implements the Connector service, accepting the connections of the clients of a tunnel server
+type Server struct {
+	connector.UnimplementedConnectorServer
+
+	logger       logr.Logger
+	token        string
+	tunnelServer *tunnel.Server
+}
+
+// Connect serves the stream of a client until either side closes it
+// The stream ends when the handler returns, so it returns once the tunnel server closes the connection, while the
+// tunnel server finishes serving it in the background.
+func (s *Server) Connect(stream connector.Connector_ConnectServer) error {
+	if err := s.authenticate(stream.Context()); err != nil {
+		return err
+	}
+	s.logger.Info("connection received")
+
+	closed := make(chan struct{})
+	c := newConn(stream, func() { close(closed) })
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s.tunnelServer.ServeConn(c)
+	}()
+	select {
+	case <-closed:
+	case <-served:
+	}
+	return nil
+}
+
+func (s *Server) authenticate(ctx context.Context) error {
+	if s.token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, token := range md.Get(TokenMetadataKey) {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid tunnel token")
+}
+
+type ServerOption interface {
+	ApplyToServer(*Server)
+}
+
+type ServerOptionFunc func(*Server)
+
+func (opt ServerOptionFunc) ApplyToServer(s *Server) {
+	opt(s)
+}
@@ -0,0 +1,224 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// DownstreamHealthCheck configures the health checks of the downstream of a tunnel client, see
+// NewDownstreamHealthChecker
+type DownstreamHealthCheck struct {
+	// Interval is the time between the checks, 10 seconds by default
+	Interval time.Duration
+	// Path is the path of the health check requests, e.g. /healthz, the downstream is healthy if it responds with a
+	// status code below 400
+	Path string
+	// Standby is the round tripper of the standby downstream the requests are sent to while the primary one is
+	// unhealthy, it's checked the same way
+	Standby http.RoundTripper
+	// Timeout is the time the downstream has to respond to a check in, 2 seconds by default
+	Timeout time.Duration
+}
+
+// DownstreamHealth is the result of the latest health checks of the downstream
+type DownstreamHealth struct {
+	// Checked is the time of the latest check, zero before the first one
+	Checked time.Time
+	// Error is the reason of the primary downstream being unhealthy
+	Error string
+	// PrimaryHealthy is whether the primary downstream passed the latest check, it's assumed before the first one
+	PrimaryHealthy bool
+	// Standby is whether the requests are sent to the standby downstream, as the primary one is unhealthy, and the
+	// standby one passed the latest check
+	Standby bool
+}
+
+// Healthy returns whether the requests are sent to a healthy downstream
+func (h DownstreamHealth) Healthy() bool {
+	return h.PrimaryHealthy || h.Standby
+}
+
+// DownstreamHealthChecker checks the health of the downstream periodically, sends the requests to the standby
+// downstream (if any) while the primary one is unhealthy, and reports the health to the tunnel server through the
+// client (see WithDownstreamHealth)
+type DownstreamHealthChecker struct {
+	config  DownstreamHealthCheck
+	primary http.RoundTripper
+
+	mutex sync.Mutex
+	// changed is closed and replaced when the health changes
+	changed chan struct{}
+	health  DownstreamHealth
+}
+
+// NewDownstreamHealthChecker returns a health checker of the primary downstream, it checks the downstreams once Run
+func NewDownstreamHealthChecker(config DownstreamHealthCheck, primary http.RoundTripper) *DownstreamHealthChecker {
+	if config.Interval <= 0 {
+		config.Interval = defaultHealthCheckInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultHealthCheckTimeout
+	}
+	return &DownstreamHealthChecker{
+		config:  config,
+		primary: primary,
+		changed: make(chan struct{}),
+		health: DownstreamHealth{
+			PrimaryHealthy: true,
+		},
+	}
+}
+
+// Run checks the downstreams until the context is cancelled
+func (c *DownstreamHealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Health returns the result of the latest checks
+func (c *DownstreamHealthChecker) Health() DownstreamHealth {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.health
+}
+
+// Changed returns a channel closed when the health (or the downstream the requests are sent to) changes
+func (c *DownstreamHealthChecker) Changed() <-chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.changed
+}
+
+// RoundTrip sends the request to the primary downstream, or to the standby one while the primary one is unhealthy
+func (c *DownstreamHealthChecker) RoundTrip(r *http.Request) (*http.Response, error) {
+	if c.Health().Standby {
+		return c.config.Standby.RoundTrip(r)
+	}
+	return c.primary.RoundTrip(r)
+}
+
+func (c *DownstreamHealthChecker) check(ctx context.Context) {
+	health := DownstreamHealth{
+		Checked:        time.Now(),
+		PrimaryHealthy: true,
+	}
+	if err := c.checkDownstream(ctx, c.primary); err != nil {
+		health.PrimaryHealthy = false
+		health.Error = err.Error()
+		if c.config.Standby != nil {
+			health.Standby = c.checkDownstream(ctx, c.config.Standby) == nil
+		}
+	}
+	if ctx.Err() != nil {
+		return // the checks of the stopped client are not reported
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if health.Healthy() != c.health.Healthy() || health.Standby != c.health.Standby {
+		close(c.changed)
+		c.changed = make(chan struct{})
+	}
+	c.health = health
+}
+
+func (c *DownstreamHealthChecker) checkDownstream(ctx context.Context, roundTripper http.RoundTripper) error {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.config.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := roundTripper.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("health check responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// WithDownstreamHealth reports the health of the downstream checked by the checker to the server, see
+// Server.DownstreamHealthy
+func WithDownstreamHealth(checker *DownstreamHealthChecker) ClientConfigOption {
+	return ClientConfigOptionFunc(func(cfg *ClientConfig) {
+		cfg.downstreamHealth = checker
+	})
+}
+
+// reportHealthLoop sends the health of the downstream to the server on the connection, and again whenever it changes
+func (c *client) reportHealthLoop(checker *DownstreamHealthChecker) error {
+	for {
+		changed := checker.Changed()
+		if err := c.writeHealth(checker.Health().Healthy()); err != nil {
+			return errors.WrapIf(err, "failed to send downstream health")
+		}
+		select {
+		case <-c.wp.Closing():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+func (c *client) writeHealth(healthy bool) error {
+	w, err := newFrameWriter(c.conn, frameTypeHealth, 0, c.maxFrameSize)
+	if err != nil {
+		return err
+	}
+	body := "0"
+	if healthy {
+		body = "1"
+	}
+	if _, err := io.WriteString(w, body); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	c.touch()
+	return nil
+}
+
+// setDownstreamHealthy records the downstream health reported by the client of the connection in the count of the
+// clients with unhealthy downstreams
+func (c *serverConn) setDownstreamHealthy(healthy bool) {
+	if unhealthy := !healthy; unhealthy != c.downstreamUnhealthy {
+		c.downstreamUnhealthy = unhealthy
+		if unhealthy {
+			atomic.AddInt32(c.unhealthyClients, 1)
+		} else {
+			atomic.AddInt32(c.unhealthyClients, -1)
+		}
+	}
+}
+
+// DownstreamHealthy returns false when tunnel clients are connected, but all of them report their downstreams
+// unhealthy (see WithDownstreamHealth), e.g. for readiness checks
+func (s *Server) DownstreamHealthy() bool {
+	clients := s.ConnectedClients()
+	return clients == 0 || int(atomic.LoadInt32(&s.unhealthyClients)) < clients
+}
@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// idleDropThreshold is the time a connection has to be idle for when it's dropped to consider the idle timeout of the
+// path to the server the reason, the connections dropped sooner were dropped while sending or receiving messages
+const idleDropThreshold = time.Second
+
+// keepaliveFailedDrops is the number of consecutive connections dropped after being idle for less than twice the
+// minimal ping interval, after which the keepalive is reported to fail
+const keepaliveFailedDrops = 2
+
+// WithAdaptivePing makes the client adapt its ping interval to the idle timeout of the path to the server, e.g. of a
+// load balancer in front of the API server proxying the connections: when a connection is dropped after being idle
+// for a while, the next connections ping the server twice as often, but at most every minInterval and at least every
+// maxInterval (if it's positive)
+// The ping interval set with WithPingInterval is the initial one, the client doesn't ping until the first idle drop
+// without it. ConnectionEventPingAdapted is emitted when the interval is changed, and ConnectionEventKeepaliveFailed
+// when the connections are dropped even with pings every minInterval.
+func WithAdaptivePing(minInterval, maxInterval time.Duration) ClientConfigOption {
+	return ClientConfigOptionFunc(func(cfg *ClientConfig) {
+		cfg.pingTuner = &pingTuner{
+			maxInterval: maxInterval,
+			minInterval: minInterval,
+		}
+	})
+}
+
+// pingTuner adapts the ping interval of the connections of a client to the time they are dropped after being idle
+type pingTuner struct {
+	maxInterval time.Duration
+	minInterval time.Duration
+	// shortDrops is the number of consecutive connections dropped after being idle for less than twice minInterval
+	shortDrops int
+}
+
+// adapt returns the ping interval of the next connection after the previous one pinging with the current interval was
+// dropped after being idle for the specified time, and the event to emit about it if any
+func (t *pingTuner) adapt(current, idle time.Duration) (time.Duration, *ConnectionEvent) {
+	if idle < idleDropThreshold {
+		return current, nil
+	}
+
+	interval := idle / 2
+	if t.maxInterval > 0 && interval > t.maxInterval {
+		interval = t.maxInterval
+	}
+	if interval < t.minInterval {
+		interval = t.minInterval
+		if t.shortDrops++; t.shortDrops == keepaliveFailedDrops {
+			return interval, &ConnectionEvent{
+				Type:         ConnectionEventKeepaliveFailed,
+				Idle:         idle,
+				PingInterval: interval,
+				Err:          errors.Errorf("connections are dropped after being idle for %s, pinging every %s can't keep them alive", idle.Round(time.Second), interval),
+			}
+		}
+	} else {
+		t.shortDrops = 0
+	}
+
+	if current > 0 && interval >= current {
+		return current, nil
+	}
+	return interval, &ConnectionEvent{
+		Type:         ConnectionEventPingAdapted,
+		Idle:         idle,
+		PingInterval: interval,
+	}
+}
@@ -0,0 +1,51 @@
+package memory
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+// connectTimeout limits the time StartTunnel waits for the client to connect
+const connectTimeout = 5 * time.Second
+
+// StartTunnel starts a tunnel server with a client connected to it in memory, the requests sent to the returned
+// server are handled by the round tripper of the client
+// The client and the server are stopped when the test ends.
+func StartTunnel(tb testing.TB, roundTripper http.RoundTripper, options ...tunnel.ServerOption) *tunnel.Server {
+	tb.Helper()
+
+	server := tunnel.NewServer(options...)
+	ctx, cancel := context.WithCancel(context.Background())
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- tunnel.RunClient(ctx, *tunnel.NewClientConfig("memory", roundTripper, tunnel.WithTransport(Transport{Server: server})))
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		if err := <-clientErr; err != nil {
+			tb.Errorf("tunnel client failed: %v", err)
+		}
+		server.Shutdown()
+	})
+
+	WaitForClients(tb, server, 1)
+	return server
+}
+
+// WaitForClients waits until the number of clients connected to the server reaches n, and fails the test if it
+// doesn't in time
+func WaitForClients(tb testing.TB, server *tunnel.Server, n int) {
+	tb.Helper()
+
+	deadline := time.Now().Add(connectTimeout)
+	for server.ConnectedClients() < n {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for %d tunnel clients, %d connected", n, server.ConnectedClients())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,215 @@
+// Package memory implements an in-memory transport of the tunnel, so the integrations of the tunnel can be tested
+// without binding ports or running WebSocket servers
+package memory
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+// closeTimeout limits the time spent on sending the close frame to the peer
+const closeTimeout = 5 * time.Second
+
+// maxChunkSize limits the size of the data frames, the messages are split into frames of this size at most
+const maxChunkSize = 64 * 1024
+
+// frame types of the connections, each frame has a 1 byte type and a 4 bytes payload length header
+const (
+	frameData  byte = iota // a chunk of the current message
+	frameEnd               // the end of the current message
+	framePing              // a keepalive message, ignored by the peer
+	frameClose             // the close reason of the peer
+)
+
+// Transport connects the tunnel clients to the tunnel server in memory, the address is ignored
+type Transport struct {
+	Server *tunnel.Server
+}
+
+func (t Transport) Dial(ctx context.Context, addr string) (tunnel.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	serverConn, clientConn := Pipe()
+	go t.Server.ServeConn(serverConn)
+	return clientConn, nil
+}
+
+// Pipe returns the two ends of an in-memory tunnel connection based on net.Pipe
+func Pipe() (tunnel.Conn, tunnel.Conn) {
+	c1, c2 := net.Pipe()
+	return NewConn(c1), NewConn(c2)
+}
+
+// NewConn returns a tunnel connection framing the messages on the network connection
+// Both ends of the network connection must be wrapped with NewConn.
+func NewConn(netConn net.Conn) tunnel.Conn {
+	return &conn{
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+	}
+}
+
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	current *messageReader
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+}
+
+func (c *conn) NextReader() (io.Reader, error) {
+	// skip the rest of the previous message, so the next frame is the start of a new one
+	if c.current != nil {
+		if _, err := io.Copy(io.Discard, c.current); err != nil {
+			return nil, err
+		}
+		c.current = nil
+	}
+
+	for {
+		typ, length, err := c.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case frameData, frameEnd:
+			c.current = &messageReader{conn: c, remaining: length, ended: typ == frameEnd}
+			return c.current, nil
+		case framePing:
+			continue
+		default:
+			return nil, errors.Errorf("unexpected frame type %d", typ)
+		}
+	}
+}
+
+// readHeader reads the header of the next frame, and returns the close frames as errors
+func (c *conn) readHeader() (byte, uint32, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+			return 0, 0, errors.WithStack(&tunnel.ConnClosedError{})
+		}
+		return 0, 0, err
+	}
+	typ, length := header[0], binary.BigEndian.Uint32(header[1:])
+	if typ == frameClose {
+		reason := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, reason); err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, errors.WithStack(&tunnel.ConnClosedError{Reason: string(reason)})
+	}
+	return typ, length, nil
+}
+
+func (c *conn) NextWriter() (io.WriteCloser, error) {
+	return &messageWriter{conn: c}, nil
+}
+
+func (c *conn) Ping() error {
+	return c.writeFrame(framePing, nil)
+}
+
+func (c *conn) Close(reason string) error {
+	_ = c.netConn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	err := c.writeFrame(frameClose, []byte(reason))
+	return errors.Combine(err, c.netConn.Close())
+}
+
+func (c *conn) writeFrame(typ byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := c.writer.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(payload); err != nil {
+		return err
+	}
+	if typ == frameData {
+		return nil // flushed at the end of the message or when the buffer is full
+	}
+	return c.writer.Flush()
+}
+
+type messageReader struct {
+	conn      *conn
+	remaining uint32
+	ended     bool
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.ended {
+			return 0, io.EOF
+		}
+		typ, length, err := r.conn.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch typ {
+		case frameData:
+			r.remaining = length
+		case frameEnd:
+			r.ended = true
+		case framePing:
+		default:
+			return 0, errors.Errorf("unexpected frame type %d", typ)
+		}
+	}
+
+	if uint32(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.conn.reader.Read(p)
+	r.remaining -= uint32(n)
+	return n, err
+}
+
+type messageWriter struct {
+	conn   *conn
+	closed bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed message writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxChunkSize {
+			chunk = chunk[:maxChunkSize]
+		}
+		if err := w.conn.writeFrame(frameData, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.conn.writeFrame(frameEnd, nil)
+}
@@ -0,0 +1,797 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+func TestStartTunnel(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+
+	server := StartTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Proto:         req.Proto,
+			ProtoMajor:    req.ProtoMajor,
+			ProtoMinor:    req.ProtoMinor,
+			Header:        http.Header{"X-Path": []string{req.URL.Path}},
+			Body:          io.NopCloser(bytes.NewReader(append(body, data...))),
+			ContentLength: int64(len(body) + len(data)),
+		}, nil
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/my/custom/path", strings.NewReader("MyCustomBody"))
+	require.NoError(t, err)
+	resp, err := server.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "/my/custom/path", resp.Header.Get("X-Path"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte("MyCustomBody"), data...), body)
+}
+
+func TestRequestCancellation(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	server := StartTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		close(started)
+		select {
+		case <-req.Context().Done():
+			close(cancelled)
+			return nil, req.Context().Err()
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("request not cancelled")
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	require.NoError(t, err)
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err = server.RoundTrip(req)
+	require.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("downstream request not cancelled")
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	server := StartTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		deadline, ok := req.Context().Deadline()
+		if !ok {
+			return nil, errors.New("no deadline")
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     req.Header.Clone(),
+			Body:       io.NopCloser(strings.NewReader(time.Until(deadline).String())),
+		}, nil
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	require.NoError(t, err)
+	resp, err := server.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("X-Kurun-Request-Timeout"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	timeout, err := time.ParseDuration(string(body))
+	require.NoError(t, err)
+	require.InDelta(t, 3*time.Second, timeout, float64(time.Second))
+}
+
+func TestFragmentation(t *testing.T) {
+	data := make([]byte, 100*1024)
+	rand.Read(data)
+
+	roundTripper := tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Proto:         req.Proto,
+			ProtoMajor:    req.ProtoMajor,
+			ProtoMinor:    req.ProtoMinor,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+		}, nil
+	})
+	server := tunnel.NewServer(tunnel.WithMaxFrameSize(4096))
+	defer server.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = tunnel.RunClient(ctx, *tunnel.NewClientConfig("memory", roundTripper, tunnel.WithMaxFrameSize(4096), tunnel.WithTransport(Transport{Server: server})))
+	}()
+	WaitForClients(t, server, 1)
+
+	reqCtx, reqCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer reqCancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, "/", bytes.NewReader(data))
+	require.NoError(t, err)
+	resp, err := server.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, data, body)
+}
+
+func TestConcurrentResponses(t *testing.T) {
+	bigBody, bigBodyWriter := io.Pipe()
+	server := StartTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Body:       io.NopCloser(strings.NewReader("small")),
+		}
+		if req.URL.Path == "/big" {
+			resp.Body = bigBody
+		}
+		return resp, nil
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bigReq, err := http.NewRequestWithContext(ctx, http.MethodGet, "/big", nil)
+	require.NoError(t, err)
+	bigResp := make(chan error, 1)
+	go func() {
+		resp, err := server.RoundTrip(bigReq)
+		if err == nil {
+			_, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		bigResp <- err
+	}()
+	// the big response is being written until its body is closed
+	_, err = bigBodyWriter.Write(make([]byte, 256*1024))
+	require.NoError(t, err)
+
+	smallReq, err := http.NewRequestWithContext(ctx, http.MethodGet, "/small", nil)
+	require.NoError(t, err)
+	resp, err := server.RoundTrip(smallReq)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "small", string(body))
+
+	require.NoError(t, bigBodyWriter.Close())
+	require.NoError(t, <-bigResp)
+}
+
+func TestConnectionEvents(t *testing.T) {
+	server := tunnel.NewServer()
+	defer server.Shutdown()
+	serverConns := make(chan tunnel.Conn, 2)
+	transport := tunnel.TransportFunc(func(ctx context.Context, addr string) (tunnel.Conn, error) {
+		serverConn, clientConn := Pipe()
+		serverConns <- serverConn
+		go server.ServeConn(serverConn)
+		return clientConn, nil
+	})
+	events := make(chan tunnel.ConnectionEvent, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- tunnel.RunClient(ctx, *tunnel.NewClientConfig("memory", http.DefaultTransport,
+			tunnel.WithTransport(transport),
+			tunnel.WithReconnect(10*time.Millisecond, 100*time.Millisecond),
+			tunnel.WithConnectionEventHandler(func(event tunnel.ConnectionEvent) {
+				events <- event
+			}),
+		))
+	}()
+
+	nextEvent := func() tunnel.ConnectionEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for connection event")
+			return tunnel.ConnectionEvent{}
+		}
+	}
+	require.Equal(t, tunnel.ConnectionEventConnected, nextEvent().Type)
+
+	require.NoError(t, (<-serverConns).Close("bye"))
+	event := nextEvent()
+	require.Equal(t, tunnel.ConnectionEventDisconnected, event.Type)
+	closeError := new(tunnel.ConnClosedError)
+	require.ErrorAs(t, event.Err, &closeError)
+	require.Equal(t, "bye", closeError.Reason)
+	event = nextEvent()
+	require.Equal(t, tunnel.ConnectionEventReconnecting, event.Type)
+	require.Equal(t, 1, event.Attempt)
+	require.Equal(t, tunnel.ConnectionEventConnected, nextEvent().Type)
+
+	cancel()
+	event = nextEvent()
+	require.Equal(t, tunnel.ConnectionEventDisconnected, event.Type)
+	require.NoError(t, event.Err)
+	require.NoError(t, <-clientErr)
+}
+
+func TestRouter(t *testing.T) {
+	router := tunnel.NewRouter(tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Body:       io.NopCloser(strings.NewReader("downstream")),
+		}, nil
+	}))
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Local", "true")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = io.WriteString(w, "local")
+	})
+	server := StartTunnel(t, router)
+
+	for path, expected := range map[string]string{"/healthz": "local", "/other": "downstream"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+		require.NoError(t, err)
+		resp, err := server.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, expected, string(body), path)
+		if expected == "local" {
+			require.Equal(t, http.StatusAccepted, resp.StatusCode)
+			require.Equal(t, "true", resp.Header.Get("X-Local"))
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	downstream := func(name string) http.RoundTripper {
+		return tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Proto:      req.Proto,
+				ProtoMajor: req.ProtoMajor,
+				ProtoMinor: req.ProtoMinor,
+				Header:     http.Header{"X-Route": req.Header.Values(tunnel.RouteHeader)},
+				Body:       io.NopCloser(strings.NewReader(name)),
+			}, nil
+		})
+	}
+	server := StartTunnel(t, tunnel.NewRouteRoundTripper(downstream("default"), map[string]http.RoundTripper{
+		"webhook": downstream("webhook"),
+	}))
+
+	for route, expected := range map[string]string{"": "default", "webhook": "webhook"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		require.NoError(t, err)
+		// the route set by the caller is overwritten
+		req.Header.Set(tunnel.RouteHeader, "other")
+		resp, err := tunnel.SetRoute(route, server).RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, expected, string(body), route)
+		require.Empty(t, resp.Header.Get("X-Route"), route)
+	}
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	var downstreamRequests int32
+	server := StartTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&downstreamRequests, 1)
+		header := http.Header{}
+		if req.URL.Path == "/static" {
+			header.Set("Cache-Control", "public, max-age=60")
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     header,
+			Body:       io.NopCloser(strings.NewReader("content of " + req.URL.Path)),
+		}, nil
+	}))
+	handler := tunnel.ChainMiddlewares(tunnel.NewRequestHandler(server), tunnel.CacheMiddleware(tunnel.CacheConfig{MaxSize: 1 << 20}))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "content of "+path, rec.Body.String())
+		return rec
+	}
+	require.Equal(t, "miss", get("/static").Header().Get(tunnel.CacheStatusHeader))
+	require.Equal(t, "hit", get("/static").Header().Get(tunnel.CacheStatusHeader))
+	require.Equal(t, "miss", get("/dynamic").Header().Get(tunnel.CacheStatusHeader))
+	require.Equal(t, "miss", get("/dynamic").Header().Get(tunnel.CacheStatusHeader))
+	require.EqualValues(t, 3, atomic.LoadInt32(&downstreamRequests))
+}
+
+func TestOfflineQueue(t *testing.T) {
+	server := tunnel.NewServer(tunnel.WithOfflineQueue(tunnel.OfflineQueueConfig{MaxSize: 1024}))
+	defer server.Shutdown()
+
+	for _, event := range []string{"first", "second"} {
+		req, err := http.NewRequest(http.MethodPost, "/hook", strings.NewReader(event))
+		require.NoError(t, err)
+		resp, err := server.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+		require.Equal(t, "true", resp.Header.Get(tunnel.QueuedHeader))
+	}
+	// too big to be queued, it waits for a client instead
+	req, err := http.NewRequest(http.MethodPost, "/hook", bytes.NewReader(make([]byte, 2048)))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = server.RoundTrip(req.WithContext(ctx))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	received := make(chan string, 2)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = tunnel.RunClient(ctx, *tunnel.NewClientConfig("memory", tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			received <- string(body)
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Proto:      req.Proto,
+				ProtoMajor: req.ProtoMajor,
+				ProtoMinor: req.ProtoMinor,
+				Body:       http.NoBody,
+			}, nil
+		}), tunnel.WithTransport(Transport{Server: server})))
+	}()
+
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case body := <-received:
+			require.Equal(t, expected, body)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for queued request")
+		}
+	}
+}
+
+func TestOfflineQueueReplayTimeout(t *testing.T) {
+	server := tunnel.NewServer(tunnel.WithOfflineQueue(tunnel.OfflineQueueConfig{MaxSize: 1024, ReplayTimeout: 100 * time.Millisecond}))
+	defer server.Shutdown()
+
+	for _, path := range []string{"/hang", "/next"} {
+		req, err := http.NewRequest(http.MethodPost, path, strings.NewReader("event"))
+		require.NoError(t, err)
+		resp, err := server.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+
+	// the request hanging in the downstream times out, so the rest of the queue is replayed
+	received := make(chan string, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = tunnel.RunClient(ctx, *tunnel.NewClientConfig("memory", tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/hang" {
+				<-req.Context().Done()
+				received <- req.URL.Path + ": " + req.Context().Err().Error()
+				return nil, req.Context().Err()
+			}
+			received <- req.URL.Path
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Proto:      req.Proto,
+				ProtoMajor: req.ProtoMajor,
+				ProtoMinor: req.ProtoMinor,
+				Body:       http.NoBody,
+			}, nil
+		}), tunnel.WithTransport(Transport{Server: server})))
+	}()
+
+	// the handler of the timed out request may report it after the next one is replayed
+	var paths []string
+	for len(paths) < 2 {
+		select {
+		case path := <-received:
+			paths = append(paths, path)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for queued request")
+		}
+	}
+	require.ElementsMatch(t, []string{"/hang: context deadline exceeded", "/next"}, paths)
+}
+
+func TestCORS(t *testing.T) {
+	var tunneled int32
+	server := StartTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&tunneled, 1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     http.Header{"Access-Control-Allow-Origin": []string{"https://downstream.example.com"}},
+			Body:       http.NoBody,
+		}, nil
+	}))
+	request := func(handler http.Handler, method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	config := tunnel.CORSConfig{AllowCredentials: true, AllowedOrigins: []string{"https://app.example.com"}}
+	require.NoError(t, config.Validate())
+	handler := tunnel.NewRequestHandler(server, tunnel.WithMiddleware(tunnel.CORSMiddleware(config)))
+
+	// the preflight is answered without the tunnel
+	recorder := request(handler, http.MethodOptions, "https://app.example.com")
+	require.Equal(t, http.StatusNoContent, recorder.Code)
+	require.Equal(t, "https://app.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", recorder.Header().Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, int32(0), atomic.LoadInt32(&tunneled))
+
+	recorder = request(handler, http.MethodGet, "https://app.example.com")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "https://app.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", recorder.Header().Get("Access-Control-Allow-Credentials"))
+
+	recorder = request(handler, http.MethodGet, "https://evil.example.com")
+	require.Equal(t, "https://downstream.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, recorder.Header().Get("Access-Control-Allow-Credentials"))
+
+	// credentials are never allowed for any origin
+	config = tunnel.CORSConfig{AllowCredentials: true, AllowedOrigins: []string{"*"}}
+	require.Error(t, config.Validate())
+	handler = tunnel.NewRequestHandler(server, tunnel.WithMiddleware(tunnel.CORSMiddleware(config)))
+	recorder = request(handler, http.MethodGet, "https://evil.example.com")
+	require.Equal(t, "*", recorder.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(t, recorder.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestSplit(t *testing.T) {
+	server := StartTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Body:       io.NopCloser(strings.NewReader("tunnel")),
+		}, nil
+	}))
+	tunnelHandler := tunnel.NewRequestHandler(server)
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "fallback")
+	})
+
+	testCases := map[string]struct {
+		matchers []tunnel.RequestMatcher
+		header   string
+		expected string
+	}{
+		"header match": {
+			matchers: []tunnel.RequestMatcher{tunnel.HeaderMatcher("X-Kurun-Dev", "alice")},
+			header:   "alice",
+			expected: "tunnel",
+		},
+		"header no match": {
+			matchers: []tunnel.RequestMatcher{tunnel.HeaderMatcher("X-Kurun-Dev", "alice")},
+			header:   "bob",
+			expected: "fallback",
+		},
+		"header missing": {
+			matchers: []tunnel.RequestMatcher{tunnel.HeaderMatcher("X-Kurun-Dev", "alice")},
+			expected: "fallback",
+		},
+		"percentage 0": {
+			matchers: []tunnel.RequestMatcher{tunnel.PercentageMatcher(0)},
+			expected: "fallback",
+		},
+		"percentage 100": {
+			matchers: []tunnel.RequestMatcher{tunnel.PercentageMatcher(100)},
+			expected: "tunnel",
+		},
+		"any matcher": {
+			matchers: []tunnel.RequestMatcher{nil, tunnel.PercentageMatcher(0), tunnel.HeaderMatcher("X-Kurun-Dev", "alice")},
+			header:   "alice",
+			expected: "tunnel",
+		},
+		"no matchers": {
+			header:   "alice",
+			expected: "fallback",
+		},
+	}
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			handler := tunnel.NewSplitHandler(tunnelHandler, fallback, testCase.matchers...)
+			// the percentage matchers are random, so every request must be split the same way
+			for i := 0; i < 20; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				if testCase.header != "" {
+					req.Header.Set("X-Kurun-Dev", testCase.header)
+				}
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, req)
+				require.Equal(t, http.StatusOK, recorder.Code)
+				require.Equal(t, testCase.expected, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthSplit(t *testing.T) {
+	server := StartTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     http.Header{"X-Authorization": []string{req.Header.Get("Authorization")}},
+			Body:       io.NopCloser(strings.NewReader("tunnel")),
+		}, nil
+	}))
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Authorization", r.Header.Get("Authorization"))
+		_, _ = io.WriteString(w, "fallback")
+	})
+	// the credentials of the request server protect only the requests sent through the tunnel
+	auth := tunnel.AuthMiddleware(tunnel.AuthConfig{BearerTokens: []string{"secret"}})
+	handler := tunnel.NewSplitHandler(tunnel.ChainMiddlewares(tunnel.NewRequestHandler(server), auth), fallback, tunnel.HeaderMatcher("X-Kurun-Dev", "alice"))
+
+	request := func(authorization, dev string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if dev != "" {
+			req.Header.Set("X-Kurun-Dev", dev)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := request("", "alice")
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	require.Equal(t, `Bearer realm="kurun"`, recorder.Header().Get("WWW-Authenticate"))
+
+	recorder = request("Bearer secret", "alice")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "tunnel", recorder.Body.String())
+	require.Empty(t, recorder.Header().Get("X-Authorization"))
+
+	recorder = request("Bearer workload", "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "fallback", recorder.Body.String())
+	require.Equal(t, "Bearer workload", recorder.Header().Get("X-Authorization"))
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	server := StartTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("request not cancelled")
+		}
+	}))
+	handler := tunnel.NewRequestHandler(server, tunnel.WithResponseHeaderTimeout(100*time.Millisecond), tunnel.WithErrorResponses(tunnel.ErrorResponses{}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+
+	// the tunnel sends the headers with the first frame of the body, so the timeout of the body is checked with a
+	// round tripper failing the body like the HTTP transport once the request is cancelled
+	handler = tunnel.NewRequestHandler(tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, writer := io.Pipe()
+		go func() {
+			select {
+			case <-time.After(300 * time.Millisecond):
+				_, _ = io.WriteString(writer, "slow body")
+				writer.Close()
+			case <-req.Context().Done():
+				writer.CloseWithError(req.Context().Err())
+			}
+		}()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Body:       body,
+		}, nil
+	}), tunnel.WithResponseHeaderTimeout(100*time.Millisecond))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, "slow body", recorder.Body.String())
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	server := StartTunnel(b, benchmarkRoundTripper())
+	req, err := http.NewRequest(http.MethodGet, "/", nil)
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchmarkRequest(b, server, req)
+	}
+}
+
+// BenchmarkRoundTripParallel measures the throughput of many concurrent requests, e.g. bursts of webhook calls
+func BenchmarkRoundTripParallel(b *testing.B) {
+	for _, parallelism := range []int{1, 16, 64} {
+		b.Run(strconv.Itoa(parallelism*runtime.GOMAXPROCS(0)), func(b *testing.B) {
+			server := StartTunnel(b, benchmarkRoundTripper())
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.SetParallelism(parallelism)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					benchmarkRequest(b, server, req)
+				}
+			})
+		})
+	}
+}
+
+func benchmarkRoundTripper() http.RoundTripper {
+	return tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Proto:         req.Proto,
+			ProtoMajor:    req.ProtoMajor,
+			ProtoMinor:    req.ProtoMinor,
+			Body:          io.NopCloser(strings.NewReader("ok")),
+			ContentLength: 2,
+		}, nil
+	})
+}
+
+func benchmarkRequest(b *testing.B, server *tunnel.Server, req *http.Request) {
+	// each request needs its own ID, which is derived from its address
+	resp, err := server.RoundTrip(req.Clone(context.Background()))
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func TestDuplicateFilter(t *testing.T) {
+	var downstreamRequests int32
+	filter := tunnel.DuplicateFilter{Windows: map[string]time.Duration{http.MethodPost: 200 * time.Millisecond}}
+	server := StartTunnel(t, filter.RoundTripper(tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(&downstreamRequests, 1)
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		statusCode := http.StatusOK
+		if req.URL.Path == "/fail" {
+			statusCode = http.StatusInternalServerError
+		}
+		return &http.Response{
+			StatusCode: statusCode,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Body:       io.NopCloser(strings.NewReader(string(body) + " " + strconv.Itoa(int(n)))),
+		}, nil
+	})))
+	handler := tunnel.NewRequestHandler(server)
+
+	send := func(method, path, body, idempotencyKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if idempotencyKey != "" {
+			req.Header.Set(tunnel.IdempotencyKeyHeader, idempotencyKey)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the duplicates within the window get the response of the original request
+	rec := send(http.MethodPost, "/hook", "event", "")
+	require.Equal(t, "event 1", rec.Body.String())
+	require.Empty(t, rec.Header().Get(tunnel.DuplicateStatusHeader))
+	rec = send(http.MethodPost, "/hook", "event", "")
+	require.Equal(t, "event 1", rec.Body.String())
+	require.Equal(t, "true", rec.Header().Get(tunnel.DuplicateStatusHeader))
+
+	// the requests with other bodies, other paths or other methods are sent through
+	require.Equal(t, "other 2", send(http.MethodPost, "/hook", "other", "").Body.String())
+	require.Equal(t, "event 3", send(http.MethodPost, "/other", "event", "").Body.String())
+	require.Equal(t, "event 4", send(http.MethodPut, "/hook", "event", "").Body.String())
+	require.Equal(t, "event 5", send(http.MethodPut, "/hook", "event", "").Body.String())
+
+	// the requests with the same idempotency key are duplicates regardless of their bodies
+	require.Equal(t, "first 6", send(http.MethodPost, "/hook", "first", "key").Body.String())
+	require.Equal(t, "first 6", send(http.MethodPost, "/hook", "retry", "key").Body.String())
+
+	// the failed requests can be retried
+	rec = send(http.MethodPost, "/fail", "event", "")
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.Equal(t, "event 7", rec.Body.String())
+	require.Equal(t, "event 8", send(http.MethodPost, "/fail", "event", "").Body.String())
+
+	// the requests are sent again once the window has passed
+	time.Sleep(250 * time.Millisecond)
+	rec = send(http.MethodPost, "/hook", "event", "")
+	require.Equal(t, "event 9", rec.Body.String())
+	require.Empty(t, rec.Header().Get(tunnel.DuplicateStatusHeader))
+	require.EqualValues(t, 9, atomic.LoadInt32(&downstreamRequests))
+}
@@ -0,0 +1,118 @@
+package tunnel
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Middleware wraps a handler, e.g. to log, authenticate or modify requests
+type Middleware func(http.Handler) http.Handler
+
+// ChainMiddlewares wraps the handler with the middlewares, the first middleware being the outermost one
+func ChainMiddlewares(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if middlewares[i] != nil {
+			handler = middlewares[i](handler)
+		}
+	}
+	return handler
+}
+
+// LoggingMiddleware logs the requests with their status code, response size and duration
+func LoggingMiddleware(logger logr.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rw, r)
+			if rw.status == 0 {
+				rw.status = http.StatusOK
+			}
+			logger.Info("request served", "method", r.Method, "url", r.URL.RequestURI(), "remoteAddr", r.RemoteAddr, "status", rw.status, "bytes", rw.written, "duration", time.Since(start))
+		})
+	}
+}
+
+// HeaderMiddleware sets the specified headers on the requests and the responses, replacing existing values
+func HeaderMiddleware(requestHeaders, responseHeaders http.Header) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(requestHeaders) > 0 {
+				r = r.Clone(r.Context())
+				for name, values := range requestHeaders {
+					r.Header[http.CanonicalHeaderKey(name)] = values
+				}
+			}
+			if len(responseHeaders) > 0 {
+				w = &headerSetter{ResponseWriter: w, headers: responseHeaders}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// headerSetter sets the headers right before the response headers are written, so they replace the values set by the
+// wrapped handler
+type headerSetter struct {
+	http.ResponseWriter
+	headers     http.Header
+	wroteHeader bool
+}
+
+func (hs *headerSetter) WriteHeader(status int) {
+	if !hs.wroteHeader {
+		hs.wroteHeader = true
+		for name, values := range hs.headers {
+			hs.ResponseWriter.Header()[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	hs.ResponseWriter.WriteHeader(status)
+}
+
+func (hs *headerSetter) Write(p []byte) (int, error) {
+	if !hs.wroteHeader {
+		hs.WriteHeader(http.StatusOK)
+	}
+	return hs.ResponseWriter.Write(p)
+}
+
+func (hs *headerSetter) Flush() {
+	if !hs.wroteHeader {
+		hs.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := hs.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// statusRecorder records the status code and the size of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.written += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming responses working through the recorder
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"io"
+	"sync"
+)
+
+// frameMux serializes the frames of the messages written concurrently to the connection, the writers take turns in
+// the order they started waiting, so the fragments of big messages are interleaved with the small ones
+type frameMux struct {
+	Conn
+
+	busy    bool
+	mutex   sync.Mutex
+	waiting []chan struct{}
+}
+
+func newFrameMux(conn Conn) *frameMux {
+	return &frameMux{Conn: conn}
+}
+
+// NextWriter waits for the turn of the caller, which lasts until the returned writer is closed
+func (m *frameMux) NextWriter() (io.WriteCloser, error) {
+	m.acquire()
+	wc, err := m.Conn.NextWriter()
+	if err != nil {
+		m.release()
+		return nil, err
+	}
+	return &muxWriter{
+		WriteCloser: wc,
+		mux:         m,
+	}, nil
+}
+
+// Ping waits for a turn too, as the transports may write the pings like the frames of the messages
+func (m *frameMux) Ping() error {
+	m.acquire()
+	defer m.release()
+	return m.Conn.Ping()
+}
+
+func (m *frameMux) acquire() {
+	m.mutex.Lock()
+	if !m.busy {
+		m.busy = true
+		m.mutex.Unlock()
+		return
+	}
+	turn := make(chan struct{})
+	m.waiting = append(m.waiting, turn)
+	m.mutex.Unlock()
+	<-turn
+}
+
+func (m *frameMux) release() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.waiting) == 0 {
+		m.busy = false
+		return
+	}
+	// the turn is passed on without becoming free, so the writers can't overtake the ones waiting
+	turn := m.waiting[0]
+	m.waiting[0] = nil
+	m.waiting = m.waiting[1:]
+	close(turn)
+}
+
+type muxWriter struct {
+	io.WriteCloser
+	mux  *frameMux
+	once sync.Once
+}
+
+func (w *muxWriter) Close() error {
+	err := w.WriteCloser.Close()
+	w.once.Do(w.mux.release)
+	return err
+}
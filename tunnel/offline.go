@@ -0,0 +1,286 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+)
+
+// QueuedHeader is set on the responses of the requests queued by the tunnel server while no tunnel client is connected
+const QueuedHeader = "X-Kurun-Queued"
+
+// defaultOfflineQueueMaxAge is the time the queued requests are kept for unless configured otherwise
+const defaultOfflineQueueMaxAge = 5 * time.Minute
+
+// defaultOfflineQueueReplayTimeout limits the time of sending a queued request unless configured otherwise
+const defaultOfflineQueueReplayTimeout = time.Minute
+
+// OfflineQueueConfig configures the queue of the requests received by the tunnel server while no tunnel client is
+// connected, e.g. to keep the webhook events sent while the laptop running the client sleeps
+type OfflineQueueConfig struct {
+	// MaxAge is the time the requests are kept in the queue for, the expired ones are dropped, 5 minutes by default
+	MaxAge time.Duration
+	// MaxSize is the size limit of the queued requests (their bodies, URLs and headers) in bytes, the requests not
+	// fitting into the queue wait for a tunnel client as usual
+	MaxSize int64
+	// Methods are the methods of the queued requests, POST by default
+	Methods []string
+	// ReplayTimeout limits the time of sending a queued request through the tunnel and reading its response, so a
+	// request hanging in the downstream doesn't hold up the rest of the queue, 1 minute by default
+	ReplayTimeout time.Duration
+}
+
+// WithOfflineQueue makes the tunnel server queue the requests of the configured methods while no tunnel client is
+// connected, and send them to the first client connecting, in the order they were received
+// The queued requests are responded with 202 Accepted (and QueuedHeader) right away, the responses of the replayed
+// requests are discarded.
+func WithOfflineQueue(config OfflineQueueConfig) ServerOption {
+	return ServerOptionFunc(func(s *Server) {
+		if config.MaxSize <= 0 {
+			s.offlineQueue = nil
+			return
+		}
+		if config.MaxAge <= 0 {
+			config.MaxAge = defaultOfflineQueueMaxAge
+		}
+		if config.ReplayTimeout <= 0 {
+			config.ReplayTimeout = defaultOfflineQueueReplayTimeout
+		}
+		methods := make(map[string]bool)
+		for _, method := range config.Methods {
+			methods[strings.ToUpper(method)] = true
+		}
+		if len(methods) == 0 {
+			methods[http.MethodPost] = true
+		}
+		s.offlineQueue = &offlineQueue{
+			maxAge:        config.MaxAge,
+			maxSize:       config.MaxSize,
+			methods:       methods,
+			replayTimeout: config.ReplayTimeout,
+		}
+	})
+}
+
+// offlineQueue holds the requests received while no tunnel client is connected
+type offlineQueue struct {
+	items   []queuedRequest
+	maxAge  time.Duration
+	maxSize int64
+	methods map[string]bool
+	mutex   sync.Mutex
+	// replaying is set while a goroutine sends the queued requests to the tunnel
+	replaying     int32
+	replayTimeout time.Duration
+	size          int64
+}
+
+type queuedRequest struct {
+	queued time.Time
+	req    *http.Request
+	size   int64
+}
+
+// push queues the request if it fits into the queue, its body is read in either case, the returned request has the
+// same body as the original one, so it can be sent through the tunnel if it's not queued
+func (q *offlineQueue) push(req *http.Request, now time.Time) (*http.Request, bool) {
+	size := int64(len(req.URL.String()))
+	for name, values := range req.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+
+	q.mutex.Lock()
+	q.dropExpired(now)
+	available := q.maxSize - q.size - size
+	q.mutex.Unlock()
+	if available < 0 {
+		return req, false
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, available+1))
+		if err != nil || int64(len(body)) > available {
+			// restore the body read so far, the request is sent as usual
+			req = req.Clone(req.Context())
+			req.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+			return req, false
+		}
+		_ = req.Body.Close()
+	}
+	size += int64(len(body))
+
+	queued := req.Clone(context.Background())
+	queued.Body = http.NoBody
+	if len(body) > 0 {
+		queued.Body = io.NopCloser(bytes.NewReader(body))
+		queued.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	queued.ContentLength = int64(len(body))
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.size+size > q.maxSize {
+		// the queue has been filled up in the meantime
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		return req, false
+	}
+	q.items = append(q.items, queuedRequest{
+		queued: now,
+		req:    queued,
+		size:   size,
+	})
+	q.size += size
+	return req, true
+}
+
+// pop returns the oldest request of the queue which hasn't expired yet
+func (q *offlineQueue) pop(now time.Time) (queuedRequest, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.dropExpired(now)
+	if len(q.items) == 0 {
+		return queuedRequest{}, false
+	}
+	item := q.items[0]
+	q.items[0] = queuedRequest{}
+	q.items = q.items[1:]
+	q.size -= item.size
+	return item, true
+}
+
+// pushFront puts the request back to the front of the queue, e.g. when the tunnel client disconnects before it's sent
+func (q *offlineQueue) pushFront(item queuedRequest) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.items = append([]queuedRequest{item}, q.items...)
+	q.size += item.size
+}
+
+func (q *offlineQueue) empty() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items) == 0
+}
+
+func (q *offlineQueue) dropExpired(now time.Time) {
+	for len(q.items) > 0 && now.Sub(q.items[0].queued) >= q.maxAge {
+		q.size -= q.items[0].size
+		q.items[0] = queuedRequest{}
+		q.items = q.items[1:]
+	}
+}
+
+// queueOfflineRequest queues the request if no tunnel client is connected and it's accepted by the offline queue, the
+// returned request is the one to send through the tunnel otherwise
+func (s *Server) queueOfflineRequest(req *http.Request) (*http.Request, *http.Response) {
+	q := s.offlineQueue
+	if q == nil || !q.methods[req.Method] || s.ConnectedClients() > 0 {
+		return req, nil
+	}
+	req, queued := q.push(req, time.Now())
+	if !queued {
+		s.logger.V(1).Info("offline queue is full, waiting for a tunnel client", "request", req)
+		return req, nil
+	}
+	s.logger.V(1).Info("request queued until a tunnel client connects", "request", req)
+	// the client may have connected while the request was queued
+	s.replayOfflineRequests()
+
+	body := "queued until a tunnel client connects\n"
+	return nil, &http.Response{
+		Status:     "202 Accepted",
+		StatusCode: http.StatusAccepted,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": {"text/plain; charset=utf-8"},
+			QueuedHeader:   {"true"},
+		},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// replayOfflineRequests sends the queued requests to the connected tunnel clients one by one, unless it's already
+// being done
+func (s *Server) replayOfflineRequests() {
+	q := s.offlineQueue
+	if q == nil || s.ConnectedClients() == 0 || !atomic.CompareAndSwapInt32(&q.replaying, 0, 1) {
+		return
+	}
+	go func() {
+		for {
+			s.replayOfflineQueue(q)
+			atomic.StoreInt32(&q.replaying, 0)
+			// requests may have been queued since the queue has been found empty
+			if q.empty() || s.ConnectedClients() == 0 || !atomic.CompareAndSwapInt32(&q.replaying, 0, 1) {
+				return
+			}
+		}
+	}()
+}
+
+func (s *Server) replayOfflineQueue(q *offlineQueue) {
+	for !s.stopped() && s.ConnectedClients() > 0 {
+		item, found := q.pop(time.Now())
+		if !found {
+			return
+		}
+		logger := s.logger.WithValues("request", item.req, "queuedFor", time.Since(item.queued).String())
+		if !s.replayQueuedRequest(q, item, logger) {
+			return
+		}
+	}
+}
+
+// replayQueuedRequest sends the queued request through the tunnel in the replay timeout, and returns whether the
+// replay can go on with the next request
+func (s *Server) replayQueuedRequest(q *offlineQueue, item queuedRequest, logger logr.Logger) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), q.replayTimeout)
+	defer cancel()
+	resp, err := s.RoundTrip(item.req.WithContext(ctx))
+	if errors.Is(err, ErrNoClient) {
+		// the client disconnected before the request could be sent, it's sent to the next one
+		if item.req.GetBody != nil {
+			item.req.Body, _ = item.req.GetBody()
+		}
+		q.pushFront(item)
+		return false
+	}
+	if err != nil {
+		logger.Error(err, "failed to replay queued request")
+		return true
+	}
+	logger.V(1).Info("queued request replayed", "status", resp.StatusCode)
+	discardResponse(logger, resp)
+	return true
+}
+
+func discardResponse(logger logr.Logger, resp *http.Response) {
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		logger.V(1).Info("failed to read the response of replayed request", "error", err.Error())
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
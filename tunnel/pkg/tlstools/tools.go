@@ -70,3 +70,19 @@ func GenerateTLSCert(caCert *x509.Certificate, caKey crypto.PrivateKey, serial *
 	cert.PrivateKey = prvKey
 	return
 }
+
+// LocalIPAddresses returns the loopback addresses of both IP families and the addresses of the network interfaces
+// (e.g. the pod IPs on dual-stack clusters), to be used as IP SANs
+func LocalIPAddresses() []net.IP {
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,294 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// ErrQuotaExceeded is returned for the requests rejected by the quota of their tunnel, see TunnelQuotas
+const ErrQuotaExceeded = errors.Sentinel("tunnel quota exceeded")
+
+// TunnelQuota limits the requests sent through a tunnel of a server serving several tunnels, so the traffic of a
+// tunnel can't starve the others
+type TunnelQuota struct {
+	// Burst is the number of requests allowed at once above RequestsPerSecond, RequestsPerSecond rounded up by default
+	Burst int
+	// BytesPerSecond limits the bandwidth of the request and the response bodies in each direction, shared by the
+	// concurrent requests of the tunnel, zero means no limit
+	BytesPerSecond int64
+	// MaxConcurrent limits the requests of the tunnel in flight, the requests beyond it are rejected with
+	// ErrQuotaExceeded, zero means no limit
+	MaxConcurrent int
+	// RequestsPerSecond limits the rate of the requests of the tunnel, the requests beyond it are rejected with
+	// ErrQuotaExceeded, zero means no limit
+	RequestsPerSecond float64
+}
+
+// Enabled returns whether any limit is set
+func (q TunnelQuota) Enabled() bool {
+	return q.BytesPerSecond > 0 || q.MaxConcurrent > 0 || q.RequestsPerSecond > 0
+}
+
+// burst returns the size of the token bucket of the rate limit
+func (q TunnelQuota) burst() float64 {
+	if q.Burst > 0 {
+		return float64(q.Burst)
+	}
+	return math.Max(1, math.Ceil(q.RequestsPerSecond))
+}
+
+// The reasons of the rejections in the metrics
+const (
+	quotaReasonConcurrency = "concurrency"
+	quotaReasonRate        = "rate"
+)
+
+// NewTunnelQuotas returns the quotas of the tunnels, the tunnels without a quota of their own get the default one
+func NewTunnelQuotas(defaultQuota TunnelQuota, quotas map[string]TunnelQuota) *TunnelQuotas {
+	q := &TunnelQuotas{
+		tunnels: make(map[string]*tunnelQuotaState),
+	}
+	q.SetQuotas(defaultQuota, quotas)
+	return q
+}
+
+// TunnelQuotas enforces the quotas of the tunnels of a server serving several tunnels, and collects the metrics of the
+// tunnels, see RoundTripper and WriteMetrics
+type TunnelQuotas struct {
+	mutex        sync.Mutex
+	defaultQuota TunnelQuota
+	quotas       map[string]TunnelQuota
+	tunnels      map[string]*tunnelQuotaState
+}
+
+// SetQuotas replaces the quotas, e.g. when the config is reloaded, the requests in flight are counted against the new
+// ones
+func (q *TunnelQuotas) SetQuotas(defaultQuota TunnelQuota, quotas map[string]TunnelQuota) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.defaultQuota = defaultQuota
+	q.quotas = quotas
+	for id, state := range q.tunnels {
+		state.setQuota(q.quotaOf(id))
+	}
+}
+
+// RoundTripper returns the round tripper of the tunnel enforcing its quota on the requests sent through next (e.g.
+// the server of the tunnel), and recording them in its metrics
+func (q *TunnelQuotas) RoundTripper(id string, next http.RoundTripper) http.RoundTripper {
+	state := q.tunnel(id)
+	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		up, down, err := state.acquire(time.Now())
+		if err != nil {
+			return nil, errors.WithDetails(err, "tunnel", id)
+		}
+
+		if r.Body != nil && r.Body != http.NoBody {
+			body := r.Body
+			if up != nil {
+				body = &throttledReadCloser{ReadCloser: body, ctx: r.Context(), limiter: up}
+			}
+			r = r.Clone(r.Context())
+			r.Body = &countingReadCloser{ReadCloser: body, onClose: state.recordRequestBody}
+		}
+		resp, err := next.RoundTrip(r)
+		if err != nil {
+			state.release(0, false)
+			return resp, err
+		}
+		body := resp.Body
+		if down != nil {
+			body = &throttledReadCloser{ReadCloser: body, ctx: r.Context(), limiter: down}
+		}
+		resp.Body = &countingReadCloser{ReadCloser: body, onClose: func(n int64) {
+			state.release(n, true)
+		}}
+		return resp, nil
+	})
+}
+
+func (q *TunnelQuotas) tunnel(id string) *tunnelQuotaState {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	state, ok := q.tunnels[id]
+	if !ok {
+		state = &tunnelQuotaState{}
+		state.setQuota(q.quotaOf(id))
+		q.tunnels[id] = state
+	}
+	return state
+}
+
+func (q *TunnelQuotas) quotaOf(id string) TunnelQuota {
+	if quota, ok := q.quotas[id]; ok {
+		return quota
+	}
+	return q.defaultQuota
+}
+
+// WriteMetrics writes the metrics of the tunnels labeled by their IDs in the Prometheus text format
+func (q *TunnelQuotas) WriteMetrics(w io.Writer) error {
+	q.mutex.Lock()
+	ids := make([]string, 0, len(q.tunnels))
+	for id := range q.tunnels {
+		ids = append(ids, id)
+	}
+	states := make(map[string]tunnelMetrics, len(ids))
+	for _, id := range ids {
+		states[id] = q.tunnels[id].snapshot()
+	}
+	q.mutex.Unlock()
+	sort.Strings(ids)
+
+	families := []struct {
+		name, help, kind string
+		value            func(m tunnelMetrics) []metricSample
+	}{
+		{"kurun_tunnel_requests_total", "Requests sent through the tunnel.", "counter", func(m tunnelMetrics) []metricSample {
+			return []metricSample{{value: float64(m.requests)}}
+		}},
+		{"kurun_tunnel_errors_total", "Requests failed to be sent through the tunnel.", "counter", func(m tunnelMetrics) []metricSample {
+			return []metricSample{{value: float64(m.errors)}}
+		}},
+		{"kurun_tunnel_rejected_requests_total", "Requests rejected by the quota of the tunnel.", "counter", func(m tunnelMetrics) []metricSample {
+			return []metricSample{
+				{label: `reason="` + quotaReasonConcurrency + `"`, value: float64(m.rejectedConcurrency)},
+				{label: `reason="` + quotaReasonRate + `"`, value: float64(m.rejectedRate)},
+			}
+		}},
+		{"kurun_tunnel_requests_in_flight", "Requests of the tunnel in flight.", "gauge", func(m tunnelMetrics) []metricSample {
+			return []metricSample{{value: float64(m.inFlight)}}
+		}},
+		{"kurun_tunnel_request_bytes_total", "Size of the request bodies sent through the tunnel.", "counter", func(m tunnelMetrics) []metricSample {
+			return []metricSample{{value: float64(m.requestBytes)}}
+		}},
+		{"kurun_tunnel_response_bytes_total", "Size of the response bodies received through the tunnel.", "counter", func(m tunnelMetrics) []metricSample {
+			return []metricSample{{value: float64(m.responseBytes)}}
+		}},
+	}
+	for _, family := range families {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			for _, sample := range family.value(states[id]) {
+				labels := `tunnel="` + EscapeMetricLabel(id) + `"`
+				if sample.label != "" {
+					labels += "," + sample.label
+				}
+				if _, err := fmt.Fprintf(w, "%s{%s} %g\n", family.name, labels, sample.value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type metricSample struct {
+	label string
+	value float64
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// EscapeMetricLabel escapes the value of a label of a metric in the Prometheus text format
+func EscapeMetricLabel(value string) string {
+	return metricLabelEscaper.Replace(value)
+}
+
+// tunnelQuotaState is the state of the quota of a tunnel, and its metrics
+type tunnelQuotaState struct {
+	mutex sync.Mutex
+	quota TunnelQuota
+	// tokens and last are the token bucket of the rate limit
+	tokens float64
+	last   time.Time
+	// up and down are the bandwidth limiters of the request and the response bodies
+	up   *bandwidthLimiter
+	down *bandwidthLimiter
+
+	metrics tunnelMetrics
+}
+
+type tunnelMetrics struct {
+	errors              int64
+	inFlight            int64
+	rejectedConcurrency int64
+	rejectedRate        int64
+	requestBytes        int64
+	requests            int64
+	responseBytes       int64
+}
+
+func (s *tunnelQuotaState) setQuota(quota TunnelQuota) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.last.IsZero() || quota.RequestsPerSecond != s.quota.RequestsPerSecond || quota.Burst != s.quota.Burst {
+		s.tokens = quota.burst()
+	}
+	if quota.BytesPerSecond != s.quota.BytesPerSecond {
+		s.up, s.down = nil, nil
+		if quota.BytesPerSecond > 0 {
+			s.up = &bandwidthLimiter{bytesPerSecond: quota.BytesPerSecond}
+			s.down = &bandwidthLimiter{bytesPerSecond: quota.BytesPerSecond}
+		}
+	}
+	s.quota = quota
+}
+
+// acquire admits a request, and returns the bandwidth limiters of its bodies (nil without limit)
+func (s *tunnelQuotaState) acquire(now time.Time) (*bandwidthLimiter, *bandwidthLimiter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.quota.MaxConcurrent > 0 && s.metrics.inFlight >= int64(s.quota.MaxConcurrent) {
+		s.metrics.rejectedConcurrency++
+		return nil, nil, errors.WithDetails(ErrQuotaExceeded, "reason", quotaReasonConcurrency)
+	}
+	if s.quota.RequestsPerSecond > 0 {
+		if !s.last.IsZero() {
+			s.tokens = math.Min(s.quota.burst(), s.tokens+now.Sub(s.last).Seconds()*s.quota.RequestsPerSecond)
+		}
+		s.last = now
+		if s.tokens < 1 {
+			s.metrics.rejectedRate++
+			return nil, nil, errors.WithDetails(ErrQuotaExceeded, "reason", quotaReasonRate)
+		}
+		s.tokens--
+	}
+	s.metrics.inFlight++
+	return s.up, s.down, nil
+}
+
+// release records the end of a request, with the size of its response body if it succeeded
+func (s *tunnelQuotaState) release(responseBytes int64, succeeded bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.metrics.inFlight--
+	s.metrics.requests++
+	if succeeded {
+		s.metrics.responseBytes += responseBytes
+	} else {
+		s.metrics.errors++
+	}
+}
+
+func (s *tunnelQuotaState) recordRequestBody(n int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.metrics.requestBytes += n
+}
+
+func (s *tunnelQuotaState) snapshot() tunnelMetrics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.metrics
+}
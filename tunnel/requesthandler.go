@@ -1,33 +1,186 @@
 package tunnel
 
 import (
+	"context"
 	"io"
+	"mime"
 	"net/http"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
 )
 
-func NewRequestHandler(rt http.RoundTripper) *RequestHandler {
-	return &RequestHandler{
+func NewRequestHandler(rt http.RoundTripper, options ...RequestHandlerOption) *RequestHandler {
+	rh := &RequestHandler{
 		RoundTripper: rt,
 	}
+	for _, opt := range options {
+		if opt != nil {
+			opt.ApplyToRequestHandler(rh)
+		}
+	}
+	return rh
 }
 
+// RequestHandler serves requests by sending them through the round tripper (e.g. the tunnel), similar to
+// httputil.ReverseProxy
 type RequestHandler struct {
 	RoundTripper http.RoundTripper
+
+	// ErrorHandler handles errors of the round tripper and ModifyResponse, and the downstream errors reported by the
+	// tunnel client (see DownstreamError), ErrorResponseHandler returns a configurable one
+	// If nil, the error is returned to the client as an internal server error.
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+
+	// FlushInterval is the interval to flush the response body to the client while copying it
+	// If zero, no periodic flushing is done. A negative value means to flush immediately after each write.
+	// Streaming responses (e.g. server-sent events or responses of unknown length) are always flushed immediately.
+	FlushInterval time.Duration
+
+	// Middlewares wrap the handling of the requests, the first middleware being the outermost one
+	// The chain is assembled for each request, so middlewares should keep their state outside of the wrapping function.
+	Middlewares []Middleware
+
+	// ModifyResponse modifies the response before it's written to the client, if it returns an error, ErrorHandler is
+	// called with it
+	ModifyResponse func(*http.Response) error
+
+	// ResponseHeaderTimeout is the time to wait for the response headers (e.g. for a tunnel client to serve the
+	// request), zero means no timeout
+	// The timeout does not apply to reading the response body.
+	ResponseHeaderTimeout time.Duration
+}
+
+type RequestHandlerOption interface {
+	ApplyToRequestHandler(*RequestHandler)
+}
+
+type RequestHandlerOptionFunc func(*RequestHandler)
+
+func (opt RequestHandlerOptionFunc) ApplyToRequestHandler(rh *RequestHandler) {
+	opt(rh)
+}
+
+// WithAuth requires the credentials of the config on the requests, see AuthMiddleware
+func WithAuth(config AuthConfig) RequestHandlerOption {
+	return WithMiddleware(AuthMiddleware(config))
+}
+
+// WithCORS handles the cross-origin requests according to the config, see CORSMiddleware
+func WithCORS(config CORSConfig) RequestHandlerOption {
+	return WithMiddleware(CORSMiddleware(config))
+}
+
+func WithErrorHandler(errorHandler func(http.ResponseWriter, *http.Request, error)) RequestHandlerOption {
+	return RequestHandlerOptionFunc(func(rh *RequestHandler) {
+		rh.ErrorHandler = errorHandler
+	})
+}
+
+// WithErrorResponses handles the errors with the configured responses, see ErrorResponseHandler
+func WithErrorResponses(config ErrorResponses) RequestHandlerOption {
+	return WithErrorHandler(ErrorResponseHandler(config))
+}
+
+func WithFlushInterval(interval time.Duration) RequestHandlerOption {
+	return RequestHandlerOptionFunc(func(rh *RequestHandler) {
+		rh.FlushInterval = interval
+	})
+}
+
+// WithMiddleware appends the middlewares to the middlewares of the request handler
+func WithMiddleware(middlewares ...Middleware) RequestHandlerOption {
+	return RequestHandlerOptionFunc(func(rh *RequestHandler) {
+		rh.Middlewares = append(rh.Middlewares, middlewares...)
+	})
+}
+
+func WithModifyResponse(modifyResponse func(*http.Response) error) RequestHandlerOption {
+	return RequestHandlerOptionFunc(func(rh *RequestHandler) {
+		rh.ModifyResponse = modifyResponse
+	})
+}
+
+func WithResponseHeaderTimeout(timeout time.Duration) RequestHandlerOption {
+	return RequestHandlerOptionFunc(func(rh *RequestHandler) {
+		rh.ResponseHeaderTimeout = timeout
+	})
 }
 
 func (rh RequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(rh.Middlewares) > 0 {
+		ChainMiddlewares(http.HandlerFunc(rh.serveHTTP), rh.Middlewares...).ServeHTTP(w, r)
+		return
+	}
+	rh.serveHTTP(w, r)
+}
+
+func (rh RequestHandler) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var timer *time.Timer
+	if rh.ResponseHeaderTimeout > 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		timer = time.AfterFunc(rh.ResponseHeaderTimeout, cancel)
+		r = r.WithContext(ctx)
+	}
+
 	resp, err := rh.RoundTripper.RoundTrip(r)
+	// the timeout doesn't apply to the body, the request timed out only if the timer fired before it was stopped
+	timedOut := timer != nil && !timer.Stop()
+	if err == nil && timedOut {
+		resp.Body.Close()
+		err = ErrResponseHeaderTimeout
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if timedOut && !errors.Is(err, ErrNoClient) {
+			err = ErrResponseHeaderTimeout
+		}
+		rh.handleError(w, r, err)
 		return
 	}
-	if err := writeResponseToResponseWriter(w, resp); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+	// failures of the tunnel client to reach the downstream are passed through as is, unless they are handled
+	if rh.ErrorHandler != nil {
+		if downstreamErr := downstreamErrorFromResponse(resp); downstreamErr != nil {
+			rh.handleError(w, r, downstreamErr)
+			return
+		}
+	}
+
+	if rh.ModifyResponse != nil {
+		if err := rh.ModifyResponse(resp); err != nil {
+			resp.Body.Close()
+			rh.handleError(w, r, err)
+			return
+		}
+	}
+
+	if err := writeResponseToResponseWriter(w, resp, rh.flushInterval(resp)); err != nil {
+		// the status code is already written, nothing to report to the client
 		return
 	}
 }
 
-func writeResponseToResponseWriter(w http.ResponseWriter, r *http.Response) error {
+func (rh RequestHandler) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if rh.ErrorHandler != nil {
+		rh.ErrorHandler(w, r, err)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (rh RequestHandler) flushInterval(resp *http.Response) time.Duration {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return -1
+	}
+	if resp.ContentLength == -1 {
+		return -1
+	}
+	return rh.FlushInterval
+}
+
+func writeResponseToResponseWriter(w http.ResponseWriter, r *http.Response, flushInterval time.Duration) error {
 	if w == nil {
 		return nil
 	}
@@ -45,6 +198,63 @@ func writeResponseToResponseWriter(w http.ResponseWriter, r *http.Response) erro
 	w.WriteHeader(r.StatusCode)
 	// copy body
 	defer r.Body.Close()
-	_, err := io.Copy(w, r.Body)
+	var dst io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok && flushInterval != 0 {
+		fw := &flushWriter{w: w, flusher: flusher, latency: flushInterval}
+		defer fw.stop()
+		dst = fw
+	}
+	_, err := io.Copy(dst, r.Body)
 	return err
 }
+
+// flushWriter flushes the written data after each write (negative latency) or periodically
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+	latency time.Duration
+
+	mu           sync.Mutex
+	flushPending bool
+	timer        *time.Timer
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	n, err := fw.w.Write(p)
+	if fw.latency < 0 {
+		fw.flusher.Flush()
+		return n, err
+	}
+	if fw.flushPending {
+		return n, err
+	}
+	if fw.timer == nil {
+		fw.timer = time.AfterFunc(fw.latency, fw.delayedFlush)
+	} else {
+		fw.timer.Reset(fw.latency)
+	}
+	fw.flushPending = true
+	return n, err
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if !fw.flushPending { // stopped
+		return
+	}
+	fw.flusher.Flush()
+	fw.flushPending = false
+}
+
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.flushPending = false
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"net/http"
+
+	"emperror.dev/errors"
+)
+
+// RouteHeader carries the route of the requests received on the additional ports of a tunnel server, so the clients
+// can send them to the downstream of the port
+// The requests of the default port have no route.
+const RouteHeader = "X-Kurun-Route"
+
+// SetRoute returns a round tripper marking the requests with the route before sending them with next (e.g. the tunnel
+// server), the route set by the callers is overwritten, or removed for the empty route of the default port
+func SetRoute(route string, next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		if route == "" {
+			req.Header.Del(RouteHeader)
+		} else {
+			req.Header.Set(RouteHeader, route)
+		}
+		return next.RoundTrip(req)
+	})
+}
+
+// NewRouteRoundTripper returns the round tripper of a tunnel client sending the requests to the round tripper of their
+// route, the requests without route to the fallback
+// The route header is removed from the requests, requests of unknown routes fail.
+func NewRouteRoundTripper(fallback http.RoundTripper, routes map[string]http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		route := req.Header.Get(RouteHeader)
+		req.Header.Del(RouteHeader)
+		if route == "" {
+			return fallback.RoundTrip(req)
+		}
+		roundTripper, ok := routes[route]
+		if !ok {
+			return nil, errors.Errorf("no downstream for route %q", route)
+		}
+		return roundTripper.RoundTrip(req)
+	})
+}
@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"emperror.dev/errors"
+)
+
+// NewRouter returns a Router sending the requests not matching any of its routes to the fallback round tripper
+func NewRouter(fallback http.RoundTripper) *Router {
+	return &Router{
+		fallback: fallback,
+		mux:      http.NewServeMux(),
+	}
+}
+
+// Router is the round tripper of a tunnel client serving the requests of the registered routes with local handlers
+// (e.g. health checks answered by the client itself), and sending the rest to the fallback round tripper (e.g. the
+// downstream)
+// The patterns of the routes are matched like the ones of http.ServeMux.
+type Router struct {
+	fallback http.RoundTripper
+	mux      *http.ServeMux
+}
+
+// Handle registers the handler for the requests matching the pattern
+func (r *Router) Handle(pattern string, handler http.Handler) {
+	r.mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers the handler function for the requests matching the pattern
+func (r *Router) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	r.mux.HandleFunc(pattern, handler)
+}
+
+func (r *Router) RoundTrip(req *http.Request) (*http.Response, error) {
+	if handler, pattern := r.mux.Handler(req); pattern != "" {
+		return serveRoundTrip(handler, req)
+	}
+	return r.fallback.RoundTrip(req)
+}
+
+// HandlerRoundTripper returns a round tripper serving the requests with the handler, e.g. to serve local content
+// through the tunnel without a local server
+func HandlerRoundTripper(handler http.Handler) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return serveRoundTrip(handler, req)
+	})
+}
+
+// serveRoundTrip serves the request with the handler, and returns the response once its header is written, the body
+// is streamed from the handler
+func serveRoundTrip(handler http.Handler, req *http.Request) (*http.Response, error) {
+	body, bodyWriter := io.Pipe()
+	w := &handlerResponseWriter{
+		body:   bodyWriter,
+		header: make(http.Header),
+		req:    req,
+		respCh: make(chan *http.Response, 1),
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			if reason := recover(); reason != nil {
+				err := errors.Errorf("panic serving %s: %v", req.URL.Path, reason)
+				if !w.sent {
+					errCh <- err
+				}
+				_ = bodyWriter.CloseWithError(err)
+			}
+		}()
+		handler.ServeHTTP(w, req)
+		w.WriteHeader(http.StatusOK) // if the handler wrote nothing
+		_ = bodyWriter.Close()
+	}()
+
+	select {
+	case resp := <-w.respCh:
+		resp.Body = body
+		return resp, nil
+	case err := <-errCh:
+		return nil, err
+	}
+}
+
+// handlerResponseWriter sends the response written by a handler, the body is written to a pipe read by the tunnel
+type handlerResponseWriter struct {
+	body   *io.PipeWriter
+	header http.Header
+	once   sync.Once
+	req    *http.Request
+	respCh chan *http.Response
+	// sent is set when the response is sent, it's only accessed by the goroutine of the handler
+	sent bool
+}
+
+func (w *handlerResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *handlerResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *handlerResponseWriter) WriteHeader(statusCode int) {
+	w.once.Do(func() {
+		w.sent = true
+		contentLength := int64(-1)
+		if value := w.header.Get("Content-Length"); value != "" {
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+				contentLength = n
+			}
+		}
+		w.respCh <- &http.Response{
+			Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+			StatusCode:    statusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        w.header.Clone(),
+			ContentLength: contentLength,
+			Request:       w.req,
+		}
+	})
+}
+
+// Flush implements http.Flusher, the body is not buffered
+func (w *handlerResponseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,651 @@
+package tunnel
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+
+	"github.com/banzaicloud/kurun/tunnel/pkg/workplace"
+)
+
+// TODO: add metrics
+
+// NewServer returns a new Server instance
+func NewServer(options ...ServerOption) *Server {
+	s := &Server{
+		logger:    logr.Discard(),
+		requestCh: make(chan *http.Request),
+		stopCh:    make(chan struct{}),
+		waitQueue: newWaitQueue(),
+	}
+	for _, option := range options {
+		if option == nil {
+			continue
+		}
+		option.ApplyToServer(s)
+	}
+	s.sessions = newServerSessions(s.sessionGracePeriod, s.waitQueue, s.logger)
+	return s
+}
+
+// Server implements a tunnel server, sending the requests to the clients connected with any transport
+type Server struct {
+	logger            logr.Logger
+	clientWaitTimeout time.Duration
+	clients           int32
+	maxFrameSize      int
+	offlineQueue      *offlineQueue
+	pingInterval      time.Duration
+	// sessionGracePeriod and sessions keep the requests of the resumable sessions of the clients, see
+	// WithSessionGracePeriod
+	sessionGracePeriod time.Duration
+	sessions           *serverSessions
+	// unhealthyClients is the number of the connected clients reporting their downstreams unhealthy
+	unhealthyClients int32
+
+	requestCh chan *http.Request
+	stopCh    chan struct{}
+	waitQueue *waitQueue
+}
+
+// RoundTrip sends the request through the tunnel and returns the response
+func (s *Server) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.logger.V(1).Info("request received", "request", req)
+
+	if s.stopped() {
+		return nil, errors.New("tunnel server stopped")
+	}
+
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	req, queuedResp := s.queueOfflineRequest(req)
+	if queuedResp != nil {
+		return queuedResp, nil
+	}
+
+	respCh := s.queueRequest(req)
+
+	if respCh == nil {
+		return nil, errors.New("no response channel")
+	}
+
+	select {
+	case respAndErr, ok := <-respCh:
+		if !ok {
+			return nil, errors.New("response channel closed")
+		}
+		return respAndErr.resp, respAndErr.err
+	case <-s.stopCh: // this branch allows shutdown by the server supervisor
+		s.cancelRequest(req)
+		return nil, errors.New("tunnel server stopped")
+	case <-req.Context().Done(): // this branch allows cancellation and timeout by the requester
+		s.cancelRequest(req)
+		return nil, req.Context().Err()
+	}
+}
+
+// ServeConn sends the requests to the tunnel client connected with the connection until either side closes it
+func (s *Server) ServeConn(conn Conn) {
+	c := &serverConn{
+		cancelCh:         make(chan requestID),
+		conn:             newFrameMux(conn),
+		maxFrameSize:     normalizeMaxFrameSize(s.maxFrameSize),
+		pingInterval:     s.pingInterval,
+		requestCh:        s.requestCh,
+		sessions:         s.sessions,
+		unhealthyClients: &s.unhealthyClients,
+		waitQueue:        s.waitQueue,
+		writes: requestWrites{
+			done: make(map[requestID]chan struct{}),
+		},
+	}
+	c.logger = s.logger.WithValues("conn", c)
+	atomic.AddInt32(&s.clients, 1)
+	defer atomic.AddInt32(&s.clients, -1)
+	s.replayOfflineRequests()
+	c.run(s.stopCh)
+	c.setDownstreamHealthy(true)
+	s.sessions.detach(c)
+}
+
+// ConnectedClients returns the number of tunnel clients connected to the server
+func (s *Server) ConnectedClients() int {
+	return int(atomic.LoadInt32(&s.clients))
+}
+
+// PendingRequests returns the number of the requests waiting for their responses, e.g. to check for leaked requests
+// when the server is idle
+func (s *Server) PendingRequests() int {
+	return s.waitQueue.len()
+}
+
+// Shutdown initiates server shutdown, but does not wait for it to finish
+func (s *Server) Shutdown() {
+	s.logger.Info("initiating tunnel server shutdown")
+	close(s.stopCh)
+}
+
+// cancelRequest drops the specified request from the wait queue, and notifies the client handling it
+func (s *Server) cancelRequest(req *http.Request) {
+	s.logger.V(1).Info("request cancelled", "request", req)
+	id := getRequestID(req)
+	if item, found := s.waitQueue.popItem(id); found && item.conn != nil {
+		item.conn.cancelRequest(id)
+	}
+}
+
+// queueRequest registers the request in the wait queue and return a channel to wait on for the response
+func (s *Server) queueRequest(req *http.Request) <-chan responseAndError {
+	id := getRequestID(req)
+
+	logger := s.logger.WithValues("request", req, "id", id)
+
+	ch := make(chan responseAndError, 1)
+	item := waitQueueItem{
+		req:    req,
+		respCh: ch,
+	}
+
+	s.waitQueue.pushItem(id, item)
+	logger.V(2).Info("item pushed to wait queue", "item", item)
+
+	var noClientCh <-chan time.Time
+	if s.clientWaitTimeout > 0 && s.ConnectedClients() == 0 {
+		timer := time.NewTimer(s.clientWaitTimeout)
+		defer timer.Stop()
+		noClientCh = timer.C
+	}
+
+	select {
+	case <-noClientCh:
+		s.waitQueue.dropItem(id)
+		respondToRequest(logger, item, nil, ErrNoClient)
+	case <-s.stopCh:
+		s.waitQueue.dropItem(id)
+		respondToRequest(logger, item, nil, errors.New("tunnel server stopped"))
+	case <-req.Context().Done():
+		s.waitQueue.dropItem(id)
+		respondToRequest(logger, item, nil, req.Context().Err())
+	case s.requestCh <- req:
+		logger.V(1).Info("request queued")
+	}
+
+	return ch
+}
+
+// stopped returns whether server shutdown has been initiated
+func (s *Server) stopped() bool {
+	select {
+	case <-s.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// serverConn is the server side of a connection to a tunnel client
+type serverConn struct {
+	cancelCh chan requestID
+	// conn is shared by the writers of the requests writing them concurrently
+	conn *frameMux
+	// downstreamUnhealthy is whether the client reported its downstream unhealthy, counted in unhealthyClients
+	downstreamUnhealthy bool
+	fragments           reassembler
+	logger              logr.Logger
+	maxFrameSize        int
+	pingInterval        time.Duration
+	requestCh           chan *http.Request
+	// session is the ID of the session of the client, empty if its connection is not resumable
+	session          string
+	sessions         *serverSessions
+	unhealthyClients *int32
+	waitQueue        *waitQueue
+	wp               workplace.Workplace
+	writes           requestWrites
+}
+
+// readLoop reads responses from the connection
+func (c *serverConn) readLoop() {
+	logger := c.logger.WithName("readLoop")
+	defer logger.V(1).Info("tunnel connection reader loop terminated")
+	defer c.wp.Close(nil)
+	defer c.fragments.releaseAll()
+
+	for {
+		if !c.wp.Open() {
+			logger.V(1).Info("connection closing, terminating reader loop")
+			return
+		}
+
+		logger.V(2).Info("getting next reader")
+		rdr, err := c.conn.NextReader()
+		if err != nil {
+			if !c.wp.Open() {
+				logger.V(1).Info("connection closing, terminating reader loop")
+				return
+			}
+			if isTemporaryError(err) {
+				logger.V(1).Error(err, "got temporary error when getting next reader")
+				continue
+			}
+			if closeError := new(ConnClosedError); errors.As(err, &closeError) {
+				logger.Info("tunnel connection closed", "reason", closeError.Reason)
+			} else {
+				logger.Error(err, "failed to get next reader")
+			}
+			return
+		}
+		// read all data before a new reader is created for the connection and the current reader is invalidated
+		msg, err := readMessage(rdr)
+		if err != nil {
+			logger.Error(err, "failed to read message data")
+			continue
+		}
+		header, err := readFrameHeader(msg)
+		if err != nil {
+			logger.Error(err, "failed to read frame header")
+			msg.release()
+			continue
+		}
+		if header.Version != frameVersion {
+			logger.Info("dropping frame of unsupported version, is the tunnel client of a different release?", "version", header.Version)
+			msg.release()
+			continue
+		}
+		if header.Type == frameTypeSession {
+			if id := msg.String(); id != "" && len(id) <= maxSessionIDLength {
+				c.sessions.attach(id, c)
+			}
+			msg.release()
+			continue
+		}
+		if header.Type == frameTypeHealth {
+			healthy := msg.String() != "0"
+			logger.V(1).Info("downstream health reported", "healthy", healthy)
+			c.setDownstreamHealthy(healthy)
+			msg.release()
+			continue
+		}
+		if header.Type != frameTypeResponse {
+			logger.V(1).Info("dropping frame of unknown type", "type", header.Type)
+			msg.release()
+			continue
+		}
+		reqID := header.RequestID
+		if header.Flags&frameFlagMore != 0 && !c.waitQueue.hasItem(reqID) {
+			// the request has been cancelled, the rest of its fragments are dropped as well
+			c.fragments.drop(reqID)
+			msg.release()
+			continue
+		}
+		msg, complete := c.fragments.add(header, msg)
+		if !complete {
+			continue
+		}
+		item, found := c.waitQueue.popItem(reqID)
+		if !found {
+			// either the request has been cancelled, never existed, or we have a bug
+			logger.V(1).Info("no wait queue item for request ID", "id", reqID)
+			msg.release()
+			continue
+		}
+		resp, err := http.ReadResponse(msg.bufferedReader(), item.req)
+		if err != nil {
+			msg.release()
+		} else {
+			resp.Body = msg.releaseWithBody(resp.Body)
+		}
+		respondToRequest(logger, item, resp, err)
+	}
+}
+
+// cancelRequest sends the cancellation of the request to the client
+func (c *serverConn) cancelRequest(id requestID) {
+	go c.wp.Do(func() {
+		// the cancellation is sent after the request, so the client doesn't receive fragments of cancelled requests
+		c.writes.wait(id, c.wp.Closing())
+		select {
+		case <-c.wp.Closing():
+		case c.cancelCh <- id:
+		}
+	})
+}
+
+// requeueRequest puts the specified request back into the request channel without updating the wait queue
+func (c *serverConn) requeueRequest(req *http.Request) {
+	logger := c.logger.WithValues("request", req)
+	select {
+	case <-c.wp.Closing():
+		logger.Info("connection closing, bailing on requeue")
+	case c.requestCh <- req:
+		logger.V(1).Info("request requeued")
+	}
+}
+
+func (c *serverConn) run(stop <-chan struct{}) {
+	go c.wp.Do(c.writeLoop)
+	go c.wp.Do(c.readLoop)
+
+	select {
+	case <-stop:
+		c.wp.Close(nil)
+	case <-c.wp.Closing():
+	}
+	_ = c.wp.Wait()
+}
+
+func (c *serverConn) tryCloseConnection(reason string) {
+	if err := c.conn.Close(reason); err != nil {
+		c.logger.Error(err, "failed to close tunnel connection")
+	}
+}
+
+// writeLoop starts the writers of the incoming requests, and writes the cancellations and the pings to the connection
+func (c *serverConn) writeLoop() {
+	logger := c.logger.WithName("writeLoop")
+	defer logger.V(1).Info("tunnel connection writer loop terminated")
+
+	defer c.tryCloseConnection("tunnel server terminating")
+	defer c.wp.Close(nil)
+
+	var pingCh <-chan time.Time
+	if c.pingInterval > 0 {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		pingCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.wp.Closing():
+			return
+		case <-pingCh:
+			logger.V(2).Info("sending ping")
+			if err := c.conn.Ping(); err != nil {
+				if isTemporaryError(err) {
+					logger.V(1).Error(err, "got temporary error when sending ping message")
+					continue
+				}
+				logger.Error(err, "failed to send ping message")
+				return
+			}
+		case req := <-c.requestCh:
+			if req.Context().Err() != nil {
+				logger.V(1).Info("dropping cancelled request", "request", req)
+				continue
+			}
+			logger.V(1).Info("processing request", "request", req)
+			id := getRequestID(req)
+			done := c.writes.start(id)
+			c.waitQueue.assignConn(id, c)
+			go c.wp.Do(func() {
+				defer c.writes.finish(id, done)
+				c.writeRequest(logger, req)
+			})
+		case id := <-c.cancelCh:
+			logger.V(1).Info("sending request cancellation", "id", id)
+			if err := c.writeCancel(id); err != nil {
+				if isTemporaryError(err) {
+					logger.V(1).Error(err, "got temporary error when writing cancellation to tunnel connection")
+					continue
+				}
+				logger.Error(err, "failed to write cancellation to tunnel connection", "id", id)
+				return
+			}
+		}
+	}
+}
+
+// writeRequest writes the request to the connection, taking turns with the requests written concurrently
+func (c *serverConn) writeRequest(logger logr.Logger, req *http.Request) {
+	err := writeRequest(c.conn, c.maxFrameSize, req)
+	if err != nil && req.Context().Err() != nil {
+		// the request body can't be read after the request is cancelled, the client drops the incomplete frame
+		logger.V(1).Info("request cancelled while writing it", "request", req, "error", err.Error())
+		return
+	}
+	if err != nil {
+		// not failed with the requests of the connection when it's closed
+		c.waitQueue.assignConn(getRequestID(req), nil)
+		go c.requeueRequest(req)
+		if !c.wp.Open() {
+			return // we're already closing
+		}
+		if isTemporaryError(err) {
+			logger.V(1).Error(err, "got temporary error when writing request to tunnel connection")
+			return
+		}
+		logger.Error(err, "failed to write request to tunnel connection", "request", req)
+		c.wp.Close(nil)
+	}
+}
+
+func (c *serverConn) writeCancel(id requestID) error {
+	wc, err := c.conn.NextWriter()
+	if err != nil {
+		return err
+	}
+	defer wc.Close()
+	return writeFrameHeader(wc, frameTypeCancel, 0, id)
+}
+
+type ServerOption interface {
+	ApplyToServer(*Server)
+}
+
+type ServerOptionFunc func(*Server)
+
+func (opt ServerOptionFunc) ApplyToServer(s *Server) {
+	opt(s)
+}
+
+// WithClientWaitTimeout sets the time requests wait for a tunnel client to connect when none is connected, after
+// which they fail with ErrNoClient, by default they wait until their context is done
+func WithClientWaitTimeout(timeout time.Duration) ServerOption {
+	return ServerOptionFunc(func(s *Server) {
+		s.clientWaitTimeout = timeout
+	})
+}
+
+// respondToRequest responds to the request in item using the response channel in item and closes the channel
+func respondToRequest(logger logr.Logger, item waitQueueItem, resp *http.Response, err error) {
+	if item.respCh == nil {
+		logger.Info("response channel is nil for request", "request", item.req)
+		return
+	}
+	item.respCh <- responseAndError{
+		resp: resp,
+		err:  err,
+	}
+	close(item.respCh)
+}
+
+// requestWrites tracks the requests being written to a connection
+type requestWrites struct {
+	done  map[requestID]chan struct{}
+	mutex sync.Mutex
+}
+
+// start registers the write of the request, the returned channel is closed by finish
+func (w *requestWrites) start(id requestID) chan struct{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	done := make(chan struct{})
+	w.done[id] = done
+	return done
+}
+
+func (w *requestWrites) finish(id requestID, done chan struct{}) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.done[id] == done {
+		delete(w.done, id)
+	}
+	close(done)
+}
+
+// wait waits until the request is written, or the abort channel is closed
+func (w *requestWrites) wait(id requestID, abort <-chan struct{}) {
+	w.mutex.Lock()
+	done, found := w.done[id]
+	w.mutex.Unlock()
+	if !found {
+		return
+	}
+	select {
+	case <-abort:
+	case <-done:
+	}
+}
+
+// waitQueueShardBits is the number of the bits of the hashed request IDs selecting their shards of the wait queue, the
+// requests of different shards don't wait for each other
+const (
+	waitQueueShardBits = 5
+	waitQueueShards    = 1 << waitQueueShardBits
+)
+
+// waitQueue holds the requests waiting for their responses, sharded by their IDs
+type waitQueue struct {
+	shards [waitQueueShards]waitQueueShard
+}
+
+type waitQueueShard struct {
+	items map[requestID]waitQueueItem
+	mutex sync.Mutex
+}
+
+func newWaitQueue() *waitQueue {
+	q := &waitQueue{}
+	for i := range q.shards {
+		q.shards[i].items = make(map[requestID]waitQueueItem)
+	}
+	return q
+}
+
+// shard returns the shard of the request, the IDs are hashed as they are aligned addresses
+func (q *waitQueue) shard(id requestID) *waitQueueShard {
+	return &q.shards[(id*0x9e3779b97f4a7c15)>>(64-waitQueueShardBits)]
+}
+
+// assignConn records the connection the request is sent to, so it can be cancelled
+func (q *waitQueue) assignConn(id requestID, c *serverConn) {
+	shard := q.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if item, found := shard.items[id]; found {
+		item.conn = c
+		shard.items[id] = item
+	}
+}
+
+// reassignConn assigns the requests sent to a connection to another one, and returns the number of them
+func (q *waitQueue) reassignConn(from, to *serverConn) int {
+	n := 0
+	for i := range q.shards {
+		shard := &q.shards[i]
+		shard.mutex.Lock()
+		for id, item := range shard.items {
+			if item.conn == from {
+				item.conn = to
+				shard.items[id] = item
+				n++
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return n
+}
+
+// popConnItems removes the requests sent to the connection from the queue, and returns them
+func (q *waitQueue) popConnItems(c *serverConn) []waitQueueItem {
+	var items []waitQueueItem
+	for i := range q.shards {
+		shard := &q.shards[i]
+		shard.mutex.Lock()
+		for id, item := range shard.items {
+			if item.conn == c {
+				items = append(items, item)
+				delete(shard.items, id)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return items
+}
+
+func (q *waitQueue) dropItem(id requestID) {
+	shard := q.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	delete(shard.items, id)
+}
+
+// hasItem returns whether the request is still waiting for its response
+func (q *waitQueue) hasItem(id requestID) bool {
+	shard := q.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	_, found := shard.items[id]
+	return found
+}
+
+func (q *waitQueue) len() int {
+	n := 0
+	for i := range q.shards {
+		shard := &q.shards[i]
+		shard.mutex.Lock()
+		n += len(shard.items)
+		shard.mutex.Unlock()
+	}
+	return n
+}
+
+func (q *waitQueue) popItem(id requestID) (item waitQueueItem, found bool) {
+	shard := q.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	item, found = shard.items[id]
+	if found {
+		delete(shard.items, id)
+	}
+	return
+}
+
+func (q *waitQueue) pushItem(id requestID, item waitQueueItem) {
+	shard := q.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.items[id] = item
+}
+
+type waitQueueItem struct {
+	// conn is the connection the request is sent to, nil while it's queued
+	conn   *serverConn
+	req    *http.Request
+	respCh chan<- responseAndError
+}
+
+type responseAndError struct {
+	resp *http.Response
+	err  error
+}
+
+// writeRequest writes the request to the connection, split into frames of at most maxFrameSize bytes if it's positive
+func writeRequest(conn Conn, maxFrameSize int, r *http.Request) error {
+	w, err := newFrameWriter(conn, frameTypeRequest, getRequestID(r), maxFrameSize)
+	if err != nil {
+		return err
+	}
+	if err := withRequestTimeout(r).Write(w); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
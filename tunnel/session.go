@@ -0,0 +1,273 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/banzaicloud/kurun/tunnel/pkg/unwind"
+)
+
+// maxSessionIDLength limits the size of the session IDs accepted by the server
+const maxSessionIDLength = 64
+
+// WithSessionGracePeriod makes the connections of a tunnel client and server resumable: the client sends the ID of its
+// session on each connection, and the server keeps the requests sent to a client for the grace period after its
+// connection is lost, so the responses can be sent on the next connection of the session, while the client keeps
+// handling the requests, e.g. during brief Wi-Fi drops
+// The requests of the lost connections fail with ErrClientDisconnected after the grace period, or right away without
+// one. The clients need WithReconnect to resume their sessions.
+type WithSessionGracePeriod time.Duration
+
+func (opt WithSessionGracePeriod) ApplyToClientConfig(c *ClientConfig) {
+	c.sessionGracePeriod = time.Duration(opt)
+}
+
+func (opt WithSessionGracePeriod) ApplyToServer(s *Server) {
+	s.sessionGracePeriod = time.Duration(opt)
+}
+
+// serverSessions tracks the sessions of the clients connected to the server, and of the ones which lost their
+// connections in the grace period
+type serverSessions struct {
+	gracePeriod time.Duration
+	logger      logr.Logger
+	mutex       sync.Mutex
+	sessions    map[string]*serverSession
+	waitQueue   *waitQueue
+}
+
+type serverSession struct {
+	conn *serverConn
+	// expiry fails the requests of the lost connection of the session after the grace period, nil while it's connected
+	expiry *time.Timer
+}
+
+func newServerSessions(gracePeriod time.Duration, waitQueue *waitQueue, logger logr.Logger) *serverSessions {
+	return &serverSessions{
+		gracePeriod: gracePeriod,
+		logger:      logger,
+		sessions:    make(map[string]*serverSession),
+		waitQueue:   waitQueue,
+	}
+}
+
+// attach makes the connection the one of the session, the requests sent to the previous connection of the session are
+// reattached to it, and the previous connection is closed if it's still open (e.g. its loss is not detected yet)
+func (s *serverSessions) attach(id string, c *serverConn) {
+	if s.gracePeriod <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c.session = id
+	session, found := s.sessions[id]
+	s.sessions[id] = &serverSession{conn: c}
+	if !found || session.conn == c {
+		return
+	}
+	if session.expiry != nil {
+		session.expiry.Stop()
+	}
+	resumed := s.waitQueue.reassignConn(session.conn, c)
+	session.conn.wp.Close(nil)
+	c.logger.Info("tunnel client session resumed", "session", id, "requests", resumed)
+}
+
+// detach handles the loss of the connection, its requests are failed after the grace period unless the session is
+// resumed, or right away if it's not the connection of a session
+func (s *serverSessions) detach(c *serverConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, found := s.sessions[c.session]
+	if !found || session.conn != c {
+		// the requests of the connections replaced by a newer one of their sessions have been reattached already
+		s.failRequests(c)
+		return
+	}
+	session.expiry = time.AfterFunc(s.gracePeriod, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.sessions[c.session] != session {
+			return
+		}
+		delete(s.sessions, c.session)
+		c.logger.Info("tunnel client session expired", "session", c.session)
+		s.failRequests(c)
+	})
+}
+
+// failRequests fails the requests sent to the connection, as their responses can't be received anymore
+func (s *serverSessions) failRequests(c *serverConn) {
+	for _, item := range s.waitQueue.popConnItems(c) {
+		respondToRequest(c.logger, item, nil, ErrClientDisconnected)
+	}
+}
+
+// newSessionID returns a random session ID
+func newSessionID() string {
+	var id [16]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// clientSession keeps the requests of a client with resumable connections (see WithSessionGracePeriod) handled across
+// its connections, the responses are written to the current connection, waiting for the next one for the grace period
+// if there's none
+type clientSession struct {
+	// ctx is cancelled when the client stops, cancelling the requests being handled
+	ctx         context.Context
+	gracePeriod time.Duration
+	handlers    sync.WaitGroup
+	id          string
+	logger      logr.Logger
+	requests    requestCancels
+
+	mutex sync.Mutex
+	// attached is closed when a connection is attached to the session
+	attached chan struct{}
+	conn     *client
+	detached time.Time
+}
+
+func newClientSession(ctx context.Context, gracePeriod time.Duration, logger logr.Logger) *clientSession {
+	s := &clientSession{
+		attached:    make(chan struct{}),
+		ctx:         ctx,
+		detached:    time.Now(),
+		gracePeriod: gracePeriod,
+		id:          newSessionID(),
+		requests: requestCancels{
+			cancels: make(map[requestID]context.CancelFunc),
+		},
+	}
+	s.logger = logger.WithValues("session", s.id)
+	return s
+}
+
+// attach sends the ID of the session on the connection, and makes it the current one of the session
+func (s *clientSession) attach(c *client) error {
+	w, err := newFrameWriter(c.conn, frameTypeSession, 0, c.maxFrameSize)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, s.id); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conn = c
+	close(s.attached)
+	return nil
+}
+
+// detach is called when the connection is closed, the responses wait for the next one
+func (s *clientSession) detach(c *client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != c {
+		return
+	}
+	s.conn = nil
+	s.attached = make(chan struct{})
+	s.detached = time.Now()
+}
+
+// currentConn returns the current connection of the session, waiting for the next one until the end of the grace
+// period, it's nil if there's none
+func (s *clientSession) currentConn() *client {
+	for {
+		s.mutex.Lock()
+		conn, attached, detached := s.conn, s.attached, s.detached
+		s.mutex.Unlock()
+		if conn != nil {
+			return conn
+		}
+
+		timer := time.NewTimer(time.Until(detached.Add(s.gracePeriod)))
+		select {
+		case <-attached:
+			timer.Stop()
+		case <-timer.C:
+			return nil
+		case <-s.ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// handleRequest handles the request received on the connection in the background, until the client stops
+func (s *clientSession) handleRequest(c *client, reqID requestID, req *http.Request, cancel context.CancelFunc) {
+	s.handlers.Add(1)
+	go func() {
+		defer s.handlers.Done()
+		uc := unwind.WithHandler(func(reason interface{}) {
+			s.logger.Error(reasonToError(reason, "while handling request"), "request handler failed")
+		})
+		uc.Do(func() {
+			logger := s.logger.WithValues("id", reqID, "request", req)
+			logger.V(1).Info("handling request")
+
+			defer triggerWhenClosed(s.ctx.Done(), cancel)() // cancel request if client is stopping
+
+			s.writeResponse(logger, responseItem{
+				ctx:   req.Context(),
+				reqID: reqID,
+				resp:  c.roundTrip(logger, req),
+			})
+		})
+	}()
+}
+
+// writeResponse writes the response to the current connection of the session, if that fails the loss of the response
+// is reported on the next connection, as a part of it may have been sent already
+func (s *clientSession) writeResponse(logger logr.Logger, item responseItem) {
+	defer s.requests.done(item.reqID)
+	for {
+		c := s.currentConn()
+		if c == nil {
+			logger.Info("no tunnel connection in the session grace period, dropping response")
+			_ = item.resp.Body.Close()
+			return
+		}
+		err := writeResponse(c.conn, c.maxFrameSize, item)
+		if err == nil {
+			c.touch()
+			c.resetPingTicker()
+			return
+		}
+		_ = item.resp.Body.Close()
+		if item.ctx.Err() != nil {
+			logger.V(1).Info("request cancelled while writing response", "error", err.Error())
+			return
+		}
+		logger.Info("failed to write response to tunnel connection, reporting it on the next connection", "error", err.Error())
+		c.wp.Close(err)
+		s.detach(c)
+		item.resp = (&DownstreamError{
+			Kind:    DownstreamErrorKindConnection,
+			Message: "tunnel connection lost while sending the response",
+		}).Response()
+	}
+}
+
+// wait waits until the requests handled in the session are done, after the client stopped
+func (s *clientSession) wait() {
+	s.handlers.Wait()
+}
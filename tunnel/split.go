@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"math/rand"
+	"net/http"
+)
+
+// NewSplitHandler returns a handler that sends requests matching any of the specified matchers through the tunnel
+// and every other request to the fallback handler
+func NewSplitHandler(tunnelHandler, fallbackHandler http.Handler, matchers ...RequestMatcher) *SplitHandler {
+	return &SplitHandler{
+		FallbackHandler: fallbackHandler,
+		Matchers:        matchers,
+		TunnelHandler:   tunnelHandler,
+	}
+}
+
+// SplitHandler splits traffic between the tunnel and a fallback (e.g. the in-cluster workload)
+type SplitHandler struct {
+	FallbackHandler http.Handler
+	Matchers        []RequestMatcher
+	TunnelHandler   http.Handler
+}
+
+func (sh SplitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, matcher := range sh.Matchers {
+		if matcher != nil && matcher.MatchRequest(r) {
+			sh.TunnelHandler.ServeHTTP(w, r)
+			return
+		}
+	}
+	sh.FallbackHandler.ServeHTTP(w, r)
+}
+
+type RequestMatcher interface {
+	MatchRequest(*http.Request) bool
+}
+
+type RequestMatcherFunc func(*http.Request) bool
+
+func (fn RequestMatcherFunc) MatchRequest(r *http.Request) bool {
+	return fn(r)
+}
+
+// HeaderMatcher matches requests having the specified header with the specified value
+func HeaderMatcher(name, value string) RequestMatcher {
+	return RequestMatcherFunc(func(r *http.Request) bool {
+		for _, v := range r.Header.Values(name) {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// PercentageMatcher matches approximately the specified percentage of requests
+func PercentageMatcher(percent int) RequestMatcher {
+	return RequestMatcherFunc(func(*http.Request) bool {
+		return rand.Intn(100) < percent
+	})
+}
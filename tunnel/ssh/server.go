@@ -0,0 +1,172 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"golang.org/x/crypto/ssh"
+)
+
+// targetDialTimeout limits the time spent on connecting to the target of a channel
+const targetDialTimeout = 10 * time.Second
+
+// NewServer returns the SSH server with the host key, accepting the clients authenticating with the authorized keys
+func NewServer(hostKey ssh.Signer, authorizedKeys []ssh.PublicKey, options ...ServerOption) *Server {
+	s := &Server{
+		authorizedKeys: authorizedKeys,
+		logger:         logr.Discard(),
+	}
+	for _, opt := range options {
+		if opt != nil {
+			opt.ApplyToServer(s)
+		}
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: s.authenticate,
+	}
+	s.config.AddHostKey(hostKey)
+	return s
+}
+
+// Server is an SSH server only opening the direct-tcpip channels (local port forwards) of its clients to the permitted
+// targets, so the clients can reach the tunnel server next to it and nothing else
+// Sessions (shells and commands) and remote port forwards are rejected.
+type Server struct {
+	authorizedKeys   []ssh.PublicKey
+	config           *ssh.ServerConfig
+	logger           logr.Logger
+	permittedTargets []string
+}
+
+type ServerOption interface {
+	ApplyToServer(*Server)
+}
+
+type WithLogger logr.Logger
+
+func (opt WithLogger) ApplyToServer(s *Server) {
+	s.logger = logr.Logger(opt)
+}
+
+// WithPermittedTargets are the host:port addresses the clients may open channels to, all of them are rejected without it
+type WithPermittedTargets []string
+
+func (opt WithPermittedTargets) ApplyToServer(s *Server) {
+	s.permittedTargets = append(s.permittedTargets, opt...)
+}
+
+// Serve serves the connections accepted by the listener until it's closed
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(netConn)
+	}
+}
+
+// ServeConn serves the connection until either side closes it
+func (s *Server) ServeConn(netConn net.Conn) {
+	defer netConn.Close()
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		s.logger.V(1).Info("SSH handshake failed", "remoteAddr", netConn.RemoteAddr().String(), "error", err.Error())
+		return
+	}
+	defer sshConn.Close()
+	logger := s.logger.WithValues("remoteAddr", sshConn.RemoteAddr().String(), "user", sshConn.User())
+	logger.Info("connection received")
+
+	// the global requests (e.g. tcpip-forward) are rejected
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip channels are supported")
+			continue
+		}
+		wg.Add(1)
+		go func(newChannel ssh.NewChannel) {
+			defer wg.Done()
+			s.serveDirectTCPIP(newChannel, logger)
+		}(newChannel)
+	}
+	logger.Info("connection closed")
+}
+
+// directTCPIPPayload is the payload of the direct-tcpip channel requests, see RFC 4254 7.2
+type directTCPIPPayload struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+func (s *Server) serveDirectTCPIP(newChannel ssh.NewChannel, logger logr.Logger) {
+	var payload directTCPIPPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip payload")
+		return
+	}
+	target := net.JoinHostPort(payload.Host, strconv.FormatUint(uint64(payload.Port), 10))
+	if !s.permitted(target) {
+		logger.Info("rejected channel to target not permitted", "target", target)
+		_ = newChannel.Reject(ssh.Prohibited, "target not permitted")
+		return
+	}
+
+	targetConn, err := net.DialTimeout("tcp", target, targetDialTimeout)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer targetConn.Close()
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	logger.V(1).Info("channel opened", "target", target)
+	copyDone := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(targetConn, channel)
+		copyDone <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(channel, targetConn)
+		copyDone <- struct{}{}
+	}()
+	// either side closing the connection closes both
+	<-copyDone
+	logger.V(1).Info("channel closed", "target", target)
+}
+
+func (s *Server) permitted(target string) bool {
+	for _, permittedTarget := range s.permittedTargets {
+		if target == permittedTarget {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	for _, authorizedKey := range s.authorizedKeys {
+		if bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+			return nil, nil
+		}
+	}
+	return nil, errors.New("unauthorized key")
+}
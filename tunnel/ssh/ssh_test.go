@@ -0,0 +1,212 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	tunnelws "github.com/banzaicloud/kurun/tunnel/websocket"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer
+}
+
+// sshServer serves the SSH server on a loopback port and keeps its connections, so they can be dropped
+type sshServer struct {
+	addr  string
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startSSHServer(t *testing.T, server *Server) *sshServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	s := &sshServer{addr: listener.Addr().String()}
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, netConn)
+			s.mu.Unlock()
+			go server.ServeConn(netConn)
+		}
+	}()
+	return s
+}
+
+func (s *sshServer) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, netConn := range s.conns {
+		_ = netConn.Close()
+	}
+	s.conns = nil
+}
+
+// startTunnel starts a WebSocket tunnel server on a loopback port, and returns its URL
+func startTunnel(t *testing.T, tunnelServer *tunnelws.Server) string {
+	server := httptest.NewServer(tunnelServer)
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func clientConfig(signer ssh.Signer, hostKey ssh.PublicKey) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            "kurun",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         5 * time.Second,
+	}
+}
+
+func TestTransport(t *testing.T) {
+	tunnelServer := tunnelws.NewServer()
+	target := startTunnel(t, tunnelServer)
+
+	hostKey, clientKey := newSigner(t), newSigner(t)
+	server := startSSHServer(t, NewServer(hostKey, []ssh.PublicKey{clientKey.PublicKey()}, WithPermittedTargets{strings.TrimPrefix(target, "ws://")}))
+
+	events := make(chan tunnel.ConnectionEvent, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- tunnel.RunClient(ctx, *tunnel.NewClientConfig(server.addr, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Proto:      req.Proto,
+				ProtoMajor: req.ProtoMajor,
+				ProtoMinor: req.ProtoMinor,
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader("through ssh " + req.URL.Path)),
+			}, nil
+		}),
+			tunnel.WithTransport(Transport{
+				Config: clientConfig(clientKey, hostKey.PublicKey()),
+				Target: target,
+			}),
+			tunnel.WithReconnect(10*time.Millisecond, 100*time.Millisecond),
+			tunnel.WithConnectionEventHandler(func(event tunnel.ConnectionEvent) {
+				events <- event
+			}),
+		))
+	}()
+
+	roundTrip := func(path string) {
+		reqCtx, cancelReq := context.WithTimeout(ctx, 5*time.Second)
+		defer cancelReq()
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, path, nil)
+		require.NoError(t, err)
+		resp, err := tunnelServer.RoundTrip(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "through ssh "+path, string(body))
+	}
+	waitForEvent := func(eventType tunnel.ConnectionEventType) {
+		for {
+			select {
+			case event := <-events:
+				if event.Type == eventType {
+					return
+				}
+			case err := <-clientErr:
+				t.Fatalf("tunnel client exited: %v", err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s event", eventType)
+			}
+		}
+	}
+
+	waitForEvent(tunnel.ConnectionEventConnected)
+	roundTrip("/first")
+
+	// the client reconnects through the SSH server when the SSH connection is dropped
+	server.dropConns()
+	waitForEvent(tunnel.ConnectionEventDisconnected)
+	waitForEvent(tunnel.ConnectionEventReconnecting)
+	waitForEvent(tunnel.ConnectionEventConnected)
+	roundTrip("/second")
+
+	cancel()
+	select {
+	case err := <-clientErr:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel client not stopped")
+	}
+}
+
+func TestTransportRejected(t *testing.T) {
+	target := startTunnel(t, tunnelws.NewServer())
+	hostKey, clientKey := newSigner(t), newSigner(t)
+	server := startSSHServer(t, NewServer(hostKey, []ssh.PublicKey{clientKey.PublicKey()}, WithPermittedTargets{strings.TrimPrefix(target, "ws://")}))
+
+	testCases := map[string]struct {
+		config *ssh.ClientConfig
+		target string
+		err    string
+	}{
+		"unauthorized key": {
+			config: clientConfig(newSigner(t), hostKey.PublicKey()),
+			target: target,
+			err:    "SSH handshake failed",
+		},
+		"unknown host key": {
+			config: clientConfig(clientKey, newSigner(t).PublicKey()),
+			target: target,
+			err:    "SSH handshake failed",
+		},
+		"target not permitted": {
+			config: clientConfig(clientKey, hostKey.PublicKey()),
+			target: "ws://127.0.0.1:1",
+			err:    "target not permitted",
+		},
+	}
+	for name, testCase := range testCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := Transport{Config: testCase.config, Target: testCase.target}.Dial(ctx, server.addr)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), testCase.err)
+		})
+	}
+}
+
+func TestServerRejectsSessionsAndRemoteForwards(t *testing.T) {
+	hostKey, clientKey := newSigner(t), newSigner(t)
+	server := startSSHServer(t, NewServer(hostKey, []ssh.PublicKey{clientKey.PublicKey()}, WithPermittedTargets{"127.0.0.1:1"}))
+
+	client, err := ssh.Dial("tcp", server.addr, clientConfig(clientKey, hostKey.PublicKey()))
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.NewSession()
+	require.Error(t, err)
+	_, err = client.Listen("tcp", "127.0.0.1:0")
+	require.Error(t, err)
+}
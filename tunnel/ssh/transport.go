@@ -0,0 +1,99 @@
+// Package ssh implements a transport of the tunnel over the direct-tcpip channels of an SSH server, for clusters
+// where the WebSocket upgrades through the API server proxy are blocked but an SSH server next to the tunnel server is
+// reachable
+// The WebSocket connection to the tunnel server is opened through the SSH server, so the tunnel server itself doesn't
+// need to be exposed, and the SSH keys authenticate both sides.
+package ssh
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/banzaicloud/kurun/tunnel"
+	tunnelws "github.com/banzaicloud/kurun/tunnel/websocket"
+)
+
+// Transport dials the tunnel servers through SSH servers, the addresses are the host:port of the SSH servers
+type Transport struct {
+	// Config authenticates the client to the SSH server and verifies the host key of the server
+	Config *ssh.ClientConfig
+	// Header is sent on the WebSocket connection requests, see websocket.Transport
+	Header http.Header
+	// IdleTimeout closes the connections not receiving anything from the server in it if it's positive
+	IdleTimeout time.Duration
+	Logger      logr.Logger
+	// Target is the ws:// or wss:// URL of the tunnel server as reached from the SSH server
+	Target string
+	// TLSConfig is used for wss:// targets
+	TLSConfig *tls.Config
+}
+
+func (t Transport) Dial(ctx context.Context, addr string) (tunnel.Conn, error) {
+	client, err := dialSSH(ctx, addr, t.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	wsTransport := tunnelws.Transport{
+		DialerCtor: func() *websocket.Dialer {
+			return &websocket.Dialer{
+				NetDial:         client.Dial,
+				TLSClientConfig: t.TLSConfig,
+			}
+		},
+		Header:      t.Header,
+		IdleTimeout: t.IdleTimeout,
+		Logger:      t.Logger,
+	}
+	wsConn, err := wsTransport.Dial(ctx, t.Target)
+	if err != nil {
+		_ = client.Close()
+		return nil, errors.WrapIfWithDetails(err, "failed to connect to the tunnel server through the SSH server", "addr", addr, "target", t.Target)
+	}
+	return &conn{Conn: wsConn, client: client}, nil
+}
+
+// dialSSH connects to the SSH server, the handshake is cancelled with the context as well as the dial
+func dialSSH(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.WrapIfWithDetails(err, "failed to connect to the SSH server", "addr", addr)
+	}
+
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = netConn.Close()
+		case <-handshakeDone:
+		}
+	}()
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	close(handshakeDone)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, errors.WrapIfWithDetails(err, "SSH handshake failed", "addr", addr)
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// conn is the tunnel connection through the SSH client, closing the client with it
+type conn struct {
+	tunnel.Conn
+	client *ssh.Client
+}
+
+func (c *conn) Close(reason string) error {
+	err := c.Conn.Close(reason)
+	_ = c.client.Close()
+	return err
+}
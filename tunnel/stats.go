@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxLatencySamples limits the memory used for the latency percentiles of long sessions, the samples are a uniform
+// random subset of the requests beyond it
+const maxLatencySamples = 10000
+
+// Stats collects statistics of the requests relayed by a tunnel client
+type Stats struct {
+	mu sync.Mutex
+
+	bytesDown    int64
+	bytesUp      int64
+	clientErrors int
+	connections  int
+	errors       int
+	latencies    []time.Duration
+	requests     int
+	serverErrors int
+}
+
+// StatsSummary is a summary of the statistics of the requests relayed by a tunnel client
+type StatsSummary struct {
+	// BytesDown is the size of the response bodies sent to the tunnel
+	BytesDown int64
+	// BytesUp is the size of the request bodies received through the tunnel
+	BytesUp int64
+	// ClientErrors is the number of 4xx responses
+	ClientErrors int
+	// Errors is the number of requests failed to be sent to the downstream
+	Errors int
+	// LatencyP50, LatencyP95 and LatencyP99 are percentiles of the time from sending the request to the downstream to
+	// reading the end of the response body
+	LatencyP50 time.Duration
+	LatencyP95 time.Duration
+	LatencyP99 time.Duration
+	// Reconnects is the number of connections to the tunnel server after the first one
+	Reconnects int
+	Requests   int
+	// ServerErrors is the number of 5xx responses
+	ServerErrors int
+}
+
+func NewStats() *Stats {
+	return &Stats{}
+}
+
+// RecordConnection records a connection (attempt) of the tunnel client to the tunnel server
+func (s *Stats) RecordConnection() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connections++
+}
+
+// RoundTripper returns a round tripper recording the requests sent by the tunnel client to the downstream
+func (s *Stats) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		start := time.Now()
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countingReadCloser{ReadCloser: r.Body, onClose: func(n int64) {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				s.bytesUp += n
+			}}
+		}
+
+		resp, err := next.RoundTrip(r)
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.requests++
+			s.errors++
+			return resp, err
+		}
+
+		statusCode := resp.StatusCode
+		resp.Body = &countingReadCloser{ReadCloser: resp.Body, onClose: func(n int64) {
+			s.recordResponse(statusCode, n, time.Since(start))
+		}}
+		return resp, nil
+	})
+}
+
+func (s *Stats) recordResponse(statusCode int, size int64, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	s.bytesDown += size
+	switch {
+	case statusCode >= 500:
+		s.serverErrors++
+	case statusCode >= 400:
+		s.clientErrors++
+	}
+
+	if len(s.latencies) < maxLatencySamples {
+		s.latencies = append(s.latencies, latency)
+	} else if i := rand.Intn(s.requests); i < maxLatencySamples {
+		s.latencies[i] = latency
+	}
+}
+
+// Summary returns the summary of the statistics collected so far
+func (s *Stats) Summary() StatsSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := StatsSummary{
+		BytesDown:    s.bytesDown,
+		BytesUp:      s.bytesUp,
+		ClientErrors: s.clientErrors,
+		Errors:       s.errors,
+		Requests:     s.requests,
+		ServerErrors: s.serverErrors,
+	}
+	if s.connections > 1 {
+		summary.Reconnects = s.connections - 1
+	}
+
+	if len(s.latencies) > 0 {
+		latencies := append([]time.Duration(nil), s.latencies...)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		percentile := func(p int) time.Duration {
+			return latencies[(len(latencies)-1)*p/100]
+		}
+		summary.LatencyP50 = percentile(50)
+		summary.LatencyP95 = percentile(95)
+		summary.LatencyP99 = percentile(99)
+	}
+
+	return summary
+}
+
+// countingReadCloser counts the bytes read, and reports them once when closed
+type countingReadCloser struct {
+	io.ReadCloser
+	n       int64
+	once    sync.Once
+	onClose func(int64)
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() {
+		c.onClose(c.n)
+	})
+	return err
+}
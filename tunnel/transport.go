@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+)
+
+// Conn is a message oriented connection between a tunnel server and a tunnel client
+// The messages are read by one goroutine and written by another one at a time.
+type Conn interface {
+	// NextReader returns the reader of the next message, it's invalidated by the next call
+	NextReader() (io.Reader, error)
+	// NextWriter returns the writer of the next message, the message is sent when the writer is closed
+	NextWriter() (io.WriteCloser, error)
+	// Ping sends a keepalive message to the peer, if the transport has one
+	Ping() error
+	// Close closes the connection, sending the reason to the peer if the transport supports it
+	Close(reason string) error
+}
+
+// ConnClosedError is returned by the connections closed by the peer
+type ConnClosedError struct {
+	Reason string
+}
+
+func (e *ConnClosedError) Error() string {
+	if e.Reason == "" {
+		return "connection closed by peer"
+	}
+	return "connection closed by peer: " + e.Reason
+}
+
+// Transport establishes the connections of the tunnel clients to the tunnel servers
+// The server side of the transport passes the accepted connections to Server.ServeConn. The transports are configured
+// for each client with WithTransport, the kurun command line selects them by name, see its extension package.
+type Transport interface {
+	Dial(ctx context.Context, addr string) (Conn, error)
+}
+
+type TransportFunc func(ctx context.Context, addr string) (Conn, error)
+
+func (fn TransportFunc) Dial(ctx context.Context, addr string) (Conn, error) {
+	return fn(ctx, addr)
+}
@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"emperror.dev/errors"
+)
+
+// TunnelMatcher returns the ID of the tunnel the request is sent through by a server serving several independent
+// tunnels, and the request to send (e.g. without the path prefix of the tunnel), ok is false if it matches no tunnel
+type TunnelMatcher func(req *http.Request) (id string, tunnelReq *http.Request, ok bool)
+
+// HostTunnelMatcher matches the requests to the tunnels by the subdomain of the domain in their Host header, e.g. the
+// requests of alice.tunnels.example.com are sent through the tunnel alice of the domain tunnels.example.com
+func HostTunnelMatcher(domain string) TunnelMatcher {
+	suffix := "." + strings.Trim(strings.ToLower(domain), ".")
+	return func(req *http.Request) (string, *http.Request, bool) {
+		host := strings.ToLower(req.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		id := strings.TrimSuffix(host, suffix)
+		if id == host || !validTunnelID(id) {
+			return "", req, false
+		}
+		return id, req, true
+	}
+}
+
+// PathTunnelMatcher matches the requests to the tunnels by the first segment of their path, which is removed from the
+// requests, e.g. /alice/webhook is sent through the tunnel alice as /webhook
+func PathTunnelMatcher() TunnelMatcher {
+	return func(req *http.Request) (string, *http.Request, bool) {
+		id, rest := splitFirstSegment(req.URL.Path)
+		if !validTunnelID(id) {
+			return "", req, false
+		}
+		tunnelReq := req.Clone(req.Context())
+		tunnelReq.URL.Path = rest
+		if req.URL.RawPath != "" {
+			_, tunnelReq.URL.RawPath = splitFirstSegment(req.URL.RawPath)
+		}
+		tunnelReq.RequestURI = ""
+		return id, tunnelReq, true
+	}
+}
+
+// NewTunnelRoundTripper returns the round tripper of a server serving several independent tunnels, sending the requests
+// through the round tripper of the tunnel matched by the matcher, tunnel returns nil for unknown tunnels
+// The requests matching no known tunnel fail with ErrNoClient.
+func NewTunnelRoundTripper(match TunnelMatcher, tunnel func(id string) http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		id, tunnelReq, ok := match(req)
+		if !ok {
+			return nil, errors.WrapWithDetails(ErrNoClient, "the request matches no tunnel", "host", req.Host, "path", req.URL.Path)
+		}
+		roundTripper := tunnel(id)
+		if roundTripper == nil {
+			return nil, errors.WrapWithDetails(ErrNoClient, "unknown tunnel", "tunnel", id)
+		}
+		return roundTripper.RoundTrip(tunnelReq)
+	})
+}
+
+// splitFirstSegment returns the first segment of the path, and the rest of it
+func splitFirstSegment(path string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(parts) < 2 {
+		return parts[0], "/"
+	}
+	return parts[0], "/" + parts[1]
+}
+
+// validTunnelID returns whether the ID can identify a tunnel in a Host header or a path segment
+func validTunnelID(id string) bool {
+	if id == "" || len(id) > 63 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
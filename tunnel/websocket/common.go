@@ -1,12 +1,11 @@
 package websocket
 
 import (
-	"net"
-	"net/http"
-	"unsafe"
+	"time"
 
-	"emperror.dev/errors"
 	"github.com/go-logr/logr"
+
+	"github.com/banzaicloud/kurun/tunnel"
 )
 
 type WithLogger logr.Logger
@@ -16,32 +15,52 @@ func (opt WithLogger) ApplyToClientConfig(c *ClientConfig) {
 }
 
 func (opt WithLogger) ApplyToServer(s *Server) {
-	s.logger = logr.Logger(opt).WithValues("server", s)
+	s.logger = logr.Logger(opt)
+}
+
+// WithMaxFrameSize sets the maximal size of the frames sent by a tunnel client or server, see tunnel.WithMaxFrameSize
+type WithMaxFrameSize int
+
+func (opt WithMaxFrameSize) ApplyToClientConfig(c *ClientConfig) {
+	c.clientOptions = append(c.clientOptions, tunnel.WithMaxFrameSize(opt))
+}
+
+func (opt WithMaxFrameSize) ApplyToServer(s *Server) {
+	s.serverOptions = append(s.serverOptions, tunnel.WithMaxFrameSize(opt))
+}
+
+// WithPingInterval sets the interval of the pings sent by a tunnel client or server, see tunnel.WithPingInterval
+type WithPingInterval time.Duration
+
+func (opt WithPingInterval) ApplyToClientConfig(c *ClientConfig) {
+	c.clientOptions = append(c.clientOptions, tunnel.WithPingInterval(opt))
+}
+
+func (opt WithPingInterval) ApplyToServer(s *Server) {
+	s.serverOptions = append(s.serverOptions, tunnel.WithPingInterval(opt))
+}
+
+// WithIdleTimeout closes the connections of a tunnel client or server with ErrIdleTimeout when nothing (not even a
+// ping or a pong) is received from the peer in the timeout, zero disables it
+// The timeout should be a few times the ping interval of either side, so the connections of idle tunnels are kept.
+type WithIdleTimeout time.Duration
+
+func (opt WithIdleTimeout) ApplyToClientConfig(c *ClientConfig) {
+	c.idleTimeout = time.Duration(opt)
 }
 
-func isTemporaryError(err error) bool {
-	if e := new(net.Error); errors.As(err, e) {
-		return (*e).Temporary()
-	}
-	return false
+func (opt WithIdleTimeout) ApplyToServer(s *Server) {
+	s.idleTimeout = time.Duration(opt)
 }
 
-type requestID = uint64
+// WithSessionGracePeriod makes the connections of a tunnel client and server resumable, see
+// tunnel.WithSessionGracePeriod
+type WithSessionGracePeriod time.Duration
 
-func getRequestID(r *http.Request) requestID {
-	return uint64(uintptr(unsafe.Pointer(r)))
+func (opt WithSessionGracePeriod) ApplyToClientConfig(c *ClientConfig) {
+	c.clientOptions = append(c.clientOptions, tunnel.WithSessionGracePeriod(opt))
 }
 
-func reasonToError(reason interface{}, context string) (err error) {
-	if reason == nil {
-		err = errors.Errorf("goexit %s", context)
-	} else {
-		msg := "panic %s"
-		if e, ok := reason.(error); ok {
-			err = errors.WithMessagef(e, msg, context)
-		} else {
-			err = errors.WithDetails(errors.Errorf(msg, context), "reason", reason)
-		}
-	}
-	return
+func (opt WithSessionGracePeriod) ApplyToServer(s *Server) {
+	s.serverOptions = append(s.serverOptions, tunnel.WithSessionGracePeriod(opt))
 }
@@ -0,0 +1,155 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/websocket"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+// closeTimeout limits the time spent on sending the close message to the peer
+const closeTimeout = 5 * time.Second
+
+// pingTimeout limits the time spent on sending a ping, so a stalled peer fails the ping (and the loop sending it)
+// instead of blocking it
+const pingTimeout = 5 * time.Second
+
+// HandshakeError is returned by Transport.Dial when the server (or a proxy in between) responds to the WebSocket
+// handshake with an HTTP status other than 101 Switching Protocols
+type HandshakeError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HandshakeError) Error() string {
+	return websocket.ErrBadHandshake.Error() + ": " + e.Status
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return websocket.ErrBadHandshake
+}
+
+// ErrIdleTimeout is returned by the connections not receiving anything from the peer in their idle timeout
+var ErrIdleTimeout = errors.Sentinel("no message received from the peer in the idle timeout")
+
+// Transport dials the tunnel servers with WebSockets, the addresses are ws:// or wss:// URLs
+type Transport struct {
+	// DialerCtor returns the dialer of each connection, websocket.DefaultDialer is used if it's nil
+	DialerCtor func() *websocket.Dialer
+	// Header is sent on the connection requests, e.g. the token of the tunnel (see WithTunnelToken)
+	Header http.Header
+	// IdleTimeout closes the connections not receiving anything from the server in it if it's positive
+	IdleTimeout time.Duration
+	Logger      logr.Logger
+}
+
+func (t Transport) Dial(ctx context.Context, addr string) (tunnel.Conn, error) {
+	dialer := websocket.DefaultDialer
+	if dialerCtor := t.DialerCtor; dialerCtor != nil {
+		dialer = dialerCtor()
+	}
+
+	wsConn, resp, err := dialer.DialContext(ctx, addr, t.Header)
+	if errors.Is(err, websocket.ErrBadHandshake) && resp != nil {
+		return nil, &HandshakeError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger := t.Logger
+	if logger.GetSink() == nil {
+		logger = logr.Discard()
+	}
+	logger = logger.WithValues("wsConn", wsConn)
+	wsConn.SetPongHandler(func(appData string) error {
+		logger.V(1).Info("received pong", "appData", appData)
+		return nil
+	})
+
+	return newConn(wsConn, t.IdleTimeout), nil
+}
+
+// NewConn returns the tunnel connection of the WebSocket connection, the messages of the tunnel are sent as binary
+// messages
+func NewConn(wsConn *websocket.Conn) tunnel.Conn {
+	return newConn(wsConn, 0)
+}
+
+// newConn returns the tunnel connection of the WebSocket connection, failing with ErrIdleTimeout when nothing is
+// received from the peer in the idle timeout if it's positive
+func newConn(wsConn *websocket.Conn, idleTimeout time.Duration) tunnel.Conn {
+	c := &conn{
+		idleTimeout: idleTimeout,
+		wsConn:      wsConn,
+	}
+	if idleTimeout > 0 {
+		// the control messages are handled while waiting for the next data message, so they extend the deadline too
+		pingHandler := wsConn.PingHandler()
+		wsConn.SetPingHandler(func(appData string) error {
+			c.extendReadDeadline()
+			return pingHandler(appData)
+		})
+		pongHandler := wsConn.PongHandler()
+		wsConn.SetPongHandler(func(appData string) error {
+			c.extendReadDeadline()
+			return pongHandler(appData)
+		})
+		c.extendReadDeadline()
+	}
+	return c
+}
+
+type conn struct {
+	idleTimeout time.Duration
+	wsConn      *websocket.Conn
+}
+
+// extendReadDeadline sets the read deadline of the connection to the end of the idle timeout from now
+func (c *conn) extendReadDeadline() {
+	_ = c.wsConn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+}
+
+func (c *conn) NextReader() (io.Reader, error) {
+	for {
+		typ, rdr, err := c.wsConn.NextReader()
+		if err != nil {
+			if closeError, ok := err.(*websocket.CloseError); ok {
+				return nil, errors.WithStack(&tunnel.ConnClosedError{Reason: closeError.Text})
+			}
+			if netErr := net.Error(nil); c.idleTimeout > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+				// not a temporary error, the connection can't be read anymore
+				return nil, errors.WithStack(ErrIdleTimeout)
+			}
+			return nil, err
+		}
+		if c.idleTimeout > 0 {
+			c.extendReadDeadline()
+		}
+		if typ == websocket.BinaryMessage {
+			return rdr, nil
+		}
+		// other data messages are skipped, control messages are handled by the connection
+	}
+}
+
+func (c *conn) NextWriter() (io.WriteCloser, error) {
+	return c.wsConn.NextWriter(websocket.BinaryMessage)
+}
+
+func (c *conn) Ping() error {
+	return c.wsConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingTimeout))
+}
+
+func (c *conn) Close(reason string) error {
+	data := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	err := c.wsConn.WriteControl(websocket.CloseMessage, data, time.Now().Add(closeTimeout))
+	return errors.Combine(err, c.wsConn.Close())
+}
@@ -3,18 +3,25 @@ package websocket
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"text/template"
 	"time"
 
 	"emperror.dev/errors"
 	"github.com/banzaicloud/kurun/tunnel"
+	"github.com/go-logr/logr"
 	logrtesting "github.com/go-logr/logr/testing"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
@@ -204,11 +211,69 @@ func TestProxiedErrorMessage(t *testing.T) {
 	require.NotNil(t, resp)
 	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
 	require.NoError(t, err)
+	require.Equal(t, tunnel.DownstreamErrorKindConnection, resp.Header.Get(tunnel.DownstreamErrorHeader))
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
 
 	dat, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	require.NoError(t, err)
-	require.Equal(t, errMsg, string(dat))
+	require.JSONEq(t, fmt.Sprintf(`{"error":%q,"kind":"connection"}`, errMsg), string(dat))
+}
+
+func TestDownstreamErrorKinds(t *testing.T) {
+	tunnelServer := NewServer()
+	tunnelControlServer := httptest.NewServer(tunnelServer)
+	defer tunnelControlServer.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := listener.Addr().String()
+	listener.Close()
+
+	targets := map[string]string{
+		"/dns":     "kurun-test.invalid",
+		"/refused": closedAddr,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	clientCfg := NewClientConfig("ws"+strings.TrimPrefix(tunnelControlServer.URL, "http"), tunnel.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		r = r.Clone(r.Context())
+		r.URL.Scheme = "http"
+		r.URL.Host = targets[r.URL.Path]
+		r.RequestURI = ""
+		return transport.RoundTrip(r)
+	}))
+	clientCtx, stopClient := context.WithCancel(context.Background())
+	defer stopClient()
+	go func() {
+		_ = RunClient(clientCtx, *clientCfg)
+	}()
+
+	requestHandler := tunnel.NewRequestHandler(tunnelServer, tunnel.WithErrorResponses(tunnel.ErrorResponses{
+		DownstreamStatusCodes: map[string]int{tunnel.DownstreamErrorKindDNS: http.StatusNotFound},
+		JSON:                  true,
+	}))
+	for path, expected := range map[string]struct {
+		kind       string
+		statusCode int
+	}{
+		"/dns":     {kind: tunnel.DownstreamErrorKindDNS, statusCode: http.StatusNotFound},
+		"/refused": {kind: tunnel.DownstreamErrorKindConnectionRefused, statusCode: http.StatusBadGateway},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+		require.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		requestHandler.ServeHTTP(recorder, req)
+		cancel()
+
+		require.Equal(t, expected.statusCode, recorder.Code, path)
+		require.Equal(t, "application/json", recorder.Header().Get("Content-Type"), path)
+		var data tunnel.ErrorResponseData
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &data), path)
+		require.Equal(t, tunnel.ErrorKindDownstream, data.Kind, path)
+		require.Equal(t, expected.kind, data.DownstreamKind, path)
+		require.Equal(t, expected.statusCode, data.StatusCode, path)
+	}
 }
 
 func TestConnectionSwitch(t *testing.T) {
@@ -248,6 +313,36 @@ func TestConnectionSwitch(t *testing.T) {
 	require.Equal(t, "client2", string(body))
 }
 
+func TestServerAddrResolver(t *testing.T) {
+	tunnelServer := NewServer()
+	require.NotNil(t, tunnelServer)
+
+	tunnelControlServer := httptest.NewServer(tunnelServer)
+	defer tunnelControlServer.Close()
+
+	// the address of the config is not dialed
+	clientCfg := NewClientConfig("ws://localhost:1", tunnel.RoundTripperFunc(staticResp([]byte("resolved"))), WithServerAddrResolver(func(ctx context.Context) (string, error) {
+		return "ws" + strings.TrimPrefix(tunnelControlServer.URL, "http"), nil
+	}))
+
+	clientCtx, stopClient := context.WithCancel(context.Background())
+	defer stopClient()
+	go func() {
+		require.NoError(t, RunClient(clientCtx, *clientCfg))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	require.NoError(t, err)
+	resp, err := tunnelServer.RoundTrip(req)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "resolved", string(body))
+}
+
 func TestTunnelBigResponse(t *testing.T) {
 	tunnelServer := NewServer(WithLogger(logrtesting.NewTestLogger(t)))
 	require.NotNil(t, tunnelServer)
@@ -313,3 +408,583 @@ func staticResp(body []byte) func(req *http.Request) (*http.Response, error) {
 		}, nil
 	}
 }
+
+// startTunnel starts a tunnel server on a free port and a client relaying its requests to the round tripper
+func startTunnel(t *testing.T, roundTripper http.RoundTripper) *Server {
+	// the test logger would format the server state concurrently with the requests
+	tunnelServer := NewServer(WithLogger(logr.Discard()))
+	tunnelControlServer := httptest.NewServer(tunnelServer)
+	t.Cleanup(tunnelControlServer.Close)
+
+	clientCtx, stopClient := context.WithCancel(context.Background())
+	t.Cleanup(stopClient)
+	go func() {
+		_ = RunClient(clientCtx, *NewClientConfig("ws://"+tunnelControlServer.Listener.Addr().String(), roundTripper))
+	}()
+	return tunnelServer
+}
+
+func TestMiddlewares(t *testing.T) {
+	tunnelServer := startTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     http.Header{"X-Downstream": []string{"downstream"}, "X-Request": []string{req.Header.Get("X-Request")}},
+			Body:       http.NoBody,
+		}, nil
+	}))
+
+	var order []string
+	recordOrder := func(name string) tunnel.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	handler := tunnel.NewRequestHandler(tunnelServer, tunnel.WithMiddleware(
+		recordOrder("first"),
+		tunnel.HeaderMiddleware(http.Header{"X-Request": []string{"injected"}}, http.Header{"X-Downstream": []string{"replaced"}}),
+		recordOrder("second"),
+	))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Equal(t, []string{"first", "second"}, order)
+	require.Equal(t, "injected", recorder.Header().Get("X-Request"))
+	require.Equal(t, "replaced", recorder.Header().Get("X-Downstream"))
+}
+
+func TestErrorResponses(t *testing.T) {
+	tunnelServer := startTunnel(t, tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}))
+
+	// without an error handler the failure reported by the tunnel client is passed through
+	recorder := httptest.NewRecorder()
+	tunnel.NewRequestHandler(tunnelServer).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	require.Equal(t, tunnel.DownstreamErrorKindConnection, recorder.Header().Get(tunnel.DownstreamErrorHeader))
+
+	recorder = httptest.NewRecorder()
+	tunnel.NewRequestHandler(tunnelServer, tunnel.WithErrorResponses(tunnel.ErrorResponses{})).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusBadGateway, recorder.Code)
+	require.Equal(t, "text/plain; charset=utf-8", recorder.Header().Get("Content-Type"))
+	require.Equal(t, "502 downstream error (connection): downstream request failed: connection refused\n", recorder.Body.String())
+
+	// the clients accepting JSON get JSON bodies
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	recorder = httptest.NewRecorder()
+	tunnel.NewRequestHandler(tunnelServer, tunnel.WithErrorResponses(tunnel.ErrorResponses{})).ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusBadGateway, recorder.Code)
+	require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	require.JSONEq(t, `{"downstreamKind":"connection","error":"downstream request failed: connection refused","kind":"downstream","method":"GET","status":502,"url":"/"}`, recorder.Body.String())
+
+	// browsers and the clients accepting any media type get plain text
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	recorder = httptest.NewRecorder()
+	tunnel.NewRequestHandler(tunnelServer, tunnel.WithErrorResponses(tunnel.ErrorResponses{})).ServeHTTP(recorder, req)
+	require.Equal(t, "text/plain; charset=utf-8", recorder.Header().Get("Content-Type"))
+	req.Header.Set("Accept", "application/json;q=0, text/plain")
+	recorder = httptest.NewRecorder()
+	tunnel.NewRequestHandler(tunnelServer, tunnel.WithErrorResponses(tunnel.ErrorResponses{})).ServeHTTP(recorder, req)
+	require.Equal(t, "text/plain; charset=utf-8", recorder.Header().Get("Content-Type"))
+
+	// JSON is sent to all clients with the option
+	recorder = httptest.NewRecorder()
+	tunnel.NewRequestHandler(tunnelServer, tunnel.WithErrorResponses(tunnel.ErrorResponses{JSON: true})).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+	recorder = httptest.NewRecorder()
+	tunnel.NewRequestHandler(tunnelServer, tunnel.WithErrorResponses(tunnel.ErrorResponses{
+		HideDetails: true,
+		Responses: map[string]tunnel.ErrorResponse{
+			tunnel.ErrorKindDownstream: {StatusCode: http.StatusNotFound, Body: template.Must(template.New("").Parse("{{.StatusCode}} {{.Kind}}:{{.Error}}"))},
+		},
+	})).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusNotFound, recorder.Code)
+	require.Equal(t, "404 downstream:", recorder.Body.String())
+}
+
+func TestStats(t *testing.T) {
+	stats := tunnel.NewStats()
+	tunnelServer := startTunnel(t, stats.RoundTripper(tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		// the request bodies are counted once closed, like the HTTP transport does
+		defer req.Body.Close()
+		if req.URL.Path == "/fail" {
+			return nil, errors.New("downstream failed")
+		}
+		_, _ = io.Copy(io.Discard, req.Body)
+		statusCode, _ := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/"))
+		return &http.Response{
+			StatusCode: statusCode,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	})))
+
+	for _, path := range []string{"/200", "/404", "/500", "/fail"} {
+		req, err := http.NewRequest(http.MethodPost, path, strings.NewReader("hello"))
+		require.NoError(t, err)
+		resp, err := tunnelServer.RoundTrip(req)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// the responses are recorded once the tunnel client closes their bodies
+	require.Eventually(t, func() bool {
+		return stats.Summary().Requests == 4
+	}, time.Second, 10*time.Millisecond)
+	summary := stats.Summary()
+	require.Equal(t, int64(6), summary.BytesDown)
+	require.Equal(t, int64(15), summary.BytesUp)
+	require.Equal(t, 1, summary.ClientErrors)
+	require.Equal(t, 1, summary.Errors)
+	require.Equal(t, 1, summary.ServerErrors)
+	require.NotZero(t, summary.LatencyP99)
+}
+
+func TestFaultInjection(t *testing.T) {
+	downstream := tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Body:       io.NopCloser(strings.NewReader(strings.Repeat("x", 500))),
+		}, nil
+	})
+	request := func(tunnelServer *Server) (*http.Response, time.Duration) {
+		req, err := http.NewRequest(http.MethodGet, "/", nil)
+		require.NoError(t, err)
+		start := time.Now()
+		resp, err := tunnelServer.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp, time.Since(start)
+	}
+
+	tunnelServer := startTunnel(t, tunnel.FaultInjection{Latency: 200 * time.Millisecond}.RoundTripper(downstream))
+	resp, elapsed := request(tunnelServer)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.GreaterOrEqual(t, elapsed, 200*time.Millisecond)
+
+	// the failures are reported by the tunnel client like the ones of the downstream
+	tunnelServer = startTunnel(t, tunnel.FaultInjection{ErrorRate: 1}.RoundTripper(downstream))
+	resp, _ = request(tunnelServer)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get(tunnel.DownstreamErrorHeader))
+
+	// 500 bytes at 1000 bytes per second are sent in chunks of 100 bytes, each after the previous one's share
+	tunnelServer = startTunnel(t, tunnel.FaultInjection{BytesPerSecond: 1000}.RoundTripper(downstream))
+	resp, elapsed = request(tunnelServer)
+	body, _ := io.ReadAll(resp.Body)
+	require.Len(t, body, 500)
+	require.GreaterOrEqual(t, elapsed, 400*time.Millisecond)
+}
+
+func TestTransportHandshakeError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "services \"kurun\" is forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	_, err := Transport{}.Dial(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"))
+	var handshakeErr *HandshakeError
+	require.True(t, errors.As(err, &handshakeErr), "unexpected error: %v", err)
+	require.Equal(t, http.StatusForbidden, handshakeErr.StatusCode)
+	require.True(t, errors.Is(err, websocket.ErrBadHandshake))
+}
+
+func TestIdleTimeout(t *testing.T) {
+	runClient := func(t *testing.T, serverOptions ...ServerOption) <-chan error {
+		tunnelControlServer := httptest.NewServer(NewServer(serverOptions...))
+		t.Cleanup(tunnelControlServer.Close)
+
+		clientCfg := NewClientConfig("ws"+strings.TrimPrefix(tunnelControlServer.URL, "http"), tunnel.RoundTripperFunc(pathEcho), WithIdleTimeout(200*time.Millisecond))
+		clientCtx, stopClient := context.WithCancel(context.Background())
+		t.Cleanup(stopClient)
+		clientErr := make(chan error, 1)
+		go func() {
+			clientErr <- RunClient(clientCtx, *clientCfg)
+		}()
+		return clientErr
+	}
+
+	t.Run("idle", func(t *testing.T) {
+		select {
+		case err := <-runClient(t):
+			require.ErrorIs(t, err, ErrIdleTimeout)
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection not closed in the idle timeout")
+		}
+	})
+
+	t.Run("pinged", func(t *testing.T) {
+		select {
+		case err := <-runClient(t, WithPingInterval(50*time.Millisecond)):
+			t.Fatalf("connection closed despite the pings: %v", err)
+		case <-time.After(time.Second):
+		}
+	})
+}
+
+func TestPingDuringTransfer(t *testing.T) {
+	// the pings are sent while the fragments of big responses are written, so they must take their turns
+	body := make([]byte, 1024*1024)
+	rand.Read(body)
+	tunnelServer := NewServer(WithPingInterval(time.Millisecond), WithMaxFrameSize(1024))
+	tunnelControlServer := httptest.NewServer(tunnelServer)
+	defer tunnelControlServer.Close()
+
+	clientCfg := NewClientConfig("ws"+strings.TrimPrefix(tunnelControlServer.URL, "http"), tunnel.RoundTripperFunc(staticResp(body)), WithPingInterval(time.Millisecond), WithMaxFrameSize(1024))
+	clientCtx, stopClient := context.WithCancel(context.Background())
+	defer stopClient()
+	go func() {
+		_ = RunClient(clientCtx, *clientCfg)
+	}()
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		require.NoError(t, err)
+		resp, err := tunnelServer.RoundTrip(req)
+		require.NoError(t, err)
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, body, respBody)
+	}
+}
+
+func TestAdaptivePing(t *testing.T) {
+	// the server drops the connections of the clients not sending anything for a while, like a load balancer
+	tunnelControlServer := httptest.NewServer(NewServer(WithIdleTimeout(1200 * time.Millisecond)))
+	defer tunnelControlServer.Close()
+
+	events := make(chan tunnel.ConnectionEvent, 10)
+	clientCfg := NewClientConfig("ws"+strings.TrimPrefix(tunnelControlServer.URL, "http"), tunnel.RoundTripperFunc(pathEcho),
+		WithAdaptivePing(50*time.Millisecond, 0),
+		WithReconnect(10*time.Millisecond, 10*time.Millisecond),
+		WithConnectionEventHandler(func(event tunnel.ConnectionEvent) {
+			events <- event
+		}),
+	)
+
+	clientCtx, stopClient := context.WithCancel(context.Background())
+	defer stopClient()
+	go func() {
+		_ = RunClient(clientCtx, *clientCfg)
+	}()
+
+	var adapted tunnel.ConnectionEvent
+	timeout := time.After(5 * time.Second)
+	for adapted.Type != tunnel.ConnectionEventPingAdapted {
+		select {
+		case adapted = <-events:
+		case <-timeout:
+			t.Fatal("ping interval not adapted")
+		}
+	}
+	require.GreaterOrEqual(t, adapted.Idle, 1200*time.Millisecond)
+	require.Equal(t, adapted.Idle/2, adapted.PingInterval)
+
+	// the pings keep the next connection alive
+	for {
+		select {
+		case event := <-events:
+			require.NotEqual(t, tunnel.ConnectionEventDisconnected, event.Type, "connection dropped despite the pings: %v", event.Err)
+		case <-time.After(2 * time.Second):
+			return
+		}
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	// runRequest sends a request through the tunnel, and drops the connection of the client while it's handled
+	runRequest := func(t *testing.T, serverOptions ...ServerOption) (*http.Response, error) {
+		tunnelServer := NewServer(serverOptions...)
+		tunnelControlServer := httptest.NewServer(tunnelServer)
+		defer tunnelControlServer.Close()
+
+		conns := make(chan net.Conn, 10)
+		handling := make(chan struct{}, 1)
+		reconnected := make(chan struct{})
+		clientCfg := NewClientConfig("ws"+strings.TrimPrefix(tunnelControlServer.URL, "http"),
+			tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				handling <- struct{}{}
+				select {
+				case <-reconnected:
+				case <-time.After(time.Second): // the request fails without reconnection
+				}
+				return staticResp([]byte("resumed"))(req)
+			}),
+			WithSessionGracePeriod(5*time.Second),
+			WithReconnect(10*time.Millisecond, 10*time.Millisecond),
+			WithDialerCtor(func() *websocket.Dialer {
+				return &websocket.Dialer{
+					NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+						if err == nil {
+							conns <- conn
+						}
+						return conn, err
+					},
+				}
+			}),
+		)
+
+		clientCtx, stopClient := context.WithCancel(context.Background())
+		defer stopClient()
+		go func() {
+			_ = RunClient(clientCtx, *clientCfg)
+		}()
+
+		conn := <-conns
+		go func() {
+			<-handling
+			conn.Close()
+			<-conns
+			close(reconnected)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		require.NoError(t, err)
+		return tunnelServer.RoundTrip(req)
+	}
+
+	t.Run("resumed", func(t *testing.T) {
+		resp, err := runRequest(t, WithSessionGracePeriod(5*time.Second))
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "resumed", string(body))
+	})
+
+	t.Run("not resumable", func(t *testing.T) {
+		_, err := runRequest(t)
+		require.ErrorIs(t, err, tunnel.ErrClientDisconnected)
+	})
+}
+
+func TestDownstreamHealth(t *testing.T) {
+	tunnelServer := NewServer()
+	tunnelControlServer := httptest.NewServer(tunnelServer)
+	defer tunnelControlServer.Close()
+
+	// downstream returns a round tripper responding with its name, and failing the health checks when it's down
+	downstream := func(name string, down *int32) http.RoundTripper {
+		return tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "/healthz" && atomic.LoadInt32(down) == 1 {
+				return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+			}
+			return staticResp([]byte(name))(req)
+		})
+	}
+	var primaryDown, standbyDown int32
+	checker := tunnel.NewDownstreamHealthChecker(tunnel.DownstreamHealthCheck{
+		Interval: 20 * time.Millisecond,
+		Path:     "/healthz",
+		Standby:  downstream("standby", &standbyDown),
+	}, downstream("primary", &primaryDown))
+
+	clientCtx, stopClient := context.WithCancel(context.Background())
+	defer stopClient()
+	go checker.Run(clientCtx)
+	clientCfg := NewClientConfig("ws"+strings.TrimPrefix(tunnelControlServer.URL, "http"), checker, WithDownstreamHealth(checker))
+	go func() {
+		_ = RunClient(clientCtx, *clientCfg)
+	}()
+
+	get := func(path string) (int, string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+		require.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		if path == ReadinessPath {
+			tunnelServer.ServeHTTP(recorder, req)
+		} else {
+			tunnel.NewRequestHandler(tunnelServer).ServeHTTP(recorder, req)
+		}
+		return recorder.Code, recorder.Body.String()
+	}
+	ready := func() bool {
+		code, _ := get(ReadinessPath)
+		return code == http.StatusOK
+	}
+
+	_, body := get("/")
+	require.Equal(t, "primary", body)
+	require.True(t, ready())
+
+	atomic.StoreInt32(&primaryDown, 1)
+	require.Eventually(t, func() bool {
+		_, body := get("/")
+		return body == "standby"
+	}, 2*time.Second, 10*time.Millisecond)
+	require.True(t, ready())
+
+	atomic.StoreInt32(&standbyDown, 1)
+	require.Eventually(t, func() bool { return !ready() }, 2*time.Second, 10*time.Millisecond)
+
+	atomic.StoreInt32(&primaryDown, 0)
+	require.Eventually(t, ready, 2*time.Second, 10*time.Millisecond)
+	_, body = get("/")
+	require.Equal(t, "primary", body)
+}
+
+func TestMultiServer(t *testing.T) {
+	multiServer := NewMultiServer(TokenTunnelIdentifier(map[string]string{
+		"alice": "alice-token",
+		"bob":   "bob-token",
+	}))
+	tunnelControlServer := httptest.NewServer(multiServer)
+	defer tunnelControlServer.Close()
+	defer multiServer.Shutdown()
+	serverAddr := "ws" + strings.TrimPrefix(tunnelControlServer.URL, "http")
+
+	clientCtx, stopClients := context.WithCancel(context.Background())
+	defer stopClients()
+	for _, id := range []string{"alice", "bob"} {
+		id := id
+		downstream := tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return staticResp([]byte(id + " " + req.URL.Path))(req)
+		})
+		clientCfg := NewClientConfig(serverAddr, downstream, WithTunnelToken(id+"-token"))
+		go func() {
+			_ = RunClient(clientCtx, *clientCfg)
+		}()
+	}
+	require.Eventually(t, func() bool { return multiServer.ConnectedClients() == 2 }, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"alice", "bob"}, multiServer.Tunnels())
+
+	_, err := Transport{Header: http.Header{TunnelTokenHeader: {"mallory-token"}}}.Dial(context.Background(), serverAddr)
+	var handshakeErr *HandshakeError
+	require.ErrorAs(t, err, &handshakeErr)
+	require.Equal(t, http.StatusUnauthorized, handshakeErr.StatusCode)
+
+	handler := tunnel.NewRequestHandler(multiServer.RoundTripper(tunnel.PathTunnelMatcher(), nil), tunnel.WithErrorResponses(tunnel.ErrorResponses{JSON: true}))
+	get := func(path string) (int, string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+		require.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code, recorder.Body.String()
+	}
+
+	code, body := get("/alice/webhook")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "alice /webhook", body)
+	code, body = get("/bob")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "bob /", body)
+	code, body = get("/carol/webhook")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Contains(t, body, `"kind":"no-client"`)
+}
+
+func TestTunnelExpiry(t *testing.T) {
+	multiServer := NewMultiServer(TokenTunnelIdentifier(map[string]string{"alice": "alice-token"}))
+	tunnelControlServer := httptest.NewServer(multiServer)
+	defer tunnelControlServer.Close()
+	defer multiServer.Shutdown()
+	expiryCtx, stopExpiry := context.WithCancel(context.Background())
+	defer stopExpiry()
+	go multiServer.ExpireTunnels(expiryCtx, 200*time.Millisecond)
+
+	clientCtx, stopClient := context.WithCancel(context.Background())
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- RunClient(clientCtx, *NewClientConfig("ws"+strings.TrimPrefix(tunnelControlServer.URL, "http"), tunnel.RoundTripperFunc(staticResp([]byte("ok"))), WithTunnelToken("alice-token")))
+	}()
+	require.Eventually(t, func() bool { return multiServer.ConnectedClients() == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// the tunnels with clients are kept
+	time.Sleep(400 * time.Millisecond)
+	require.Equal(t, []string{"alice"}, multiServer.Tunnels())
+
+	stopClient()
+	<-clientErr
+	require.Eventually(t, func() bool { return len(multiServer.Tunnels()) == 0 }, 2*time.Second, 10*time.Millisecond)
+	require.Nil(t, multiServer.Tunnel("alice"))
+}
+
+func TestTunnelQuotas(t *testing.T) {
+	multiServer := NewMultiServer(TokenTunnelIdentifier(map[string]string{"alice": "alice-token"}))
+	tunnelControlServer := httptest.NewServer(multiServer)
+	defer tunnelControlServer.Close()
+	defer multiServer.Shutdown()
+
+	release := make(chan struct{})
+	downstream := tunnel.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		return staticResp([]byte("ok"))(req)
+	})
+	clientCtx, stopClient := context.WithCancel(context.Background())
+	defer stopClient()
+	clientCfg := NewClientConfig("ws"+strings.TrimPrefix(tunnelControlServer.URL, "http"), downstream, WithTunnelToken("alice-token"))
+	go func() {
+		_ = RunClient(clientCtx, *clientCfg)
+	}()
+	require.Eventually(t, func() bool { return multiServer.ConnectedClients() == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	quotas := tunnel.NewTunnelQuotas(tunnel.TunnelQuota{}, map[string]tunnel.TunnelQuota{
+		"alice": {MaxConcurrent: 1, RequestsPerSecond: 0.001, Burst: 3},
+	})
+	handler := tunnel.NewRequestHandler(multiServer.RoundTripper(tunnel.PathTunnelMatcher(), quotas), tunnel.WithErrorResponses(tunnel.ErrorResponses{JSON: true}))
+	get := func(path string) int {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+		require.NoError(t, err)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	metrics := func() string {
+		var buf bytes.Buffer
+		require.NoError(t, quotas.WriteMetrics(&buf))
+		return buf.String()
+	}
+
+	slowCode := make(chan int, 1)
+	go func() {
+		slowCode <- get("/alice/slow")
+	}()
+	require.Eventually(t, func() bool {
+		return strings.Contains(metrics(), `kurun_tunnel_requests_in_flight{tunnel="alice"} 1`)
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusTooManyRequests, get("/alice/fast"))
+	close(release)
+	require.Equal(t, http.StatusOK, <-slowCode)
+
+	// the rejected request took no token of the burst
+	require.Equal(t, http.StatusOK, get("/alice/fast"))
+	require.Equal(t, http.StatusOK, get("/alice/fast"))
+	require.Equal(t, http.StatusTooManyRequests, get("/alice/fast"))
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(metrics(), `kurun_tunnel_requests_total{tunnel="alice"} 3`)
+	}, 2*time.Second, 10*time.Millisecond)
+	output := metrics()
+	require.Contains(t, output, `kurun_tunnel_rejected_requests_total{tunnel="alice",reason="concurrency"} 1`)
+	require.Contains(t, output, `kurun_tunnel_rejected_requests_total{tunnel="alice",reason="rate"} 1`)
+	require.Contains(t, output, `kurun_tunnel_response_bytes_total{tunnel="alice"} 6`)
+}
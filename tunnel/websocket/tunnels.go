@@ -0,0 +1,205 @@
+package websocket
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/websocket"
+
+	"github.com/banzaicloud/kurun/tunnel"
+)
+
+// TunnelTokenHeader carries the token identifying the tunnel of a client connecting to a server serving several
+// tunnels, it's not the Authorization header, as that is taken by the API server proxy the clients connect through
+const TunnelTokenHeader = "X-Kurun-Tunnel-Token"
+
+// TunnelIdentifier returns the ID of the tunnel of the connection request of a tunnel client, the client is rejected if
+// it fails
+type TunnelIdentifier func(r *http.Request) (string, error)
+
+// TokenTunnelIdentifier identifies the tunnels of the clients by the token of their TunnelTokenHeader, the tokens are
+// given by the IDs of the tunnels
+func TokenTunnelIdentifier(tokens map[string]string) TunnelIdentifier {
+	return func(r *http.Request) (string, error) {
+		token := r.Header.Get(TunnelTokenHeader)
+		if token == "" {
+			return "", errors.New("no tunnel token")
+		}
+		for id, tunnelToken := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(tunnelToken)) == 1 {
+				return id, nil
+			}
+		}
+		return "", errors.New("invalid tunnel token")
+	}
+}
+
+// NewMultiServer returns a server of several independent tunnels, the tunnels of the clients are identified when they
+// connect, and each tunnel is served by a Server created with the options when its first client connects
+func NewMultiServer(identify TunnelIdentifier, options ...ServerOption) *MultiServer {
+	// the logger of the options is the base of the loggers of the tunnels
+	template := &Server{
+		logger: logr.Discard(),
+	}
+	for _, option := range options {
+		if option != nil {
+			option.ApplyToServer(template)
+		}
+	}
+	return &MultiServer{
+		identify: identify,
+		logger:   template.logger,
+		options:  options,
+		servers:  make(map[string]*Server),
+	}
+}
+
+// MultiServer implements a server of several independent tunnels accepting the connections of the clients with
+// WebSockets, see NewMultiServer
+// The tunnels are kept once created, so the requests wait for the clients of the tunnels reconnecting like with a
+// single tunnel, until they are expired by ExpireTunnels.
+type MultiServer struct {
+	identify TunnelIdentifier
+	logger   logr.Logger
+	options  []ServerOption
+
+	mutex   sync.RWMutex
+	servers map[string]*Server
+}
+
+// ServeHTTP serves the connection requests of the clients with the servers of their tunnels
+func (s *MultiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the health of the downstreams of a tunnel doesn't affect the others
+	if r.URL.Path == ReadinessPath && !websocket.IsWebSocketUpgrade(r) {
+		_, _ = io.WriteString(w, "ok\n")
+		return
+	}
+
+	id, err := s.identify(r)
+	if err != nil {
+		s.logger.Info("tunnel client rejected", "reason", err.Error(), "remoteAddr", r.RemoteAddr)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	s.tunnelServer(id).ServeHTTP(w, r)
+}
+
+// Tunnel returns the server of the tunnel, nil if no client of the tunnel has connected yet
+func (s *MultiServer) Tunnel(id string) *Server {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.servers[id]
+}
+
+// Tunnels returns the IDs of the tunnels in order
+func (s *MultiServer) Tunnels() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	ids := make([]string, 0, len(s.servers))
+	for id := range s.servers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// RoundTripper returns the round tripper sending the requests through the tunnels matched by the matcher (see
+// tunnel.NewTunnelRoundTripper), enforcing the quotas of the tunnels unless quotas is nil
+func (s *MultiServer) RoundTripper(match tunnel.TunnelMatcher, quotas *tunnel.TunnelQuotas) http.RoundTripper {
+	return tunnel.NewTunnelRoundTripper(match, func(id string) http.RoundTripper {
+		server := s.Tunnel(id)
+		switch {
+		case server == nil:
+			return nil
+		case quotas != nil:
+			return quotas.RoundTripper(id, server)
+		default:
+			return server
+		}
+	})
+}
+
+// ConnectedClients returns the number of tunnel clients connected to the tunnels
+func (s *MultiServer) ConnectedClients() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	clients := 0
+	for _, server := range s.servers {
+		clients += server.ConnectedClients()
+	}
+	return clients
+}
+
+// Shutdown initiates the shutdown of the servers of the tunnels, but does not wait for it to finish
+func (s *MultiServer) Shutdown() {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, server := range s.servers {
+		server.Shutdown()
+	}
+}
+
+// ExpireTunnels removes the tunnels no client has been connected to for the expiry (checked at a tenth of it) until
+// the context is cancelled, so the tunnels of the clients gone for good don't pile up, the expiry must be positive
+// The requests waiting for the clients of an expired tunnel fail, the next client of the tunnel creates it again.
+func (s *MultiServer) ExpireTunnels(ctx context.Context, expiry time.Duration) {
+	ticker := time.NewTicker(expiry / 10)
+	defer ticker.Stop()
+	// idleSince are the times the tunnels were first seen without clients
+	idleSince := make(map[*Server]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.expireTunnels(now, expiry, idleSince)
+		}
+	}
+}
+
+func (s *MultiServer) expireTunnels(now time.Time, expiry time.Duration, idleSince map[*Server]time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, server := range s.servers {
+		if server.ConnectedClients() > 0 {
+			delete(idleSince, server)
+			continue
+		}
+		since, ok := idleSince[server]
+		if !ok {
+			idleSince[server] = now
+			continue
+		}
+		if now.Sub(since) >= expiry {
+			s.logger.Info("tunnel expired", "tunnel", id)
+			delete(s.servers, id)
+			delete(idleSince, server)
+			server.Shutdown()
+		}
+	}
+}
+
+// tunnelServer returns the server of the tunnel, and creates it for the first client of the tunnel
+func (s *MultiServer) tunnelServer(id string) *Server {
+	if server := s.Tunnel(id); server != nil {
+		return server
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if server, ok := s.servers[id]; ok {
+		return server
+	}
+	logger := s.logger.WithValues("tunnel", id)
+	logger.Info("tunnel created")
+	options := append(s.options[:len(s.options):len(s.options)], WithLogger(logger))
+	server := NewServer(options...)
+	s.servers[id] = server
+	return server
+}